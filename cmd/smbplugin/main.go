@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/kubernetes-csi/csi-driver-smb/pkg/smb"
 	"k8s.io/component-base/metrics/legacyregistry"
@@ -44,6 +45,60 @@ var (
 	enableGetVolumeStats          = flag.Bool("enable-get-volume-stats", true, "allow GET_VOLUME_STATS on agent node")
 	removeSMBMappingDuringUnmount = flag.Bool("remove-smb-mapping-during-unmount", true, "remove SMBMapping during unmount on Windows node")
 	workingMountDir               = flag.String("working-mount-dir", "/tmp", "working directory for provisioner to mount smb shares temporarily")
+	requireEncryption             = flag.Bool("require-encryption", false, "reject mounts without seal(encryption) mount option on Linux node")
+	enforceEncryptionAuto         = flag.Bool("enforce-encryption-auto", false, "add seal(encryption) mount option automatically if not provided on Linux node")
+	rejectSymlinkTargetPath       = flag.Bool("reject-symlink-target-path", false, "reject NodeUnpublishVolume if target path is a symlink instead of resolving it on Linux node")
+	maxKrb5CacheSize              = flag.Int64("max-krb5-cache-size", smb.DefaultMaxKrb5CacheSize, "max size in bytes of kerberos cache provided in secret, 0 means no limit")
+	corruptedMountPublishPolicy   = flag.String("corrupted-mount-publish-policy", "ignore", "how to handle corrupted mount detected during NodePublishVolume, supported values: ignore, fail(return FailedPrecondition), recover(unmount corrupted target path and publish again)")
+	kubeletRootDir                = flag.String("kubelet-root-dir", smb.DefaultKubeletRootDir, "kubelet root directory under which staging paths are created")
+	volumeStatsWalkMaxEntries     = flag.Int("volume-stats-walk-max-entries", 0, "walk volume path to get subdir scoped used bytes and inodes in NodeGetVolumeStats if there are no more than this number of entries, otherwise fall back to statfs, 0 means statfs is always used")
+	mountErrorRulesFile           = flag.String("mount-error-rules-file", "", "file of rules to map mount errors to CSI error codes in NodeStageVolume, one \"<code> <regex>\" rule per line, e.g. \"Unavailable (?i)host is down\", rules are consulted in order before default rules which map connectivity, permission and share not found errors to Unavailable, PermissionDenied and NotFound, other mount errors are Internal")
+	omitUnavailableInodesUsage    = flag.Bool("omit-unavailable-inodes-usage", true, "return only BYTES usage in NodeGetVolumeStats if inode metrics are not reported by smb server")
+	krb5CacheGracePeriod          = flag.Duration("krb5-cache-grace-period", 0, "delay kerberos cache deletion on NodeUnstageVolume, deletion is cancelled if the same volume is staged again within this period, 0 means delete immediately")
+	unstageBusyRetryTimeout       = flag.Duration("unstage-busy-retry-timeout", 0, "retry unmount with backoff in NodeUnstageVolume within this period if the staging path is busy(EBUSY), 0 means no retry")
+	mountProfilesFile             = flag.String("mount-profiles-file", "", "file of named mount option profiles referenced by profile parameter in volume context, one \"<name> <comma separated mount options>\" profile per line, e.g. \"media vers=3.1.1,cache=loose,actimeo=60\"")
+	defaultDomain                 = flag.String("default-domain", "", "domain used in NodeStageVolume on Windows node if domain is not specified in secret, built-in default AZURE is used if empty")
+	quarantineThreshold           = flag.Int("stage-failure-quarantine-threshold", 0, "quarantine a volume after this number of consecutive NodeStageVolume failures, stage requests of a quarantined volume fail fast until it's unstaged or the cooldown expires, 0 means no quarantine")
+	quarantineCooldown            = flag.Duration("stage-failure-quarantine-cooldown", 10*time.Minute, "period after which quarantine of a volume is lifted")
+	recreateStagingDir            = flag.Bool("recreate-staging-dir", false, "remove and recreate staging directory in NodeStageVolume before mount if it's not mounted on Linux node, staging directory with any mount point inside is never removed")
+	enableVolumeClone             = flag.Bool("enable-volume-clone", true, "allow creating a volume from an existing volume, CLONE_VOLUME controller capability is advertised only if enabled")
+	unknownSecretKeysPolicy       = flag.String("unknown-secret-keys-policy", "ignore", "how to handle unknown keys in node stage secret, known keys are username, password, domain, mountOptions and krb5cc_*, supported values: ignore, warn, reject(return InvalidArgument)")
+	enableHostnameTopology        = flag.Bool("enable-hostname-topology", false, "report node host name as topology segment in NodeGetInfo and pin volumes to the node in CreateVolume, it should be set on both controller and node")
+	nodeHostname                  = flag.String("node-hostname", "", "host name reported in topology segment, e.g. spec.nodeName from downward API, nodeid is used if empty")
+	cleanOrphanKrb5OnStart        = flag.Bool("clean-orphan-krb5-on-start", false, "remove kerberos cache files and dangling krb5cc_* symlinks which are not used by staged volumes in kerberos cache directory on driver start")
+	strictSubDirTokens            = flag.Bool("strict-subdir-tokens", false, "return InvalidArgument in NodeStageVolume if ${...} tokens are left in subDir after replacement, e.g. ${pvc.metadata.name} of a static provisioned PV, otherwise only a warning is logged")
+	checkStagedOnPublish          = flag.Bool("check-staged-on-publish", false, "return retryable FailedPrecondition in NodePublishVolume if staging path is neither in stage cache nor mounted on Linux node, instead of bind mounting an incomplete staging path")
+	minSMBVersion                 = flag.String("min-smb-version", "", "minimum SMB version on Linux node, e.g. 3.0, vers mount option is set to this version if not specified and mount with a lower vers is rejected, no limit if empty")
+	reuseLiveStageMount           = flag.Bool("reuse-live-stage-mount", true, "return success in NodeStageVolume without remount if a readable cifs mount is found on staging path in mount table on Linux node, e.g. after driver restart, a stale mount is unmounted and mounted again")
+	postUnmountHook               = flag.String("post-unmount-hook", "", "command run with volume id and staging path as arguments after staging path is unmounted in NodeUnstageVolume, only PATH is passed in its environment, failure is logged and does not fail NodeUnstageVolume")
+	postUnmountHookTimeout        = flag.Duration("post-unmount-hook-timeout", 30*time.Second, "timeout of post unmount hook command, 0 means no timeout")
+	resolveMountGroupName         = flag.Bool("resolve-mount-group-name", false, "resolve non-numeric volumeMountGroup as a group name to gid in NodeStageVolume, otherwise non-numeric volumeMountGroup is rejected with InvalidArgument; the name is resolved against the group database of the driver container, not the one of the host, so the gid could differ from the group of the same name on the host")
+	enforceKubeletRootDir         = flag.Bool("enforce-kubelet-root-dir", false, "return InvalidArgument in node server if staging path or target path is not under --kubelet-root-dir, this prevents a malformed request from mounting to an arbitrary location")
+	bindMode                      = flag.String("bind-mode", "bind", "first mount option of bind mount in NodePublishVolume on Linux node, bind or rbind, rbind also bind mounts nested mounts under staging path, could be overridden by bindMode in volume context")
+	enableDrainEndpoint           = flag.Bool("enable-drain-endpoint", false, "serve /drain on --metrics-address, POST /drain?enabled=true rejects new NodeStageVolume and NodePublishVolume requests with Unavailable during node maintenance, POST /drain?enabled=false resumes, POST is only allowed from a loopback address, unstage and unpublish are always served")
+	preAuthProbe                  = flag.Bool("pre-auth-probe", false, "validate username and password by setting up a session with smbclient before mount in NodeStageVolume on Linux node, bad credentials fail fast with Unauthenticated, mount is not blocked if the probe fails for other reasons")
+	preAuthProbeTimeout           = flag.Duration("pre-auth-probe-timeout", 5*time.Second, "timeout of pre-auth probe, 0 means no timeout")
+	maxVolumeIDLength             = flag.Int("max-volume-id-length", 0, "volume id longer than this is replaced by {server}#{sha256 hash} in CreateVolume, the full volume id is kept in fullVolumeID of volume context and in a hidden file under share root which is read in DeleteVolume and volume clone, volume which does not create subdirectory could not be hashed, 0 means no limit")
+	mountRetryJitter              = flag.Float64("mount-retry-jitter", 0, "delay mount retry of a volume whose last mount failed by mount poll interval(1s) plus a random jitter up to this fraction of the interval, so that retries of many pods on the same broken share spread out, between 0 and 1, 0 disables the delay")
+	maxSubDirDepth                = flag.Int("max-subdir-depth", 0, "max number of path segments in subDir after ${pvc.metadata.name} and similar tokens are replaced, NodeStageVolume returns InvalidArgument on a deeper subDir, 0 means no limit")
+	retainFailedStaging           = flag.Bool("retain-failed-staging", false, "write failure.json with the sanitized error, mount flags and volume context into staging directory on NodeStageVolume failure for later inspection on Linux node, the record is removed before the next mount attempt or on NodeUnstageVolume")
+	pinDefaultVers                = flag.String("pin-default-vers", "", "SMB version on Linux node, e.g. 3.1.1, vers mount option is set to this version if not specified or vers=default, so that mounts negotiate the same dialect on nodes with different kernel defaults, no pinning if empty")
+	enableConfigEndpoint          = flag.Bool("enable-config-endpoint", false, "serve non-sensitive effective configuration of the driver in JSON on /config of metrics address, e.g. kubelet root dir, SMB version defaults and timeouts")
+	remountOnRecovery             = flag.Bool("remount-on-recovery", false, "after an invalid mount on staging or target path is unmounted, NodeStageVolume and NodePublishVolume mount it again in the same call instead of failing and waiting for a retry")
+	publishSecretsPolicy          = flag.String("publish-secrets-policy", "require", "how node publish secrets are used in a dedicated cifs mount of NodePublishVolume, require: username and password must be in node publish secrets, merge: credentials of NodeStageVolume are kept in memory and keys missing in node publish secrets are filled with them")
+	defaultCredUID                = flag.String("default-cred-uid", "", "uid used as cruid mount option of a kerberos(sec=krb5) mount on Linux node if cruid= is not in mount options, e.g. uid which pods run as, the kerberos cache of this uid must be in node stage secrets, kerberos mount without cruid= is rejected if empty")
+	nodeConditionFailureThreshold = flag.Int("node-condition-failure-threshold", 0, "set SMBConnectivityProblem condition of the node after this number of consecutive mount failures of a smb server with connectivity errors, the condition is cleared once mounts succeed again, requires permission to get nodes and update nodes/status, 0 means no node condition")
+	windowsUsernameFormat         = flag.String("windows-username-format", "down-level", "username format of smb mapping on Windows node, down-level: domain\\username, upn: username@domain, username which already contains \\ or @ is used as is")
+	enableUnstageAllEndpoint      = flag.Bool("enable-unstage-all-endpoint", false, "serve /unstage-all on --metrics-address, POST /unstage-all from a loopback address unstages every staged volume on the node which is not bind mounted in pods, e.g. before node decommission, and returns the result of each volume in JSON")
+	readDirRetries                = flag.Int("readdir-retries", 0, "number of retries of the ReadDir probe on an existing mount point in NodeStageVolume and NodePublishVolume before the mount is considered invalid and unmounted, a transient ReadDir failure on a busy share does not cause a remount if it recovers on retry")
+	blockAdminShares              = flag.Bool("block-admin-shares", false, "reject NodeStageVolume of administrative shares whose name ends with $, e.g. C$ or ADMIN$, with InvalidArgument unless allowAdminShare is set to true in volume context")
+	mountAttemptTimeout           = flag.Duration("mount-attempt-timeout", 0, "timeout of each cifs mount attempt in host mount namespace in NodeStageVolume, an attempt hung e.g. on TCP connect is killed and retried within the overall mount timeout(2m) of NodeStageVolume, which returns DeadlineExceeded if no attempt completes in time, an attempt which could not be killed is abandoned and the volume is busy(Aborted) until it completes or at most 10m, it's unmounted if it succeeds, 0 means no timeout")
+	secretKeyAliases              = flag.String("secret-key-aliases", "", "comma separated alias=field pairs of secret keys(case-insensitive) accepted as username, password or domain, e.g. user=username,pass=password, a field key present in secrets takes precedence over its alias")
+	credentialConflictPolicy      = flag.String("credential-conflict-policy", "secret", "how domain provided in both volume context and node stage secret with different values is resolved, secret: value in secret is used with a warning, strict: return InvalidArgument")
+	rejectReferencedUnstage       = flag.Bool("reject-referenced-unstage", false, "return FailedPrecondition in NodeUnstageVolume instead of unmounting the staging path if it is still bind mounted under pods directory of kubelet, so that the CO retries after unpublish, bind mounts of a subdir of the staging path are not detected")
+	waitForKrb5Dir                = flag.Duration("wait-for-krb5-dir", 0, "max duration to wait on startup for kerberos cache directory /var/lib/kubelet/kerberos/ provided by another DaemonSet, kerberos mount returns Unavailable until it exists or the wait times out while the driver stays ready, 0 means no wait")
+	normalizeSourceSlashes        = flag.Bool("normalize-source-slashes", false, "convert backslashes in source and sources to forward slashes in NodeStageVolume on Linux node, e.g. \\\\server\\share copied from Windows is mounted as //server/share, username is not changed")
+	allowedMountNamespaces        = flag.String("allowed-mount-namespaces", "", "comma separated glob patterns of mount namespace files allowed in mountNamespace parameter on Linux node, e.g. /proc/*/ns/mnt, mountNamespace is rejected if it does not match any pattern, empty allows none")
 )
 
 func main() {
@@ -60,7 +115,6 @@ func main() {
 		// nodeid is not needed in controller component
 		klog.Warning("nodeid is empty")
 	}
-	exportMetrics()
 	handle()
 	os.Exit(0)
 }
@@ -72,13 +126,78 @@ func handle() {
 		EnableGetVolumeStats:          *enableGetVolumeStats,
 		RemoveSMBMappingDuringUnmount: *removeSMBMappingDuringUnmount,
 		WorkingMountDir:               *workingMountDir,
+		RequireEncryption:             *requireEncryption,
+		EnforceEncryptionAuto:         *enforceEncryptionAuto,
+		RejectSymlinkTargetPath:       *rejectSymlinkTargetPath,
+		MaxKrb5CacheSize:              *maxKrb5CacheSize,
+		CorruptedMountPublishPolicy:   *corruptedMountPublishPolicy,
+		KubeletRootDir:                *kubeletRootDir,
+		VolumeStatsWalkMaxEntries:     *volumeStatsWalkMaxEntries,
+		MountErrorRulesFile:           *mountErrorRulesFile,
+		ReportUnavailableInodesUsage:  !*omitUnavailableInodesUsage,
+		Krb5CacheGracePeriod:          *krb5CacheGracePeriod,
+		UnstageBusyRetryTimeout:       *unstageBusyRetryTimeout,
+		MountProfilesFile:             *mountProfilesFile,
+		DefaultDomain:                 *defaultDomain,
+		QuarantineThreshold:           *quarantineThreshold,
+		QuarantineCooldown:            *quarantineCooldown,
+		RecreateStagingDir:            *recreateStagingDir,
+		DisableVolumeClone:            !*enableVolumeClone,
+		UnknownSecretKeysPolicy:       *unknownSecretKeysPolicy,
+		EnableHostnameTopology:        *enableHostnameTopology,
+		NodeHostname:                  *nodeHostname,
+		CleanOrphanKrb5OnStart:        *cleanOrphanKrb5OnStart,
+		StrictSubDirTokens:            *strictSubDirTokens,
+		CheckStagedOnPublish:          *checkStagedOnPublish,
+		MinSMBVersion:                 *minSMBVersion,
+		DisableLiveStageMountReuse:    !*reuseLiveStageMount,
+		PostUnmountHook:               *postUnmountHook,
+		PostUnmountHookTimeout:        *postUnmountHookTimeout,
+		ResolveMountGroupName:         *resolveMountGroupName,
+		EnforceKubeletRootDir:         *enforceKubeletRootDir,
+		BindMode:                      *bindMode,
+		PreAuthProbe:                  *preAuthProbe,
+		PreAuthProbeTimeout:           *preAuthProbeTimeout,
+		MaxVolumeIDLength:             *maxVolumeIDLength,
+		MountRetryJitter:              *mountRetryJitter,
+		MaxSubDirDepth:                *maxSubDirDepth,
+		RetainFailedStaging:           *retainFailedStaging,
+		PinDefaultVers:                *pinDefaultVers,
+		RemountOnRecovery:             *remountOnRecovery,
+		PublishSecretsPolicy:          *publishSecretsPolicy,
+		DefaultCredUID:                *defaultCredUID,
+		NodeConditionFailureThreshold: *nodeConditionFailureThreshold,
+		WindowsUsernameFormat:         *windowsUsernameFormat,
+		ReadDirRetries:                *readDirRetries,
+		BlockAdminShares:              *blockAdminShares,
+		MountAttemptTimeout:           *mountAttemptTimeout,
+		SecretKeyAliases:              *secretKeyAliases,
+		CredentialConflictPolicy:      *credentialConflictPolicy,
+		RejectReferencedUnstage:       *rejectReferencedUnstage,
+		WaitForKrb5Dir:                *waitForKrb5Dir,
+		NormalizeSourceSlashes:        *normalizeSourceSlashes,
+		AllowedMountNamespaces:        *allowedMountNamespaces,
 	}
 	driver := smb.NewDriver(&driverOptions)
+	handlers := map[string]http.Handler{}
+	if *enableDrainEndpoint {
+		handlers["/drain"] = driver.DrainHandler()
+	}
+	if *enableConfigEndpoint {
+		handlers["/config"] = driver.ConfigHandler()
+	}
+	if *enableUnstageAllEndpoint {
+		handlers["/unstage-all"] = driver.UnstageAllHandler()
+	}
+	exportMetrics(handlers)
 	driver.Run(*endpoint, *kubeconfig, false)
 }
 
-func exportMetrics() {
+func exportMetrics(handlers map[string]http.Handler) {
 	if *metricsAddress == "" {
+		for path := range handlers {
+			klog.Warningf("%s endpoint is not served since metrics-address is empty", path)
+		}
 		return
 	}
 	l, err := net.Listen("tcp", *metricsAddress)
@@ -86,7 +205,9 @@ func exportMetrics() {
 		klog.Warningf("failed to get listener for metrics endpoint: %v", err)
 		return
 	}
-	serve(context.Background(), l, serveMetrics)
+	serve(context.Background(), l, func(l net.Listener) error {
+		return serveMetrics(l, handlers)
+	})
 }
 
 func serve(ctx context.Context, l net.Listener, serveFunc func(net.Listener) error) {
@@ -100,9 +221,12 @@ func serve(ctx context.Context, l net.Listener, serveFunc func(net.Listener) err
 	}()
 }
 
-func serveMetrics(l net.Listener) error {
+func serveMetrics(l net.Listener, handlers map[string]http.Handler) error {
 	m := http.NewServeMux()
 	m.Handle("/metrics", legacyregistry.Handler())
+	for path, handler := range handlers {
+		m.Handle(path, handler)
+	}
 	return trapClosedConnErr(http.Serve(l, m))
 }
 
@@ -18,16 +18,22 @@ package csicommon
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"k8s.io/klog/v2"
 )
 
+// DurationTrailerKey is the gRPC response trailer which carries the server side duration of a call in milliseconds
+const DurationTrailerKey = "x-csi-smb-duration-ms"
+
 func ParseEndpoint(ep string) (string, string, error) {
 	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
 		s := strings.SplitN(ep, "://", 2)
@@ -84,3 +90,14 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	}
 	return resp, err
 }
+
+// setDurationTrailer attaches the server side duration of a call to the response trailer
+func setDurationTrailer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	duration := strconv.FormatInt(time.Since(start).Milliseconds(), 10)
+	if e := grpc.SetTrailer(ctx, metadata.Pairs(DurationTrailerKey, duration)); e != nil {
+		klog.V(6).Infof("failed to set trailer %s on %s: %v", DurationTrailerKey, info.FullMethod, e)
+	}
+	return resp, err
+}
@@ -20,9 +20,15 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"net"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"k8s.io/klog/v2"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -146,6 +152,49 @@ func TestLogGRPC(t *testing.T) {
 	}
 }
 
+type fakeNodeServer struct {
+	csi.UnimplementedNodeServer
+	delay time.Duration
+}
+
+func (f *fakeNodeServer) NodeStageVolume(_ context.Context, _ *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	time.Sleep(f.delay)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func TestSetDurationTrailer(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "csi.sock")
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", addr, err)
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(setDurationTrailer))
+	csi.RegisterNodeServer(server, &fakeNodeServer{delay: 10 * time.Millisecond})
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	conn, err := grpc.Dial("unix://"+addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	var trailer metadata.MD
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = csi.NewNodeClient(conn).NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: "vol_1"}, grpc.Trailer(&trailer))
+	assert.NoError(t, err)
+
+	values := trailer.Get(DurationTrailerKey)
+	if assert.Len(t, values, 1) {
+		duration, err := strconv.ParseInt(values[0], 10, 64)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, duration, int64(10))
+	}
+}
+
 func TestNewVolumeCapabilityAccessMode(t *testing.T) {
 	tests := []struct {
 		mode csi.VolumeCapability_AccessMode_Mode
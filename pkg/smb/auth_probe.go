@@ -0,0 +1,123 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+)
+
+const smbclientCmd = "smbclient"
+
+// errAuthFailed is wrapped by errors of authProber if the server rejects credentials
+var errAuthFailed = errors.New("authentication failed")
+
+// authFailureStatuses are NT status codes in smbclient output which indicate bad credentials
+var authFailureStatuses = []string{
+	"NT_STATUS_LOGON_FAILURE",
+	"NT_STATUS_WRONG_PASSWORD",
+	"NT_STATUS_NO_SUCH_USER",
+	"NT_STATUS_ACCOUNT_LOCKED_OUT",
+	"NT_STATUS_ACCOUNT_DISABLED",
+	"NT_STATUS_PASSWORD_EXPIRED",
+	"NT_STATUS_PASSWORD_MUST_CHANGE",
+}
+
+// authProber sets up a session with smb server to validate credentials before mount
+type authProber interface {
+	// Probe returns an error wrapping errAuthFailed if credentials are rejected by server,
+	// other errors mean the probe could not tell whether credentials are valid
+	Probe(ctx context.Context, server string, creds *Credentials) error
+}
+
+// smbclientProber lists shares of server with smbclient, which sets up a session with credentials
+type smbclientProber struct {
+	exec utilexec.Interface
+}
+
+func newSmbclientProber() *smbclientProber {
+	return &smbclientProber{exec: utilexec.New()}
+}
+
+func (p *smbclientProber) Probe(ctx context.Context, server string, creds *Credentials) error {
+	if _, err := p.exec.LookPath(smbclientCmd); err != nil {
+		return fmt.Errorf("%s is not found on the node: %v", smbclientCmd, err)
+	}
+	args := []string{"-L", "//" + server, "-g", "-U", creds.Username}
+	if creds.Domain != "" {
+		args = append(args, "-W", creds.Domain)
+	}
+	cmd := p.exec.CommandContext(ctx, smbclientCmd, args...)
+	// password is passed in environment instead of command line which is visible to other processes
+	cmd.SetEnv([]string{"PATH=" + os.Getenv("PATH"), "PASSWD=" + creds.Password})
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ntStatus, ok := getAuthFailureStatus(string(output)); ok {
+		return fmt.Errorf("%w: %s", errAuthFailed, ntStatus)
+	}
+	return fmt.Errorf("%s failed: %v, output: %s", smbclientCmd, err, string(output))
+}
+
+// getAuthFailureStatus returns the NT status in output which indicates bad credentials
+func getAuthFailureStatus(output string) (string, bool) {
+	for _, ntStatus := range authFailureStatuses {
+		if strings.Contains(output, ntStatus) {
+			return ntStatus, true
+		}
+	}
+	return "", false
+}
+
+// probeAuth returns Unauthenticated error if credentials are rejected by server of source,
+// mount is not blocked if the probe fails for other reasons, e.g. timeout or smbclient is not installed,
+// the probe is bound to ctx of the request, so it's aborted when the request is canceled
+func (d *Driver) probeAuth(ctx context.Context, volumeID, source string, creds *Credentials) error {
+	if d.authProber == nil {
+		return nil
+	}
+	probeCtx := ctx
+	if d.preAuthProbeTimeout > 0 {
+		var cancel context.CancelFunc
+		probeCtx, cancel = context.WithTimeout(ctx, d.preAuthProbeTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := d.authProber.Probe(probeCtx, getServerFromSource(source), creds)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return status.FromContextError(ctx.Err()).Err()
+	case err == nil:
+		klog.V(4).Infof("volume(%s): pre-auth probe of %s succeeded in %v", volumeID, source, time.Since(start))
+		return nil
+	case errors.Is(err, errAuthFailed):
+		return status.Errorf(codes.Unauthenticated, "volume(%s): credentials are rejected by server of %s: %v", volumeID, source, err)
+	default:
+		klog.Warningf("volume(%s): pre-auth probe of %s failed, continue to mount: %v", volumeID, source, err)
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+type fakeAuthProber struct {
+	err         error
+	servers     []string
+	creds       []Credentials
+	deadlineSet bool
+}
+
+func (p *fakeAuthProber) Probe(ctx context.Context, server string, creds *Credentials) error {
+	p.servers = append(p.servers, server)
+	p.creds = append(p.creds, *creds)
+	_, p.deadlineSet = ctx.Deadline()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.err
+}
+
+func TestGetAuthFailureStatus(t *testing.T) {
+	tests := []struct {
+		output         string
+		expectedStatus string
+		expectedFound  bool
+	}{
+		{
+			output:         "session setup failed: NT_STATUS_LOGON_FAILURE",
+			expectedStatus: "NT_STATUS_LOGON_FAILURE",
+			expectedFound:  true,
+		},
+		{
+			output:         "session setup failed: NT_STATUS_ACCOUNT_LOCKED_OUT",
+			expectedStatus: "NT_STATUS_ACCOUNT_LOCKED_OUT",
+			expectedFound:  true,
+		},
+		{
+			output: "do_connect: Connection to smb-server failed (Error NT_STATUS_IO_TIMEOUT)",
+		},
+	}
+
+	for _, test := range tests {
+		ntStatus, found := getAuthFailureStatus(test.output)
+		assert.Equal(t, test.expectedStatus, ntStatus, test.output)
+		assert.Equal(t, test.expectedFound, found, test.output)
+	}
+}
+
+func TestNodeStageVolumePreAuthProbe(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pre-auth probe is only supported on Linux node")
+	}
+	tests := []struct {
+		desc              string
+		probeErr          error
+		canceled          bool
+		expectedErrorCode codes.Code
+		expectedMountNum  int
+	}{
+		{
+			desc:             "probe succeeds",
+			expectedMountNum: 1,
+		},
+		{
+			desc:              "credentials are rejected",
+			probeErr:          fmt.Errorf("%w: NT_STATUS_LOGON_FAILURE", errAuthFailed),
+			expectedErrorCode: codes.Unauthenticated,
+		},
+		{
+			desc:             "probe error does not block mount",
+			probeErr:         fmt.Errorf("smbclient is not found on the node"),
+			expectedMountNum: 1,
+		},
+		{
+			desc:              "probe is aborted when request is canceled",
+			canceled:          true,
+			expectedErrorCode: codes.Canceled,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+		prober := &fakeAuthProber{err: test.probeErr}
+		d.authProber = prober
+		d.preAuthProbeTimeout = 5 * time.Second
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.canceled {
+			cancel()
+		}
+
+		_, err := d.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass", domainField: "CONTOSO"},
+		})
+		assert.Equal(t, test.expectedErrorCode, status.Code(err), test.desc)
+		assert.Equal(t, test.expectedMountNum, len(fakeMounter.MountPoints), test.desc)
+		assert.Equal(t, []string{"smb-server"}, prober.servers, test.desc)
+		assert.Equal(t, []Credentials{{Username: "user", Password: "pass", Domain: "CONTOSO"}}, prober.creds, test.desc)
+		assert.True(t, prober.deadlineSet, test.desc)
+		cancel()
+	}
+}
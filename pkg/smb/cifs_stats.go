@@ -0,0 +1,118 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+// per share statistics of cifs client on Linux node
+const cifsStatsFile = "/proc/fs/cifs/Stats"
+
+var (
+	// cifsStatsSharePattern matches the header of share statistics, e.g. "1) \\server\share" or "2) \\server\share	DISCONNECTED"
+	cifsStatsSharePattern = regexp.MustCompile(`^\d+\) (\\\\.+?)(\s+DISCONNECTED)?\s*$`)
+	// cifsStatsFailedPattern matches an operation counter of SMB2 and later, e.g. "Reads: 10 total 2 failed" or "OplockBreaks: 0 sent 0 failed"
+	cifsStatsFailedPattern = regexp.MustCompile(`^(\w+): \d+ \w+ (\d+) failed$`)
+)
+
+// readCifsStats returns content of cifs statistics file, it is replaced in unit tests
+var readCifsStats = func() ([]byte, error) {
+	return os.ReadFile(cifsStatsFile)
+}
+
+// parseCifsStats returns failed operation counters keyed by share(e.g. //server/share) and lower case operation name,
+// counters of the same share mounted with different credentials are summed
+func parseCifsStats(content string) map[string]map[string]float64 {
+	result := map[string]map[string]float64{}
+	var share string
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := cifsStatsSharePattern.FindStringSubmatch(line); m != nil {
+			share = strings.ReplaceAll(m[1], "\\", "/")
+			if _, ok := result[share]; !ok {
+				result[share] = map[string]float64{}
+			}
+			continue
+		}
+		if share == "" {
+			continue
+		}
+		if m := cifsStatsFailedPattern.FindStringSubmatch(line); m != nil {
+			failed, err := strconv.ParseFloat(m[2], 64)
+			if err != nil {
+				continue
+			}
+			result[share][strings.ToLower(m[1])] += failed
+		}
+	}
+	return result
+}
+
+// cifsStatsCollector reports failed operations of each mounted share in cifs statistics on scrape,
+// nothing is reported if the statistics file could not be read, e.g. cifs module is not loaded or procfs is restricted
+type cifsStatsCollector struct {
+	metrics.BaseStableCollector
+	desc *metrics.Desc
+}
+
+func newCifsStatsCollector() *cifsStatsCollector {
+	return &cifsStatsCollector{
+		desc: metrics.NewDesc(
+			metrics.BuildFQName(metricsNamespace, metricsSubsystem, "cifs_failed_operations_total"),
+			"Number of failed SMB operations of each mounted share reported by cifs client in "+cifsStatsFile+", labeled by share and operation. Counters restart from zero when the share is reconnected with a new tree connection.",
+			[]string{"share", "operation"}, nil, metrics.ALPHA, ""),
+	}
+}
+
+// DescribeWithStability implements metrics.StableCollector
+func (c *cifsStatsCollector) DescribeWithStability(ch chan<- *metrics.Desc) {
+	ch <- c.desc
+}
+
+// CollectWithStability implements metrics.StableCollector
+func (c *cifsStatsCollector) CollectWithStability(ch chan<- metrics.Metric) {
+	content, err := readCifsStats()
+	if err != nil {
+		klog.V(4).Infof("failed to read %s: %v", cifsStatsFile, err)
+		return
+	}
+	for share, operations := range parseCifsStats(string(content)) {
+		for operation, failed := range operations {
+			ch <- metrics.NewLazyConstMetric(c.desc, metrics.CounterValue, failed, share, operation)
+		}
+	}
+}
+
+var registerCifsStatsOnce sync.Once
+
+// registerCifsStats registers failed operations in cifs statistics into the legacy registry
+func registerCifsStats() {
+	registerCifsStatsOnce.Do(func() {
+		legacyregistry.CustomMustRegister(newCifsStatsCollector())
+	})
+}
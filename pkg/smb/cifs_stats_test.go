@@ -0,0 +1,137 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/component-base/metrics"
+)
+
+const sampleCifsStats = `Resources in use
+CIFS Session: 2
+Share (unique mount targets): 3
+SMB Request/Response Buffer: 2 Pool size: 6
+SMB Small Req/Resp Buffer: 2 Pool size: 30
+Operations (MIDs): 0
+
+1 session 2 share reconnects
+Total vfs operations: 120 maximum at one time: 3
+
+Max requests in flight: 4
+
+1) \\smb-server\share
+SMBs: 85
+Bytes read: 4096  Bytes written: 1024
+Open files: 1 total (local), 1 open on server
+TreeConnects: 1 total 0 failed
+TreeDisconnects: 0 total 0 failed
+Creates: 20 total 1 failed
+Closes: 19 total 0 failed
+Flushes: 2 total 0 failed
+Reads: 10 total 2 failed
+Writes: 5 total 3 failed
+Locks: 0 total 0 failed
+IOCTLs: 1 total 0 failed
+QueryDirectories: 4 total 0 failed
+ChangeNotifies: 0 total 0 failed
+QueryInfos: 22 total 0 failed
+SetInfos: 1 total 0 failed
+OplockBreaks: 0 sent 0 failed
+2) \\smb-server\data	DISCONNECTED
+SMBs: 3
+Reads: 1 total 1 failed
+3) \\smb-server\share
+SMBs: 7
+Reads: 4 total 1 failed
+`
+
+func TestParseCifsStats(t *testing.T) {
+	stats := parseCifsStats(sampleCifsStats)
+	assert.Equal(t, map[string]float64{
+		"treeconnects":     0,
+		"treedisconnects":  0,
+		"creates":          1,
+		"closes":           0,
+		"flushes":          0,
+		"reads":            3,
+		"writes":           3,
+		"locks":            0,
+		"ioctls":           0,
+		"querydirectories": 0,
+		"changenotifies":   0,
+		"queryinfos":       0,
+		"setinfos":         0,
+		"oplockbreaks":     0,
+	}, stats["//smb-server/share"])
+	assert.Equal(t, map[string]float64{"reads": 1}, stats["//smb-server/data"])
+	assert.Len(t, stats, 2)
+
+	assert.Empty(t, parseCifsStats(""))
+}
+
+func TestCifsStatsCollector(t *testing.T) {
+	defer func(f func() ([]byte, error)) { readCifsStats = f }(readCifsStats)
+
+	tests := []struct {
+		desc     string
+		content  string
+		err      error
+		expected map[string]float64
+	}{
+		{
+			desc:    "failed operations of each share",
+			content: sampleCifsStats,
+			expected: map[string]float64{
+				"//smb-server/share/creates": 1,
+				"//smb-server/share/reads":   3,
+				"//smb-server/share/writes":  3,
+				"//smb-server/data/reads":    1,
+			},
+		},
+		{
+			desc:     "statistics file is not readable",
+			err:      fmt.Errorf("open /proc/fs/cifs/Stats: permission denied"),
+			expected: map[string]float64{},
+		},
+	}
+
+	for _, test := range tests {
+		readCifsStats = func() ([]byte, error) { return []byte(test.content), test.err }
+		registry := metrics.NewKubeRegistry()
+		registry.CustomMustRegister(newCifsStatsCollector())
+		families, err := registry.Gather()
+		assert.NoError(t, err, test.desc)
+
+		result := map[string]float64{}
+		for _, family := range families {
+			assert.Equal(t, "csi_smb_cifs_failed_operations_total", family.GetName(), test.desc)
+			for _, m := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				if value := m.GetCounter().GetValue(); value > 0 {
+					result[labels["share"]+"/"+labels["operation"]] = value
+				}
+			}
+		}
+		assert.Equal(t, test.expected, result, test.desc)
+	}
+}
@@ -18,6 +18,8 @@ package smb
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"os/exec"
@@ -32,6 +34,16 @@ import (
 
 const (
 	separator = "#"
+	// suffix of the hidden file next to a subdirectory which records the volume owning the subdirectory
+	subDirOwnerFileSuffix = ".csi-smb-owner"
+	// prefix of a volume id hashed from a volume id longer than --max-volume-id-length
+	hashedVolumeIDPrefix = "sha256-"
+	// length of the hash in a hashed volume id
+	hashedVolumeIDLength = len(hashedVolumeIDPrefix) + sha256.Size*2
+	// volume context parameter which keeps the full volume id of a hashed volume id
+	fullVolumeIDField = "fullvolumeid"
+	// suffix of the hidden file under share root which maps a hashed volume id to the full volume id
+	hashedVolumeIDFileSuffix = ".csi-smb-volume"
 )
 
 // smbVolume is an internal representation of a volume
@@ -47,6 +59,8 @@ type smbVolume struct {
 	size int64
 	// pv name when subDir is not empty
 	uuid string
+	// subDir is resolved from a template with pv/pvc metadata, so it may collide across volumes
+	subDirTemplated bool
 }
 
 // Ordering of elements in the CSI volume id.
@@ -63,6 +77,9 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	if len(name) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume name must be provided")
 	}
+	// the second request of the same name waits and finds the subdirectory created by the first one
+	d.createVolumeLocks.Lock(name)
+	defer d.createVolumeLocks.Unlock(name)
 
 	volumeCapabilities := req.GetVolumeCapabilities()
 	if err := isValidVolumeCapabilities(volumeCapabilities); err != nil {
@@ -78,6 +95,15 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	fullVolumeID := ""
+	if d.maxVolumeIDLength > 0 && len(smbVol.id) > d.maxVolumeIDLength {
+		klog.V(2).Infof("CreateVolume(%s): volume id %s is longer than %d, hash it", name, smbVol.id, d.maxVolumeIDLength)
+		fullVolumeID = smbVol.id
+		if smbVol.id = getHashedVolumeID(smbVol); len(smbVol.id) > d.maxVolumeIDLength {
+			return nil, status.Errorf(codes.InvalidArgument, "hashed volume id %s is still longer than %d", smbVol.id, d.maxVolumeIDLength)
+		}
+		setKeyValueInMap(parameters, fullVolumeIDField, fullVolumeID)
+	}
 
 	secrets := req.GetSecrets()
 	createSubDir := len(secrets) > 0
@@ -94,6 +120,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			createSubDir = true
 		}
 	}
+	if fullVolumeID != "" && !createSubDir {
+		// full volume id of a hashed volume id is recorded on the share when the subdirectory is created
+		return nil, status.Errorf(codes.InvalidArgument, "volume id %s is longer than %d, it could only be hashed when subdirectory is created", fullVolumeID, d.maxVolumeIDLength)
+	}
 
 	if createSubDir {
 		// Mount smb base share so we can create a subdirectory
@@ -106,11 +136,21 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			}
 		}()
 		// Create subdirectory under base-dir
-		// TODO: revisit permissions
 		internalVolumePath := getInternalVolumePath(d.workingMountDir, smbVol)
-		if err = os.MkdirAll(internalVolumePath, 0777); err != nil {
+		if smbVol.subDirTemplated {
+			if err = createOwnedSubDir(internalVolumePath, name); err != nil {
+				return nil, err
+			}
+		} else if err = ensureDir(internalVolumePath, 0777); err != nil {
+			// a fixed subDir could be shared by volumes on purpose
 			return nil, status.Errorf(codes.Internal, "failed to make subdirectory: %v", err.Error())
 		}
+		if fullVolumeID != "" {
+			hashedVolumeIDFile := getHashedVolumeIDFilePath(getInternalMountPath(d.workingMountDir, smbVol), smbVol.id)
+			if err = os.WriteFile(hashedVolumeIDFile, []byte(fullVolumeID), 0644); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to write full volume id to %s: %v", hashedVolumeIDFile, err)
+			}
+		}
 
 		if req.GetVolumeContentSource() != nil {
 			if err := d.copyVolume(ctx, req, smbVol); err != nil {
@@ -178,12 +218,34 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 			}
 		}()
 
+		hashedVolumeIDFile := ""
+		if isHashedVolumeID(volumeID) {
+			hashedVolumeIDFile = getHashedVolumeIDFilePath(getInternalMountPath(d.workingMountDir, smbVol), volumeID)
+			found, err := resolveHashedVolume(smbVol, hashedVolumeIDFile)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if !found {
+				klog.Warningf("full volume id of hashed volume id %s is not found in %s, subdirectory is already deleted", volumeID, hashedVolumeIDFile)
+				return &csi.DeleteVolumeResponse{}, nil
+			}
+		}
+
 		// Delete subdirectory under base-dir
 		internalVolumePath := getInternalVolumePath(d.workingMountDir, smbVol)
 		klog.V(2).Infof("Removing subdirectory at %v", internalVolumePath)
 		if err = os.RemoveAll(internalVolumePath); err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to delete subdirectory: %v", err.Error())
 		}
+		if err = os.Remove(getSubDirOwnerFilePath(internalVolumePath)); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("failed to delete owner file of subdirectory %s: %v", internalVolumePath, err)
+		}
+		// full volume id is removed after the subdirectory, so that a retry could still find the subdirectory
+		if hashedVolumeIDFile != "" {
+			if err = os.Remove(hashedVolumeIDFile); err != nil && !os.IsNotExist(err) {
+				return nil, status.Errorf(codes.Internal, "failed to delete %s: %v", hashedVolumeIDFile, err)
+			}
+		}
 	} else {
 		klog.V(2).Infof("DeleteVolume(%s) does not delete subdirectory", volumeID)
 	}
@@ -294,14 +356,11 @@ func (d *Driver) internalUnmount(ctx context.Context, vol *smbVolume) error {
 
 // copyFromVolume create a copied volume from a volume
 func (d *Driver) copyFromVolume(ctx context.Context, req *csi.CreateVolumeRequest, dstVol *smbVolume) error {
-	srcVol, err := getSmbVolFromID(req.GetVolumeContentSource().GetVolume().GetVolumeId())
+	srcVolumeID := req.GetVolumeContentSource().GetVolume().GetVolumeId()
+	srcVol, err := getSmbVolFromID(srcVolumeID)
 	if err != nil {
 		return status.Error(codes.NotFound, err.Error())
 	}
-	// Note that the source path must include trailing '/.', can't use 'filepath.Join()' as it performs path cleaning
-	srcPath := fmt.Sprintf("%v/.", getInternalVolumePath(d.workingMountDir, srcVol))
-	dstPath := getInternalVolumePath(d.workingMountDir, dstVol)
-	klog.V(2).Infof("copy volume from volume %v -> %v", srcPath, dstPath)
 
 	var volCap *csi.VolumeCapability
 	if len(req.GetVolumeCapabilities()) > 0 {
@@ -317,6 +376,20 @@ func (d *Driver) copyFromVolume(ctx context.Context, req *csi.CreateVolumeReques
 			klog.Warningf("failed to unmount nfs server: %v", err)
 		}
 	}()
+	if isHashedVolumeID(srcVolumeID) {
+		hashedVolumeIDFile := getHashedVolumeIDFilePath(getInternalMountPath(d.workingMountDir, srcVol), srcVolumeID)
+		found, err := resolveHashedVolume(srcVol, hashedVolumeIDFile)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if !found {
+			return status.Errorf(codes.NotFound, "full volume id of source volume %s is not found in %s", srcVolumeID, hashedVolumeIDFile)
+		}
+	}
+	// Note that the source path must include trailing '/.', can't use 'filepath.Join()' as it performs path cleaning
+	srcPath := fmt.Sprintf("%v/.", getInternalVolumePath(d.workingMountDir, srcVol))
+	dstPath := getInternalVolumePath(d.workingMountDir, dstVol)
+	klog.V(2).Infof("copy volume from volume %v -> %v", srcPath, dstPath)
 	if err = d.internalMount(ctx, dstVol, volCap, secrets); err != nil {
 		return status.Errorf(codes.Internal, "failed to mount dst nfs server: %v", err)
 	}
@@ -341,6 +414,9 @@ func (d *Driver) copyVolume(ctx context.Context, req *csi.CreateVolumeRequest, v
 	case *csi.VolumeContentSource_Snapshot:
 		return status.Errorf(codes.InvalidArgument, "copy volume from volumeSnapshot is not supported")
 	case *csi.VolumeContentSource_Volume:
+		if !d.enableVolumeClone {
+			return status.Errorf(codes.InvalidArgument, "copy volume from volume is disabled")
+		}
 		return d.copyFromVolume(ctx, req, vol)
 	default:
 		return status.Errorf(codes.InvalidArgument, "%v is not a proper volume source", vs)
@@ -356,6 +432,47 @@ func getVolumeIDFromSmbVol(vol *smbVolume) string {
 	return strings.Join(idElements, separator)
 }
 
+// getHashedVolumeID returns a volume id of the form {server}#{hash}, hash is a fixed length sha256 hash of the full volume id,
+// source is kept so that the share could be mounted to look up the full volume id
+func getHashedVolumeID(vol *smbVolume) string {
+	sum := sha256.Sum256([]byte(vol.id))
+	return strings.Trim(vol.source, "/") + separator + hashedVolumeIDPrefix + hex.EncodeToString(sum[:])
+}
+
+// isHashedVolumeID checks whether id is hashed by getHashedVolumeID
+func isHashedVolumeID(id string) bool {
+	segments := strings.Split(id, separator)
+	return len(segments) == 2 && len(segments[1]) == hashedVolumeIDLength && strings.HasPrefix(segments[1], hashedVolumeIDPrefix)
+}
+
+// getHashedVolumeIDFilePath returns the path of the file under share root which records the full volume id of a hashed volume id
+func getHashedVolumeIDFilePath(internalMountPath, hashedVolumeID string) string {
+	segments := strings.Split(hashedVolumeID, separator)
+	return filepath.Join(internalMountPath, "."+segments[len(segments)-1]+hashedVolumeIDFileSuffix)
+}
+
+// resolveHashedVolume sets subDir of vol parsed from a hashed volume id with the full volume id recorded in hashedVolumeIDFile,
+// it returns false if the file does not exist
+func resolveHashedVolume(vol *smbVolume, hashedVolumeIDFile string) (bool, error) {
+	content, err := os.ReadFile(hashedVolumeIDFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read full volume id from %s: %v", hashedVolumeIDFile, err)
+	}
+	fullVol, err := getSmbVolFromID(strings.TrimSpace(string(content)))
+	if err != nil {
+		return false, fmt.Errorf("invalid full volume id in %s: %v", hashedVolumeIDFile, err)
+	}
+	if fullVol.subDir == "" {
+		return false, fmt.Errorf("full volume id in %s has no subDir", hashedVolumeIDFile)
+	}
+	// uuid is not changed so that the internal mount path of vol is kept
+	vol.subDir = fullVol.subDir
+	return true, nil
+}
+
 // getInternalMountPath: get working directory for CreateVolume and DeleteVolume
 func getInternalMountPath(workingMountDir string, vol *smbVolume) string {
 	if vol == nil {
@@ -370,7 +487,7 @@ func getInternalMountPath(workingMountDir string, vol *smbVolume) string {
 
 // Convert VolumeCreate parameters to an smbVolume
 func newSMBVolume(name string, size int64, params map[string]string) (*smbVolume, error) {
-	var source, subDir string
+	var source, subDir, prefixPath string
 	subDirReplaceMap := map[string]string{}
 
 	// validate parameters (case-insensitive).
@@ -380,12 +497,18 @@ func newSMBVolume(name string, size int64, params map[string]string) (*smbVolume
 			source = v
 		case subDirField:
 			subDir = v
+		case prefixPathField:
+			prefixPath = v
 		case pvcNamespaceKey:
 			subDirReplaceMap[pvcNamespaceMetadata] = v
 		case pvcNameKey:
 			subDirReplaceMap[pvcNameMetadata] = v
 		case pvNameKey:
 			subDirReplaceMap[pvNameMetadata] = v
+		case posixField, bsizeField, rdmaField, resilientHandlesField, mapCharsField, mapPosixField, noHandleCacheField, backupUIDField, backupGIDField, snapshotField, closeTimeoField, maxCreditsField, transportField, sfuField, modeFromSIDField, profileField, expectedSPNField, mountNamespaceField, retryableErrorsField, autoServerinoField, domainsField, domainSelectorField, credentialProviderField, tcpNoDelayField, noBlockSendField, echoIntervalField, strictSyncField, wsizeField, noShareSockField, persistentHandlesField, disableGidMountField, realmField, strictConsistencyField, allowAdminShareField, domainField, noLeaseField:
+			// parameters only used in NodeStageVolume
+		case publishMountOptionsField, bindModeField:
+			// parameters only used in NodePublishVolume
 		default:
 			return nil, fmt.Errorf("invalid parameter %s in storage class", k)
 		}
@@ -394,9 +517,13 @@ func newSMBVolume(name string, size int64, params map[string]string) (*smbVolume
 	if source == "" {
 		return nil, fmt.Errorf("%v is a required parameter", sourceField)
 	}
+	if err := validatePrefixPath(prefixPath); err != nil {
+		return nil, err
+	}
 
 	vol := &smbVolume{
-		source: source,
+		// subDir is created under prefixPath which is joined to source in NodeStageVolume
+		source: getMountSource(source, prefixPath),
 		size:   size,
 	}
 	if subDir == "" {
@@ -405,6 +532,7 @@ func newSMBVolume(name string, size int64, params map[string]string) (*smbVolume
 	} else {
 		// replace pv/pvc name namespace metadata in subDir
 		vol.subDir = replaceWithMap(subDir, subDirReplaceMap)
+		vol.subDirTemplated = strings.Contains(subDir, "${")
 		// make volume id unique if subDir is provided
 		vol.uuid = name
 	}
@@ -423,14 +551,95 @@ func getInternalVolumePath(workingMountDir string, vol *smbVolume) string {
 	return filepath.Join(getInternalMountPath(workingMountDir, vol), vol.subDir)
 }
 
+// getSubDirOwnerFilePath returns the path of the owner file of a subdirectory,
+// owner file is placed next to the subdirectory so that it's not visible inside the volume
+func getSubDirOwnerFilePath(subDirPath string) string {
+	return filepath.Join(filepath.Dir(subDirPath), "."+filepath.Base(subDirPath)+subDirOwnerFileSuffix)
+}
+
+// createOwnedSubDir creates subdirectory and records the owner volume name,
+// it returns AlreadyExists error if the subdirectory is already owned by another volume,
+// e.g. two PVCs in different namespaces are mapped to the same subDir template.
+// The owner file is created exclusively, so only one of the volumes racing for the same subdirectory wins,
+// a pre-existing subdirectory without owner file is not claimed since it may hold data of another volume
+func createOwnedSubDir(subDirPath, owner string) error {
+	ownerFilePath := getSubDirOwnerFilePath(subDirPath)
+	f, err := os.OpenFile(ownerFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	switch {
+	case err == nil:
+		if err := claimSubDir(f, subDirPath, owner); err != nil {
+			if err := os.Remove(ownerFilePath); err != nil {
+				klog.Warningf("failed to remove owner file %s: %v", ownerFilePath, err)
+			}
+			return err
+		}
+	case os.IsExist(err):
+		content, err := os.ReadFile(ownerFilePath)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read owner file %s: %v", ownerFilePath, err)
+		}
+		existingOwner := strings.TrimSpace(string(content))
+		if existingOwner == "" {
+			return status.Errorf(codes.AlreadyExists, "subdirectory %s is being created by another volume", subDirPath)
+		}
+		if existingOwner != owner {
+			return status.Errorf(codes.AlreadyExists, "subdirectory %s is already used by volume %s", subDirPath, existingOwner)
+		}
+		klog.V(2).Infof("subdirectory %s is already created by volume %s", subDirPath, owner)
+	default:
+		return status.Errorf(codes.Internal, "failed to create owner file %s: %v", ownerFilePath, err)
+	}
+
+	// TODO: revisit permissions
+	if err := ensureDir(subDirPath, 0777); err != nil {
+		return status.Errorf(codes.Internal, "failed to make subdirectory: %v", err.Error())
+	}
+	return nil
+}
+
+// claimSubDir writes owner into the newly created owner file f of subDirPath and closes it,
+// it returns AlreadyExists error if subDirPath already exists without owner file
+func claimSubDir(f *os.File, subDirPath, owner string) error {
+	defer f.Close()
+	if _, err := os.Stat(subDirPath); err == nil {
+		klog.Warningf("subdirectory %s already exists without owner file, it's not claimed by volume %s", subDirPath, owner)
+		return status.Errorf(codes.AlreadyExists, "subdirectory %s already exists without owner file", subDirPath)
+	} else if !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "failed to check subdirectory %s: %v", subDirPath, err)
+	}
+	if _, err := f.WriteString(owner); err != nil {
+		return status.Errorf(codes.Internal, "failed to write owner file %s: %v", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return status.Errorf(codes.Internal, "failed to write owner file %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
 // Convert into smbVolume into a csi.Volume
 func (d *Driver) smbVolToCSI(vol *smbVolume, req *csi.CreateVolumeRequest, parameters map[string]string) *csi.Volume {
-	return &csi.Volume{
+	volume := &csi.Volume{
 		CapacityBytes: 0, // by setting it to zero, Provisioner will use PVC requested size as PV size
 		VolumeId:      vol.id,
 		VolumeContext: parameters,
 		ContentSource: req.GetVolumeContentSource(),
 	}
+	if d.enableHostnameTopology {
+		volume.AccessibleTopology = getAccessibleTopology(req.GetAccessibilityRequirements())
+	}
+	return volume
+}
+
+// getAccessibleTopology returns the most preferred topology in requirements, which pins the volume to one node
+func getAccessibleTopology(requirements *csi.TopologyRequirement) []*csi.Topology {
+	for _, topologies := range [][]*csi.Topology{requirements.GetPreferred(), requirements.GetRequisite()} {
+		for _, topology := range topologies {
+			if _, ok := topology.GetSegments()[topologyKeyHostname]; ok {
+				return []*csi.Topology{{Segments: map[string]string{topologyKeyHostname: topology.GetSegments()[topologyKeyHostname]}}}
+			}
+		}
+	}
+	return nil
 }
 
 // Given a CSI volume id, return a smbVolume
@@ -438,6 +647,9 @@ func (d *Driver) smbVolToCSI(vol *smbVolume, req *csi.CreateVolumeRequest, param
 //
 //	smb-server.default.svc.cluster.local/share#pvc-4729891a-f57e-4982-9c60-e9884af1be2f
 //	smb-server.default.svc.cluster.local/share#subdir#pvc-4729891a-f57e-4982-9c60-e9884af1be2f
+//
+// subDir of a hashed volume id(e.g. smb-server.default.svc.cluster.local/share#sha256-<hash>) is empty,
+// it is resolved with resolveHashedVolume after the share is mounted
 func getSmbVolFromID(id string) (*smbVolume, error) {
 	segments := strings.Split(id, separator)
 	if len(segments) < 2 {
@@ -455,6 +667,10 @@ func getSmbVolFromID(id string) (*smbVolume, error) {
 	if len(segments) >= 3 {
 		vol.uuid = segments[2]
 	}
+	if isHashedVolumeID(id) {
+		// hash is used as internal mount directory which is unique per volume
+		vol.subDir, vol.uuid = "", segments[1]
+	}
 	return vol, nil
 }
 
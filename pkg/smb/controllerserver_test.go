@@ -23,13 +23,17 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-driver-smb/test/utils/testutil"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
 )
 
 const (
@@ -624,11 +628,12 @@ func TestNewSMBVolume(t *testing.T) {
 				pvNameKey:       "pvname",
 			},
 			expectVol: &smbVolume{
-				id:     "smb-server.default.svc.cluster.local/share#subdir-pvcname-pvcnamespace-pvname#pv-name",
-				source: "//smb-server.default.svc.cluster.local/share",
-				subDir: "subdir-pvcname-pvcnamespace-pvname",
-				size:   100,
-				uuid:   "pv-name",
+				id:              "smb-server.default.svc.cluster.local/share#subdir-pvcname-pvcnamespace-pvname#pv-name",
+				source:          "//smb-server.default.svc.cluster.local/share",
+				subDir:          "subdir-pvcname-pvcnamespace-pvname",
+				size:            100,
+				uuid:            "pv-name",
+				subDirTemplated: true,
 			},
 		},
 		{
@@ -646,6 +651,44 @@ func TestNewSMBVolume(t *testing.T) {
 				uuid:   "",
 			},
 		},
+		{
+			desc: "mount option parameters are accepted",
+			name: "pv-name",
+			size: 200,
+			params: map[string]string{
+				"source": "//smb-server.default.svc.cluster.local/share",
+				"posix":  "on",
+			},
+			expectVol: &smbVolume{
+				id:     "smb-server.default.svc.cluster.local/share#pv-name#",
+				source: "//smb-server.default.svc.cluster.local/share",
+				subDir: "pv-name",
+				size:   200,
+				uuid:   "",
+			},
+		},
+		{
+			desc: "prefixPath and subDir are specified",
+			name: "pv-name",
+			size: 100,
+			params: map[string]string{
+				"source":     "//smb-server.default.svc.cluster.local/share",
+				"prefixPath": "/data/",
+				"subDir":     "subdir",
+			},
+			expectVol: &smbVolume{
+				id:     "smb-server.default.svc.cluster.local/share/data#subdir#pv-name",
+				source: "//smb-server.default.svc.cluster.local/share/data/",
+				subDir: "subdir",
+				size:   100,
+				uuid:   "pv-name",
+			},
+		},
+		{
+			desc:      "prefixPath escapes share root",
+			params:    map[string]string{"source": "//smb-server.default.svc.cluster.local/share", "prefixPath": "data/../../share2"},
+			expectErr: fmt.Errorf("invalid prefixpath value: data/../../share2, it must not contain .."),
+		},
 		{
 			desc:      "invalid parameter",
 			params:    map[string]string{"invalid-parameter": "value"},
@@ -830,3 +873,501 @@ func TestCopyFromVolume(t *testing.T) {
 		})
 	}
 }
+
+func TestCopyFromHashedVolume(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip copy volume test on Windows")
+	}
+	d := NewFakeDriver()
+	d.workingMountDir = t.TempDir()
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+	srcVolumeID := getHashedVolumeID(&smbVolume{id: "smb-server/share#srcdir#pvc-src", source: "//smb-server/share"})
+	srcVol, err := getSmbVolFromID(srcVolumeID)
+	assert.NoError(t, err)
+	srcMountPath := getInternalMountPath(d.workingMountDir, srcVol)
+	dstVol := &smbVolume{id: "smb-server/share#dstdir#pvc-dst", source: "//smb-server/share", subDir: "dstdir", uuid: "pvc-dst"}
+	assert.NoError(t, os.MkdirAll(getInternalVolumePath(d.workingMountDir, dstVol), 0750))
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-dst",
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcVolumeID}},
+		},
+		Secrets: map[string]string{usernameField: "test", passwordField: "test"},
+	}
+
+	// full volume id of source volume is not recorded
+	err = d.copyFromVolume(context.Background(), req, dstVol)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(srcMountPath, "srcdir"), 0750))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcMountPath, "srcdir", "data"), []byte("data"), 0644))
+	assert.NoError(t, os.WriteFile(getHashedVolumeIDFilePath(srcMountPath, srcVolumeID), []byte("smb-server/share#srcdir#pvc-src"), 0644))
+	assert.NoError(t, d.copyFromVolume(context.Background(), req, dstVol))
+	content, err := os.ReadFile(filepath.Join(getInternalVolumePath(d.workingMountDir, dstVol), "data"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(content))
+}
+
+func TestCopyVolumeCloneDisabled(t *testing.T) {
+	d := NewFakeDriver()
+	d.enableVolumeClone = false
+	req := &csi.CreateVolumeRequest{
+		Name: testCSIVolume,
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{
+					VolumeId: testVolumeID,
+				},
+			},
+		},
+	}
+	err := d.copyVolume(context.TODO(), req, &smbVolume{})
+	assert.Equal(t, status.Error(codes.InvalidArgument, "copy volume from volume is disabled"), err)
+}
+
+func TestCreateOwnedSubDir(t *testing.T) {
+	workingDir, err := os.MkdirTemp("", "csi-smb-subdir-test")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+	// subdirectory created before owner files are introduced
+	if err := os.Mkdir(filepath.Join(workingDir, "pre-existing"), 0750); err != nil {
+		t.Fatalf("failed to create pre-existing subdirectory: %v", err)
+	}
+
+	cases := []struct {
+		desc        string
+		subDir      string
+		owner       string
+		expectedErr error
+	}{
+		{
+			desc:   "[Success] first volume creates subdirectory",
+			subDir: "ns1-pvc",
+			owner:  "pvc-uid-1",
+		},
+		{
+			desc:   "[Success] duplicate request is idempotent",
+			subDir: "ns1-pvc",
+			owner:  "pvc-uid-1",
+		},
+		{
+			desc:   "[Success] collision avoided with unique subdirectory",
+			subDir: "ns2-pvc",
+			owner:  "pvc-uid-2",
+		},
+		{
+			desc:        "[Error] pre-existing subdirectory without owner file is not claimed",
+			subDir:      "pre-existing",
+			owner:       "pvc-uid-3",
+			expectedErr: status.Errorf(codes.AlreadyExists, "subdirectory %s already exists without owner file", filepath.Join(workingDir, "pre-existing")),
+		},
+		{
+			desc:        "[Error] subdirectory owned by another volume",
+			subDir:      "ns1-pvc",
+			owner:       "pvc-uid-2",
+			expectedErr: status.Errorf(codes.AlreadyExists, "subdirectory %s is already used by volume %s", filepath.Join(workingDir, "ns1-pvc"), "pvc-uid-1"),
+		},
+	}
+
+	for _, test := range cases {
+		subDirPath := filepath.Join(workingDir, test.subDir)
+		err := createOwnedSubDir(subDirPath, test.owner)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if test.expectedErr == nil {
+			info, err := os.Stat(subDirPath)
+			if err != nil || !info.IsDir() {
+				t.Errorf("test[%s]: subdirectory %s not created: %v", test.desc, subDirPath, err)
+			}
+			owner, err := os.ReadFile(getSubDirOwnerFilePath(subDirPath))
+			if err != nil || string(owner) != test.owner {
+				t.Errorf("test[%s]: unexpected owner: %s, expected: %s, error: %v", test.desc, owner, test.owner, err)
+			}
+		}
+	}
+	// owner file is not left behind for the subdirectory which is not claimed
+	_, err = os.Stat(getSubDirOwnerFilePath(filepath.Join(workingDir, "pre-existing")))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// shareMounter mounts source by a symlink to shareDir, so that mounts of different volumes see the same smb share,
+// each mount waits until all mounts counted in mounted are done, so that the volumes race on the share
+type shareMounter struct {
+	*mount.FakeMounter
+	shareDir string
+	mounted  *sync.WaitGroup
+}
+
+func (m *shareMounter) MountSensitive(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(m.shareDir, target); err != nil {
+		return err
+	}
+	if err := m.FakeMounter.MountSensitive(source, target, fstype, options, sensitiveOptions); err != nil {
+		return err
+	}
+	m.mounted.Done()
+	m.mounted.Wait()
+	return nil
+}
+
+func TestCreateVolumeConcurrentSameSubDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip concurrent CreateVolume test on Windows")
+	}
+	newRequest := func(name string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			// PVCs of the same name in different namespaces are resolved to the same subdirectory
+			Parameters: map[string]string{sourceField: testServer, subDirField: "${pvc.metadata.name}", pvcNameKey: "shared"},
+			Secrets:    map[string]string{usernameField: "test", passwordField: "test"},
+		}
+	}
+
+	for round := 0; round < 10; round++ {
+		d := NewFakeDriver()
+		d.workingMountDir = t.TempDir()
+		shareDir := t.TempDir()
+		names := []string{"pvc-1", "pvc-2"}
+		mounted := &sync.WaitGroup{}
+		mounted.Add(len(names))
+		d.mounter = &mount.SafeFormatAndMount{Interface: &shareMounter{FakeMounter: mount.NewFakeMounter(nil), shareDir: shareDir, mounted: mounted}}
+
+		errs := make([]error, len(names))
+		var wg sync.WaitGroup
+		for i := range names {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = d.CreateVolume(context.Background(), newRequest(names[i]))
+			}(i)
+		}
+		wg.Wait()
+
+		// only one of the volumes owns the subdirectory
+		var winner string
+		for i, err := range errs {
+			if err == nil {
+				assert.Empty(t, winner, "round %d: both volumes own the subdirectory", round)
+				winner = names[i]
+				continue
+			}
+			assert.Equal(t, codes.AlreadyExists, status.Code(err), "round %d", round)
+		}
+		if assert.NotEmpty(t, winner, "round %d", round) {
+			owner, err := os.ReadFile(getSubDirOwnerFilePath(filepath.Join(shareDir, "shared")))
+			assert.NoError(t, err)
+			assert.Equal(t, winner, string(owner), "round %d", round)
+		}
+	}
+}
+
+func TestGetAccessibleTopology(t *testing.T) {
+	node1 := &csi.Topology{Segments: map[string]string{topologyKeyHostname: "node-1"}}
+	node2 := &csi.Topology{Segments: map[string]string{topologyKeyHostname: "node-2", "zone": "z1"}}
+	tests := []struct {
+		desc         string
+		requirements *csi.TopologyRequirement
+		expected     []*csi.Topology
+	}{
+		{
+			desc: "no requirements",
+		},
+		{
+			desc:         "preferred topology first",
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{node2}, Preferred: []*csi.Topology{node1}},
+			expected:     []*csi.Topology{{Segments: map[string]string{topologyKeyHostname: "node-1"}}},
+		},
+		{
+			desc:         "requisite topology without host name key in preferred",
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{node2}, Preferred: []*csi.Topology{{Segments: map[string]string{"zone": "z1"}}}},
+			expected:     []*csi.Topology{{Segments: map[string]string{topologyKeyHostname: "node-2"}}},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getAccessibleTopology(test.requirements), test.desc)
+	}
+}
+
+// concurrencyMounter records the max number of concurrent mounts
+type concurrencyMounter struct {
+	fakeMounter
+	mux           sync.Mutex
+	running       int
+	maxConcurrent int
+	mounts        int
+}
+
+func (m *concurrencyMounter) MountSensitive(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	m.mux.Lock()
+	m.running++
+	m.mounts++
+	if m.running > m.maxConcurrent {
+		m.maxConcurrent = m.running
+	}
+	m.mux.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	m.mux.Lock()
+	m.running--
+	m.mux.Unlock()
+	return nil
+}
+
+func TestCreateVolumeConcurrentSameName(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip concurrent CreateVolume test on Windows")
+	}
+	d := NewFakeDriver()
+	d.workingMountDir = t.TempDir()
+	m := &concurrencyMounter{}
+	d.mounter = &mount.SafeFormatAndMount{Interface: m}
+
+	newRequest := func() *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: "pvc-concurrent",
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			Parameters: map[string]string{sourceField: testServer, subDirField: "${pvc.metadata.name}", pvcNameKey: "pvc-concurrent"},
+			Secrets:    map[string]string{usernameField: "test", passwordField: "test"},
+		}
+	}
+
+	var wg sync.WaitGroup
+	resps := make([]*csi.CreateVolumeResponse, 2)
+	errs := make([]error, 2)
+	for i := range resps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i], errs[i] = d.CreateVolume(context.Background(), newRequest())
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range resps {
+		assert.NoError(t, errs[i])
+	}
+	assert.Equal(t, resps[0], resps[1])
+	assert.Equal(t, 1, m.maxConcurrent, "CreateVolume of the same name should be serialized")
+	assert.Equal(t, 2, m.mounts)
+
+	owner, err := os.ReadFile(getSubDirOwnerFilePath(getInternalVolumePath(d.workingMountDir, &smbVolume{id: resps[0].Volume.VolumeId, subDir: "pvc-concurrent"})))
+	assert.NoError(t, err)
+	assert.Equal(t, "pvc-concurrent", string(owner))
+}
+
+func TestCreateVolumeSubDirOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip CreateVolume test on Windows")
+	}
+	tests := []struct {
+		desc        string
+		parameters  map[string]string
+		expectedErr codes.Code
+	}{
+		{
+			desc:       "fixed subDir could be shared by volumes",
+			parameters: map[string]string{sourceField: testServer, subDirField: "shared"},
+		},
+		{
+			desc:        "subDir template resolved to a subdirectory owned by another volume",
+			parameters:  map[string]string{sourceField: testServer, subDirField: "${pvc.metadata.name}", pvcNameKey: "shared"},
+			expectedErr: codes.AlreadyExists,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.workingMountDir = t.TempDir()
+		d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+		vol, err := newSMBVolume("pvc-2", 0, test.parameters)
+		assert.NoError(t, err, test.desc)
+		// subdirectory is already created by another volume
+		internalVolumePath := getInternalVolumePath(d.workingMountDir, vol)
+		assert.NoError(t, os.MkdirAll(internalVolumePath, 0750), test.desc)
+		assert.NoError(t, os.WriteFile(getSubDirOwnerFilePath(internalVolumePath), []byte("pvc-1"), 0644), test.desc)
+
+		_, err = d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: "pvc-2",
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			Parameters: test.parameters,
+			Secrets:    map[string]string{usernameField: "test", passwordField: "test"},
+		})
+		assert.Equal(t, test.expectedErr, status.Code(err), test.desc)
+		// owner of the subdirectory is not changed
+		owner, err := os.ReadFile(getSubDirOwnerFilePath(internalVolumePath))
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, "pvc-1", string(owner), test.desc)
+	}
+}
+
+func TestCreateVolumeMaxVolumeIDLength(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip CreateVolume test on Windows")
+	}
+	longSubDir := strings.Repeat("a", 200)
+	tests := []struct {
+		desc             string
+		subDir           string
+		expectedHashed   bool
+		expectedVolumeID string
+	}{
+		{
+			desc:             "short volume id passes through",
+			subDir:           "subdir",
+			expectedVolumeID: "test-server/baseDir#subdir#pvc-1",
+		},
+		{
+			desc:             "long volume id is hashed",
+			subDir:           longSubDir,
+			expectedHashed:   true,
+			expectedVolumeID: getHashedVolumeID(&smbVolume{id: "test-server/baseDir#" + longSubDir + "#pvc-1", source: "//" + testServer}),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.workingMountDir = t.TempDir()
+		d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+		d.maxVolumeIDLength = 128
+		resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: "pvc-1",
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			Parameters: map[string]string{sourceField: testServer, subDirField: test.subDir},
+		})
+		assert.NoError(t, err, test.desc)
+		volumeID := resp.Volume.VolumeId
+		assert.Equal(t, test.expectedVolumeID, volumeID, test.desc)
+		assert.LessOrEqual(t, len(volumeID), d.maxVolumeIDLength, test.desc)
+		assert.Equal(t, test.expectedHashed, isHashedVolumeID(volumeID), test.desc)
+
+		fullVolumeID, found := resp.Volume.VolumeContext[fullVolumeIDField]
+		assert.Equal(t, test.expectedHashed, found, test.desc)
+		if test.expectedHashed {
+			// source and subDir are recovered from full volume id in volume context
+			vol, err := getSmbVolFromID(fullVolumeID)
+			assert.NoError(t, err, test.desc)
+			assert.Equal(t, "//"+testServer, vol.source, test.desc)
+			assert.Equal(t, test.subDir, vol.subDir, test.desc)
+			assert.Equal(t, test.subDir, resp.Volume.VolumeContext[subDirField], test.desc)
+
+			// full volume id is recorded under share root
+			hashedVol, err := getSmbVolFromID(volumeID)
+			assert.NoError(t, err, test.desc)
+			assert.Equal(t, "//"+testServer, hashedVol.source, test.desc)
+			assert.Empty(t, hashedVol.subDir, test.desc)
+			shareRoot := filepath.Join(d.workingMountDir, "pvc-1")
+			content, err := os.ReadFile(getHashedVolumeIDFilePath(shareRoot, volumeID))
+			assert.NoError(t, err, test.desc)
+			assert.Equal(t, fullVolumeID, string(content), test.desc)
+
+			// share is mounted on internal mount path of the hashed volume id in DeleteVolume
+			assert.NoError(t, os.Rename(shareRoot, getInternalMountPath(d.workingMountDir, hashedVol)), test.desc)
+			deleteReq := &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: map[string]string{usernameField: "test", passwordField: "test"}}
+			_, err = d.DeleteVolume(context.Background(), deleteReq)
+			assert.NoError(t, err, test.desc)
+			for _, path := range []string{
+				filepath.Join(getInternalMountPath(d.workingMountDir, hashedVol), longSubDir),
+				getHashedVolumeIDFilePath(getInternalMountPath(d.workingMountDir, hashedVol), volumeID),
+			} {
+				_, err = os.Stat(path)
+				assert.True(t, os.IsNotExist(err), "%s: %s is not deleted", test.desc, path)
+			}
+			// DeleteVolume is idempotent after the full volume id is deleted
+			_, err = d.DeleteVolume(context.Background(), deleteReq)
+			assert.NoError(t, err, test.desc)
+		}
+	}
+}
+
+func TestCreateVolumeHashedVolumeIDRejected(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip CreateVolume test on Windows")
+	}
+	tests := []struct {
+		desc       string
+		name       string
+		parameters map[string]string
+	}{
+		{
+			desc:       "subdirectory is not created",
+			name:       strings.Repeat("a", 200),
+			parameters: map[string]string{sourceField: testServer},
+		},
+		{
+			desc:       "hashed volume id is still too long",
+			name:       "pvc-1",
+			parameters: map[string]string{sourceField: testServer + "/" + strings.Repeat("a", 200), subDirField: "subdir"},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.workingMountDir = t.TempDir()
+		d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+		d.maxVolumeIDLength = 128
+		_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: test.name,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			Parameters: test.parameters,
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), test.desc)
+	}
+}
+
+func TestResolveHashedVolume(t *testing.T) {
+	dir := t.TempDir()
+	vol, err := getSmbVolFromID("smb-server/share#" + hashedVolumeIDPrefix + strings.Repeat("0", 64))
+	assert.NoError(t, err)
+	file := getHashedVolumeIDFilePath(dir, vol.id)
+	assert.Equal(t, filepath.Join(dir, "."+hashedVolumeIDPrefix+strings.Repeat("0", 64)+hashedVolumeIDFileSuffix), file)
+
+	found, err := resolveHashedVolume(vol, file)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, os.WriteFile(file, []byte("smb-server/share#"), 0644))
+	_, err = resolveHashedVolume(vol, file)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(file, []byte("smb-server/share#subdir#pvc-1\n"), 0644))
+	found, err = resolveHashedVolume(vol, file)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "subdir", vol.subDir)
+	// internal mount path is not changed
+	assert.Equal(t, hashedVolumeIDPrefix+strings.Repeat("0", 64), vol.uuid)
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// volume context parameter which selects the credential provider used in NodeStageVolume
+	credentialProviderField = "credentialprovider"
+	// default credential provider which reads credentials from CSI secrets
+	secretCredentialProviderName = "secret"
+
+	// policies on unknown keys in node stage secret
+	unknownSecretKeysPolicyIgnore = "ignore"
+	unknownSecretKeysPolicyWarn   = "warn"
+	unknownSecretKeysPolicyReject = "reject"
+
+	// policies on node publish secrets in dedicated mount, require uses publish secrets only,
+	// merge also keeps credentials of stage in memory and fills keys missing in publish secrets with them
+	publishSecretsPolicyRequire = "require"
+	publishSecretsPolicyMerge   = "merge"
+
+	// policies on a credential field(e.g. domain) provided in both volume context and secrets with different values,
+	// secret uses the value in secrets, strict rejects the volume
+	credentialConflictPolicySecret = "secret"
+	credentialConflictPolicyStrict = "strict"
+)
+
+// Credentials are used to mount smb share
+type Credentials struct {
+	Username string
+	Password string
+	Domain   string
+}
+
+// CredentialProvider provides credentials to mount smb share, e.g. from an external secret store
+type CredentialProvider interface {
+	// GetCredentials returns credentials of volumeID, volumeContext and secrets are from NodeStageVolume request
+	GetCredentials(ctx context.Context, volumeID string, volumeContext, secrets map[string]string) (*Credentials, error)
+}
+
+// sanitize trims leading and trailing whitespace(e.g. trailing newline of a secret created from a file)
+// from credentials, and returns error if a control character is left in any of them
+func (c *Credentials) sanitize() error {
+	for _, cred := range []struct {
+		field string
+		value *string
+	}{
+		{field: usernameField, value: &c.Username},
+		{field: passwordField, value: &c.Password},
+		{field: domainField, value: &c.Domain},
+	} {
+		*cred.value = strings.TrimSpace(*cred.value)
+		// value is not included in error since it could be a password
+		for i, r := range []rune(*cred.value) {
+			if unicode.IsControl(r) {
+				return fmt.Errorf("%s contains control character %U at position %d", cred.field, r, i)
+			}
+		}
+	}
+	return nil
+}
+
+// secretCredentialProvider reads credentials from CSI secrets
+type secretCredentialProvider struct{}
+
+func (p *secretCredentialProvider) GetCredentials(_ context.Context, _ string, _, secrets map[string]string) (*Credentials, error) {
+	creds := &Credentials{}
+	for k, v := range secrets {
+		switch strings.ToLower(k) {
+		case usernameField:
+			creds.Username = strings.TrimSpace(v)
+		case passwordField:
+			creds.Password = strings.TrimSpace(v)
+		case domainField:
+			creds.Domain = strings.TrimSpace(v)
+		}
+	}
+	return creds, nil
+}
+
+// credentialProviders is a registry of credential providers keyed by name
+type credentialProviders struct {
+	providers map[string]CredentialProvider
+	mux       sync.RWMutex
+}
+
+func newCredentialProviders() *credentialProviders {
+	return &credentialProviders{
+		providers: map[string]CredentialProvider{
+			secretCredentialProviderName: &secretCredentialProvider{},
+		},
+	}
+}
+
+func (cp *credentialProviders) register(name string, provider CredentialProvider) {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	cp.providers[strings.ToLower(name)] = provider
+}
+
+// get returns credential provider by name, default provider is returned if name is empty
+func (cp *credentialProviders) get(name string) (CredentialProvider, error) {
+	if name == "" {
+		name = secretCredentialProviderName
+	}
+	cp.mux.RLock()
+	defer cp.mux.RUnlock()
+	provider, ok := cp.providers[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("credential provider %s is not registered", name)
+	}
+	return provider, nil
+}
+
+// RegisterCredentialProvider registers a credential provider which could be selected by
+// credentialProvider parameter in volume context, an existing provider with the same name is replaced
+func (d *Driver) RegisterCredentialProvider(name string, provider CredentialProvider) {
+	d.credentialProviders.register(name, provider)
+}
+
+// getUnknownSecretKeys returns sorted keys in secrets which are not recognized by the default credential provider,
+// known keys are username, password, domain and kerberos caches prefixed with krb5cc_
+func getUnknownSecretKeys(secrets map[string]string) []string {
+	var unknownKeys []string
+	for k := range secrets {
+		key := strings.ToLower(k)
+		switch key {
+		case usernameField, passwordField, domainField, mountOptionsField:
+			continue
+		}
+		if strings.HasPrefix(key, krb5Prefix) {
+			continue
+		}
+		unknownKeys = append(unknownKeys, k)
+	}
+	sort.Strings(unknownKeys)
+	return unknownKeys
+}
+
+// parseSecretKeyAliases parses comma separated alias=field pairs(e.g. user=username,pass=password) into a map
+// keyed by lower case alias, field must be one of username, password and domain
+func parseSecretKeyAliases(aliases string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, pair := range strings.Split(aliases, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		alias, field, found := strings.Cut(pair, "=")
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !found || alias == "" {
+			return nil, fmt.Errorf("invalid secret key alias %q, expected format is alias=field", pair)
+		}
+		switch field {
+		case usernameField, passwordField, domainField:
+		default:
+			return nil, fmt.Errorf("invalid secret key alias %q, field must be one of %s, %s and %s", pair, usernameField, passwordField, domainField)
+		}
+		switch alias {
+		case usernameField, passwordField, domainField:
+			return nil, fmt.Errorf("invalid secret key alias %q, alias must not be a field name", pair)
+		}
+		if existing, ok := result[alias]; ok && existing != field {
+			return nil, fmt.Errorf("secret key alias %s is mapped to both %s and %s", alias, existing, field)
+		}
+		result[alias] = field
+	}
+	return result, nil
+}
+
+// applySecretKeyAliases returns a copy of secrets in which keys matching an alias(case-insensitive) are renamed
+// to their field, an alias is left as is if its field is already present in secrets
+func applySecretKeyAliases(secrets map[string]string, aliases map[string]string) map[string]string {
+	if len(aliases) == 0 || len(secrets) == 0 {
+		return secrets
+	}
+	present := map[string]bool{}
+	for k := range secrets {
+		present[strings.ToLower(k)] = true
+	}
+	result := make(map[string]string, len(secrets))
+	for k, v := range secrets {
+		if field, ok := aliases[strings.ToLower(k)]; ok && !present[field] {
+			result[field] = v
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// validateUnknownSecretKeysPolicy returns error if policy is not a supported unknown secret keys policy, empty policy means ignore
+func validateUnknownSecretKeysPolicy(policy string) error {
+	switch policy {
+	case "", unknownSecretKeysPolicyIgnore, unknownSecretKeysPolicyWarn, unknownSecretKeysPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("invalid unknown secret keys policy: %s, supported values: %s, %s, %s", policy, unknownSecretKeysPolicyIgnore, unknownSecretKeysPolicyWarn, unknownSecretKeysPolicyReject)
+}
+
+// validatePublishSecretsPolicy returns error if policy is not a supported publish secrets policy, empty policy means require
+func validatePublishSecretsPolicy(policy string) error {
+	switch policy {
+	case "", publishSecretsPolicyRequire, publishSecretsPolicyMerge:
+		return nil
+	}
+	return fmt.Errorf("invalid publish secrets policy: %s, supported values: %s, %s", policy, publishSecretsPolicyRequire, publishSecretsPolicyMerge)
+}
+
+// validateCredentialConflictPolicy returns error if policy is not a supported credential conflict policy, empty policy means secret
+func validateCredentialConflictPolicy(policy string) error {
+	switch policy {
+	case "", credentialConflictPolicySecret, credentialConflictPolicyStrict:
+		return nil
+	}
+	return fmt.Errorf("invalid credential conflict policy: %s, supported values: %s, %s", policy, credentialConflictPolicySecret, credentialConflictPolicyStrict)
+}
+
+// resolveCredentialField returns value of a credential field provided in volume context and secrets,
+// the value in secrets takes precedence and values differing only in case are regarded as the same,
+// different values are rejected in strict policy, values are not included in error since field could be sensitive
+func resolveCredentialField(volumeID, field, contextValue, secretValue, policy string) (string, error) {
+	if secretValue == "" {
+		return contextValue, nil
+	}
+	if contextValue == "" || strings.EqualFold(contextValue, secretValue) {
+		return secretValue, nil
+	}
+	if policy == credentialConflictPolicyStrict {
+		return "", fmt.Errorf("%s in volume context and secrets have different values", field)
+	}
+	klog.Warningf("volume(%s): %s in volume context is overridden by %s in secrets", volumeID, field, field)
+	return secretValue, nil
+}
+
+// mergeCredentials returns credentials in which empty fields of c are filled with fields of staged
+func (c *Credentials) mergeCredentials(staged *Credentials) *Credentials {
+	merged := *c
+	if staged == nil {
+		return &merged
+	}
+	if merged.Username == "" {
+		merged.Username = staged.Username
+	}
+	if merged.Password == "" {
+		merged.Password = staged.Password
+	}
+	if merged.Domain == "" {
+		merged.Domain = staged.Domain
+	}
+	return &merged
+}
+
+// checkUnknownSecretKeys logs a warning or returns an error on unknown keys in secrets according to policy,
+// it helps to catch typos in secret keys, e.g. passwd instead of password
+func checkUnknownSecretKeys(volumeID string, secrets map[string]string, policy string) error {
+	if policy != unknownSecretKeysPolicyWarn && policy != unknownSecretKeysPolicyReject {
+		return nil
+	}
+	unknownKeys := getUnknownSecretKeys(secrets)
+	if len(unknownKeys) == 0 {
+		return nil
+	}
+	if policy == unknownSecretKeysPolicyReject {
+		return fmt.Errorf("unknown keys %v in secret, supported keys: %s, %s, %s, mountOptions, %s*", unknownKeys, usernameField, passwordField, domainField, krb5Prefix)
+	}
+	klog.Warningf("volume(%s): unknown keys %v in secret are ignored", volumeID, unknownKeys)
+	return nil
+}
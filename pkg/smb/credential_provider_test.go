@@ -0,0 +1,426 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+type fakeCredentialProvider struct {
+	creds     *Credentials
+	err       error
+	volumeIDs []string
+}
+
+func (p *fakeCredentialProvider) GetCredentials(_ context.Context, volumeID string, _, _ map[string]string) (*Credentials, error) {
+	p.volumeIDs = append(p.volumeIDs, volumeID)
+	return p.creds, p.err
+}
+
+func TestSecretCredentialProvider(t *testing.T) {
+	providers := newCredentialProviders()
+	provider, err := providers.get("")
+	assert.NoError(t, err)
+
+	creds, err := provider.GetCredentials(context.Background(), "vol_1", nil, map[string]string{
+		"Username": " user ",
+		"password": "pass",
+		"domain":   "CONTOSO",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &Credentials{Username: "user", Password: "pass", Domain: "CONTOSO"}, creds)
+
+	_, err = providers.get("vault")
+	assert.Equal(t, fmt.Errorf("credential provider vault is not registered"), err)
+}
+
+func TestNodeStageVolumeCredentialProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	tmpDir, err := os.MkdirTemp("", "csi-smb-credential-provider-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	secrets := map[string]string{"username": "secretuser", "password": "secretpass"}
+
+	tests := []struct {
+		desc                     string
+		context                  map[string]string
+		provider                 *fakeCredentialProvider
+		expectedErr              error
+		expectedSensitiveOptions string
+	}{
+		{
+			desc:                     "[Success] default secret provider",
+			context:                  map[string]string{sourceField: "//server/share"},
+			expectedSensitiveOptions: "username=secretuser,password=secretpass",
+		},
+		{
+			desc:                     "[Success] fake provider",
+			context:                  map[string]string{sourceField: "//server/share", "credentialProvider": "fake"},
+			provider:                 &fakeCredentialProvider{creds: &Credentials{Username: "fakeuser", Password: "fakepass"}},
+			expectedSensitiveOptions: "username=fakeuser,password=fakepass",
+		},
+		{
+			desc:        "[Error] fake provider failed",
+			context:     map[string]string{sourceField: "//server/share", "credentialProvider": "fake"},
+			provider:    &fakeCredentialProvider{err: fmt.Errorf("store unavailable")},
+			expectedErr: status.Error(codes.Internal, "volume(vol_1): failed to get credentials from provider fake: store unavailable"),
+		},
+		{
+			desc:                     "[Success] trailing newline in password is trimmed",
+			context:                  map[string]string{sourceField: "//server/share", "credentialProvider": "fake"},
+			provider:                 &fakeCredentialProvider{creds: &Credentials{Username: "fakeuser", Password: "fakepass\r\n"}},
+			expectedSensitiveOptions: "username=fakeuser,password=fakepass",
+		},
+		{
+			desc:        "[Error] embedded control character in password",
+			context:     map[string]string{sourceField: "//server/share", "credentialProvider": "fake"},
+			provider:    &fakeCredentialProvider{creds: &Credentials{Username: "fakeuser", Password: "fake\bpass"}},
+			expectedErr: status.Error(codes.InvalidArgument, "volume(vol_1): invalid credentials: password contains control character U+0008 at position 4"),
+		},
+		{
+			desc:        "[Error] unknown provider",
+			context:     map[string]string{sourceField: "//server/share", "credentialProvider": "vault"},
+			expectedErr: status.Error(codes.InvalidArgument, "volume(vol_1): credential provider vault is not registered"),
+		},
+	}
+
+	for i, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+		if test.provider != nil {
+			d.RegisterCredentialProvider("fake", test.provider)
+		}
+		req := csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1",
+			StagingTargetPath: filepath.Join(tmpDir, fmt.Sprintf("staging-%d", i)),
+			VolumeCapability:  &stdVolCap,
+			VolumeContext:     test.context,
+			Secrets:           secrets,
+		}
+		_, err := d.NodeStageVolume(context.Background(), &req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+		}
+		if test.provider != nil {
+			assert.Equal(t, []string{"vol_1"}, test.provider.volumeIDs, test.desc)
+		}
+		if test.expectedErr != nil {
+			continue
+		}
+		mountPoints, _ := d.mounter.List()
+		if assert.Equal(t, 1, len(mountPoints), test.desc) {
+			assert.Contains(t, mountPoints[0].Opts, test.expectedSensitiveOptions, test.desc)
+		}
+	}
+}
+
+func TestCheckUnknownSecretKeys(t *testing.T) {
+	secrets := map[string]string{
+		"username":          "test",
+		"passwd":            "test",
+		"Domain":            "test_domain",
+		"krb5cc_1000":       "cache",
+		"KRB5CC_1001":       "cache",
+		"mountOptions":      "dir_mode=0777",
+		"unexpected-option": "value",
+	}
+
+	tests := []struct {
+		desc        string
+		secrets     map[string]string
+		policy      string
+		expectedErr error
+	}{
+		{
+			desc:    "unknown keys ignored by default",
+			secrets: secrets,
+		},
+		{
+			desc:    "unknown keys ignored",
+			secrets: secrets,
+			policy:  unknownSecretKeysPolicyIgnore,
+		},
+		{
+			desc:    "unknown keys warned",
+			secrets: secrets,
+			policy:  unknownSecretKeysPolicyWarn,
+		},
+		{
+			desc:        "unknown keys rejected",
+			secrets:     secrets,
+			policy:      unknownSecretKeysPolicyReject,
+			expectedErr: fmt.Errorf("unknown keys [passwd unexpected-option] in secret, supported keys: username, password, domain, mountOptions, krb5cc_*"),
+		},
+		{
+			desc:    "no unknown keys",
+			secrets: map[string]string{"username": "test", "password": "test"},
+			policy:  unknownSecretKeysPolicyReject,
+		},
+	}
+
+	for _, test := range tests {
+		err := checkUnknownSecretKeys("vol_1", test.secrets, test.policy)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+	assert.Equal(t, []string{"passwd", "unexpected-option"}, getUnknownSecretKeys(secrets))
+
+	assert.NoError(t, validateUnknownSecretKeysPolicy(""))
+	assert.NoError(t, validateUnknownSecretKeysPolicy(unknownSecretKeysPolicyReject))
+	assert.Equal(t, fmt.Errorf("invalid unknown secret keys policy: deny, supported values: ignore, warn, reject"), validateUnknownSecretKeysPolicy("deny"))
+}
+
+func TestParseSecretKeyAliases(t *testing.T) {
+	tests := []struct {
+		desc        string
+		aliases     string
+		expected    map[string]string
+		expectedErr error
+	}{
+		{
+			desc:     "empty",
+			expected: map[string]string{},
+		},
+		{
+			desc:     "aliases are lower cased",
+			aliases:  "USER=username, Pass=Password,,workgroup=domain",
+			expected: map[string]string{"user": usernameField, "pass": passwordField, "workgroup": domainField},
+		},
+		{
+			desc:        "missing field",
+			aliases:     "user",
+			expectedErr: fmt.Errorf(`invalid secret key alias "user", expected format is alias=field`),
+		},
+		{
+			desc:        "unknown field",
+			aliases:     "user=login",
+			expectedErr: fmt.Errorf(`invalid secret key alias "user=login", field must be one of username, password and domain`),
+		},
+		{
+			desc:        "alias is a field name",
+			aliases:     "password=username",
+			expectedErr: fmt.Errorf(`invalid secret key alias "password=username", alias must not be a field name`),
+		},
+		{
+			desc:        "alias mapped to different fields",
+			aliases:     "user=username,user=domain",
+			expectedErr: fmt.Errorf("secret key alias user is mapped to both username and domain"),
+		},
+	}
+
+	for _, test := range tests {
+		result, err := parseSecretKeyAliases(test.aliases)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		if test.expectedErr == nil {
+			assert.Equal(t, test.expected, result, test.desc)
+		}
+	}
+}
+
+func TestApplySecretKeyAliases(t *testing.T) {
+	aliases := map[string]string{"user": usernameField, "pass": passwordField}
+	tests := []struct {
+		desc     string
+		secrets  map[string]string
+		expected map[string]string
+	}{
+		{
+			desc:     "user and pass are mapped",
+			secrets:  map[string]string{"user": "test", "pass": "secret", "domain": "CONTOSO"},
+			expected: map[string]string{usernameField: "test", passwordField: "secret", domainField: "CONTOSO"},
+		},
+		{
+			desc:     "aliases are case-insensitive",
+			secrets:  map[string]string{"USER": "test", "Pass": "secret"},
+			expected: map[string]string{usernameField: "test", passwordField: "secret"},
+		},
+		{
+			desc:     "field takes precedence over its alias",
+			secrets:  map[string]string{"Username": "test", "user": "other", "pass": "secret"},
+			expected: map[string]string{"Username": "test", "user": "other", passwordField: "secret"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, applySecretKeyAliases(test.secrets, aliases), test.desc)
+	}
+
+	secrets := map[string]string{"user": "test"}
+	assert.Equal(t, secrets, applySecretKeyAliases(secrets, nil))
+}
+
+func TestNodeStageVolumeSecretKeyAliases(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	d := NewFakeDriver()
+	d.secretKeyAliases = map[string]string{"user": usernameField, "pass": passwordField}
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+
+	_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{sourceField: "//server/share"},
+		Secrets:       map[string]string{"User": "secretuser", "PASS": "secretpass"},
+	})
+	assert.NoError(t, err)
+	mountPoints, _ := d.mounter.List()
+	if assert.Equal(t, 1, len(mountPoints)) {
+		assert.Contains(t, mountPoints[0].Opts, "username=secretuser,password=secretpass")
+	}
+}
+
+func TestResolveCredentialField(t *testing.T) {
+	tests := []struct {
+		desc          string
+		contextValue  string
+		secretValue   string
+		policy        string
+		expectedValue string
+		expectedErr   error
+	}{
+		{
+			desc:          "only in volume context",
+			contextValue:  "CONTOSO",
+			expectedValue: "CONTOSO",
+		},
+		{
+			desc:          "only in secrets",
+			secretValue:   "CONTOSO",
+			policy:        credentialConflictPolicyStrict,
+			expectedValue: "CONTOSO",
+		},
+		{
+			desc:          "same value in different case",
+			contextValue:  "contoso",
+			secretValue:   "CONTOSO",
+			policy:        credentialConflictPolicyStrict,
+			expectedValue: "CONTOSO",
+		},
+		{
+			desc:          "secrets take precedence by default",
+			contextValue:  "FABRIKAM",
+			secretValue:   "CONTOSO",
+			expectedValue: "CONTOSO",
+		},
+		{
+			desc:          "secrets take precedence in secret policy",
+			contextValue:  "FABRIKAM",
+			secretValue:   "CONTOSO",
+			policy:        credentialConflictPolicySecret,
+			expectedValue: "CONTOSO",
+		},
+		{
+			desc:         "different values rejected in strict policy",
+			contextValue: "FABRIKAM",
+			secretValue:  "CONTOSO",
+			policy:       credentialConflictPolicyStrict,
+			expectedErr:  fmt.Errorf("domain in volume context and secrets have different values"),
+		},
+	}
+
+	for _, test := range tests {
+		value, err := resolveCredentialField("vol_1", domainField, test.contextValue, test.secretValue, test.policy)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedValue, value, test.desc)
+	}
+
+	assert.NoError(t, validateCredentialConflictPolicy(""))
+	assert.NoError(t, validateCredentialConflictPolicy(credentialConflictPolicyStrict))
+	assert.Equal(t, fmt.Errorf("invalid credential conflict policy: context, supported values: secret, strict"), validateCredentialConflictPolicy("context"))
+}
+
+func TestNodeStageVolumeContextDomain(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	tests := []struct {
+		desc                  string
+		secrets               map[string]string
+		policy                string
+		expectedErr           error
+		expectedDomainOptions string
+	}{
+		{
+			desc:                  "domain in volume context",
+			secrets:               map[string]string{usernameField: "user", passwordField: "pass"},
+			policy:                credentialConflictPolicyStrict,
+			expectedDomainOptions: "domain=FABRIKAM",
+		},
+		{
+			desc:                  "domain in secrets takes precedence",
+			secrets:               map[string]string{usernameField: "user", passwordField: "pass", domainField: "CONTOSO"},
+			expectedDomainOptions: "domain=CONTOSO",
+		},
+		{
+			desc:        "different domains rejected in strict policy",
+			secrets:     map[string]string{usernameField: "user", passwordField: "pass", domainField: "CONTOSO"},
+			policy:      credentialConflictPolicyStrict,
+			expectedErr: status.Error(codes.InvalidArgument, "volume(vol_1): domain in volume context and secrets have different values"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.credentialConflictPolicy = test.policy
+		d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "//server/share", "domain": "FABRIKAM"},
+			Secrets:       test.secrets,
+		})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		mountPoints, _ := d.mounter.List()
+		if test.expectedErr != nil {
+			assert.Empty(t, mountPoints, test.desc)
+			continue
+		}
+		if assert.Equal(t, 1, len(mountPoints), test.desc) {
+			assert.Contains(t, mountPoints[0].Opts, test.expectedDomainOptions, test.desc)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// deferredDeletes runs delete functions keyed by volume ID after a grace period unless they are cancelled in between
+type deferredDeletes struct {
+	gracePeriod time.Duration
+	timers      map[string]*time.Timer
+	mux         sync.Mutex
+}
+
+func newDeferredDeletes(gracePeriod time.Duration) *deferredDeletes {
+	return &deferredDeletes{
+		gracePeriod: gracePeriod,
+		timers:      map[string]*time.Timer{},
+	}
+}
+
+// Schedule runs deleteFunc of volumeID after grace period, a pending delete of the same volumeID is replaced
+func (dd *deferredDeletes) Schedule(volumeID string, deleteFunc func() error) {
+	dd.mux.Lock()
+	defer dd.mux.Unlock()
+	if timer, ok := dd.timers[volumeID]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(dd.gracePeriod, func() {
+		dd.mux.Lock()
+		if dd.timers[volumeID] != timer {
+			// cancelled or replaced in between
+			dd.mux.Unlock()
+			return
+		}
+		delete(dd.timers, volumeID)
+		dd.mux.Unlock()
+		if err := deleteFunc(); err != nil {
+			klog.Errorf("deferred delete of volume(%s) failed: %v", volumeID, err)
+		}
+	})
+	dd.timers[volumeID] = timer
+}
+
+// Cancel cancels pending delete of volumeID and returns true if there is one
+func (dd *deferredDeletes) Cancel(volumeID string) bool {
+	dd.mux.Lock()
+	defer dd.mux.Unlock()
+	timer, ok := dd.timers[volumeID]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(dd.timers, volumeID)
+	return true
+}
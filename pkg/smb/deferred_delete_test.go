@@ -0,0 +1,54 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeferredDeletes(t *testing.T) {
+	dd := newDeferredDeletes(50 * time.Millisecond)
+
+	// delete after grace period
+	deleted := make(chan string, 2)
+	dd.Schedule("vol_1", func() error {
+		deleted <- "vol_1"
+		return nil
+	})
+	select {
+	case volumeID := <-deleted:
+		assert.Equal(t, "vol_1", volumeID)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("deferred delete of vol_1 is not run after grace period")
+	}
+	assert.False(t, dd.Cancel("vol_1"))
+
+	// cancel on restage within grace period
+	dd.Schedule("vol_2", func() error {
+		deleted <- "vol_2"
+		return nil
+	})
+	assert.True(t, dd.Cancel("vol_2"))
+	select {
+	case volumeID := <-deleted:
+		t.Errorf("deferred delete of %s is not cancelled", volumeID)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
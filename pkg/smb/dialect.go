@@ -0,0 +1,58 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+)
+
+// dialects up to this version are insecure, SMB1 and SMB 2.0 support neither encryption nor pre-auth integrity
+const insecureDialectMaxVersion = "2.0"
+
+// checkNegotiatedDialect reads the dialect negotiated by cifs client from vers option of the mount on stagingPath in mount table,
+// a warning is logged and insecure dialect mount counter is increased if the dialect is insecure.
+// It returns the negotiated dialect and whether it's insecure, an empty dialect means it's unknown.
+func (d *Driver) checkNegotiatedDialect(volumeID, stagingPath string) (string, bool) {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		klog.Warningf("failed to list mount points: %v", err)
+		return "", false
+	}
+	stagingAbs, err := filepath.Abs(stagingPath)
+	if err != nil {
+		return "", false
+	}
+	for _, mp := range mountPoints {
+		if mp.Path != stagingAbs || mp.Type != "cifs" {
+			continue
+		}
+		dialect, found := getMountOptionValue(mp.Opts, versMountOption)
+		if !found || len(parseSMBVersion(dialect)) == 0 {
+			break
+		}
+		if compareSMBVersion(dialect, insecureDialectMaxVersion) > 0 {
+			return dialect, false
+		}
+		klog.Warningf("volume(%s): mount %s on %s negotiated insecure SMB dialect %s, use vers=3.0 or later on the server", volumeID, mp.Device, stagingPath, dialect)
+		recordInsecureDialectMount(dialect)
+		return dialect, true
+	}
+	klog.V(4).Infof("volume(%s): negotiated SMB dialect of %s is unknown", volumeID, stagingPath)
+	return "", false
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+)
+
+func TestCheckNegotiatedDialect(t *testing.T) {
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	tests := []struct {
+		desc             string
+		opts             []string
+		mountType        string
+		expectedDialect  string
+		expectedInsecure bool
+	}{
+		{
+			desc:             "SMB1 mount",
+			opts:             []string{"rw", "vers=1.0", "cache=strict"},
+			expectedDialect:  "1.0",
+			expectedInsecure: true,
+		},
+		{
+			desc:             "SMB 2.0 mount",
+			opts:             []string{"rw", "vers=2.0"},
+			expectedDialect:  "2.0",
+			expectedInsecure: true,
+		},
+		{
+			desc:            "SMB 2.1 mount",
+			opts:            []string{"rw", "vers=2.1"},
+			expectedDialect: "2.1",
+		},
+		{
+			desc:            "SMB 3.1.1 mount",
+			opts:            []string{"rw", "vers=3.1.1"},
+			expectedDialect: "3.1.1",
+		},
+		{
+			desc: "dialect not in mount options",
+			opts: []string{"rw"},
+		},
+		{
+			desc:      "not a cifs mount",
+			opts:      []string{"rw", "vers=1.0"},
+			mountType: "ext4",
+		},
+	}
+
+	for _, test := range tests {
+		mountType := test.mountType
+		if mountType == "" {
+			mountType = "cifs"
+		}
+		d := NewFakeDriver()
+		d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{
+			{Device: "//smb-server/share", Path: stagingPath, Type: mountType, Opts: test.opts},
+		})}
+		labels := map[string]string{"dialect": test.expectedDialect}
+		before, _ := getMetricValue(t, "csi_smb_insecure_dialect_mounts_total", labels)
+
+		dialect, insecure := d.checkNegotiatedDialect("vol_1##", stagingPath)
+		assert.Equal(t, test.expectedDialect, dialect, test.desc)
+		assert.Equal(t, test.expectedInsecure, insecure, test.desc)
+
+		after, _ := getMetricValue(t, "csi_smb_insecure_dialect_mounts_total", labels)
+		if test.expectedInsecure {
+			assert.Equal(t, before+1, after, test.desc)
+		} else {
+			assert.Equal(t, before, after, test.desc)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// drainMode rejects new NodeStageVolume and NodePublishVolume requests during node maintenance,
+// NodeUnstageVolume and NodeUnpublishVolume are still served and existing mounts are not affected
+type drainMode struct {
+	draining atomic.Bool
+}
+
+// SetDraining enables or disables drain mode of node server
+func (d *Driver) SetDraining(draining bool) {
+	if d.drainMode.draining.Swap(draining) != draining {
+		klog.V(2).Infof("drain mode of node server is set to %v", draining)
+	}
+}
+
+// IsDraining returns whether node server is in drain mode
+func (d *Driver) IsDraining() bool {
+	return d.drainMode.draining.Load()
+}
+
+// checkDraining returns retryable Unavailable error if node server is in drain mode
+func (d *Driver) checkDraining(method, volumeID string) error {
+	if d.IsDraining() {
+		return status.Errorf(codes.Unavailable, "%s of volume(%s) is rejected since node is draining", method, volumeID)
+	}
+	return nil
+}
+
+// DrainHandler returns a http handler of drain mode, GET returns current mode,
+// POST with enabled=true or enabled=false query parameter sets the mode, it's only allowed from a loopback address
+// since --metrics-address could be reachable from other hosts
+func (d *Driver) DrainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !isLoopbackRequest(r) {
+				http.Error(w, "setting drain mode is only allowed from a loopback address", http.StatusForbidden)
+				return
+			}
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid enabled value: %q, supported values: true, false", r.URL.Query().Get("enabled")), http.StatusBadRequest)
+				return
+			}
+			d.SetDraining(enabled)
+		default:
+			http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(w, "draining: %v\n", d.IsDraining())
+	})
+}
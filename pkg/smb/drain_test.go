@@ -0,0 +1,143 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDrainMode(t *testing.T) {
+	d := NewFakeDriver()
+	mounter, err := NewFakeMounter()
+	assert.NoError(t, err)
+	d.mounter = mounter
+	volumeCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+
+	d.SetDraining(true)
+	assert.True(t, d.IsDraining())
+
+	_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  volumeCap,
+		VolumeContext:     map[string]string{sourceField: "//smb-server/share"},
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol_1##",
+		TargetPath:        filepath.Join(t.TempDir(), "mount"),
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  volumeCap,
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol_1##",
+		TargetPath: filepath.Join(t.TempDir(), "mount"),
+	})
+	assert.NoError(t, err)
+
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+	})
+	assert.NoError(t, err)
+
+	// a failure in drain mode is not counted by stage quarantine
+	assert.NoError(t, d.stageQuarantine.Check("vol_1##"))
+
+	d.SetDraining(false)
+	assert.NoError(t, d.checkDraining("NodeStageVolume", "vol_1##"))
+}
+
+func TestDrainHandler(t *testing.T) {
+	tests := []struct {
+		desc             string
+		method           string
+		url              string
+		remoteAddr       string
+		expectedCode     int
+		expectedBody     string
+		expectedDraining bool
+	}{
+		{
+			desc:         "get drain mode",
+			method:       http.MethodGet,
+			url:          "/drain",
+			expectedCode: http.StatusOK,
+			expectedBody: "draining: false\n",
+		},
+		{
+			desc:             "enable drain mode",
+			method:           http.MethodPost,
+			url:              "/drain?enabled=true",
+			remoteAddr:       "127.0.0.1:1234",
+			expectedCode:     http.StatusOK,
+			expectedBody:     "draining: true\n",
+			expectedDraining: true,
+		},
+		{
+			desc:         "invalid enabled value",
+			method:       http.MethodPost,
+			url:          "/drain?enabled=maybe",
+			remoteAddr:   "[::1]:1234",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "invalid enabled value: \"maybe\", supported values: true, false\n",
+		},
+		{
+			desc:         "enable drain mode from non-loopback address",
+			method:       http.MethodPost,
+			url:          "/drain?enabled=true",
+			remoteAddr:   "10.0.0.1:1234",
+			expectedCode: http.StatusForbidden,
+			expectedBody: "setting drain mode is only allowed from a loopback address\n",
+		},
+		{
+			desc:         "method not allowed",
+			method:       http.MethodDelete,
+			url:          "/drain",
+			expectedCode: http.StatusMethodNotAllowed,
+			expectedBody: "method DELETE is not allowed\n",
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(test.method, test.url, nil)
+		if test.remoteAddr != "" {
+			req.RemoteAddr = test.remoteAddr
+		}
+		d.DrainHandler().ServeHTTP(w, req)
+		assert.Equal(t, test.expectedCode, w.Code, test.desc)
+		assert.Equal(t, test.expectedBody, w.Body.String(), test.desc)
+		assert.Equal(t, test.expectedDraining, d.IsDraining(), test.desc)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// effectiveConfig is the non-sensitive configuration a driver is running with, it never contains
+// credentials, kerberos caches or volume context of staged volumes
+type effectiveConfig struct {
+	DriverName                  string  `json:"driverName"`
+	DriverVersion               string  `json:"driverVersion"`
+	NodeID                      string  `json:"nodeID"`
+	FSType                      string  `json:"fsType"`
+	KubeletRootDir              string  `json:"kubeletRootDir"`
+	Krb5CacheDirectory          string  `json:"krb5CacheDirectory"`
+	WorkingMountDir             string  `json:"workingMountDir"`
+	MinSMBVersion               string  `json:"minSMBVersion"`
+	PinDefaultVers              string  `json:"pinDefaultVers"`
+	BindMode                    string  `json:"bindMode"`
+	RequireEncryption           bool    `json:"requireEncryption"`
+	EnforceEncryptionAuto       bool    `json:"enforceEncryptionAuto"`
+	DefaultDomain               string  `json:"defaultDomain"`
+	MountProfilesFile           string  `json:"mountProfilesFile"`
+	CorruptedMountPublishPolicy string  `json:"corruptedMountPublishPolicy"`
+	UnknownSecretKeysPolicy     string  `json:"unknownSecretKeysPolicy"`
+	MaxKrb5CacheSize            int64   `json:"maxKrb5CacheSize"`
+	Krb5CacheGracePeriod        string  `json:"krb5CacheGracePeriod"`
+	UnstageBusyRetryTimeout     string  `json:"unstageBusyRetryTimeout"`
+	PostUnmountHookTimeout      string  `json:"postUnmountHookTimeout"`
+	PreAuthProbe                bool    `json:"preAuthProbe"`
+	PreAuthProbeTimeout         string  `json:"preAuthProbeTimeout"`
+	QuarantineThreshold         int     `json:"quarantineThreshold"`
+	QuarantineCooldown          string  `json:"quarantineCooldown"`
+	MountRetryJitter            float64 `json:"mountRetryJitter"`
+	PublishSecretsPolicy        string  `json:"publishSecretsPolicy"`
+	DefaultCredUID              string  `json:"defaultCredUID"`
+	NodeConditionThreshold      int     `json:"nodeConditionFailureThreshold"`
+	WindowsUsernameFormat       string  `json:"windowsUsernameFormat"`
+	ReadDirRetries              int     `json:"readDirRetries"`
+	BlockAdminShares            bool    `json:"blockAdminShares"`
+	MountAttemptTimeout         string  `json:"mountAttemptTimeout"`
+	SecretKeyAliases            string  `json:"secretKeyAliases"`
+	CredentialConflictPolicy    string  `json:"credentialConflictPolicy"`
+	RejectReferencedUnstage     bool    `json:"rejectReferencedUnstage"`
+	WaitForKrb5Dir              string  `json:"waitForKrb5Dir"`
+	NormalizeSourceSlashes      bool    `json:"normalizeSourceSlashes"`
+	AllowedMountNamespaces      string  `json:"allowedMountNamespaces"`
+}
+
+// getEffectiveConfig returns the non-sensitive configuration of the driver
+func (d *Driver) getEffectiveConfig() effectiveConfig {
+	config := effectiveConfig{
+		DriverName:                  d.Name,
+		DriverVersion:               d.Version,
+		NodeID:                      d.NodeID,
+		FSType:                      "cifs",
+		KubeletRootDir:              d.kubeletRootDir,
+		Krb5CacheDirectory:          krb5CacheDirectory,
+		WorkingMountDir:             d.workingMountDir,
+		MinSMBVersion:               d.minSMBVersion,
+		PinDefaultVers:              d.pinDefaultVers,
+		BindMode:                    d.bindMode,
+		RequireEncryption:           d.requireEncryption,
+		EnforceEncryptionAuto:       d.enforceEncryptionAuto,
+		DefaultDomain:               d.defaultDomain,
+		MountProfilesFile:           d.mountProfilesFile,
+		CorruptedMountPublishPolicy: d.corruptedMountPublishPolicy,
+		UnknownSecretKeysPolicy:     d.unknownSecretKeysPolicy,
+		MaxKrb5CacheSize:            d.maxKrb5CacheSize,
+		Krb5CacheGracePeriod:        d.krb5CacheGracePeriod.String(),
+		UnstageBusyRetryTimeout:     d.unstageBusyRetryTimeout.String(),
+		PreAuthProbe:                d.authProber != nil,
+		PreAuthProbeTimeout:         d.preAuthProbeTimeout.String(),
+		PublishSecretsPolicy:        d.publishSecretsPolicy,
+		DefaultCredUID:              d.defaultCredUID,
+		NodeConditionThreshold:      d.nodeConditionFailureThreshold,
+		WindowsUsernameFormat:       d.windowsUsernameFormat,
+		ReadDirRetries:              d.readDirRetries,
+		BlockAdminShares:            d.blockAdminShares,
+		MountAttemptTimeout:         d.mountAttemptTimeout.String(),
+		SecretKeyAliases:            d.secretKeyAliasesSpec,
+		CredentialConflictPolicy:    d.credentialConflictPolicy,
+		RejectReferencedUnstage:     d.rejectReferencedUnstage,
+		WaitForKrb5Dir:              d.waitForKrb5Dir.String(),
+		NormalizeSourceSlashes:      d.normalizeSourceSlashes,
+		AllowedMountNamespaces:      d.allowedMountNamespacesSpec,
+	}
+	if d.postUnmountHook != nil {
+		config.PostUnmountHookTimeout = d.postUnmountHook.timeout.String()
+	}
+	if d.stageQuarantine != nil {
+		config.QuarantineThreshold = d.stageQuarantine.threshold
+		config.QuarantineCooldown = d.stageQuarantine.cooldown.String()
+	}
+	if d.mountRetryJitter != nil {
+		config.MountRetryJitter = d.mountRetryJitter.fraction
+	}
+	return config
+}
+
+// ConfigHandler returns a http handler which serves the non-sensitive configuration of the driver in JSON
+func (d *Driver) ConfigHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		content, err := json.MarshalIndent(d.getEffectiveConfig(), "", "  ")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal driver configuration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(append(content, '\n'))
+	})
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigHandler(t *testing.T) {
+	d := NewDriver(&DriverOptions{
+		NodeID:                 "node-1",
+		DriverName:             DefaultDriverName,
+		KubeletRootDir:         "/var/lib/kubelet",
+		MinSMBVersion:          "3.0",
+		PinDefaultVers:         "3.1.1",
+		BindMode:               bindModeRBind,
+		RequireEncryption:      true,
+		PreAuthProbe:           true,
+		PreAuthProbeTimeout:    5 * time.Second,
+		PostUnmountHookTimeout: 30 * time.Second,
+		QuarantineThreshold:    3,
+		QuarantineCooldown:     time.Minute,
+	})
+	// stage parameters and credentials of a staged volume must not be exposed
+	d.stageCache.set("/var/lib/kubelet/plugins/kubernetes.io/csi/smb.csi.k8s.io/pv-1/globalmount", stageEntry{
+		volumeID:     "vol_1##",
+		source:       "//smb-server/share",
+		mountOptions: []string{"username=user", "password=secretpass"},
+	})
+
+	w := httptest.NewRecorder()
+	d.ConfigHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.NotContains(t, w.Body.String(), "secretpass")
+	assert.NotContains(t, w.Body.String(), "smb-server")
+
+	var config effectiveConfig
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &config))
+	assert.Equal(t, "node-1", config.NodeID)
+	assert.Equal(t, DefaultDriverName, config.DriverName)
+	assert.Equal(t, "cifs", config.FSType)
+	assert.Equal(t, "/var/lib/kubelet", config.KubeletRootDir)
+	assert.Equal(t, krb5CacheDirectory, config.Krb5CacheDirectory)
+	assert.Equal(t, "3.0", config.MinSMBVersion)
+	assert.Equal(t, "3.1.1", config.PinDefaultVers)
+	assert.Equal(t, bindModeRBind, config.BindMode)
+	assert.True(t, config.RequireEncryption)
+	assert.True(t, config.PreAuthProbe)
+	assert.Equal(t, "5s", config.PreAuthProbeTimeout)
+	assert.Equal(t, "30s", config.PostUnmountHookTimeout)
+	assert.Equal(t, 3, config.QuarantineThreshold)
+	assert.Equal(t, "1m0s", config.QuarantineCooldown)
+
+	w = httptest.NewRecorder()
+	d.ConfigHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/config", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -53,14 +53,42 @@ func (f *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeRe
 // GetPluginCapabilities returns the capabilities of the plugin
 func (f *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+		Capabilities: getPluginCapabilities(f.getControllerServiceCapabilities(), f.enableHostnameTopology),
+	}, nil
+}
+
+// getPluginCapabilities returns plugin capabilities derived from enabled controller service capabilities,
+// accessibility constraints are advertised if volumes are constrained by topology
+func getPluginCapabilities(controllerCaps []csi.ControllerServiceCapability_RPC_Type, accessibilityConstraints bool) []*csi.PluginCapability {
+	var caps []*csi.PluginCapability
+	if len(controllerCaps) > 0 {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 				},
 			},
-		},
-	}, nil
+		})
+	}
+	if accessibilityConstraints {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
+	for _, c := range controllerCaps {
+		if c == csi.ControllerServiceCapability_RPC_EXPAND_VOLUME {
+			caps = append(caps, &csi.PluginCapability{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			})
+		}
+	}
+	return caps
 }
@@ -90,3 +90,72 @@ func TestGetPluginCapabilities(t *testing.T) {
 	assert.Equal(t, resp.XXX_sizecache, int32(0))
 	assert.Equal(t, resp.Capabilities, expectedCap)
 }
+
+func TestGetPluginCapabilitiesWithFeatures(t *testing.T) {
+	controllerService := &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+			},
+		},
+	}
+	onlineExpansion := &csi.PluginCapability{
+		Type: &csi.PluginCapability_VolumeExpansion_{
+			VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+				Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+			},
+		},
+	}
+
+	tests := []struct {
+		desc                   string
+		enableVolumeClone      bool
+		expectedControllerCaps []csi.ControllerServiceCapability_RPC_Type
+	}{
+		{
+			desc:              "volume clone enabled",
+			enableVolumeClone: true,
+			expectedControllerCaps: []csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+				csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			},
+		},
+		{
+			desc:              "volume clone disabled",
+			enableVolumeClone: false,
+			expectedControllerCaps: []csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.enableVolumeClone = test.enableVolumeClone
+		assert.Equal(t, test.expectedControllerCaps, d.getControllerServiceCapabilities(), test.desc)
+		resp, err := d.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, []*csi.PluginCapability{controllerService}, resp.Capabilities, test.desc)
+	}
+
+	assert.Empty(t, getPluginCapabilities(nil, false))
+	assert.Equal(t, []*csi.PluginCapability{controllerService, onlineExpansion}, getPluginCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	}, false))
+
+	accessibilityConstraints := &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+			},
+		},
+	}
+	d := NewFakeDriver()
+	d.enableHostnameTopology = true
+	resp, err := d.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []*csi.PluginCapability{controllerService, accessibilityConstraints}, resp.Capabilities)
+}
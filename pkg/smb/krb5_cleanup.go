@@ -0,0 +1,108 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// isVolumeKerberosCacheName checks whether name could be generated by volumeKerberosCacheName
+func isVolumeKerberosCacheName(name string) bool {
+	if name == "" || strings.HasPrefix(name, krb5Prefix) {
+		return false
+	}
+	encoded := strings.ReplaceAll(strings.ReplaceAll(name, "-", "/"), "_", "+")
+	_, err := base64.StdEncoding.DecodeString(encoded)
+	return err == nil
+}
+
+// removeOrphanKerberosCaches removes kerberos caches in dir which are not used by staged volumes and returns removed paths.
+// Since volume id of an entry reconstructed from mount table is unknown, the cache file linked by krb5cc_<cruid>
+// is kept for every staged kerberos mount, and nothing is removed if cruid of a staged kerberos mount is unknown.
+// Regular krb5cc_* files are never removed since they are not created by this driver.
+func removeOrphanKerberosCaches(dir string, entries map[string]stageEntry) ([]string, error) {
+	activeFiles := map[string]bool{}
+	for stagingPath, entry := range entries {
+		if entry.volumeID != "" {
+			activeFiles[filepath.Join(dir, volumeKerberosCacheName(entry.volumeID))] = true
+		}
+		if !hasKerberosMountOption(entry.mountOptions) {
+			continue
+		}
+		credUID, err := getCredUID(entry.mountOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cruid of kerberos mount on %s: %v", stagingPath, err)
+		}
+		link := filepath.Join(dir, getKrb5CcacheName(credUID))
+		if target, err := os.Readlink(link); err == nil {
+			activeFiles[target] = true
+		}
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	// remove orphan cache files first so that symlinks to them become dangling
+	for _, dirEntry := range dirEntries {
+		path := filepath.Join(dir, dirEntry.Name())
+		if !dirEntry.Type().IsRegular() || !isVolumeKerberosCacheName(dirEntry.Name()) || activeFiles[path] {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			klog.Warningf("failed to remove orphan kerberos cache %s: %v", path, err)
+			continue
+		}
+		removed = append(removed, path)
+	}
+	for _, dirEntry := range dirEntries {
+		path := filepath.Join(dir, dirEntry.Name())
+		if dirEntry.Type()&os.ModeSymlink == 0 || !strings.HasPrefix(dirEntry.Name(), krb5Prefix) {
+			continue
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			klog.Warningf("failed to remove dangling kerberos cache symlink %s: %v", path, err)
+			continue
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// cleanOrphanKerberosCaches removes kerberos caches in krb5CacheDirectory which are not used by volumes in stage cache
+func (d *Driver) cleanOrphanKerberosCaches() {
+	if _, err := os.Stat(krb5CacheDirectory); err != nil {
+		klog.V(2).Infof("skip cleaning orphan kerberos caches: %v", err)
+		return
+	}
+	removed, err := removeOrphanKerberosCaches(krb5CacheDirectory, d.stageCache.list())
+	if err != nil {
+		klog.Warningf("skip cleaning orphan kerberos caches: %v", err)
+		return
+	}
+	klog.V(2).Infof("removed %d orphan kerberos caches: %v", len(removed), removed)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsVolumeKerberosCacheName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{
+			name:     volumeKerberosCacheName("smb-server.default.svc.cluster.local/share#pvc-1##"),
+			expected: true,
+		},
+		{
+			name:     volumeKerberosCacheName("a?b>c"),
+			expected: true,
+		},
+		{
+			name:     "krb5cc_1000",
+			expected: false,
+		},
+		{
+			name:     "README",
+			expected: false,
+		},
+		{
+			name:     "",
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isVolumeKerberosCacheName(test.name), test.name)
+	}
+}
+
+func TestRemoveOrphanKerberosCaches(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip kerberos cache test on Windows")
+	}
+	writeFile := func(t *testing.T, path string) {
+		if err := os.WriteFile(path, []byte("ticket"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(t *testing.T, target, link string) {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		desc            string
+		entries         map[string]stageEntry
+		expectedRemoved []string
+		expectedErr     bool
+	}{
+		{
+			desc: "orphan caches are removed while active caches are kept",
+			entries: map[string]stageEntry{
+				"/staging/active":        {volumeID: "server/share#active##", mountOptions: []string{"sec=krb5", "cruid=1000"}},
+				"/staging/reconstructed": {mountOptions: []string{"sec=krb5", "cruid=2000"}},
+			},
+			expectedRemoved: []string{
+				"krb5cc_3000",
+				"krb5cc_4000",
+				volumeKerberosCacheName("server/share#orphan##"),
+			},
+		},
+		{
+			desc: "nothing is removed if cruid of kerberos mount is unknown",
+			entries: map[string]stageEntry{
+				"/staging/unknown": {mountOptions: []string{"sec=krb5"}},
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		active := filepath.Join(dir, volumeKerberosCacheName("server/share#active##"))
+		reconstructed := filepath.Join(dir, volumeKerberosCacheName("server/share#reconstructed##"))
+		orphan := filepath.Join(dir, volumeKerberosCacheName("server/share#orphan##"))
+		for _, path := range []string{active, reconstructed, orphan, filepath.Join(dir, "krb5cc_5000"), filepath.Join(dir, "README")} {
+			writeFile(t, path)
+		}
+		symlink(t, active, filepath.Join(dir, "krb5cc_1000"))
+		symlink(t, reconstructed, filepath.Join(dir, "krb5cc_2000"))
+		// symlink of user without staged volume to orphan cache
+		symlink(t, orphan, filepath.Join(dir, "krb5cc_3000"))
+		// dangling symlink left by a crash
+		symlink(t, filepath.Join(dir, "missing"), filepath.Join(dir, "krb5cc_4000"))
+
+		removed, err := removeOrphanKerberosCaches(dir, test.entries)
+		if test.expectedErr {
+			assert.Error(t, err, test.desc)
+		} else {
+			assert.NoError(t, err, test.desc)
+		}
+		var expectedRemoved []string
+		for _, name := range test.expectedRemoved {
+			expectedRemoved = append(expectedRemoved, filepath.Join(dir, name))
+		}
+		sort.Strings(removed)
+		sort.Strings(expectedRemoved)
+		assert.Equal(t, expectedRemoved, removed, test.desc)
+
+		dirEntries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, 9-len(test.expectedRemoved), len(dirEntries), test.desc)
+		for _, path := range expectedRemoved {
+			_, err := os.Lstat(path)
+			assert.True(t, os.IsNotExist(err), "%s: %s is not removed", test.desc, path)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// interval of polling for the kerberos cache directory, it is replaced in unit tests
+var krb5DirPollInterval = time.Second
+
+// krb5DirWait tracks whether the driver is still waiting for the kerberos cache directory on startup,
+// which could be provided by another DaemonSet starting later, kerberos mount returns Unavailable while waiting,
+// Probe is still ready so that a liveness probe does not restart the driver meanwhile
+type krb5DirWait struct {
+	waiting atomic.Bool
+}
+
+// startKrb5DirWait polls dir in background until it exists or timeout expires,
+// kerberos mount fails as before if dir does not appear in time, the returned channel is closed when the wait ends
+func (d *Driver) startKrb5DirWait(dir string, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	if _, err := os.Stat(dir); err == nil {
+		close(done)
+		return done
+	}
+	klog.V(2).Infof("wait up to %v for kerberos cache directory %s", timeout, dir)
+	d.krb5DirWait.waiting.Store(true)
+	go func() {
+		defer close(done)
+		defer d.krb5DirWait.waiting.Store(false)
+		err := wait.PollImmediate(krb5DirPollInterval, timeout, func() (bool, error) {
+			_, err := os.Stat(dir)
+			return err == nil, nil
+		})
+		if err != nil {
+			klog.Warningf("kerberos cache directory %s does not exist after waiting for %v", dir, timeout)
+			return
+		}
+		klog.V(2).Infof("kerberos cache directory %s exists", dir)
+	}()
+	return done
+}
+
+// isWaitingForKrb5Dir returns whether the driver is still waiting for the kerberos cache directory
+func (d *Driver) isWaitingForKrb5Dir() bool {
+	return d.krb5DirWait.waiting.Load()
+}
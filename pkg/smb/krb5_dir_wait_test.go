@@ -0,0 +1,92 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func waitForDone(t *testing.T, done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait for kerberos cache directory does not end")
+	}
+}
+
+func TestKrb5DirWait(t *testing.T) {
+	defer func(interval time.Duration) { krb5DirPollInterval = interval }(krb5DirPollInterval)
+	krb5DirPollInterval = 10 * time.Millisecond
+
+	isReady := func(d *Driver) bool {
+		resp, err := d.Probe(context.Background(), &csi.ProbeRequest{})
+		assert.NoError(t, err)
+		return resp.GetReady().GetValue()
+	}
+
+	// directory already exists
+	d := NewFakeDriver()
+	waitForDone(t, d.startKrb5DirWait(t.TempDir(), time.Minute))
+	assert.False(t, d.isWaitingForKrb5Dir())
+
+	// directory appears within the wait, the driver is ready meanwhile
+	d = NewFakeDriver()
+	dir := filepath.Join(t.TempDir(), "kerberos")
+	done := d.startKrb5DirWait(dir, time.Minute)
+	assert.True(t, d.isWaitingForKrb5Dir())
+	assert.True(t, isReady(d))
+	assert.NoError(t, os.Mkdir(dir, 0750))
+	waitForDone(t, done)
+	assert.False(t, d.isWaitingForKrb5Dir())
+
+	// directory does not appear before timeout
+	d = NewFakeDriver()
+	done = d.startKrb5DirWait(filepath.Join(t.TempDir(), "kerberos"), 50*time.Millisecond)
+	assert.True(t, d.isWaitingForKrb5Dir())
+	waitForDone(t, done)
+	assert.False(t, d.isWaitingForKrb5Dir())
+}
+
+func TestNodeStageVolumeWaitingForKrb5Dir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+	d.krb5DirWait.waiting.Store(true)
+
+	_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"sec=krb5", "cruid=1000"}}},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+	})
+	assert.Equal(t, status.Errorf(codes.Unavailable, "volume(vol_1): waiting for kerberos cache directory %s", krb5CacheDirectory), err)
+}
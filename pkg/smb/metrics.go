@@ -0,0 +1,151 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"runtime"
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	metricsNamespace = "csi"
+	metricsSubsystem = "smb"
+)
+
+var (
+	buildInfo = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      metricsSubsystem,
+			Name:           "build_info",
+			Help:           "A metric with a constant '1' value labeled by version, git commit and go version from which the driver was built.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"version", "git_commit", "go_version"},
+	)
+
+	deprecatedMountOptionsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      metricsSubsystem,
+			Name:           "deprecated_mount_options_total",
+			Help:           "Number of mounts requested with deprecated cifs mount options, labeled by option.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"option"},
+	)
+
+	quarantinedVolumes = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      metricsSubsystem,
+			Name:           "quarantined_volumes",
+			Help:           "Number of volumes quarantined after repeated stage failures.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	insecureDialectMountsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      metricsSubsystem,
+			Name:           "insecure_dialect_mounts_total",
+			Help:           "Number of mounts which negotiated SMB1 or SMB 2.0 dialect, labeled by dialect.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"dialect"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers all driver metrics into the legacy registry which is served on metrics address
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(buildInfo)
+		legacyregistry.MustRegister(deprecatedMountOptionsTotal)
+		legacyregistry.MustRegister(quarantinedVolumes)
+		legacyregistry.MustRegister(insecureDialectMountsTotal)
+	})
+}
+
+// stageMountAgeCollector reports age of each staged volume in stage cache on scrape
+type stageMountAgeCollector struct {
+	metrics.BaseStableCollector
+	cache *stageCache
+	desc  *metrics.Desc
+}
+
+func newStageMountAgeCollector(cache *stageCache) *stageMountAgeCollector {
+	return &stageMountAgeCollector{
+		cache: cache,
+		desc: metrics.NewDesc(
+			metrics.BuildFQName(metricsNamespace, metricsSubsystem, "stage_mount_age_seconds"),
+			"Seconds since the volume was staged, labeled by volume id and staging path. A mount reconstructed from mount table after driver restart has empty volume id and its age counts from the reconstruction.",
+			[]string{"volume_id", "staging_path"}, nil, metrics.ALPHA, ""),
+	}
+}
+
+// DescribeWithStability implements metrics.StableCollector
+func (c *stageMountAgeCollector) DescribeWithStability(ch chan<- *metrics.Desc) {
+	ch <- c.desc
+}
+
+// CollectWithStability implements metrics.StableCollector
+func (c *stageMountAgeCollector) CollectWithStability(ch chan<- metrics.Metric) {
+	for stagingPath, entry := range c.cache.list() {
+		ch <- metrics.NewLazyConstMetric(c.desc, metrics.GaugeValue, c.cache.now().Sub(entry.createdAt).Seconds(), entry.volumeID, stagingPath)
+	}
+}
+
+var registerStageMountAgeOnce sync.Once
+
+// registerStageMountAge registers age of staged volumes in cache into the legacy registry
+func registerStageMountAge(cache *stageCache) {
+	registerStageMountAgeOnce.Do(func() {
+		legacyregistry.CustomMustRegister(newStageMountAgeCollector(cache))
+	})
+}
+
+// recordBuildInfo sets build info gauge and logs the same build info
+func recordBuildInfo() {
+	registerMetrics()
+	buildInfo.WithLabelValues(driverVersion, gitCommit, runtime.Version()).Set(1)
+	klog.Infof("driver build info: version(%s) gitCommit(%s) goVersion(%s)", driverVersion, gitCommit, runtime.Version())
+}
+
+// recordDeprecatedMountOption increases deprecated mount option counter of option
+func recordDeprecatedMountOption(option string) {
+	registerMetrics()
+	deprecatedMountOptionsTotal.WithLabelValues(option).Inc()
+}
+
+// recordQuarantinedVolumes sets quarantined volumes gauge
+func recordQuarantinedVolumes(count int) {
+	registerMetrics()
+	quarantinedVolumes.Set(float64(count))
+}
+
+// recordInsecureDialectMount increases insecure dialect mount counter of dialect
+func recordInsecureDialectMount(dialect string) {
+	registerMetrics()
+	insecureDialectMountsTotal.WithLabelValues(dialect).Inc()
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// getMetricValue returns the value of the gathered gauge or counter with the given name and labels from legacy registry
+func getMetricValue(t *testing.T, name string, labels map[string]string) (float64, bool) {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			metricLabels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				metricLabels[label.GetName()] = label.GetValue()
+			}
+			if !reflect.DeepEqual(metricLabels, labels) {
+				continue
+			}
+			if m.GetGauge() != nil {
+				return m.GetGauge().GetValue(), true
+			}
+			return m.GetCounter().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestRecordBuildInfo(t *testing.T) {
+	recordBuildInfo()
+
+	value, found := getMetricValue(t, "csi_smb_build_info", map[string]string{
+		"version":    driverVersion,
+		"git_commit": gitCommit,
+		"go_version": runtime.Version(),
+	})
+	assert.True(t, found)
+	assert.Equal(t, float64(1), value)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	// newline separated regexes in volume context, mount errors matching any of them are classified as Unavailable
+	retryableErrorsField = "retryableerrors"
+	// reason in ErrorInfo detail of mount errors not classified by default rules
+	defaultMountErrorReason = "MOUNT_FAILED"
+	// metadata keys in ErrorInfo detail of mount errors
+	mountErrorServerKey       = "server"
+	mountErrorMountOptionsKey = "mountOptions"
+)
+
+// mountErrorRule maps mount errors matching pattern to a CSI error code
+type mountErrorRule struct {
+	pattern *regexp.Regexp
+	code    codes.Code
+}
+
+// defaultMountErrorRules classify common cifs mount errors, errors not matched are classified as Internal,
+// which was the code of all mount errors before classification, see docs/csi-debug.md
+var defaultMountErrorRules = []mountErrorRule{
+	{pattern: regexp.MustCompile(`(?i)host is down|no route to host|connection refused|connection timed out|could not resolve address`), code: codes.Unavailable},
+	{pattern: regexp.MustCompile(`(?i)permission denied`), code: codes.PermissionDenied},
+	{pattern: regexp.MustCompile(`(?i)no such file or directory`), code: codes.NotFound},
+}
+
+// mountErrorReasons are reasons in ErrorInfo detail of mount errors keyed by error code
+var mountErrorReasons = map[codes.Code]string{
+	codes.Unavailable:      "SERVER_UNAVAILABLE",
+	codes.PermissionDenied: "PERMISSION_DENIED",
+	codes.NotFound:         "SHARE_NOT_FOUND",
+}
+
+// newMountError returns a status error of mount failure with ErrorInfo detail,
+// which carries reason, smb server in source and mount options without credentials
+func newMountError(code codes.Code, domain, source string, mountOptions []string, msg string) error {
+	reason, ok := mountErrorReasons[code]
+	if !ok {
+		reason = defaultMountErrorReason
+	}
+	detail := &anypb.Any{}
+	// deterministic marshaling keeps the detail stable regardless of metadata map order
+	if err := anypb.MarshalFrom(detail, &errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: domain,
+		Metadata: map[string]string{
+			mountErrorServerKey:       getServerFromSource(source),
+			mountErrorMountOptionsKey: strings.Join(removeSensitiveMountOptions(mountOptions), ","),
+		},
+	}, proto.MarshalOptions{Deterministic: true}); err != nil {
+		return status.Error(code, msg)
+	}
+	return status.FromProto(&spb.Status{Code: int32(code), Message: msg, Details: []*anypb.Any{detail}}).Err()
+}
+
+// classifyMountError returns CSI error code of a mount error, rules are consulted in order before default rules
+func classifyMountError(err error, rules []mountErrorRule) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+	msg := err.Error()
+	for _, ruleSet := range [][]mountErrorRule{rules, defaultMountErrorRules} {
+		for _, rule := range ruleSet {
+			if rule.pattern.MatchString(msg) {
+				return rule.code
+			}
+		}
+	}
+	return codes.Internal
+}
+
+// parseErrorCode parses CSI error code by name, e.g. Unavailable or UNAVAILABLE
+func parseErrorCode(name string) (codes.Code, error) {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "_", "")
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.EqualFold(c.String(), name) {
+			return c, nil
+		}
+	}
+	return codes.Unknown, fmt.Errorf("unknown error code %q", name)
+}
+
+// parseMountErrorRules parses rules in the form of "<code> <regex>" per line,
+// empty lines and lines starting with # are ignored
+func parseMountErrorRules(content string) ([]mountErrorRule, error) {
+	var rules []mountErrorRule
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("line %d: expected \"<code> <regex>\", got %q", lineNum, line)
+		}
+		code, err := parseErrorCode(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid regex: %v", lineNum, err)
+		}
+		rules = append(rules, mountErrorRule{pattern: pattern, code: code})
+	}
+	return rules, scanner.Err()
+}
+
+// parseRetryableErrors parses newline separated regexes in retryableErrors parameter into rules
+// which classify matched mount errors as Unavailable, empty lines are ignored
+func parseRetryableErrors(value string) ([]mountErrorRule, error) {
+	var rules []mountErrorRule
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %q, invalid regex: %v", retryableErrorsField, line, err)
+		}
+		rules = append(rules, mountErrorRule{pattern: pattern, code: codes.Unavailable})
+	}
+	return rules, nil
+}
+
+// loadMountErrorRules loads mount error rules from file
+func loadMountErrorRules(path string) ([]mountErrorRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseMountErrorRules(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mount error rules file %s: %v", path, err)
+	}
+	return rules, nil
+}
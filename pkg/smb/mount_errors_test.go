@@ -0,0 +1,261 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyMountError(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "csi-smb-mount-errors-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	rulesFile := filepath.Join(tmpDir, "rules")
+	content := `# retry on server busy
+RESOURCE_EXHAUSTED (?i)STATUS_INSUFF_SERVER_RESOURCES
+Aborted mount error\(16\)
+
+Internal (?i)permission denied
+`
+	assert.NoError(t, os.WriteFile(rulesFile, []byte(content), 0644))
+	rules, err := loadMountErrorRules(rulesFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(rules))
+
+	tests := []struct {
+		desc         string
+		err          error
+		rules        []mountErrorRule
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "no error",
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "default rule",
+			err:          fmt.Errorf("mount error(112): Host is down"),
+			expectedCode: codes.Unavailable,
+		},
+		{
+			desc:         "no rule matched",
+			err:          fmt.Errorf("mount error(22): Invalid argument"),
+			expectedCode: codes.Internal,
+		},
+		{
+			desc:         "custom rule matched",
+			err:          fmt.Errorf("STATUS_INSUFF_SERVER_RESOURCES"),
+			rules:        rules,
+			expectedCode: codes.ResourceExhausted,
+		},
+		{
+			desc:         "custom rule consulted before default rules",
+			err:          fmt.Errorf("mount error(13): Permission denied"),
+			rules:        rules,
+			expectedCode: codes.Internal,
+		},
+		{
+			desc:         "default rule without custom rule matched",
+			err:          fmt.Errorf("mount error(13): Permission denied"),
+			expectedCode: codes.PermissionDenied,
+		},
+	}
+
+	for _, test := range tests {
+		code := classifyMountError(test.err, test.rules)
+		if code != test.expectedCode {
+			t.Errorf("test[%s]: unexpected code: %v, expected code: %v", test.desc, code, test.expectedCode)
+		}
+	}
+}
+
+func TestParseMountErrorRules(t *testing.T) {
+	tests := []struct {
+		desc        string
+		content     string
+		expectedErr error
+	}{
+		{
+			desc:        "missing regex",
+			content:     "Unavailable",
+			expectedErr: fmt.Errorf("line 1: expected \"<code> <regex>\", got \"Unavailable\""),
+		},
+		{
+			desc:        "unknown code",
+			content:     "\nRetry host is down",
+			expectedErr: fmt.Errorf("line 2: unknown error code \"Retry\""),
+		},
+		{
+			desc:        "invalid regex",
+			content:     "Unavailable host(",
+			expectedErr: fmt.Errorf("line 1: invalid regex: error parsing regexp: missing closing ): `host(`"),
+		},
+	}
+
+	for _, test := range tests {
+		_, err := parseMountErrorRules(test.content)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+	}
+}
+
+func TestNodeStageVolumeMountErrorDetails(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	d := NewFakeDriver()
+	mounter, err := NewFakeMounter()
+	assert.NoError(t, err)
+	d.mounter = mounter
+	d.mountErrorRules = []mountErrorRule{{pattern: regexp.MustCompile("target error"), code: codes.PermissionDenied}}
+
+	_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: filepath.Join(t.TempDir(), "error_mount_sens_target"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=3.0", "password=secret"}},
+			},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server.default.svc.cluster.local/share"},
+		Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+	})
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.PermissionDenied, st.Code())
+	details := st.Details()
+	assert.Len(t, details, 1)
+	errorInfo, ok := details[0].(*errdetails.ErrorInfo)
+	assert.True(t, ok)
+	assert.Equal(t, "PERMISSION_DENIED", errorInfo.GetReason())
+	assert.Equal(t, DefaultDriverName, errorInfo.GetDomain())
+	assert.Equal(t, map[string]string{
+		mountErrorServerKey:       "smb-server.default.svc.cluster.local",
+		mountErrorMountOptionsKey: "vers=3.0",
+	}, errorInfo.GetMetadata())
+}
+
+func TestNewMountError(t *testing.T) {
+	tests := []struct {
+		code           codes.Code
+		expectedReason string
+	}{
+		{code: codes.Unavailable, expectedReason: "SERVER_UNAVAILABLE"},
+		{code: codes.NotFound, expectedReason: "SHARE_NOT_FOUND"},
+		{code: codes.Internal, expectedReason: defaultMountErrorReason},
+	}
+
+	for _, test := range tests {
+		st := status.Convert(newMountError(test.code, DefaultDriverName, "\\\\smb-server\\share", nil, "mount failed"))
+		assert.Equal(t, test.code, st.Code())
+		assert.Equal(t, "mount failed", st.Message())
+		assert.Len(t, st.Details(), 1)
+		errorInfo := st.Details()[0].(*errdetails.ErrorInfo)
+		assert.Equal(t, test.expectedReason, errorInfo.GetReason())
+		assert.Equal(t, "smb-server", errorInfo.GetMetadata()[mountErrorServerKey])
+	}
+}
+
+func TestParseRetryableErrors(t *testing.T) {
+	tests := []struct {
+		desc             string
+		value            string
+		expectedPatterns []string
+		expectedErr      error
+	}{
+		{
+			desc: "empty value",
+		},
+		{
+			desc:             "newline separated regexes",
+			value:            "resource temporarily unavailable\n\n  (?i)server busy, retry  \n",
+			expectedPatterns: []string{"resource temporarily unavailable", "(?i)server busy, retry"},
+		},
+		{
+			desc:        "invalid regex",
+			value:       "busy\n[",
+			expectedErr: fmt.Errorf("invalid retryableerrors value: \"[\", invalid regex: error parsing regexp: missing closing ]: `[`"),
+		},
+	}
+
+	for _, test := range tests {
+		rules, err := parseRetryableErrors(test.value)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		var patterns []string
+		for _, rule := range rules {
+			assert.Equal(t, codes.Unavailable, rule.code, test.desc)
+			patterns = append(patterns, rule.pattern.String())
+		}
+		assert.Equal(t, test.expectedPatterns, patterns, test.desc)
+	}
+}
+
+func TestNodeStageVolumeRetryableErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tests := []struct {
+		desc            string
+		retryableErrors string
+		expectedCode    codes.Code
+	}{
+		{
+			desc:         "default classification",
+			expectedCode: codes.Internal,
+		},
+		{
+			desc:            "per-volume retryable pattern",
+			retryableErrors: "target error",
+			expectedCode:    codes.Unavailable,
+		},
+		{
+			desc:            "invalid regex",
+			retryableErrors: "(",
+			expectedCode:    codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		mounter, err := NewFakeMounter()
+		assert.NoError(t, err)
+		d.mounter = mounter
+
+		_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "error_mount_sens_target"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "//smb-server/share", "retryableErrors": test.retryableErrors},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+	}
+}
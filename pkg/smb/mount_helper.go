@@ -0,0 +1,72 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// cifsMountHelper is the user space helper invoked by mount to mount cifs file system
+const cifsMountHelper = "mount.cifs"
+
+// mountHelperDirs are searched for mount helper if it's not found in PATH, mount looks up helpers in /sbin
+var mountHelperDirs = []string{"/sbin", "/usr/sbin"}
+
+// mountHelperChecker checks whether cifs mount helper is installed, a found helper is cached
+// while a missing helper is checked again next time so that it could be installed without restarting driver
+type mountHelperChecker struct {
+	lookPath func(file string) (string, error)
+	found    bool
+	mux      sync.Mutex
+}
+
+func newMountHelperChecker() *mountHelperChecker {
+	return &mountHelperChecker{lookPath: lookPathWithMountHelperDirs}
+}
+
+// Check returns error if cifs mount helper is not installed
+func (c *mountHelperChecker) Check() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.found {
+		return nil
+	}
+	if _, err := c.lookPath(cifsMountHelper); err != nil {
+		return fmt.Errorf("%s is not found on the node, install cifs-utils package on the node: %v", cifsMountHelper, err)
+	}
+	c.found = true
+	return nil
+}
+
+// lookPathWithMountHelperDirs searches file in PATH and then in mountHelperDirs
+func lookPathWithMountHelperDirs(file string) (string, error) {
+	path, err := exec.LookPath(file)
+	if err == nil {
+		return path, nil
+	}
+	for _, dir := range mountHelperDirs {
+		candidate := filepath.Join(dir, file)
+		if info, statErr := os.Stat(candidate); statErr == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", err
+}
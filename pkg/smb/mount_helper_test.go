@@ -0,0 +1,98 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMountHelperChecker(t *testing.T) {
+	lookups := 0
+	installed := false
+	c := newMountHelperChecker()
+	c.lookPath = func(file string) (string, error) {
+		lookups++
+		if !installed {
+			return "", fmt.Errorf("exec: %q: executable file not found in $PATH", file)
+		}
+		return "/sbin/" + file, nil
+	}
+
+	// helper absent is checked again on each call
+	expectedErr := fmt.Errorf("mount.cifs is not found on the node, install cifs-utils package on the node: exec: \"mount.cifs\": executable file not found in $PATH")
+	assert.Equal(t, expectedErr, c.Check())
+	assert.Equal(t, expectedErr, c.Check())
+	assert.Equal(t, 2, lookups)
+
+	// helper present is cached
+	installed = true
+	assert.NoError(t, c.Check())
+	assert.NoError(t, c.Check())
+	assert.Equal(t, 3, lookups)
+}
+
+func TestNodeStageVolumeMountHelperMissing(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("skip test on non-Linux")
+	}
+	tmpDir, err := os.MkdirTemp("", "csi-smb-mount-helper-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	d := NewFakeDriver()
+	mounter, err := NewFakeMounter()
+	assert.NoError(t, err)
+	d.mounter = mounter
+	d.mountHelperChecker.lookPath = func(file string) (string, error) {
+		return "", fmt.Errorf("exec: %q: executable file not found in $PATH", file)
+	}
+	req := &csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: filepath.Join(tmpDir, "staging"),
+		VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{}},
+		VolumeContext:    map[string]string{sourceField: "//smb-server/share"}}
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, status.Error(codes.FailedPrecondition, "volume(vol_1): mount.cifs is not found on the node, install cifs-utils package on the node: exec: \"mount.cifs\": executable file not found in $PATH"), err)
+}
+
+func TestLookPathWithMountHelperDirs(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "csi-smb-mount-helper-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	helper := filepath.Join(tmpDir, "mount.fake")
+	assert.NoError(t, os.WriteFile(helper, []byte{}, 0755))
+	defer func(dirs []string) {
+		mountHelperDirs = dirs
+	}(mountHelperDirs)
+	mountHelperDirs = []string{tmpDir}
+
+	path, err := lookPathWithMountHelperDirs("mount.fake")
+	assert.NoError(t, err)
+	assert.Equal(t, helper, path)
+
+	_, err = lookPathWithMountHelperDirs("mount.not-exist")
+	assert.Error(t, err)
+}
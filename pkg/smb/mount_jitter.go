@@ -0,0 +1,81 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// interval of mount poll in NodeStageVolume
+const mountPollInterval = 1 * time.Second
+
+// mountRetryJitter delays the mount retry of a volume whose last mount failed by mount poll interval with jitter,
+// so that retries of many volumes on the same broken share do not synchronize and hammer the server
+type mountRetryJitter struct {
+	// max jitter as a fraction of mount poll interval, 0 disables the delay
+	fraction float64
+	mux      sync.Mutex
+	failed   map[string]bool
+	// sleep is replaced in unit tests
+	sleep func(time.Duration)
+}
+
+func newMountRetryJitter(fraction float64) *mountRetryJitter {
+	return &mountRetryJitter{
+		fraction: fraction,
+		failed:   map[string]bool{},
+		sleep:    time.Sleep,
+	}
+}
+
+// Wait sleeps before the mount of volumeID if its last mount failed, it returns the time slept
+func (j *mountRetryJitter) Wait(volumeID string) time.Duration {
+	if j.fraction <= 0 {
+		return 0
+	}
+	j.mux.Lock()
+	failed := j.failed[volumeID]
+	j.mux.Unlock()
+	if !failed {
+		return 0
+	}
+	delay := j.delay()
+	j.sleep(delay)
+	return delay
+}
+
+// delay returns a duration between mountPollInterval and mountPollInterval*(1+fraction)
+func (j *mountRetryJitter) delay() time.Duration {
+	return wait.Jitter(mountPollInterval, j.fraction)
+}
+
+// Record records the mount result of volumeID
+func (j *mountRetryJitter) Record(volumeID string, err error) {
+	if j.fraction <= 0 {
+		return
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	if err != nil {
+		j.failed[volumeID] = true
+	} else {
+		delete(j.failed, volumeID)
+	}
+}
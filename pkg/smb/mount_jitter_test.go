@@ -0,0 +1,90 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountRetryJitterDelay(t *testing.T) {
+	fraction := 0.5
+	j := newMountRetryJitter(fraction)
+	maxDelay := time.Duration(float64(mountPollInterval) * (1 + fraction))
+	delays := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		delay := j.delay()
+		assert.GreaterOrEqual(t, delay, mountPollInterval)
+		assert.LessOrEqual(t, delay, maxDelay)
+		delays[delay] = true
+	}
+	assert.Greater(t, len(delays), 1, "retry delays with jitter should vary")
+}
+
+func TestMountRetryJitterWait(t *testing.T) {
+	volumeID := "smb-server.default.svc.cluster.local/share#pvc-1"
+	mountErr := fmt.Errorf("mount error(112): Host is down")
+
+	tests := []struct {
+		desc        string
+		fraction    float64
+		results     []error
+		expectSleep bool
+	}{
+		{
+			desc:     "no delay for first mount",
+			fraction: 0.5,
+		},
+		{
+			desc:        "delay after failed mount",
+			fraction:    0.5,
+			results:     []error{mountErr},
+			expectSleep: true,
+		},
+		{
+			desc:     "no delay after successful mount",
+			fraction: 0.5,
+			results:  []error{mountErr, nil},
+		},
+		{
+			desc:     "jitter is disabled",
+			fraction: 0,
+			results:  []error{mountErr},
+		},
+	}
+
+	for _, test := range tests {
+		j := newMountRetryJitter(test.fraction)
+		var slept time.Duration
+		j.sleep = func(d time.Duration) { slept += d }
+		for _, err := range test.results {
+			j.Record(volumeID, err)
+		}
+		delay := j.Wait(volumeID)
+		assert.Equal(t, slept, delay, test.desc)
+		if test.expectSleep {
+			assert.GreaterOrEqual(t, delay, mountPollInterval, test.desc)
+			assert.LessOrEqual(t, delay, time.Duration(float64(mountPollInterval)*(1+test.fraction)), test.desc)
+		} else {
+			assert.Zero(t, delay, test.desc)
+		}
+		assert.Zero(t, j.Wait("other-volume"), test.desc)
+	}
+}
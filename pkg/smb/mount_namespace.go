@@ -0,0 +1,186 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// path of a mount namespace file on the node, e.g. /proc/<pid>/ns/mnt, cifs mount is performed in this namespace
+	mountNamespaceField = "mountnamespace"
+	nsenterCmd          = "nsenter"
+)
+
+// namespaceMounter mounts a filesystem in the mount namespace referred by a namespace file
+type namespaceMounter interface {
+	// Supported returns an error if mount in a namespace is not supported on this node
+	Supported() error
+	MountSensitive(namespace, source, target, fstype string, options, sensitiveOptions []string) error
+	// Unmount unmounts target in the mount namespace
+	Unmount(namespace, target string) error
+	// IsMountPoint returns true if target is a mount point in the mount namespace
+	IsMountPoint(namespace, target string) (bool, error)
+}
+
+// mountInfoUnescaper unescapes octal escaped characters of a path in mountinfo
+var mountInfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// nsenterMounter enters the mount namespace with nsenter and runs mount in it
+type nsenterMounter struct {
+	exec utilexec.Interface
+}
+
+func newNsenterMounter() *nsenterMounter {
+	return &nsenterMounter{exec: utilexec.New()}
+}
+
+func (m *nsenterMounter) Supported() error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("mount in a namespace is not supported on %s node", runtime.GOOS)
+	}
+	if _, err := m.exec.LookPath(nsenterCmd); err != nil {
+		return fmt.Errorf("%s is not found on the node: %v", nsenterCmd, err)
+	}
+	return nil
+}
+
+func (m *nsenterMounter) MountSensitive(namespace, source, target, fstype string, options, sensitiveOptions []string) error {
+	if err := checkMountNamespace(namespace); err != nil {
+		return err
+	}
+	args := []string{"--mount=" + namespace, "--", "mount", "-t", fstype}
+	if allOptions := append(append([]string{}, options...), sensitiveOptions...); len(allOptions) > 0 {
+		args = append(args, "-o", strings.Join(allOptions, ","))
+	}
+	args = append(args, source, target)
+	if output, err := m.exec.Command(nsenterCmd, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("mount in namespace %s failed: %v, output: %s", namespace, err, string(output))
+	}
+	return nil
+}
+
+func (m *nsenterMounter) Unmount(namespace, target string) error {
+	if err := checkMountNamespace(namespace); err != nil {
+		return err
+	}
+	if output, err := m.exec.Command(nsenterCmd, "--mount="+namespace, "--", "umount", target).CombinedOutput(); err != nil {
+		return fmt.Errorf("unmount in namespace %s failed: %v, output: %s", namespace, err, string(output))
+	}
+	return nil
+}
+
+func (m *nsenterMounter) IsMountPoint(namespace, target string) (bool, error) {
+	if err := checkMountNamespace(namespace); err != nil {
+		return false, err
+	}
+	// /proc/self/mountinfo of the command lists mounts of the namespace it runs in
+	output, err := m.exec.Command(nsenterCmd, "--mount="+namespace, "--", "cat", "/proc/self/mountinfo").Output()
+	if err != nil {
+		return false, fmt.Errorf("failed to read mountinfo in namespace %s: %v", namespace, err)
+	}
+	return isMountInfoMountPoint(string(output), target), nil
+}
+
+// checkMountNamespace returns an error if namespace is not an accessible absolute path
+func checkMountNamespace(namespace string) error {
+	if !filepath.IsAbs(namespace) {
+		return fmt.Errorf("mount namespace %s must be an absolute path", namespace)
+	}
+	if _, err := os.Stat(namespace); err != nil {
+		return fmt.Errorf("mount namespace %s is not accessible: %v", namespace, err)
+	}
+	return nil
+}
+
+// isMountInfoMountPoint returns true if target is a mount point in the content of mountinfo
+func isMountInfoMountPoint(mountInfo, target string) bool {
+	target = filepath.Clean(target)
+	for _, line := range strings.Split(mountInfo, "\n") {
+		// mount point is the 5th field of a mountinfo line
+		fields := strings.Fields(line)
+		if len(fields) > 4 && mountInfoUnescaper.Replace(fields[4]) == target {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMountNamespacePatterns parses comma separated glob patterns of mount namespace files, e.g. /proc/*/ns/mnt
+func parseMountNamespacePatterns(spec string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			return nil, fmt.Errorf("mount namespace pattern %s must be an absolute path", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid mount namespace pattern %s: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// isMountNamespaceAllowed returns true if namespace matches any of the patterns
+func isMountNamespaceAllowed(namespace string, patterns []string) bool {
+	namespace = filepath.Clean(namespace)
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// mountInNamespace mounts cifs on target in the mount namespace unless target is already a mount point there
+func (d *Driver) mountInNamespace(namespace, source, target string, options, sensitiveOptions []string) error {
+	mounted, err := d.namespaceMounter.IsMountPoint(namespace, target)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		klog.V(2).Infof("%s is already mounted in namespace %s", target, namespace)
+		return nil
+	}
+	return d.namespaceMounter.MountSensitive(namespace, source, target, "cifs", options, sensitiveOptions)
+}
+
+// unmountInNamespace unmounts target in the mount namespace if it's a mount point there,
+// a namespace which does not exist any more is skipped since its mounts are gone with it
+func (d *Driver) unmountInNamespace(namespace, target string) error {
+	if _, err := os.Stat(namespace); os.IsNotExist(err) {
+		klog.Warningf("mount namespace %s of %s does not exist any more, skip unmounting in it", namespace, target)
+		return nil
+	}
+	mounted, err := d.namespaceMounter.IsMountPoint(namespace, target)
+	if err != nil || !mounted {
+		return err
+	}
+	klog.V(2).Infof("unmounting %s in namespace %s", target, namespace)
+	return d.namespaceMounter.Unmount(namespace, target)
+}
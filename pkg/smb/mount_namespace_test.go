@@ -0,0 +1,264 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+type fakeNamespaceMounter struct {
+	supportedErr error
+	namespaces   []string
+	// mount points keyed by namespace
+	mountPoints map[string][]string
+	unmounted   []string
+}
+
+func (f *fakeNamespaceMounter) Supported() error {
+	return f.supportedErr
+}
+
+func (f *fakeNamespaceMounter) MountSensitive(namespace, source, target, fstype string, options, sensitiveOptions []string) error {
+	f.namespaces = append(f.namespaces, namespace)
+	if f.mountPoints == nil {
+		f.mountPoints = map[string][]string{}
+	}
+	f.mountPoints[namespace] = append(f.mountPoints[namespace], target)
+	return nil
+}
+
+func (f *fakeNamespaceMounter) Unmount(namespace, target string) error {
+	f.unmounted = append(f.unmounted, target)
+	var remaining []string
+	for _, mp := range f.mountPoints[namespace] {
+		if mp != target {
+			remaining = append(remaining, mp)
+		}
+	}
+	f.mountPoints[namespace] = remaining
+	return nil
+}
+
+func (f *fakeNamespaceMounter) IsMountPoint(namespace, target string) (bool, error) {
+	for _, mp := range f.mountPoints[namespace] {
+		if mp == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestNsenterMounterMountSensitive(t *testing.T) {
+	m := newNsenterMounter()
+	missing := filepath.Join(t.TempDir(), "missing")
+	tests := []struct {
+		desc        string
+		namespace   string
+		expectedErr error
+	}{
+		{
+			desc:        "relative namespace path",
+			namespace:   "proc/1/ns/mnt",
+			expectedErr: fmt.Errorf("mount namespace proc/1/ns/mnt must be an absolute path"),
+		},
+		{
+			desc:        "namespace path not found",
+			namespace:   missing,
+			expectedErr: fmt.Errorf("mount namespace %s is not accessible: stat %s: no such file or directory", missing, missing),
+		},
+	}
+
+	for _, test := range tests {
+		err := m.MountSensitive(test.namespace, "//smb-server/share", "/tmp/target", "cifs", nil, nil)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+	}
+}
+
+func TestIsMountInfoMountPoint(t *testing.T) {
+	mountInfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+36 22 0:33 / /var/lib/kubelet/plugins/kubernetes.io/csi/smb.csi.k8s.io/abc/globalmount rw,relatime shared:20 - cifs //smb-server/share rw,vers=3.0
+37 22 0:34 / /mnt/with\040space rw,relatime - cifs //smb-server/other rw
+`
+	tests := []struct {
+		target   string
+		expected bool
+	}{
+		{target: "/var/lib/kubelet/plugins/kubernetes.io/csi/smb.csi.k8s.io/abc/globalmount", expected: true},
+		{target: "/var/lib/kubelet/plugins/kubernetes.io/csi/smb.csi.k8s.io/abc/globalmount/", expected: true},
+		{target: "/mnt/with space", expected: true},
+		{target: "/var/lib/kubelet/plugins/kubernetes.io/csi/smb.csi.k8s.io/abc", expected: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isMountInfoMountPoint(mountInfo, test.target), test.target)
+	}
+}
+
+func TestParseMountNamespacePatterns(t *testing.T) {
+	tests := []struct {
+		spec             string
+		expectedPatterns []string
+		expectedErr      error
+	}{
+		{spec: ""},
+		{spec: " /proc/*/ns/mnt, /run/ns/mnt-* ,", expectedPatterns: []string{"/proc/*/ns/mnt", "/run/ns/mnt-*"}},
+		{spec: "proc/*/ns/mnt", expectedErr: fmt.Errorf("mount namespace pattern proc/*/ns/mnt must be an absolute path")},
+		{spec: "/proc/[/ns/mnt", expectedErr: fmt.Errorf("invalid mount namespace pattern /proc/[/ns/mnt: syntax error in pattern")},
+	}
+	for _, test := range tests {
+		patterns, err := parseMountNamespacePatterns(test.spec)
+		assert.Equal(t, test.expectedErr, err, test.spec)
+		assert.Equal(t, test.expectedPatterns, patterns, test.spec)
+	}
+}
+
+func TestIsMountNamespaceAllowed(t *testing.T) {
+	patterns := []string{"/proc/*/ns/mnt"}
+	assert.True(t, isMountNamespaceAllowed("/proc/1234/ns/mnt", patterns))
+	assert.True(t, isMountNamespaceAllowed("/proc/1234/ns/../ns/mnt", patterns))
+	assert.False(t, isMountNamespaceAllowed("/proc/1234/ns/net", patterns))
+	assert.False(t, isMountNamespaceAllowed("/proc/1234/ns/mnt", nil))
+}
+
+func TestNodeStageVolumeMountNamespace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip mount namespace test on Windows")
+	}
+	tests := []struct {
+		desc                 string
+		mountNamespace       string
+		allowedNamespaces    []string
+		supportedErr         error
+		expectedErrorCode    codes.Code
+		expectedNamespaces   []string
+		expectedHostMountNum int
+	}{
+		{
+			desc:               "mount in namespace",
+			mountNamespace:     "/proc/1234/ns/mnt",
+			allowedNamespaces:  []string{"/proc/*/ns/mnt"},
+			expectedNamespaces: []string{"/proc/1234/ns/mnt"},
+		},
+		{
+			desc:                 "mount in host namespace without hint",
+			expectedHostMountNum: 1,
+		},
+		{
+			desc:              "not mounted in host namespace if namespace is not supported",
+			mountNamespace:    "/proc/1234/ns/mnt",
+			allowedNamespaces: []string{"/proc/*/ns/mnt"},
+			supportedErr:      fmt.Errorf("nsenter is not found"),
+			expectedErrorCode: codes.FailedPrecondition,
+		},
+		{
+			desc:              "namespace is not allowed",
+			mountNamespace:    "/proc/1234/ns/mnt",
+			allowedNamespaces: []string{"/run/ns/*"},
+			expectedErrorCode: codes.InvalidArgument,
+		},
+		{
+			desc:              "namespace is not allowed by default",
+			mountNamespace:    "/proc/1234/ns/mnt",
+			expectedErrorCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.allowedMountNamespaces = test.allowedNamespaces
+		hostMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: hostMounter}
+		nsMounter := &fakeNamespaceMounter{supportedErr: test.supportedErr}
+		d.namespaceMounter = nsMounter
+
+		volContext := map[string]string{sourceField: "//smb-server/share"}
+		if test.mountNamespace != "" {
+			volContext["mountNamespace"] = test.mountNamespace
+		}
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: volContext,
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.Equal(t, test.expectedErrorCode, status.Code(err), test.desc)
+		assert.Equal(t, test.expectedNamespaces, nsMounter.namespaces, test.desc)
+		assert.Equal(t, test.expectedHostMountNum, len(hostMounter.MountPoints), test.desc)
+	}
+}
+
+func TestNodeUnstageVolumeMountNamespace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip mount namespace test on Windows")
+	}
+	namespaceDir := t.TempDir()
+	namespace := filepath.Join(namespaceDir, "mnt")
+	assert.NoError(t, os.WriteFile(namespace, nil, 0600))
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+
+	d := NewFakeDriver()
+	d.allowedMountNamespaces = []string{filepath.Join(namespaceDir, "*")}
+	hostMounter := mount.NewFakeMounter(nil)
+	d.mounter = &mount.SafeFormatAndMount{Interface: hostMounter}
+	nsMounter := &fakeNamespaceMounter{}
+	d.namespaceMounter = nsMounter
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server/share", "mountNamespace": namespace},
+		Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+	}
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	// staging path which is already mounted in the namespace is not mounted again
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{namespace: {stagingPath}}, nsMounter.mountPoints)
+	assert.Empty(t, hostMounter.MountPoints)
+
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{stagingPath}, nsMounter.unmounted)
+	assert.Empty(t, nsMounter.mountPoints[namespace])
+	_, ok := d.stageCache.get(stagingPath)
+	assert.False(t, ok)
+
+	// mount namespace which does not exist any more is skipped
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(namespace))
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{stagingPath}, nsMounter.unmounted)
+}
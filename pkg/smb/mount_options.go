@@ -0,0 +1,630 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	sealMountOption             = "seal"
+	versMountOption             = "vers"
+	posixMountOption            = "posix"
+	noPosixMountOption          = "noposix"
+	bsizeMountOption            = "bsize"
+	rdmaMountOption             = "rdma"
+	resilientHandlesMountOption = "resilienthandles"
+	mapCharsMountOption         = "mapchars"
+	mapPosixMountOption         = "mapposix"
+	noHandleCacheMountOption    = "nohandlecache"
+	backupUIDMountOption        = "backupuid"
+	backupGIDMountOption        = "backupgid"
+	snapshotMountOption         = "snapshot"
+	closeTimeoMountOption       = "closetimeo"
+	maxCreditsMountOption       = "max_credits"
+	sfuMountOption              = "sfu"
+	mfsymlinksMountOption       = "mfsymlinks"
+	modeFromSIDMountOption      = "modefromsid"
+	secMountOption              = "sec"
+	guestMountOption            = "guest"
+	strictSyncMountOption       = "strictsync"
+	noStrictSyncMountOption     = "nostrictsync"
+	wsizeMountOption            = "wsize"
+	noShareSockMountOption      = "nosharesock"
+	cruidMountOption            = "cruid"
+
+	// volume context parameters translated into cifs mount options
+	posixField            = "posix"
+	bsizeField            = "bsize"
+	rdmaField             = "rdma"
+	resilientHandlesField = "resilienthandles"
+	mapCharsField         = "mapchars"
+	mapPosixField         = "mapposix"
+	noHandleCacheField    = "nohandlecache"
+	backupUIDField        = "backupuid"
+	backupGIDField        = "backupgid"
+	snapshotField         = "snapshot"
+	closeTimeoField       = "closetimeo"
+	maxCreditsField       = "maxcredits"
+	transportField        = "transport"
+	sfuField              = "sfu"
+	modeFromSIDField      = "modefromsid"
+	strictSyncField       = "strictsync"
+	wsizeField            = "wsize"
+	noShareSockField      = "nosharesock"
+	// expands into strictConsistencyMountOptions for immediate metadata and data visibility across clients
+	strictConsistencyField = "strictconsistency"
+	// name of mount option profile defined in --mount-profiles-file
+	profileField = "profile"
+	// mount options applied in NodePublishVolume, a dedicated cifs mount is created if any option could not be applied on a bind mount
+	publishMountOptionsField = "publishmountoptions"
+	// type of bind mount created in NodePublishVolume, overrides --bind-mode
+	bindModeField = "bindmode"
+	// bind mount modes, rbind also bind mounts nested mounts under staging path
+	bindModeBind  = "bind"
+	bindModeRBind = "rbind"
+	// skip gid mount option derived from volumeMountGroup in NodeStageVolume
+	disableGidMountField = "disablegidmount"
+
+	// minimum SMB dialect which supports SMB3 POSIX extensions
+	posixMinSMBVersion = "3.1.1"
+	// minimum SMB dialect required to mount over SMB Direct(RDMA)
+	rdmaMinSMBVersion = "3.1.1"
+	// minimum SMB dialect which supports SMB over QUIC
+	quicMinSMBVersion = "3.1.1"
+	// transports of SMB connection
+	transportTCP  = "tcp"
+	transportRDMA = "rdma"
+	transportQUIC = "quic"
+	// minimum SMB dialect which supports resilient handles
+	resilientHandlesMinSMBVersion = "2.1"
+
+	// persistent handles of Windows continuous availability shares, mutually exclusive with resilient handles
+	persistentHandlesMountOption   = "persistenthandles"
+	persistentHandlesField         = "persistenthandles"
+	persistentHandlesMinSMBVersion = "3.0"
+
+	// format of previous version token exposed by windows servers, e.g. @GMT-2023.05.01-13.30.00
+	gmtTokenFormat = "@GMT-2006.01.02-15.04.05"
+	// seconds between 1601-01-01(NT time epoch) and 1970-01-01(unix epoch)
+	ntEpochOffsetSeconds = 11644473600
+
+	// range of SMB credits accepted by cifs max_credits mount option
+	minMaxCredits = 20
+	maxMaxCredits = 60000
+
+	// range of block size accepted by cifs bsize mount option
+	minBsize = 16 * 1024
+	maxBsize = 128 * 1024 * 1024
+
+	// range of write size accepted by cifs wsize mount option, it must be a multiple of page size
+	minWsize  = 4096
+	maxWsize  = 16 * 1024 * 1024
+	wsizeUnit = 4096
+)
+
+// strictConsistencyMountOptions disable attribute caching and page cache of the client, each option is skipped
+// if any of its overriding keys is already in mount options, e.g. explicit acregmax keeps its value instead of actimeo=0
+var strictConsistencyMountOptions = []struct {
+	option     string
+	overrideBy []string
+}{
+	{option: "actimeo=0", overrideBy: []string{"actimeo", "acregmax", "acdirmax"}},
+	{option: "cache=none", overrideBy: []string{"cache"}},
+}
+
+// bindMountOptions are mount options which could be applied on a bind mount
+var bindMountOptions = map[string]bool{
+	"ro":         true,
+	"rw":         true,
+	"nosuid":     true,
+	"nodev":      true,
+	"noexec":     true,
+	"noatime":    true,
+	"nodiratime": true,
+	"relatime":   true,
+}
+
+// validateBindMode returns error if mode is not a supported bind mount mode
+func validateBindMode(mode string) error {
+	switch mode {
+	case bindModeBind, bindModeRBind:
+		return nil
+	}
+	return fmt.Errorf("invalid %s value: %s, supported values: %s, %s", bindModeField, mode, bindModeBind, bindModeRBind)
+}
+
+// deprecatedMountOptions maps deprecated cifs mount options to migration hints,
+// key is either an option key or an option key=value pair
+var deprecatedMountOptions = map[string]string{
+	"sec=lanman":    "LANMAN authentication is removed from recent kernels, use sec=ntlmssp instead",
+	"sec=ntlm":      "NTLM authentication is removed from recent kernels, use sec=ntlmssp instead",
+	"sec=ntlmi":     "NTLM authentication is removed from recent kernels, use sec=ntlmsspi instead",
+	"vers=1.0":      "SMB1 is deprecated and insecure, use vers=3.0 or later instead",
+	"forcedirectio": "use cache=none instead",
+	"directio":      "use cache=none instead",
+	"strictcache":   "use cache=strict instead",
+}
+
+// splitMountOptions splits comma separated entries in options into single mount options
+func splitMountOptions(options []string) []string {
+	var result []string
+	for _, option := range options {
+		for _, o := range strings.Split(option, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				result = append(result, o)
+			}
+		}
+	}
+	return result
+}
+
+// getMountOptionKey returns the key of a mount option, e.g. "vers" for "vers=3.0"
+func getMountOptionKey(option string) string {
+	return strings.SplitN(option, "=", 2)[0]
+}
+
+// getMountOptionValue returns the value of the mount option with the given key,
+// the second return value indicates whether the mount option is present
+func getMountOptionValue(options []string, key string) (string, bool) {
+	for _, option := range splitMountOptions(options) {
+		kv := strings.SplitN(option, "=", 2)
+		if kv[0] != key {
+			continue
+		}
+		if len(kv) == 2 {
+			return kv[1], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// hasMountOption checks whether a mount option with the given key is present in options
+func hasMountOption(options []string, key string) bool {
+	_, found := getMountOptionValue(options, key)
+	return found
+}
+
+// appendMountOption appends option to options unless a mount option with the same key is already present
+func appendMountOption(options []string, option string) []string {
+	if hasMountOption(options, getMountOptionKey(option)) {
+		return options
+	}
+	return append(options, option)
+}
+
+// setMountOption replaces the mount option with the same key in options by option, or appends it if not present
+func setMountOption(options []string, option string) []string {
+	key := getMountOptionKey(option)
+	var result []string
+	for _, o := range splitMountOptions(options) {
+		if getMountOptionKey(o) != key {
+			result = append(result, o)
+		}
+	}
+	return append(result, option)
+}
+
+// escapableMountOptionKeys are mount options whose value may contain commas escaped by doubling them,
+// cifs client only unescapes values of password options
+var escapableMountOptionKeys = map[string]bool{
+	"password":  true,
+	"password2": true,
+	"pass":      true,
+}
+
+// formatMountOption returns key=value mount option, commas in value would split the option, so they are escaped
+// in values of password options and rejected in values of other options, value is not included in error since it could be a password
+func formatMountOption(key, value string) (string, error) {
+	if strings.Contains(value, ",") {
+		if !escapableMountOptionKeys[strings.ToLower(key)] {
+			return "", fmt.Errorf("value of mount option %s must not contain a comma", key)
+		}
+		value = strings.ReplaceAll(value, ",", ",,")
+	}
+	return fmt.Sprintf("%s=%s", key, value), nil
+}
+
+// getCifsMountOptions translates volume context parameters into cifs mount options and appends them to mountOptions,
+// mount options which are already present in mountOptions would not be appended again
+func getCifsMountOptions(context map[string]string, mountOptions []string) ([]string, error) {
+	params := map[string]string{}
+	for k, v := range context {
+		params[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+
+	if v, ok := params[posixField]; ok && v != "" {
+		var option, conflictOption string
+		switch strings.ToLower(v) {
+		case "on":
+			if !isSMBVersionCompatible(mountOptions, posixMinSMBVersion) {
+				return nil, fmt.Errorf("%s=%s requires vers=%s or later, current mount options: %v", posixField, v, posixMinSMBVersion, mountOptions)
+			}
+			option, conflictOption = posixMountOption, noPosixMountOption
+		case "off":
+			option, conflictOption = noPosixMountOption, posixMountOption
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: on, off", posixField, v)
+		}
+		if hasMountOption(mountOptions, conflictOption) {
+			return nil, fmt.Errorf("%s=%s conflicts with mount option %s", posixField, v, conflictOption)
+		}
+		mountOptions = appendMountOption(mountOptions, option)
+	}
+
+	if v, ok := params[bsizeField]; ok && v != "" {
+		bsize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || bsize < minBsize || bsize > maxBsize || bsize&(bsize-1) != 0 {
+			return nil, fmt.Errorf("invalid %s value: %s, it must be a power of two between %d and %d", bsizeField, v, minBsize, maxBsize)
+		}
+		mountOptions = appendMountOption(mountOptions, fmt.Sprintf("%s=%d", bsizeMountOption, bsize))
+	}
+
+	if v, ok := params[rdmaField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			if !isSMBVersionCompatible(mountOptions, rdmaMinSMBVersion) {
+				return nil, fmt.Errorf("%s=%s requires vers=%s or later, current mount options: %v", rdmaField, v, rdmaMinSMBVersion, mountOptions)
+			}
+			mountOptions = appendMountOption(mountOptions, rdmaMountOption)
+		case "false":
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", rdmaField, v)
+		}
+	}
+
+	if v, ok := params[transportField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case transportTCP:
+		case transportRDMA:
+			if !isSMBVersionCompatible(mountOptions, rdmaMinSMBVersion) {
+				return nil, fmt.Errorf("%s=%s requires vers=%s or later, current mount options: %v", transportField, v, rdmaMinSMBVersion, mountOptions)
+			}
+			mountOptions = appendMountOption(mountOptions, rdmaMountOption)
+		case transportQUIC:
+			if !isSMBVersionCompatible(mountOptions, quicMinSMBVersion) {
+				return nil, fmt.Errorf("%s=%s requires vers=%s or later, current mount options: %v", transportField, v, quicMinSMBVersion, mountOptions)
+			}
+			// cifs kernel client does not provide a mount option to connect over QUIC
+			return nil, fmt.Errorf("%s=%s is not supported by cifs client on Linux node", transportField, v)
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: %s, %s, %s", transportField, v, transportTCP, transportRDMA, transportQUIC)
+		}
+	}
+
+	if v, ok := params[resilientHandlesField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			if !isSMBVersionCompatible(mountOptions, resilientHandlesMinSMBVersion) {
+				return nil, fmt.Errorf("%s=%s requires vers=%s or later, current mount options: %v", resilientHandlesField, v, resilientHandlesMinSMBVersion, mountOptions)
+			}
+			if hasMountOption(mountOptions, persistentHandlesMountOption) {
+				return nil, fmt.Errorf("%s=true conflicts with mount option %s", resilientHandlesField, persistentHandlesMountOption)
+			}
+			mountOptions = appendMountOption(mountOptions, resilientHandlesMountOption)
+		case "false":
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", resilientHandlesField, v)
+		}
+	}
+
+	if v, ok := params[persistentHandlesField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			if !isSMBVersionCompatible(mountOptions, persistentHandlesMinSMBVersion) {
+				return nil, fmt.Errorf("%s=%s requires vers=%s or later, current mount options: %v", persistentHandlesField, v, persistentHandlesMinSMBVersion, mountOptions)
+			}
+			if strings.EqualFold(params[resilientHandlesField], "true") {
+				return nil, fmt.Errorf("%s and %s are mutually exclusive", persistentHandlesField, resilientHandlesField)
+			}
+			if hasMountOption(mountOptions, resilientHandlesMountOption) {
+				return nil, fmt.Errorf("%s=true conflicts with mount option %s", persistentHandlesField, resilientHandlesMountOption)
+			}
+			mountOptions = appendMountOption(mountOptions, persistentHandlesMountOption)
+		case "false":
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", persistentHandlesField, v)
+		}
+	}
+
+	if v, ok := params[noHandleCacheField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			mountOptions = appendMountOption(mountOptions, noHandleCacheMountOption)
+		case "false":
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", noHandleCacheField, v)
+		}
+	}
+
+	if v, ok := params[noShareSockField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			// a dedicated socket isolates failures of this mount from other mounts to the same server
+			mountOptions = appendMountOption(mountOptions, noShareSockMountOption)
+		case "false":
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", noShareSockField, v)
+		}
+	}
+
+	if v, ok := params[sfuField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			// symlinks would be created in both SFU and Minshall+French format
+			if hasMountOption(mountOptions, mfsymlinksMountOption) {
+				return nil, fmt.Errorf("%s=true conflicts with mount option %s", sfuField, mfsymlinksMountOption)
+			}
+			mountOptions = appendMountOption(mountOptions, sfuMountOption)
+		case "false":
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", sfuField, v)
+		}
+	}
+
+	for _, backup := range []struct{ field, option string }{
+		{field: backupUIDField, option: backupUIDMountOption},
+		{field: backupGIDField, option: backupGIDMountOption},
+	} {
+		if v, ok := params[backup.field]; ok && v != "" {
+			if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid %s value: %s, it must be a numeric id", backup.field, v)
+			}
+			mountOptions = appendMountOption(mountOptions, fmt.Sprintf("%s=%s", backup.option, v))
+		}
+	}
+
+	if v, ok := params[closeTimeoField]; ok && v != "" {
+		if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid %s value: %s, it must be a non-negative number of seconds", closeTimeoField, v)
+		}
+		mountOptions = appendMountOption(mountOptions, fmt.Sprintf("%s=%s", closeTimeoMountOption, v))
+	}
+
+	if v, ok := params[maxCreditsField]; ok && v != "" {
+		credits, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || credits < minMaxCredits || credits > maxMaxCredits {
+			return nil, fmt.Errorf("invalid %s value: %s, it must be an integer between %d and %d", maxCreditsField, v, minMaxCredits, maxMaxCredits)
+		}
+		mountOptions = appendMountOption(mountOptions, fmt.Sprintf("%s=%d", maxCreditsMountOption, credits))
+	}
+
+	if v, ok := params[snapshotField]; ok && v != "" {
+		snapshot, err := parseSnapshotTime(v)
+		if err != nil {
+			return nil, err
+		}
+		mountOptions = appendMountOption(mountOptions, fmt.Sprintf("%s=%d", snapshotMountOption, snapshot))
+	}
+
+	if v, ok := params[modeFromSIDField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			// mode bits are stored in ACL of the file which could not be accessed by an anonymous session
+			if sec, _ := getMountOptionValue(mountOptions, secMountOption); strings.EqualFold(sec, "none") || hasMountOption(mountOptions, guestMountOption) {
+				return nil, fmt.Errorf("%s=true requires an authenticated session, current mount options: %v", modeFromSIDField, mountOptions)
+			}
+			mountOptions = appendMountOption(mountOptions, modeFromSIDMountOption)
+		case "false":
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", modeFromSIDField, v)
+		}
+	}
+
+	if v, ok := params[strictSyncField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			if hasMountOption(mountOptions, noStrictSyncMountOption) {
+				return nil, fmt.Errorf("%s=true conflicts with mount option %s", strictSyncField, noStrictSyncMountOption)
+			}
+		case "false":
+			if hasMountOption(mountOptions, strictSyncMountOption) {
+				return nil, fmt.Errorf("%s=false conflicts with mount option %s", strictSyncField, strictSyncMountOption)
+			}
+			klog.V(2).Infof("%s=false: fsync is not flushed to the server, writes are batched at the risk of losing data acknowledged by fsync on client crash", strictSyncField)
+			mountOptions = appendMountOption(mountOptions, noStrictSyncMountOption)
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", strictSyncField, v)
+		}
+	}
+
+	if v, ok := params[wsizeField]; ok && v != "" {
+		wsize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || wsize < minWsize || wsize > maxWsize || wsize%wsizeUnit != 0 {
+			return nil, fmt.Errorf("invalid %s value: %s, it must be a multiple of %d between %d and %d", wsizeField, v, wsizeUnit, minWsize, maxWsize)
+		}
+		klog.V(2).Infof("%s=%d: a larger write size batches more data per request, which improves throughput while increasing latency of each write request", wsizeField, wsize)
+		mountOptions = appendMountOption(mountOptions, fmt.Sprintf("%s=%d", wsizeMountOption, wsize))
+	}
+
+	if v, ok := params[strictConsistencyField]; ok && v != "" {
+		switch strings.ToLower(v) {
+		case "true":
+			for _, o := range strictConsistencyMountOptions {
+				overridden := false
+				for _, key := range o.overrideBy {
+					overridden = overridden || hasMountOption(mountOptions, key)
+				}
+				if overridden {
+					klog.V(2).Infof("%s=true: %s is skipped since it is overridden by mount options %v", strictConsistencyField, o.option, mountOptions)
+					continue
+				}
+				mountOptions = append(mountOptions, o.option)
+			}
+		case "false":
+		default:
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", strictConsistencyField, v)
+		}
+	}
+
+	mapChars, mapPosix := strings.EqualFold(params[mapCharsField], "true"), strings.EqualFold(params[mapPosixField], "true")
+	for _, field := range []string{mapCharsField, mapPosixField} {
+		if v := params[field]; v != "" && !strings.EqualFold(v, "true") && !strings.EqualFold(v, "false") {
+			return nil, fmt.Errorf("invalid %s value: %s, supported values: true, false", field, v)
+		}
+	}
+	switch {
+	case mapChars && mapPosix:
+		return nil, fmt.Errorf("%s and %s are mutually exclusive", mapCharsField, mapPosixField)
+	case mapChars:
+		if hasMountOption(mountOptions, mapPosixMountOption) {
+			return nil, fmt.Errorf("%s=true conflicts with mount option %s", mapCharsField, mapPosixMountOption)
+		}
+		mountOptions = appendMountOption(mountOptions, mapCharsMountOption)
+	case mapPosix:
+		if hasMountOption(mountOptions, mapCharsMountOption) {
+			return nil, fmt.Errorf("%s=true conflicts with mount option %s", mapPosixField, mapCharsMountOption)
+		}
+		mountOptions = appendMountOption(mountOptions, mapPosixMountOption)
+	}
+
+	return mountOptions, nil
+}
+
+// parseSnapshotTime parses snapshot into the NT time(100ns intervals since 1601-01-01 UTC) expected by cifs snapshot mount option,
+// snapshot is either a positive NT time or a previous version token, e.g. @GMT-2023.05.01-13.30.00
+func parseSnapshotTime(snapshot string) (uint64, error) {
+	if strings.HasPrefix(strings.ToUpper(snapshot), "@GMT-") {
+		t, err := time.Parse(gmtTokenFormat, "@GMT-"+snapshot[len("@GMT-"):])
+		if err != nil || t.Unix() < -ntEpochOffsetSeconds {
+			return 0, fmt.Errorf("invalid %s value: %s, it must be in %s format", snapshotField, snapshot, gmtTokenFormat)
+		}
+		return uint64(t.Unix()+ntEpochOffsetSeconds) * 10000000, nil
+	}
+	nt, err := strconv.ParseUint(snapshot, 10, 64)
+	if err != nil || nt == 0 {
+		return 0, fmt.Errorf("invalid %s value: %s, it must be a positive NT time or in %s format", snapshotField, snapshot, gmtTokenFormat)
+	}
+	return nt, nil
+}
+
+// isSMBVersionCompatible checks whether the vers mount option in mountOptions could negotiate minVersion,
+// it returns true if vers is not specified or is a negotiation range, e.g. vers=3 or vers=default
+func isSMBVersionCompatible(mountOptions []string, minVersion string) bool {
+	vers, found := getMountOptionValue(mountOptions, versMountOption)
+	if !found {
+		return true
+	}
+	switch vers {
+	case "", "default", "3":
+		return true
+	}
+	return compareSMBVersion(vers, minVersion) >= 0
+}
+
+// pinDefaultSMBVersion sets vers=pinVersion if vers mount option is not specified or is vers=default,
+// since kernels default to different dialects, it returns whether vers is pinned
+func pinDefaultSMBVersion(mountOptions []string, pinVersion string) ([]string, bool) {
+	if pinVersion == "" {
+		return mountOptions, false
+	}
+	vers, found := getMountOptionValue(mountOptions, versMountOption)
+	if found && vers != "default" {
+		return mountOptions, false
+	}
+	return setMountOption(mountOptions, fmt.Sprintf("%s=%s", versMountOption, pinVersion)), true
+}
+
+// applyMinSMBVersion adds vers=minVersion if vers mount option is not specified,
+// or returns error if the lowest dialect which could be negotiated by vers is lower than minVersion
+func applyMinSMBVersion(mountOptions []string, minVersion string) ([]string, error) {
+	if minVersion == "" {
+		return mountOptions, nil
+	}
+	vers, found := getMountOptionValue(mountOptions, versMountOption)
+	if !found {
+		return append(mountOptions, fmt.Sprintf("%s=%s", versMountOption, minVersion)), nil
+	}
+	lowest := vers
+	switch vers {
+	case "default":
+		lowest = "2.1"
+	case "3":
+		lowest = "3.0"
+	}
+	if compareSMBVersion(lowest, minVersion) < 0 {
+		return nil, fmt.Errorf("%s=%s is lower than minimum SMB version %s", versMountOption, vers, minVersion)
+	}
+	return mountOptions, nil
+}
+
+// compareSMBVersion compares two SMB dialects, e.g. 3.0, 3.02, 3.1.1 or 3.11,
+// it returns -1, 0 or 1 if v1 is lower than, equal to or higher than v2
+func compareSMBVersion(v1, v2 string) int {
+	s1, s2 := parseSMBVersion(v1), parseSMBVersion(v2)
+	for i := 0; i < len(s1) || i < len(s2); i++ {
+		var n1, n2 int
+		if i < len(s1) {
+			n1 = s1[i]
+		}
+		if i < len(s2) {
+			n2 = s2[i]
+		}
+		if n1 != n2 {
+			if n1 < n2 {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseSMBVersion parses SMB dialect into numeric segments, 3.02 and 3.11 are aliases of 3.0.2 and 3.1.1
+func parseSMBVersion(vers string) []int {
+	switch vers {
+	case "3.02":
+		vers = "3.0.2"
+	case "3.11":
+		vers = "3.1.1"
+	}
+	var segments []int
+	for _, s := range strings.Split(vers, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			break
+		}
+		segments = append(segments, n)
+	}
+	return segments
+}
+
+// checkDeprecatedMountOptions logs a warning and records a metric for each deprecated option in mountOptions,
+// it returns the deprecated options found, the mount is not blocked by deprecated options
+func checkDeprecatedMountOptions(volumeID string, mountOptions []string) []string {
+	var deprecated []string
+	for _, option := range splitMountOptions(mountOptions) {
+		key := strings.ToLower(option)
+		hint, found := deprecatedMountOptions[key]
+		if !found {
+			key = strings.ToLower(getMountOptionKey(option))
+			if hint, found = deprecatedMountOptions[key]; !found {
+				continue
+			}
+		}
+		klog.Warningf("volume(%s): mount option %s is deprecated, %s", volumeID, option, hint)
+		recordDeprecatedMountOption(key)
+		deprecated = append(deprecated, option)
+	}
+	return deprecated
+}
@@ -0,0 +1,851 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSplitMountOptions(t *testing.T) {
+	tests := []struct {
+		desc     string
+		options  []string
+		expected []string
+	}{
+		{
+			desc:     "empty options",
+			expected: nil,
+		},
+		{
+			desc:     "single options",
+			options:  []string{"vers=3.0", "seal"},
+			expected: []string{"vers=3.0", "seal"},
+		},
+		{
+			desc:     "comma separated options",
+			options:  []string{"dir_mode=0777,file_mode=0777", " seal ,", "vers=3.0"},
+			expected: []string{"dir_mode=0777", "file_mode=0777", "seal", "vers=3.0"},
+		},
+	}
+
+	for _, test := range tests {
+		result := splitMountOptions(test.options)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestGetMountOptionValue(t *testing.T) {
+	tests := []struct {
+		desc          string
+		options       []string
+		key           string
+		expectedValue string
+		expectedFound bool
+	}{
+		{
+			desc:          "empty options",
+			key:           "vers",
+			expectedFound: false,
+		},
+		{
+			desc:          "key/value option",
+			options:       []string{"dir_mode=0777,vers=3.1.1"},
+			key:           "vers",
+			expectedValue: "3.1.1",
+			expectedFound: true,
+		},
+		{
+			desc:          "flag option",
+			options:       []string{"vers=3.0", "seal"},
+			key:           "seal",
+			expectedFound: true,
+		},
+		{
+			desc:          "prefix of another option",
+			options:       []string{"sealed"},
+			key:           "seal",
+			expectedFound: false,
+		},
+	}
+
+	for _, test := range tests {
+		value, found := getMountOptionValue(test.options, test.key)
+		if value != test.expectedValue || found != test.expectedFound {
+			t.Errorf("test[%s]: unexpected output: (%s, %v), expected result: (%s, %v)", test.desc, value, found, test.expectedValue, test.expectedFound)
+		}
+	}
+}
+
+func TestAppendMountOption(t *testing.T) {
+	tests := []struct {
+		desc     string
+		options  []string
+		option   string
+		expected []string
+	}{
+		{
+			desc:     "empty options",
+			option:   "seal",
+			expected: []string{"seal"},
+		},
+		{
+			desc:     "option not present",
+			options:  []string{"vers=3.0"},
+			option:   "seal",
+			expected: []string{"vers=3.0", "seal"},
+		},
+		{
+			desc:     "option already present",
+			options:  []string{"dir_mode=0777,seal"},
+			option:   "seal",
+			expected: []string{"dir_mode=0777,seal"},
+		},
+		{
+			desc:     "option key already present with different value",
+			options:  []string{"vers=3.0"},
+			option:   "vers=3.1.1",
+			expected: []string{"vers=3.0"},
+		},
+	}
+
+	for _, test := range tests {
+		result := appendMountOption(test.options, test.option)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestFormatMountOption(t *testing.T) {
+	tests := []struct {
+		key            string
+		value          string
+		expectedOption string
+		expectedErr    error
+	}{
+		{key: "domain", value: "CONTOSO", expectedOption: "domain=CONTOSO"},
+		{key: "password", value: "pa,ss,", expectedOption: "password=pa,,ss,,"},
+		{key: "domain", value: "CONTOSO,ou=dev", expectedErr: fmt.Errorf("value of mount option domain must not contain a comma")},
+		{key: "username", value: "user,admin", expectedErr: fmt.Errorf("value of mount option username must not contain a comma")},
+	}
+
+	for _, test := range tests {
+		option, err := formatMountOption(test.key, test.value)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("formatMountOption(%s): unexpected error: %v, expected error: %v", test.key, err, test.expectedErr)
+		}
+		if option != test.expectedOption {
+			t.Errorf("formatMountOption(%s): unexpected output: %s, expected result: %s", test.key, option, test.expectedOption)
+		}
+	}
+}
+
+func TestGetCifsMountOptions(t *testing.T) {
+	tests := []struct {
+		desc            string
+		context         map[string]string
+		mountOptions    []string
+		expectedOptions []string
+		expectedErr     error
+	}{
+		{
+			desc:            "no context parameters",
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:            "posix on",
+			context:         map[string]string{"posix": "on"},
+			mountOptions:    []string{"vers=3.1.1"},
+			expectedOptions: []string{"vers=3.1.1", "posix"},
+		},
+		{
+			desc:            "posix on without vers",
+			context:         map[string]string{"POSIX": "On"},
+			expectedOptions: []string{"posix"},
+		},
+		{
+			desc:            "posix on deduplicated",
+			context:         map[string]string{"posix": "on"},
+			mountOptions:    []string{"vers=3.11,posix"},
+			expectedOptions: []string{"vers=3.11,posix"},
+		},
+		{
+			desc:            "posix off",
+			context:         map[string]string{"posix": "off"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "noposix"},
+		},
+		{
+			desc:         "posix on with incompatible vers",
+			context:      map[string]string{"posix": "on"},
+			mountOptions: []string{"vers=3.0"},
+			expectedErr:  fmt.Errorf("posix=on requires vers=3.1.1 or later, current mount options: [vers=3.0]"),
+		},
+		{
+			desc:         "posix on conflicts with noposix",
+			context:      map[string]string{"posix": "on"},
+			mountOptions: []string{"noposix"},
+			expectedErr:  fmt.Errorf("posix=on conflicts with mount option noposix"),
+		},
+		{
+			desc:        "invalid posix value",
+			context:     map[string]string{"posix": "true"},
+			expectedErr: fmt.Errorf("invalid posix value: true, supported values: on, off"),
+		},
+		{
+			desc:            "valid bsize",
+			context:         map[string]string{"bsize": "65536"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "bsize=65536"},
+		},
+		{
+			desc:            "bsize deduplicated",
+			context:         map[string]string{"bsize": "65536"},
+			mountOptions:    []string{"bsize=1048576"},
+			expectedOptions: []string{"bsize=1048576"},
+		},
+		{
+			desc:        "bsize not power of two",
+			context:     map[string]string{"bsize": "100000"},
+			expectedErr: fmt.Errorf("invalid bsize value: 100000, it must be a power of two between 16384 and 134217728"),
+		},
+		{
+			desc:        "bsize out of range",
+			context:     map[string]string{"bsize": "4096"},
+			expectedErr: fmt.Errorf("invalid bsize value: 4096, it must be a power of two between 16384 and 134217728"),
+		},
+		{
+			desc:            "rdma with compatible vers",
+			context:         map[string]string{"rdma": "true"},
+			mountOptions:    []string{"vers=3.1.1"},
+			expectedOptions: []string{"vers=3.1.1", "rdma"},
+		},
+		{
+			desc:            "rdma disabled",
+			context:         map[string]string{"rdma": "false"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:         "rdma with incompatible vers",
+			context:      map[string]string{"rdma": "true"},
+			mountOptions: []string{"vers=2.1"},
+			expectedErr:  fmt.Errorf("rdma=true requires vers=3.1.1 or later, current mount options: [vers=2.1]"),
+		},
+		{
+			desc:        "invalid rdma value",
+			context:     map[string]string{"rdma": "on"},
+			expectedErr: fmt.Errorf("invalid rdma value: on, supported values: true, false"),
+		},
+		{
+			desc:            "resilienthandles with compatible vers",
+			context:         map[string]string{"resilientHandles": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "resilienthandles"},
+		},
+		{
+			desc:            "resilienthandles deduplicated",
+			context:         map[string]string{"resilientHandles": "true"},
+			mountOptions:    []string{"resilienthandles"},
+			expectedOptions: []string{"resilienthandles"},
+		},
+		{
+			desc:            "resilienthandles unset",
+			context:         map[string]string{"resilientHandles": ""},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:         "resilienthandles with incompatible vers",
+			context:      map[string]string{"resilientHandles": "true"},
+			mountOptions: []string{"vers=2.0"},
+			expectedErr:  fmt.Errorf("resilienthandles=true requires vers=2.1 or later, current mount options: [vers=2.0]"),
+		},
+		{
+			desc:            "nohandlecache",
+			context:         map[string]string{"noHandleCache": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "nohandlecache"},
+		},
+		{
+			desc:            "nohandlecache deduplicated",
+			context:         map[string]string{"noHandleCache": "true"},
+			mountOptions:    []string{"vers=3.0,nohandlecache"},
+			expectedOptions: []string{"vers=3.0,nohandlecache"},
+		},
+		{
+			desc:            "nohandlecache unset",
+			context:         map[string]string{"noHandleCache": ""},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:        "invalid nohandlecache value",
+			context:     map[string]string{"noHandleCache": "1"},
+			expectedErr: fmt.Errorf("invalid nohandlecache value: 1, supported values: true, false"),
+		},
+		{
+			desc:            "sfu",
+			context:         map[string]string{"sfu": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "sfu"},
+		},
+		{
+			desc:            "sfu deduplicated",
+			context:         map[string]string{"sfu": "True"},
+			mountOptions:    []string{"sfu"},
+			expectedOptions: []string{"sfu"},
+		},
+		{
+			desc:         "sfu conflicts with mfsymlinks mount option",
+			context:      map[string]string{"sfu": "true"},
+			mountOptions: []string{"vers=3.0", "mfsymlinks"},
+			expectedErr:  fmt.Errorf("sfu=true conflicts with mount option mfsymlinks"),
+		},
+		{
+			desc:        "invalid sfu value",
+			context:     map[string]string{"sfu": "on"},
+			expectedErr: fmt.Errorf("invalid sfu value: on, supported values: true, false"),
+		},
+		{
+			desc:            "modefromsid",
+			context:         map[string]string{"modeFromSid": "true"},
+			mountOptions:    []string{"vers=3.0", "sec=ntlmssp"},
+			expectedOptions: []string{"vers=3.0", "sec=ntlmssp", "modefromsid"},
+		},
+		{
+			desc:            "modefromsid deduplicated",
+			context:         map[string]string{"modeFromSid": "true"},
+			mountOptions:    []string{"modefromsid"},
+			expectedOptions: []string{"modefromsid"},
+		},
+		{
+			desc:         "modefromsid with sec=none",
+			context:      map[string]string{"modeFromSid": "true"},
+			mountOptions: []string{"sec=none"},
+			expectedErr:  fmt.Errorf("modefromsid=true requires an authenticated session, current mount options: [sec=none]"),
+		},
+		{
+			desc:         "modefromsid with guest",
+			context:      map[string]string{"modeFromSid": "true"},
+			mountOptions: []string{"guest"},
+			expectedErr:  fmt.Errorf("modefromsid=true requires an authenticated session, current mount options: [guest]"),
+		},
+		{
+			desc:        "invalid modefromsid value",
+			context:     map[string]string{"modeFromSid": "1"},
+			expectedErr: fmt.Errorf("invalid modefromsid value: 1, supported values: true, false"),
+		},
+		{
+			desc:            "mapchars",
+			context:         map[string]string{"mapChars": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "mapchars"},
+		},
+		{
+			desc:            "mapposix",
+			context:         map[string]string{"mapPosix": "true", "mapChars": "false"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "mapposix"},
+		},
+		{
+			desc:            "mapposix deduplicated",
+			context:         map[string]string{"mapPosix": "true"},
+			mountOptions:    []string{"mapposix"},
+			expectedOptions: []string{"mapposix"},
+		},
+		{
+			desc:        "mapchars and mapposix are mutually exclusive",
+			context:     map[string]string{"mapChars": "true", "mapPosix": "true"},
+			expectedErr: fmt.Errorf("mapchars and mapposix are mutually exclusive"),
+		},
+		{
+			desc:         "mapchars conflicts with mapposix mount option",
+			context:      map[string]string{"mapChars": "true"},
+			mountOptions: []string{"mapposix"},
+			expectedErr:  fmt.Errorf("mapchars=true conflicts with mount option mapposix"),
+		},
+		{
+			desc:        "invalid mapchars value",
+			context:     map[string]string{"mapChars": "yes"},
+			expectedErr: fmt.Errorf("invalid mapchars value: yes, supported values: true, false"),
+		},
+		{
+			desc:            "backupuid and backupgid",
+			context:         map[string]string{"backupUID": "1000", "backupGID": "2000"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "backupuid=1000", "backupgid=2000"},
+		},
+		{
+			desc:            "backupuid deduplicated",
+			context:         map[string]string{"backupUID": "1000"},
+			mountOptions:    []string{"vers=3.0,backupuid=0"},
+			expectedOptions: []string{"vers=3.0,backupuid=0"},
+		},
+		{
+			desc:            "backupuid and backupgid absent",
+			context:         map[string]string{"backupUID": ""},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:        "invalid backupgid value",
+			context:     map[string]string{"backupGID": "users"},
+			expectedErr: fmt.Errorf("invalid backupgid value: users, it must be a numeric id"),
+		},
+		{
+			desc:            "closetimeo",
+			context:         map[string]string{"closeTimeo": "5"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "closetimeo=5"},
+		},
+		{
+			desc:            "closetimeo deduplicated",
+			context:         map[string]string{"closeTimeo": "5"},
+			mountOptions:    []string{"vers=3.0", "closetimeo=1"},
+			expectedOptions: []string{"vers=3.0", "closetimeo=1"},
+		},
+		{
+			desc:            "closetimeo absent",
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:        "invalid closetimeo value",
+			context:     map[string]string{"closeTimeo": "5s"},
+			expectedErr: fmt.Errorf("invalid closetimeo value: 5s, it must be a non-negative number of seconds"),
+		},
+		{
+			desc:            "transport tcp",
+			context:         map[string]string{"transport": "tcp"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:            "transport rdma",
+			context:         map[string]string{"transport": "RDMA"},
+			mountOptions:    []string{"vers=3.1.1"},
+			expectedOptions: []string{"vers=3.1.1", "rdma"},
+		},
+		{
+			desc:         "transport quic with compatible vers",
+			context:      map[string]string{"transport": "quic"},
+			mountOptions: []string{"vers=3.1.1"},
+			expectedErr:  fmt.Errorf("transport=quic is not supported by cifs client on Linux node"),
+		},
+		{
+			desc:         "transport quic with incompatible vers",
+			context:      map[string]string{"transport": "quic"},
+			mountOptions: []string{"vers=3.0"},
+			expectedErr:  fmt.Errorf("transport=quic requires vers=3.1.1 or later, current mount options: [vers=3.0]"),
+		},
+		{
+			desc:        "invalid transport",
+			context:     map[string]string{"transport": "udp"},
+			expectedErr: fmt.Errorf("invalid transport value: udp, supported values: tcp, rdma, quic"),
+		},
+		{
+			desc:            "max_credits",
+			context:         map[string]string{"maxCredits": "128"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "max_credits=128"},
+		},
+		{
+			desc:            "max_credits deduplicated",
+			context:         map[string]string{"maxCredits": "128"},
+			mountOptions:    []string{"vers=3.0,max_credits=64"},
+			expectedOptions: []string{"vers=3.0,max_credits=64"},
+		},
+		{
+			desc:            "max_credits absent",
+			context:         map[string]string{"maxCredits": ""},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:        "max_credits out of range",
+			context:     map[string]string{"maxCredits": "10"},
+			expectedErr: fmt.Errorf("invalid maxcredits value: 10, it must be an integer between 20 and 60000"),
+		},
+		{
+			desc:            "persistentHandles with compatible version",
+			context:         map[string]string{"persistentHandles": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "persistenthandles"},
+		},
+		{
+			desc:            "persistentHandles deduplicated",
+			context:         map[string]string{"persistentHandles": "true"},
+			mountOptions:    []string{"vers=3.1.1,persistenthandles"},
+			expectedOptions: []string{"vers=3.1.1,persistenthandles"},
+		},
+		{
+			desc:            "persistentHandles false",
+			context:         map[string]string{"persistentHandles": "false"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:         "persistentHandles with incompatible version",
+			context:      map[string]string{"persistentHandles": "true"},
+			mountOptions: []string{"vers=2.1"},
+			expectedErr:  fmt.Errorf("persistenthandles=true requires vers=3.0 or later, current mount options: [vers=2.1]"),
+		},
+		{
+			desc:         "persistentHandles and resilientHandles are mutually exclusive",
+			context:      map[string]string{"persistentHandles": "true", "resilientHandles": "true"},
+			mountOptions: []string{"vers=3.0"},
+			expectedErr:  fmt.Errorf("persistenthandles and resilienthandles are mutually exclusive"),
+		},
+		{
+			desc:         "persistentHandles conflicts with resilienthandles mount option",
+			context:      map[string]string{"persistentHandles": "true"},
+			mountOptions: []string{"vers=3.0,resilienthandles"},
+			expectedErr:  fmt.Errorf("persistenthandles=true conflicts with mount option resilienthandles"),
+		},
+		{
+			desc:         "resilientHandles conflicts with persistenthandles mount option",
+			context:      map[string]string{"resilientHandles": "true"},
+			mountOptions: []string{"vers=3.0,persistenthandles"},
+			expectedErr:  fmt.Errorf("resilienthandles=true conflicts with mount option persistenthandles"),
+		},
+		{
+			desc:        "invalid persistentHandles value",
+			context:     map[string]string{"persistentHandles": "on"},
+			expectedErr: fmt.Errorf("invalid persistenthandles value: on, supported values: true, false"),
+		},
+		{
+			desc:            "noShareSock true",
+			context:         map[string]string{"noShareSock": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "nosharesock"},
+		},
+		{
+			desc:            "noShareSock true deduplicated",
+			context:         map[string]string{"noShareSock": "True"},
+			mountOptions:    []string{"vers=3.0,nosharesock"},
+			expectedOptions: []string{"vers=3.0,nosharesock"},
+		},
+		{
+			desc:            "noShareSock false",
+			context:         map[string]string{"noShareSock": "false"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:            "noShareSock unset",
+			context:         map[string]string{"noShareSock": ""},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:        "invalid noShareSock value",
+			context:     map[string]string{"noShareSock": "1"},
+			expectedErr: fmt.Errorf("invalid nosharesock value: 1, supported values: true, false"),
+		},
+		{
+			desc:            "strictSync false",
+			context:         map[string]string{"strictSync": "false"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "nostrictsync"},
+		},
+		{
+			desc:            "strictSync false deduplicated",
+			context:         map[string]string{"strictSync": "false"},
+			mountOptions:    []string{"vers=3.0,nostrictsync"},
+			expectedOptions: []string{"vers=3.0,nostrictsync"},
+		},
+		{
+			desc:            "strictSync true",
+			context:         map[string]string{"strictSync": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:            "strictSync absent",
+			context:         map[string]string{"strictSync": ""},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:         "strictSync true conflicts with nostrictsync",
+			context:      map[string]string{"strictSync": "true"},
+			mountOptions: []string{"nostrictsync"},
+			expectedErr:  fmt.Errorf("strictsync=true conflicts with mount option nostrictsync"),
+		},
+		{
+			desc:        "invalid strictSync value",
+			context:     map[string]string{"strictSync": "no"},
+			expectedErr: fmt.Errorf("invalid strictsync value: no, supported values: true, false"),
+		},
+		{
+			desc:            "wsize",
+			context:         map[string]string{"wsize": "1048576"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "wsize=1048576"},
+		},
+		{
+			desc:            "wsize deduplicated",
+			context:         map[string]string{"wsize": "1048576"},
+			mountOptions:    []string{"vers=3.0,wsize=65536"},
+			expectedOptions: []string{"vers=3.0,wsize=65536"},
+		},
+		{
+			desc:            "wsize absent",
+			context:         map[string]string{"wsize": ""},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:        "wsize not a multiple of page size",
+			context:     map[string]string{"wsize": "5000"},
+			expectedErr: fmt.Errorf("invalid wsize value: 5000, it must be a multiple of 4096 between 4096 and 16777216"),
+		},
+		{
+			desc:            "strictConsistency",
+			context:         map[string]string{"strictConsistency": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "actimeo=0", "cache=none"},
+		},
+		{
+			desc:            "strictConsistency overridden by explicit options",
+			context:         map[string]string{"strictConsistency": "true"},
+			mountOptions:    []string{"vers=3.0,cache=strict", "acregmax=1"},
+			expectedOptions: []string{"vers=3.0,cache=strict", "acregmax=1"},
+		},
+		{
+			desc:            "strictConsistency partially overridden",
+			context:         map[string]string{"strictConsistency": "true"},
+			mountOptions:    []string{"vers=3.0", "actimeo=1"},
+			expectedOptions: []string{"vers=3.0", "actimeo=1", "cache=none"},
+		},
+		{
+			desc:            "strictConsistency false",
+			context:         map[string]string{"strictConsistency": "false"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:        "invalid strictConsistency value",
+			context:     map[string]string{"strictConsistency": "yes"},
+			expectedErr: fmt.Errorf("invalid strictconsistency value: yes, supported values: true, false"),
+		},
+		{
+			desc:            "snapshot in NT time",
+			context:         map[string]string{"snapshot": "133274214000000000"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "snapshot=133274214000000000"},
+		},
+		{
+			desc:            "snapshot in GMT token",
+			context:         map[string]string{"snapshot": "@GMT-2023.05.01-13.30.00"},
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "snapshot=133274214000000000"},
+		},
+		{
+			desc:        "invalid snapshot token",
+			context:     map[string]string{"snapshot": "@GMT-2023-05-01"},
+			expectedErr: fmt.Errorf("invalid snapshot value: @GMT-2023-05-01, it must be in @GMT-2006.01.02-15.04.05 format"),
+		},
+		{
+			desc:        "invalid snapshot value",
+			context:     map[string]string{"snapshot": "yesterday"},
+			expectedErr: fmt.Errorf("invalid snapshot value: yesterday, it must be a positive NT time or in @GMT-2006.01.02-15.04.05 format"),
+		},
+	}
+
+	for _, test := range tests {
+		result, err := getCifsMountOptions(test.context, test.mountOptions)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if !reflect.DeepEqual(result, test.expectedOptions) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expectedOptions)
+		}
+	}
+}
+
+func TestCompareSMBVersion(t *testing.T) {
+	tests := []struct {
+		v1       string
+		v2       string
+		expected int
+	}{
+		{v1: "3.0", v2: "3.1.1", expected: -1},
+		{v1: "3.02", v2: "3.0", expected: 1},
+		{v1: "3.11", v2: "3.1.1", expected: 0},
+		{v1: "2.1", v2: "2.0", expected: 1},
+		{v1: "1.0", v2: "3.0", expected: -1},
+	}
+
+	for _, test := range tests {
+		result := compareSMBVersion(test.v1, test.v2)
+		if result != test.expected {
+			t.Errorf("compareSMBVersion(%s, %s): unexpected output: %d, expected result: %d", test.v1, test.v2, result, test.expected)
+		}
+	}
+}
+
+func TestApplyMinSMBVersion(t *testing.T) {
+	tests := []struct {
+		desc            string
+		mountOptions    []string
+		minVersion      string
+		expectedOptions []string
+		expectedErr     error
+	}{
+		{
+			desc:            "no minimum version",
+			mountOptions:    []string{"dir_mode=0777"},
+			expectedOptions: []string{"dir_mode=0777"},
+		},
+		{
+			desc:            "minimum version injected",
+			mountOptions:    []string{"dir_mode=0777"},
+			minVersion:      "3.0",
+			expectedOptions: []string{"dir_mode=0777", "vers=3.0"},
+		},
+		{
+			desc:            "explicit version above minimum version",
+			mountOptions:    []string{"vers=3.1.1"},
+			minVersion:      "3.0",
+			expectedOptions: []string{"vers=3.1.1"},
+		},
+		{
+			desc:            "negotiation range above minimum version",
+			mountOptions:    []string{"vers=3"},
+			minVersion:      "3.0",
+			expectedOptions: []string{"vers=3"},
+		},
+		{
+			desc:         "explicit version below minimum version",
+			mountOptions: []string{"vers=2.1"},
+			minVersion:   "3.0",
+			expectedErr:  fmt.Errorf("vers=2.1 is lower than minimum SMB version 3.0"),
+		},
+		{
+			desc:         "negotiation range below minimum version",
+			mountOptions: []string{"vers=default"},
+			minVersion:   "3.0",
+			expectedErr:  fmt.Errorf("vers=default is lower than minimum SMB version 3.0"),
+		},
+	}
+
+	for _, test := range tests {
+		options, err := applyMinSMBVersion(test.mountOptions, test.minVersion)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if !reflect.DeepEqual(options, test.expectedOptions) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, options, test.expectedOptions)
+		}
+	}
+}
+
+func TestCheckDeprecatedMountOptions(t *testing.T) {
+	tests := []struct {
+		desc               string
+		mountOptions       []string
+		expectedDeprecated []string
+		expectedCounters   map[string]float64
+	}{
+		{
+			desc:         "current mount options",
+			mountOptions: []string{"vers=3.1.1,sec=ntlmssp", "cache=none"},
+		},
+		{
+			desc:               "deprecated mount options",
+			mountOptions:       []string{"vers=1.0,sec=ntlm", "forcedirectio"},
+			expectedDeprecated: []string{"vers=1.0", "sec=ntlm", "forcedirectio"},
+			expectedCounters:   map[string]float64{"vers=1.0": 1, "sec=ntlm": 1, "forcedirectio": 1},
+		},
+	}
+
+	registerMetrics()
+	for _, test := range tests {
+		before := map[string]float64{}
+		for _, option := range []string{"vers=1.0", "sec=ntlm", "forcedirectio", "sec=ntlmssp", "cache=none"} {
+			before[option], _ = getMetricValue(t, "csi_smb_deprecated_mount_options_total", map[string]string{"option": option})
+		}
+		result := checkDeprecatedMountOptions("vol_1", test.mountOptions)
+		if !reflect.DeepEqual(result, test.expectedDeprecated) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expectedDeprecated)
+		}
+		for option, value := range before {
+			after, _ := getMetricValue(t, "csi_smb_deprecated_mount_options_total", map[string]string{"option": option})
+			if after-value != test.expectedCounters[option] {
+				t.Errorf("test[%s]: unexpected counter increase of %s: %v, expected: %v", test.desc, option, after-value, test.expectedCounters[option])
+			}
+		}
+	}
+}
+
+func TestPinDefaultSMBVersion(t *testing.T) {
+	tests := []struct {
+		desc            string
+		mountOptions    []string
+		pinVersion      string
+		expectedOptions []string
+		expectedPinned  bool
+	}{
+		{
+			desc:            "pinning disabled",
+			mountOptions:    []string{"dir_mode=0777"},
+			expectedOptions: []string{"dir_mode=0777"},
+		},
+		{
+			desc:            "pinning disabled with vers=default",
+			mountOptions:    []string{"vers=default"},
+			expectedOptions: []string{"vers=default"},
+		},
+		{
+			desc:            "version pinned if vers is not specified",
+			mountOptions:    []string{"dir_mode=0777"},
+			pinVersion:      "3.1.1",
+			expectedOptions: []string{"dir_mode=0777", "vers=3.1.1"},
+			expectedPinned:  true,
+		},
+		{
+			desc:            "vers=default is pinned",
+			mountOptions:    []string{"dir_mode=0777,vers=default"},
+			pinVersion:      "3.1.1",
+			expectedOptions: []string{"dir_mode=0777", "vers=3.1.1"},
+			expectedPinned:  true,
+		},
+		{
+			desc:            "explicit version is kept",
+			mountOptions:    []string{"vers=3.0"},
+			pinVersion:      "3.1.1",
+			expectedOptions: []string{"vers=3.0"},
+		},
+	}
+
+	for _, test := range tests {
+		options, pinned := pinDefaultSMBVersion(test.mountOptions, test.pinVersion)
+		if !reflect.DeepEqual(options, test.expectedOptions) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, options, test.expectedOptions)
+		}
+		if pinned != test.expectedPinned {
+			t.Errorf("test[%s]: unexpected pinned: %v, expected pinned: %v", test.desc, pinned, test.expectedPinned)
+		}
+	}
+}
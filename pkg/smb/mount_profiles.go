@@ -0,0 +1,72 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// parseMountProfiles parses named mount option profiles in the form of "<name> <comma separated mount options>" per line,
+// empty lines and lines starting with # are ignored
+func parseMountProfiles(content string) (map[string][]string, error) {
+	profiles := map[string][]string{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"<name> <mount options>\", got %q", lineNum, line)
+		}
+		if _, found := profiles[fields[0]]; found {
+			return nil, fmt.Errorf("line %d: duplicate mount profile %s", lineNum, fields[0])
+		}
+		profiles[fields[0]] = splitMountOptions([]string{fields[1]})
+	}
+	return profiles, scanner.Err()
+}
+
+// loadMountProfiles loads named mount option profiles from file
+func loadMountProfiles(path string) (map[string][]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := parseMountProfiles(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mount profiles file %s: %v", path, err)
+	}
+	return profiles, nil
+}
+
+// applyMountProfile merges mount options of profile into mountOptions,
+// mount options which are already present in mountOptions take precedence
+func applyMountProfile(profiles map[string][]string, profile string, mountOptions []string) ([]string, error) {
+	options, found := profiles[profile]
+	if !found {
+		return nil, fmt.Errorf("mount profile %s is not found", profile)
+	}
+	for _, option := range options {
+		mountOptions = appendMountOption(mountOptions, option)
+	}
+	return mountOptions, nil
+}
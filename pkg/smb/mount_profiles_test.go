@@ -0,0 +1,122 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMountProfiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "csi-smb-mount-profiles-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	profilesFile := filepath.Join(tmpDir, "profiles")
+	content := `# media workloads
+media vers=3.1.1,cache=loose,actimeo=60
+
+database   vers=3.1.1,cache=none,nobrl
+`
+	assert.NoError(t, os.WriteFile(profilesFile, []byte(content), 0644))
+	profiles, err := loadMountProfiles(profilesFile)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"media":    {"vers=3.1.1", "cache=loose", "actimeo=60"},
+		"database": {"vers=3.1.1", "cache=none", "nobrl"},
+	}, profiles)
+
+	_, err = loadMountProfiles(filepath.Join(tmpDir, "not-exist"))
+	assert.Error(t, err)
+}
+
+func TestParseMountProfiles(t *testing.T) {
+	tests := []struct {
+		desc        string
+		content     string
+		expectedErr error
+	}{
+		{
+			desc:    "valid profiles",
+			content: "media cache=loose\n# comment\nbackup backupuid=0",
+		},
+		{
+			desc:        "missing mount options",
+			content:     "media",
+			expectedErr: fmt.Errorf("line 1: expected \"<name> <mount options>\", got \"media\""),
+		},
+		{
+			desc:        "duplicate profile",
+			content:     "media cache=loose\nmedia cache=none",
+			expectedErr: fmt.Errorf("line 2: duplicate mount profile media"),
+		},
+	}
+
+	for _, test := range tests {
+		_, err := parseMountProfiles(test.content)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestApplyMountProfile(t *testing.T) {
+	profiles := map[string][]string{
+		"media": {"vers=3.1.1", "cache=loose", "actimeo=60"},
+	}
+
+	tests := []struct {
+		desc            string
+		profile         string
+		mountOptions    []string
+		expectedOptions []string
+		expectedErr     error
+	}{
+		{
+			desc:            "profile applied",
+			profile:         "media",
+			mountOptions:    []string{"dir_mode=0777"},
+			expectedOptions: []string{"dir_mode=0777", "vers=3.1.1", "cache=loose", "actimeo=60"},
+		},
+		{
+			desc:            "mount options take precedence over profile",
+			profile:         "media",
+			mountOptions:    []string{"vers=3.0,cache=strict"},
+			expectedOptions: []string{"vers=3.0,cache=strict", "actimeo=60"},
+		},
+		{
+			desc:        "profile not found",
+			profile:     "database",
+			expectedErr: fmt.Errorf("mount profile database is not found"),
+		},
+	}
+
+	for _, test := range tests {
+		result, err := applyMountProfile(profiles, test.profile, test.mountOptions)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if !reflect.DeepEqual(result, test.expectedOptions) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expectedOptions)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+var (
+	// errMountAttemptTimeout is returned by mountWithTimeout if a mount attempt is killed after it does not complete in time
+	errMountAttemptTimeout = errors.New("mount attempt timed out")
+	// errMountAttemptAbandoned is returned by mountWithTimeout if a timed out mount attempt could not be killed
+	errMountAttemptAbandoned = errors.New("mount attempt timed out and could not be killed")
+
+	// a timed out mount attempt is abandoned if it does not exit within this period after it's canceled
+	mountAttemptKillGracePeriod = 5 * time.Second
+	// volume lock is released after this period even if an abandoned mount attempt is still running,
+	// so that the volume is not busy forever if mount.cifs never returns
+	maxAbandonedMountLockHold = 10 * time.Minute
+)
+
+// contextMounter is implemented by mounters whose mount could be canceled by ctx
+type contextMounter interface {
+	MountSensitiveWithContext(ctx context.Context, source, target, fstype string, options, sensitiveOptions []string) error
+}
+
+// cifsMountAttempt returns a mount attempt of cifs source on target, which is killed once its ctx is done
+func cifsMountAttempt(m *mount.SafeFormatAndMount, source, target string, options, sensitiveOptions []string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		return MountWithContext(ctx, m, source, target, "cifs", options, sensitiveOptions)
+	}
+}
+
+// mountWithTimeout runs mount with a context which is canceled if it does not complete within timeout, 0 means no timeout.
+// errMountAttemptTimeout is returned once the canceled attempt exits, e.g. mount.cifs is killed, so that it could be retried.
+// If the attempt does not exit within mountAttemptKillGracePeriod, e.g. the mounter does not take ctx, it is abandoned with
+// errMountAttemptAbandoned: onAbandonedDone is called with its result once it completes, e.g. to undo a late mount, and
+// onAbandonedExpired is called if it's still running after maxAbandonedMountLockHold, its result is only logged afterwards.
+func mountWithTimeout(timeout time.Duration, mount func(ctx context.Context) error, onAbandonedDone func(error), onAbandonedExpired func()) error {
+	if timeout <= 0 {
+		return mount(context.Background())
+	}
+	killGracePeriod, maxLockHold := mountAttemptKillGracePeriod, maxAbandonedMountLockHold
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- mount(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	killTimer := time.NewTimer(killGracePeriod)
+	defer killTimer.Stop()
+	select {
+	case err := <-done:
+		if err == nil {
+			// mount completed right before it's canceled
+			return nil
+		}
+		klog.V(2).Infof("timed out mount attempt exited with %v", err)
+		return errMountAttemptTimeout
+	case <-killTimer.C:
+	}
+
+	go func() {
+		expireTimer := time.NewTimer(maxLockHold)
+		defer expireTimer.Stop()
+		select {
+		case err := <-done:
+			onAbandonedDone(err)
+		case <-expireTimer.C:
+			onAbandonedExpired()
+			klog.Warningf("abandoned mount attempt completed after %v with %v, it's left as is", maxLockHold, <-done)
+		}
+	}()
+	return errMountAttemptAbandoned
+}
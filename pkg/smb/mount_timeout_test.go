@@ -0,0 +1,326 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+// setMountAttemptTimers shortens kill grace period and max lock hold of abandoned mount attempts in a test
+func setMountAttemptTimers(t *testing.T, killGracePeriod, maxLockHold time.Duration) {
+	origKillGracePeriod, origMaxLockHold := mountAttemptKillGracePeriod, maxAbandonedMountLockHold
+	mountAttemptKillGracePeriod, maxAbandonedMountLockHold = killGracePeriod, maxLockHold
+	t.Cleanup(func() {
+		mountAttemptKillGracePeriod, maxAbandonedMountLockHold = origKillGracePeriod, origMaxLockHold
+	})
+}
+
+func TestMountWithTimeout(t *testing.T) {
+	setMountAttemptTimers(t, 50*time.Millisecond, time.Second)
+	forever := make(chan struct{})
+	defer close(forever)
+
+	tests := []struct {
+		desc            string
+		timeout         time.Duration
+		delay           time.Duration
+		killable        bool
+		hangForever     bool
+		mountErr        error
+		expectedErr     error
+		expectAbandoned bool
+		expectExpired   bool
+	}{
+		{
+			desc:  "no timeout",
+			delay: 10 * time.Millisecond,
+		},
+		{
+			desc:        "mount completes in time",
+			timeout:     time.Second,
+			mountErr:    fmt.Errorf("mount error(13): Permission denied"),
+			expectedErr: fmt.Errorf("mount error(13): Permission denied"),
+		},
+		{
+			desc:        "hung mount is killed",
+			timeout:     10 * time.Millisecond,
+			delay:       time.Hour,
+			killable:    true,
+			expectedErr: errMountAttemptTimeout,
+		},
+		{
+			desc:            "hung mount which could not be killed succeeds late",
+			timeout:         10 * time.Millisecond,
+			delay:           200 * time.Millisecond,
+			expectedErr:     errMountAttemptAbandoned,
+			expectAbandoned: true,
+		},
+		{
+			desc:            "hung mount which could not be killed fails late",
+			timeout:         10 * time.Millisecond,
+			delay:           200 * time.Millisecond,
+			mountErr:        fmt.Errorf("mount error(113): No route to host"),
+			expectedErr:     errMountAttemptAbandoned,
+			expectAbandoned: true,
+		},
+		{
+			desc:          "hung mount which could not be killed never returns",
+			timeout:       10 * time.Millisecond,
+			hangForever:   true,
+			expectedErr:   errMountAttemptAbandoned,
+			expectExpired: true,
+		},
+	}
+
+	for _, test := range tests {
+		abandonedResult := make(chan error, 1)
+		expired := make(chan struct{})
+		err := mountWithTimeout(test.timeout, func(ctx context.Context) error {
+			switch {
+			case test.hangForever:
+				<-forever
+			case test.killable:
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(test.delay):
+				}
+			default:
+				time.Sleep(test.delay)
+			}
+			return test.mountErr
+		}, func(err error) {
+			abandonedResult <- err
+		}, func() {
+			close(expired)
+		})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		switch {
+		case test.expectAbandoned:
+			select {
+			case err := <-abandonedResult:
+				assert.Equal(t, test.mountErr, err, test.desc)
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: result of abandoned attempt is not reported", test.desc)
+			}
+		case test.expectExpired:
+			select {
+			case <-expired:
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: abandoned attempt is not expired", test.desc)
+			}
+		default:
+			assert.Empty(t, abandonedResult, test.desc)
+		}
+	}
+}
+
+// hungMounter blocks the first mount attempt until release is closed and lets it succeed afterwards
+type hungMounter struct {
+	*mount.FakeMounter
+	attempts  int32
+	release   chan struct{}
+	unmounted chan string
+}
+
+func (m *hungMounter) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	if atomic.AddInt32(&m.attempts, 1) == 1 {
+		<-m.release
+	}
+	return m.FakeMounter.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+func (m *hungMounter) Unmount(target string) error {
+	if err := m.FakeMounter.Unmount(target); err != nil {
+		return err
+	}
+	m.unmounted <- target
+	return nil
+}
+
+func TestNodeStageVolumeMountAttemptTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	setMountAttemptTimers(t, 10*time.Millisecond, time.Hour)
+	d := NewFakeDriver()
+	d.mountAttemptTimeout = 50 * time.Millisecond
+	fakeMounter := &hungMounter{
+		FakeMounter: mount.NewFakeMounter(nil),
+		release:     make(chan struct{}),
+		unmounted:   make(chan string, 1),
+	}
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+		Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+	}
+
+	// first attempt hangs and could not be killed
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// volume is busy until the abandoned attempt completes
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, "vol_1##"), err)
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: stagingPath})
+	assert.Equal(t, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, "vol_1##"), err)
+
+	// abandoned attempt succeeds late and is unmounted before the volume is released
+	close(fakeMounter.release)
+	select {
+	case target := <-fakeMounter.unmounted:
+		assert.Equal(t, stagingPath, target)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("late mount on %s is not unmounted", stagingPath)
+	}
+	assert.Eventually(t, func() bool {
+		_, err = d.NodeStageVolume(context.Background(), req)
+		return status.Code(err) != codes.Aborted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, err)
+
+	// mount of the newer stage is kept
+	assert.Empty(t, fakeMounter.unmounted)
+	assert.Len(t, fakeMounter.MountPoints, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fakeMounter.attempts))
+}
+
+// killableMounter blocks the first mount attempt until its ctx is done and lets it succeed afterwards
+type killableMounter struct {
+	*mount.FakeMounter
+	attempts int32
+}
+
+func (m *killableMounter) MountSensitiveWithContext(ctx context.Context, source, target, fstype string, options, sensitiveOptions []string) error {
+	if atomic.AddInt32(&m.attempts, 1) == 1 {
+		<-ctx.Done()
+		return fmt.Errorf("mount failed: signal: killed")
+	}
+	return m.FakeMounter.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+func getMountAttemptTimeoutStageRequest(stagingPath string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+		Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+	}
+}
+
+func TestNodeStageVolumeMountAttemptKilled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	d := NewFakeDriver()
+	d.mountAttemptTimeout = 50 * time.Millisecond
+	fakeMounter := &killableMounter{FakeMounter: mount.NewFakeMounter(nil)}
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	req := getMountAttemptTimeoutStageRequest(filepath.Join(t.TempDir(), "globalmount"))
+
+	// hung attempt is killed and retried within the same NodeStageVolume
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fakeMounter.attempts))
+	assert.Len(t, fakeMounter.MountPoints, 1)
+
+	// volume lock is released
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: req.StagingTargetPath})
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumeAbandonedMountAttemptNeverReturns(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	setMountAttemptTimers(t, 10*time.Millisecond, 200*time.Millisecond)
+	d := NewFakeDriver()
+	d.mountAttemptTimeout = 50 * time.Millisecond
+	fakeMounter := &hungMounter{
+		FakeMounter: mount.NewFakeMounter(nil),
+		release:     make(chan struct{}),
+		unmounted:   make(chan string, 1),
+	}
+	defer close(fakeMounter.release)
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	req := getMountAttemptTimeoutStageRequest(filepath.Join(t.TempDir(), "globalmount"))
+
+	// first attempt blocks forever and could not be killed
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, "vol_1##"), err)
+
+	// volume lock is taken again by a later stage once max lock hold of the abandoned attempt expires
+	assert.Eventually(t, func() bool {
+		_, err = d.NodeStageVolume(context.Background(), req)
+		return status.Code(err) != codes.Aborted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Len(t, fakeMounter.MountPoints, 1)
+	assert.Empty(t, fakeMounter.unmounted)
+}
+
+func TestMountWithContext(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("skip test on non-Linux")
+	}
+	binDir := t.TempDir()
+	mountScript := filepath.Join(binDir, "mount")
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	m := &mount.SafeFormatAndMount{Interface: mount.New("")}
+
+	// output of mount command is kept in error
+	assert.NoError(t, os.WriteFile(mountScript, []byte("#!/bin/sh\necho 'mount error(112): Host is down'\nexit 32\n"), 0755))
+	err := MountWithContext(context.Background(), m, "//smb-server/share", "/mnt", "cifs", []string{"vers=3.0"}, []string{"password=secret"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Host is down")
+		assert.NotContains(t, err.Error(), "secret")
+	}
+
+	// hung mount command and its children are killed once ctx is done
+	assert.NoError(t, os.WriteFile(mountScript, []byte("#!/bin/sh\nsleep 3600\n"), 0755))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = MountWithContext(ctx, m, "//smb-server/share", "/mnt", "cifs", nil, nil)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// type of node condition set by nodeConditionReporter
+	smbConnectivityCondition v1.NodeConditionType = "SMBConnectivityProblem"
+
+	smbServerUnreachableReason = "SMBServerUnreachable"
+	smbServerReachableReason   = "SMBServerReachable"
+
+	// timeout of node condition update in the API server
+	nodeConditionUpdateTimeout = 10 * time.Second
+)
+
+// nodeConditionReporter sets SMBConnectivityProblem condition of the node once mounts of a server fail
+// with connectivity errors for threshold consecutive times, the condition is cleared after mounts of all such servers succeed,
+// the condition is updated by a single background worker so that mount is never blocked by the API server,
+// failed updates are logged and retried on the next mount result
+type nodeConditionReporter struct {
+	client   kubernetes.Interface
+	nodeName string
+	// consecutive connectivity failures of a server to set the condition
+	threshold   int
+	failures    map[string]int
+	unreachable map[string]bool
+	// condition in the API server is not in sync with unreachable servers, e.g. after a failed update
+	dirty bool
+	mux   sync.Mutex
+	// wakes up the worker to update the condition, buffered so that Record never blocks
+	updateCh chan struct{}
+}
+
+func newNodeConditionReporter(client kubernetes.Interface, nodeName string, threshold int) *nodeConditionReporter {
+	r := &nodeConditionReporter{
+		client:      client,
+		nodeName:    nodeName,
+		threshold:   threshold,
+		failures:    map[string]int{},
+		unreachable: map[string]bool{},
+		updateCh:    make(chan struct{}, 1),
+	}
+	go r.run()
+	return r
+}
+
+// getKubeClient returns a kubernetes client from kubeconfig, in-cluster config is used if kubeconfig is empty
+func getKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Record records the mount result of server, mount errors classified as Unavailable are connectivity failures,
+// other errors are not counted since they do not tell whether server is reachable
+func (r *nodeConditionReporter) Record(server string, err error) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	switch {
+	case err == nil:
+		delete(r.failures, server)
+		if r.unreachable[server] {
+			klog.V(2).Infof("smb server %s is reachable again", server)
+			delete(r.unreachable, server)
+			r.dirty = true
+		}
+	case status.Code(err) == codes.Unavailable:
+		r.failures[server]++
+		if r.failures[server] >= r.threshold && !r.unreachable[server] {
+			klog.Warningf("smb server %s is unreachable after %d consecutive mount failures, last error: %v", server, r.failures[server], err)
+			r.unreachable[server] = true
+			r.dirty = true
+		}
+	}
+	if !r.dirty {
+		return
+	}
+	select {
+	case r.updateCh <- struct{}{}:
+	default:
+		// an update is already pending, it would pick up the latest state
+	}
+}
+
+// run updates the condition whenever it's woken up by Record, only one update is in flight at a time
+func (r *nodeConditionReporter) run() {
+	for range r.updateCh {
+		r.update()
+	}
+}
+
+// update copies unreachable servers under the lock and sets the condition of the node without holding the lock,
+// the reporter is marked dirty again if the update fails
+func (r *nodeConditionReporter) update() {
+	r.mux.Lock()
+	if !r.dirty {
+		r.mux.Unlock()
+		return
+	}
+	servers := make([]string, 0, len(r.unreachable))
+	for server := range r.unreachable {
+		servers = append(servers, server)
+	}
+	r.dirty = false
+	r.mux.Unlock()
+
+	if err := r.updateCondition(servers); err != nil {
+		klog.Warningf("failed to update %s condition of node %s: %v", smbConnectivityCondition, r.nodeName, err)
+		r.mux.Lock()
+		r.dirty = true
+		r.mux.Unlock()
+	}
+}
+
+// updateCondition sets the condition of the node according to unreachable servers
+func (r *nodeConditionReporter) updateCondition(servers []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeConditionUpdateTimeout)
+	defer cancel()
+
+	condition := v1.NodeCondition{
+		Type:    smbConnectivityCondition,
+		Status:  v1.ConditionFalse,
+		Reason:  smbServerReachableReason,
+		Message: "smb servers are reachable",
+	}
+	if len(servers) > 0 {
+		sort.Strings(servers)
+		condition.Status = v1.ConditionTrue
+		condition.Reason = smbServerUnreachableReason
+		condition.Message = fmt.Sprintf("mounts of smb servers %s failed %d consecutive times with connectivity errors", strings.Join(servers, ","), r.threshold)
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := r.client.CoreV1().Nodes().Get(ctx, r.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		now := metav1.Now()
+		condition.LastHeartbeatTime = now
+		condition.LastTransitionTime = now
+		found := false
+		for i, c := range node.Status.Conditions {
+			if c.Type != smbConnectivityCondition {
+				continue
+			}
+			if c.Status == condition.Status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+			node.Status.Conditions[i] = condition
+			found = true
+		}
+		if !found {
+			node.Status.Conditions = append(node.Status.Conditions, condition)
+		}
+		_, err = r.client.CoreV1().Nodes().UpdateStatus(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+}
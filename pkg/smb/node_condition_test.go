@@ -0,0 +1,167 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func getSMBConnectivityCondition(t *testing.T, client *fake.Clientset) *v1.NodeCondition {
+	node, err := client.CoreV1().Nodes().Get(context.Background(), fakeNodeID, metav1.GetOptions{})
+	assert.NoError(t, err)
+	for _, c := range node.Status.Conditions {
+		if c.Type == smbConnectivityCondition {
+			return &c
+		}
+	}
+	return nil
+}
+
+// waitForSMBConnectivityCondition waits until the condition set by the background worker of reporter matches expected
+func waitForSMBConnectivityCondition(t *testing.T, client *fake.Clientset, expected func(c *v1.NodeCondition) bool) {
+	assert.Eventually(t, func() bool {
+		return expected(getSMBConnectivityCondition(t, client))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNodeConditionReporter(t *testing.T) {
+	readyCondition := v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue}
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: fakeNodeID},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{readyCondition}},
+	})
+	r := newNodeConditionReporter(client, fakeNodeID, 2)
+	unavailableErr := status.Error(codes.Unavailable, "host is down")
+
+	// condition is not set before failures reach threshold, other errors are not counted
+	r.Record("server1", unavailableErr)
+	r.Record("server1", status.Error(codes.PermissionDenied, "permission denied"))
+	assert.Nil(t, getSMBConnectivityCondition(t, client))
+
+	r.Record("server1", unavailableErr)
+	waitForSMBConnectivityCondition(t, client, func(c *v1.NodeCondition) bool {
+		return c != nil && c.Status == v1.ConditionTrue && c.Reason == smbServerUnreachableReason && strings.Contains(c.Message, "server1")
+	})
+
+	r.Record("server2", unavailableErr)
+	r.Record("server2", unavailableErr)
+	r.Record("server1", nil)
+	waitForSMBConnectivityCondition(t, client, func(c *v1.NodeCondition) bool {
+		return c != nil && c.Status == v1.ConditionTrue && strings.Contains(c.Message, "server2") && !strings.Contains(c.Message, "server1")
+	})
+
+	// condition is cleared once mounts of all servers succeed
+	r.Record("server2", nil)
+	waitForSMBConnectivityCondition(t, client, func(c *v1.NodeCondition) bool {
+		return c != nil && c.Status == v1.ConditionFalse && c.Reason == smbServerReachableReason
+	})
+
+	// other conditions of the node are kept
+	node, err := client.CoreV1().Nodes().Get(context.Background(), fakeNodeID, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, node.Status.Conditions, 2)
+	assert.Equal(t, readyCondition, node.Status.Conditions[0])
+}
+
+func TestNodeConditionReporterWithoutAPIAccess(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: fakeNodeID}})
+	var forbidden, updates int32 = 1, 0
+	client.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt32(&updates, 1)
+		if atomic.LoadInt32(&forbidden) == 1 {
+			return true, nil, apierrors.NewForbidden(v1.Resource("nodes"), fakeNodeID, fmt.Errorf("no permission"))
+		}
+		return false, nil, nil
+	})
+	r := newNodeConditionReporter(client, fakeNodeID, 1)
+	isDirty := func() bool {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		return r.dirty
+	}
+
+	// failed update does not panic or block, and is retried on the next mount result
+	r.Record("server1", status.Error(codes.Unavailable, "host is down"))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&updates) > 0 && isDirty()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, getSMBConnectivityCondition(t, client))
+
+	atomic.StoreInt32(&forbidden, 0)
+	r.Record("server2", status.Error(codes.Internal, "mount error"))
+	waitForSMBConnectivityCondition(t, client, func(c *v1.NodeCondition) bool {
+		return c != nil && c.Status == v1.ConditionTrue
+	})
+	assert.Eventually(t, func() bool {
+		return !isDirty()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// disabled reporter is a no-op
+	var disabled *nodeConditionReporter
+	disabled.Record("server1", status.Error(codes.Unavailable, "host is down"))
+}
+
+func TestNodeConditionReporterNotBlockedByAPIServer(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: fakeNodeID}})
+	release := make(chan struct{})
+	var updates int32
+	client.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt32(&updates, 1)
+		<-release
+		return false, nil, nil
+	})
+	r := newNodeConditionReporter(client, fakeNodeID, 1)
+
+	// mount results are recorded while an update is hung in the API server
+	done := make(chan struct{})
+	go func() {
+		r.Record("server1", status.Error(codes.Unavailable, "host is down"))
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&updates) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		r.Record("server2", status.Error(codes.Unavailable, "host is down"))
+		r.Record("server1", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Record is blocked by node condition update")
+	}
+
+	// latest state is applied by the pending update once the hung update returns
+	close(release)
+	waitForSMBConnectivityCondition(t, client, func(c *v1.NodeCondition) bool {
+		return c != nil && c.Status == v1.ConditionTrue && strings.Contains(c.Message, "server2") && !strings.Contains(c.Message, "server1")
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&updates))
+}
@@ -18,19 +18,27 @@ package smb
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume"
+	mount "k8s.io/mount-utils"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -47,6 +55,9 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if err := d.checkDraining("NodePublishVolume", volumeID); err != nil {
+		return nil, err
+	}
 
 	target := req.GetTargetPath()
 	if len(target) == 0 {
@@ -57,17 +68,58 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	if len(source) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
 	}
+	for _, path := range []string{target, source} {
+		if err := d.checkUnderKubeletRootDir(path); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if d.checkStagedOnPublish {
+		// kubelet could call NodePublishVolume before NodeStageVolume completes
+		if err := d.checkStageComplete(source); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume(%s) staging not complete: %s", volumeID, status.Convert(err).Message())
+		}
+	}
+
+	var publishMountOptions []string
+	bindMode := d.bindMode
+	for k, v := range req.GetVolumeContext() {
+		switch strings.ToLower(k) {
+		case publishMountOptionsField:
+			publishMountOptions = splitMountOptions([]string{v})
+		case bindModeField:
+			if v != "" {
+				bindMode = strings.ToLower(v)
+			}
+		}
+	}
+	if err := validateBindMode(bindMode); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if runtime.GOOS != "windows" && requiresDedicatedMount(publishMountOptions) {
+		return d.publishDedicatedMount(volumeID, source, target, req.GetReadonly(), publishMountOptions, applySecretKeyAliases(req.GetSecrets(), d.secretKeyAliases))
+	}
 
-	mountOptions := []string{"bind"}
+	mountOptions := []string{bindMode}
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
 	}
+	mountOptions = append(mountOptions, publishMountOptions...)
+
+	if err := d.handleCorruptedMount(source, target, IsCorruptedDir); err != nil {
+		return nil, err
+	}
 
 	mnt, err := d.ensureMountPoint(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not mount target %q: %v", target, err)
 	}
 	if mnt {
+		if runtime.GOOS != "windows" {
+			if err := d.checkPublishedSource(volumeID, source, target); err != nil {
+				return nil, err
+			}
+		}
 		klog.V(2).Infof("NodePublishVolume: %s is already mounted", target)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
@@ -87,6 +139,100 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// publishDedicatedMount mounts the smb share of staging path on target directly instead of bind mount,
+// so that mount options which could not be applied on a bind mount take effect, e.g. cache=none.
+// Stage parameters are read from stage cache while credentials are read from node publish secrets.
+func (d *Driver) publishDedicatedMount(volumeID, stagingPath, target string, readOnly bool, publishMountOptions []string, secrets map[string]string) (*csi.NodePublishVolumeResponse, error) {
+	entry, ok := d.stageCache.get(stagingPath)
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "stage state of volume(%s) on %s not found, could not publish with mount options %v", volumeID, stagingPath, publishMountOptions)
+	}
+	if len(entry.unionSources) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume(%s) is a union of shares %v, could not publish with mount options %v", volumeID, entry.unionSources, publishMountOptions)
+	}
+
+	mountOptions := entry.mountOptions
+	for _, option := range publishMountOptions {
+		mountOptions = setMountOption(mountOptions, option)
+	}
+	if readOnly {
+		mountOptions = setMountOption(mountOptions, "ro")
+	}
+
+	var sensitiveMountOptions []string
+	if !hasKerberosMountOption(mountOptions) && !hasGuestMountOptions(mountOptions) {
+		creds := &Credentials{}
+		for k, v := range secrets {
+			switch strings.ToLower(k) {
+			case usernameField:
+				creds.Username = v
+			case passwordField:
+				creds.Password = v
+			case domainField:
+				if d.publishSecretsPolicy == publishSecretsPolicyMerge {
+					creds.Domain = v
+				}
+			}
+		}
+		if err := creds.sanitize(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): invalid node publish secrets: %v", volumeID, err)
+		}
+		if d.publishSecretsPolicy == publishSecretsPolicyMerge {
+			// publish secrets override credentials of stage
+			creds = creds.mergeCredentials(entry.credentials)
+		}
+		if creds.Username == "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "%s is required in node publish secrets to publish volume(%s) with mount options %v", usernameField, volumeID, publishMountOptions)
+		}
+		usernameOption, err := formatMountOption(usernameField, creds.Username)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+		mountOptions = setMountOption(mountOptions, usernameOption)
+		if creds.Domain != "" {
+			domainOption, err := formatMountOption(domainField, creds.Domain)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+			}
+			mountOptions = setMountOption(mountOptions, domainOption)
+		}
+		passwordOption, err := formatMountOption(passwordField, creds.Password)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+		sensitiveMountOptions = []string{passwordOption}
+	}
+
+	mnt, err := d.ensureMountPoint(target)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not mount target %q: %v", target, err)
+	}
+	if mnt {
+		klog.V(2).Infof("NodePublishVolume: %s is already mounted", target)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	klog.V(2).Infof("NodePublishVolume: mounting %s at %s with dedicated mount, mountOptions: %v volumeID(%s)", entry.source, target, mountOptions, volumeID)
+	if err := Mount(d.mounter, entry.source, target, "cifs", mountOptions, sensitiveMountOptions); err != nil {
+		if removeErr := os.Remove(target); removeErr != nil {
+			return nil, status.Errorf(codes.Internal, "Could not remove mount target %q: %v", target, removeErr)
+		}
+		return nil, newMountError(classifyMountError(err, d.mountErrorRules), d.Name, entry.source, mountOptions, fmt.Sprintf("Could not mount %q at %q: %v", entry.source, target, err))
+	}
+	klog.V(2).Infof("NodePublishVolume: mount %s at %s volumeID(%s) successfully", entry.source, target, volumeID)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// requiresDedicatedMount checks whether any of options could not be applied on a bind mount
+func requiresDedicatedMount(options []string) bool {
+	for _, option := range options {
+		if !bindMountOptions[getMountOptionKey(option)] {
+			return true
+		}
+	}
+	return false
+}
+
 // NodeUnpublishVolume unmount the volume from the target path
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
@@ -97,18 +243,94 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if err := d.checkUnderKubeletRootDir(targetPath); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// on Windows, target path is a symlink to staging path created by csi proxy
+	symlinkPath := ""
+	if runtime.GOOS != "windows" {
+		resolvedPath, err := resolveSymlinkTargetPath(targetPath, d.rejectSymlinkTargetPath)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if resolvedPath != targetPath {
+			klog.V(2).Infof("NodeUnpublishVolume: target path %s is a symlink to %s", targetPath, resolvedPath)
+			symlinkPath, targetPath = targetPath, resolvedPath
+		}
+	}
 
 	klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
-	err := CleanupMountPoint(d.mounter, targetPath, true /*extensiveMountPointCheck*/)
+	err := cleanupMountPointWithContext(ctx, targetPath, func() error {
+		if runtime.GOOS != "windows" {
+			// target path published with rbind could not be unmounted while nested mounts exist under it
+			if err := unmountNestedMounts(d.mounter, targetPath); err != nil {
+				return err
+			}
+		}
+		return CleanupMountPoint(d.mounter, targetPath, true /*extensiveMountPointCheck*/)
+	}, lazyUnmount, nil)
 	if err != nil {
+		if isContextError(err) {
+			return nil, err
+		}
 		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
 	}
+	if symlinkPath != "" {
+		if err := os.Remove(symlinkPath); err != nil && !os.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "failed to remove symlink %q: %v", symlinkPath, err)
+		}
+	}
 	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-// NodeStageVolume mount the volume to a staging path
+// unmountNestedMounts unmounts mount points nested under target deepest first, target itself is not unmounted
+func unmountNestedMounts(mounter mount.Interface, target string) error {
+	mountPoints, err := mounter.List()
+	if err != nil {
+		return fmt.Errorf("failed to list mount points: %v", err)
+	}
+	prefix := filepath.Clean(target) + string(filepath.Separator)
+	var nestedMounts []string
+	for _, mp := range mountPoints {
+		if strings.HasPrefix(mp.Path, prefix) {
+			nestedMounts = append(nestedMounts, mp.Path)
+		}
+	}
+	// a nested mount point is always longer than the mount point it's nested under
+	sort.SliceStable(nestedMounts, func(i, j int) bool {
+		return len(nestedMounts[i]) > len(nestedMounts[j])
+	})
+	for _, path := range nestedMounts {
+		klog.V(2).Infof("unmounting nested mount point %s under %s", path, target)
+		if err := mounter.Unmount(path); err != nil {
+			return fmt.Errorf("failed to unmount nested mount point %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// NodeStageVolume mount the volume to a staging path, a volume failing repeatedly is quarantined
 func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if err := d.checkDraining("NodeStageVolume", volumeID); err != nil {
+		return nil, err
+	}
+	if err := d.stageQuarantine.Check(volumeID); err != nil {
+		return nil, err
+	}
+	resp, err := d.nodeStageVolume(ctx, req)
+	if volumeID != "" {
+		d.stageQuarantine.Record(volumeID, err)
+	}
+	if err != nil {
+		d.recordStageFailure(req, err)
+	}
+	return resp, err
+}
+
+func (d *Driver) nodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -123,21 +345,58 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
 	}
+	if err := d.checkUnderKubeletRootDir(targetPath); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	context := req.GetVolumeContext()
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 	volumeMountGroup := req.GetVolumeCapability().GetMount().GetVolumeMountGroup()
-	secrets := req.GetSecrets()
+	secrets := applySecretKeyAliases(req.GetSecrets(), d.secretKeyAliases)
 	gidPresent := checkGidPresentInMountFlags(mountFlags)
 
-	var source, subDir string
+	var source, sources, subDir, prefixPath, contextDomain, domainSelector, credentialProviderName, profile, expectedSPN, realm, mountNamespace, retryableErrors string
+	var domains []string
+	var autoServerino, disableGidMount, allowAdminShare bool
 	subDirReplaceMap := map[string]string{}
 	for k, v := range context {
 		switch strings.ToLower(k) {
 		case sourceField:
 			source = v
+		case sourcesField:
+			sources = v
 		case subDirField:
 			subDir = v
+		case prefixPathField:
+			prefixPath = v
+		case domainsField:
+			for _, domain := range strings.Split(v, ",") {
+				if domain = strings.TrimSpace(domain); domain != "" {
+					domains = append(domains, domain)
+				}
+			}
+		case domainField:
+			contextDomain = strings.TrimSpace(v)
+		case domainSelectorField:
+			domainSelector = strings.ToLower(v)
+		case credentialProviderField:
+			credentialProviderName = v
+		case autoServerinoField:
+			autoServerino = strings.EqualFold(v, "true")
+		case disableGidMountField:
+			disableGidMount = strings.EqualFold(v, "true")
+		case allowAdminShareField:
+			allowAdminShare = strings.EqualFold(v, "true")
+		case profileField:
+			profile = v
+		case expectedSPNField:
+			expectedSPN = strings.TrimSpace(v)
+		case realmField:
+			realm = strings.TrimSpace(v)
+		case mountNamespaceField:
+			mountNamespace = strings.TrimSpace(v)
+		case retryableErrorsField:
+			retryableErrors = v
 		case pvcNamespaceKey:
 			subDirReplaceMap[pvcNamespaceMetadata] = v
 		case pvcNameKey:
@@ -147,24 +406,113 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		}
 	}
 
+	if d.normalizeSourceSlashes && runtime.GOOS == "linux" {
+		source, sources = normalizeSourceSlashes(source), normalizeSourceSlashes(sources)
+	}
+
+	var unionSources []string
+	if sources != "" {
+		if runtime.GOOS != "linux" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is only supported on Linux node", sourcesField)
+		}
+		var err error
+		if unionSources, err = parseUnionSources(sources); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+		if subDir != "" || prefixPath != "" || mountNamespace != "" || autoServerino {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %s could not be used with %s, %s, %s or %s", volumeID, sourcesField, subDirField, prefixPathField, mountNamespaceField, autoServerinoField)
+		}
+		if source == "" {
+			// server of the first share is used in checks of source, e.g. pre-auth probe
+			source = unionSources[0]
+		}
+	}
+	if mountNamespace != "" && !isMountNamespaceAllowed(mountNamespace, d.allowedMountNamespaces) {
+		return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %s %s is not allowed on this node", volumeID, mountNamespaceField, mountNamespace)
+	}
+	if mountNamespace != "" {
+		if err := d.namespaceMounter.Supported(); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume(%s): could not mount in %s %s: %v", volumeID, mountNamespaceField, mountNamespace, err)
+		}
+	}
 	if source == "" {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s field is missing, current context: %v", sourceField, context))
 	}
+	if err := validatePrefixPath(prefixPath); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+	}
+	if d.blockAdminShares && !allowAdminShare {
+		for _, s := range append([]string{source}, unionSources...) {
+			if share := getShareFromSource(s); isAdminShare(share) {
+				return nil, status.Errorf(codes.InvalidArgument, "volume(%s): administrative share %s of %s is blocked, set %s to true in volume context to allow it", volumeID, share, s, allowAdminShareField)
+			}
+		}
+	}
+	// rules of this volume are consulted before rules of the driver
+	volumeErrorRules, err := parseRetryableErrors(retryableErrors)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+	}
+	mountErrorRules := append(volumeErrorRules, d.mountErrorRules...)
+	if domainSelector != "" && domainSelector != domainSelectorHostname {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s value: %s, supported values: %s", domainSelectorField, domainSelector, domainSelectorHostname)
+	}
+	if expectedSPN != "" {
+		if runtime.GOOS != "windows" && !hasKerberosMountOption(mountFlags) {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is only supported in kerberos mount", expectedSPNField)
+		}
+		if err := validateExpectedSPN(expectedSPN, getServerFromSource(source)); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if realm != "" && runtime.GOOS != "windows" && !hasKerberosMountOption(mountFlags) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is only supported in kerberos mount", realmField)
+	}
 
 	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
 		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
 	}
-	defer d.volumeLocks.Release(volumeID)
+	// the lock is handed over to an abandoned mount attempt which is still running on the staging path
+	lockHandedOver := false
+	defer func() {
+		if !lockHandedOver {
+			d.volumeLocks.Release(volumeID)
+		}
+	}()
 
-	var username, password, domain string
-	for k, v := range secrets {
-		switch strings.ToLower(k) {
-		case usernameField:
-			username = strings.TrimSpace(v)
-		case passwordField:
-			password = strings.TrimSpace(v)
-		case domainField:
-			domain = strings.TrimSpace(v)
+	provider, err := d.credentialProviders.get(credentialProviderName)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+	}
+	if credentialProviderName == "" || strings.EqualFold(credentialProviderName, secretCredentialProviderName) {
+		if err := checkUnknownSecretKeys(volumeID, secrets, d.unknownSecretKeysPolicy); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+	}
+	creds, err := provider.GetCredentials(ctx, volumeID, context, secrets)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "volume(%s): failed to get credentials from provider %s: %v", volumeID, credentialProviderName, err)
+	}
+	if err := creds.sanitize(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume(%s): invalid credentials: %v", volumeID, err)
+	}
+	username, password := creds.Username, creds.Password
+	domain, err := resolveCredentialField(volumeID, domainField, contextDomain, creds.Domain, d.credentialConflictPolicy)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+	}
+	if domainSelector == domainSelectorHostname {
+		if selected := selectDomainByHostname(getServerFromSource(source), domains); selected != "" {
+			klog.V(2).Infof("NodeStageVolume: select domain %s for volume(%s) by server host name", selected, volumeID)
+			domain = selected
+		}
+	}
+	if domain == "" && runtime.GOOS != "windows" {
+		if domain, err = getKerberosDomain(domain, realm, expectedSPN, mountFlags); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+		if domain != "" {
+			klog.V(2).Infof("NodeStageVolume: use kerberos realm %s as domain of volume(%s)", domain, volumeID)
 		}
 	}
 
@@ -172,40 +520,112 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	requireUsernamePwdOption := !hasGuestMountOptions(mountFlags)
 
 	var mountOptions, sensitiveMountOptions []string
+	// credentials kept in stage cache for dedicated mount in NodePublishVolume
+	var stagedCredentials *Credentials
 	if runtime.GOOS == "windows" {
-		if domain == "" {
-			domain = defaultDomainName
-		}
 		if requireUsernamePwdOption {
-			if !strings.Contains(username, "\\") {
-				username = fmt.Sprintf("%s\\%s", domain, username)
-			}
-			mountOptions = []string{username}
+			mountOptions = []string{getWindowsMountUsername(username, domain, d.defaultDomain, d.windowsUsernameFormat)}
 			sensitiveMountOptions = []string{password}
 		}
 	} else {
-		var useKerberosCache, err = ensureKerberosCache(volumeID, mountFlags, secrets)
+		if d.krb5CacheDeletes.Cancel(volumeID) {
+			klog.V(2).Infof("NodeStageVolume: cancelled pending kerberos cache deletion of volume(%s)", volumeID)
+		}
+		if hasKerberosMountOption(mountFlags) && d.isWaitingForKrb5Dir() {
+			return nil, status.Errorf(codes.Unavailable, "volume(%s): waiting for kerberos cache directory %s", volumeID, krb5CacheDirectory)
+		}
+		var err error
+		if mountFlags, err = ensureCredUID(mountFlags, d.defaultCredUID); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+		useKerberosCache, err := ensureKerberosCache(volumeID, mountFlags, secrets, d.maxKrb5CacheSize)
 		if err != nil {
+			if status.Code(err) == codes.InvalidArgument {
+				return nil, err
+			}
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Error writing kerberos cache: %v", err))
 		}
-		if err := os.MkdirAll(targetPath, 0750); err != nil {
+		if err := ensureDir(targetPath, 0750); err != nil {
+			if errors.Is(err, syscall.EROFS) {
+				return nil, status.Errorf(codes.FailedPrecondition, "failed to create staging path %s since node filesystem is read-only, check whether kubelet directory is mounted read-write: %v", targetPath, err)
+			}
 			return nil, status.Error(codes.Internal, fmt.Sprintf("MkdirAll %s failed with error: %v", targetPath, err))
 		}
 		if requireUsernamePwdOption && !useKerberosCache {
-			sensitiveMountOptions = []string{fmt.Sprintf("%s=%s,%s=%s", usernameField, username, passwordField, password)}
+			usernameOption, err := formatMountOption(usernameField, username)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+			}
+			passwordOption, err := formatMountOption(passwordField, password)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+			}
+			sensitiveMountOptions = []string{fmt.Sprintf("%s,%s", usernameOption, passwordOption)}
+			if d.publishSecretsPolicy == publishSecretsPolicyMerge {
+				stagedCredentials = &Credentials{Username: username, Password: password, Domain: domain}
+			}
 		}
 		mountOptions = mountFlags
-		if !gidPresent && volumeMountGroup != "" {
-			mountOptions = append(mountOptions, fmt.Sprintf("gid=%s", volumeMountGroup))
+		if disableGidMount && volumeMountGroup != "" {
+			klog.V(2).Infof("NodeStageVolume: gid mount option is not derived from volume mount group %s of volume(%s) since %s is set", volumeMountGroup, volumeID, disableGidMountField)
+		}
+		if !gidPresent && !disableGidMount && volumeMountGroup != "" {
+			gid, err := getVolumeMountGroupID(volumeMountGroup, d.resolveMountGroupName)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+			}
+			mountOptions = append(mountOptions, fmt.Sprintf("gid=%s", gid))
 		}
 		if domain != "" {
-			mountOptions = append(mountOptions, fmt.Sprintf("%s=%s", domainField, domain))
+			domainOption, err := formatMountOption(domainField, domain)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+			}
+			mountOptions = append(mountOptions, domainOption)
+		}
+		if profile != "" {
+			if mountOptions, err = applyMountProfile(d.mountProfiles, profile, mountOptions); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+			}
+		}
+		// pin vers before cifs parameters which check vers
+		var pinned bool
+		if mountOptions, pinned = pinDefaultSMBVersion(mountOptions, d.pinDefaultVers); pinned {
+			klog.V(2).Infof("NodeStageVolume: pin SMB version of volume(%s) to %s=%s", volumeID, versMountOption, d.pinDefaultVers)
+		}
+		if mountOptions, err = getCifsMountOptions(context, mountOptions); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
 		}
+		if mountOptions, _, err = getSocketMountOptions(context, mountOptions); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+		if mountOptions, _, err = getWriteHintMountOptions(context, mountOptions); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+		if mountOptions, err = applyMinSMBVersion(mountOptions, d.minSMBVersion); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume(%s): %v", volumeID, err)
+		}
+		if mountOptions, err = applyEncryptionPolicy(mountOptions, d.requireEncryption, d.enforceEncryptionAuto); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume(%s): %v", volumeID, err)
+		}
+		checkDeprecatedMountOptions(volumeID, mountOptions)
 	}
 
 	klog.V(2).Infof("NodeStageVolume: targetPath(%v) volumeID(%v) context(%v) mountflags(%v) mountOptions(%v)",
 		targetPath, volumeID, context, mountFlags, mountOptions)
 
+	if d.reuseLiveStageMount && runtime.GOOS == "linux" {
+		// a live mount survives driver restart while stage cache does not
+		if mp, live := d.getLiveStageMount(targetPath); live {
+			klog.V(2).Infof("NodeStageVolume: reuse live mount %s on %s for volume(%s)", mp.Device, targetPath, volumeID)
+			if entry, ok := d.stageCache.get(targetPath); !ok || entry.volumeID == "" {
+				// age of a reconstructed entry is kept since the mount is not recreated
+				d.stageCache.set(targetPath, stageEntry{volumeID: volumeID, source: mp.Device, mountOptions: mp.Opts, createdAt: entry.createdAt})
+			}
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+	}
+
 	isDirMounted, err := d.ensureMountPoint(targetPath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not mount target %s: %v", targetPath, err)
@@ -213,29 +633,113 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	if isDirMounted {
 		klog.V(2).Infof("NodeStageVolume: already mounted volume %s on target %s", volumeID, targetPath)
 	} else {
+		if runtime.GOOS == "linux" {
+			if err = d.mountHelperChecker.Check(); err != nil {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume(%s): %v", volumeID, err)
+			}
+		}
+		if d.recreateStagingDir && runtime.GOOS != "windows" {
+			if err = d.recreateDir(targetPath, 0750); err != nil {
+				return nil, status.Errorf(codes.FailedPrecondition, "failed to recreate staging path %s: %v", targetPath, err)
+			}
+		}
+		if runtime.GOOS != "windows" {
+			removeStageFailure(targetPath)
+		}
 		if err = prepareStagePath(targetPath, d.mounter); err != nil {
 			return nil, fmt.Errorf("prepare stage path failed for %s with error: %v", targetPath, err)
 		}
 		if subDir != "" {
 			// replace pv/pvc name namespace metadata in subDir
 			subDir = replaceWithMap(subDir, subDirReplaceMap)
-
-			source = strings.TrimRight(source, "/")
-			source = fmt.Sprintf("%s/%s", source, subDir)
+			if tokens := getUnresolvedTokens(subDir); len(tokens) > 0 {
+				if d.strictSubDirTokens {
+					return nil, status.Errorf(codes.InvalidArgument, "volume(%s): unresolved tokens %v in %s: %s", volumeID, tokens, subDirField, subDir)
+				}
+				klog.Warningf("volume(%s): unresolved tokens %v in %s: %s", volumeID, tokens, subDirField, subDir)
+			}
+			if depth := getSubDirDepth(subDir); d.maxSubDirDepth > 0 && depth > d.maxSubDirDepth {
+				return nil, status.Errorf(codes.InvalidArgument, "volume(%s): depth %d of %s %s exceeds max subdir depth %d", volumeID, depth, subDirField, subDir, d.maxSubDirDepth)
+			}
+		}
+		source = getMountSource(getMountSource(source, prefixPath), subDir)
+		if autoServerino && runtime.GOOS != "windows" {
+			mountOptions = d.appendServerinoOption(source, mountOptions, sensitiveMountOptions)
+		}
+		if runtime.GOOS == "linux" && requireUsernamePwdOption && !hasKerberosMountOption(mountFlags) {
+			if err := d.probeAuth(ctx, volumeID, source, &Credentials{Username: username, Password: password, Domain: domain}); err != nil {
+				return nil, err
+			}
+		}
+		if delay := d.mountRetryJitter.Wait(volumeID); delay > 0 {
+			klog.V(2).Infof("volume(%s): last mount failed, retry after %v", volumeID, delay)
 		}
 		mountComplete := false
-		err = wait.PollImmediate(1*time.Second, 2*time.Minute, func() (bool, error) {
-			err := Mount(d.mounter, source, targetPath, "cifs", mountOptions, sensitiveMountOptions)
+		attemptTimedOut := false
+		err = wait.PollImmediate(mountPollInterval, 2*time.Minute, func() (bool, error) {
+			var err error
+			if len(unionSources) > 0 {
+				err = d.mountUnion(volumeID, unionSources, targetPath, mountOptions, sensitiveMountOptions)
+			} else if mountNamespace != "" {
+				err = d.mountInNamespace(mountNamespace, source, targetPath, mountOptions, sensitiveMountOptions)
+			} else {
+				err = mountWithTimeout(d.mountAttemptTimeout, cifsMountAttempt(d.mounter, source, targetPath, mountOptions, sensitiveMountOptions), func(err error) {
+					// volume lock is held until the abandoned attempt completes, so the staging path is not
+					// mounted by another NodeStageVolume or unmounted by NodeUnstageVolume meanwhile
+					defer d.volumeLocks.Release(volumeID)
+					if err != nil {
+						klog.V(2).Infof("volume(%s): abandoned mount attempt of %q on %q failed: %v", volumeID, source, targetPath, err)
+						return
+					}
+					klog.Warningf("volume(%s): abandoned mount attempt of %q on %q succeeded late, unmount it", volumeID, source, targetPath)
+					if err := d.mounter.Unmount(targetPath); err != nil {
+						klog.Errorf("volume(%s): failed to unmount late mount on %q: %v", volumeID, targetPath, err)
+					}
+				}, func() {
+					klog.Errorf("volume(%s): abandoned mount attempt of %q on %q is still running after %v, release the volume", volumeID, source, targetPath, maxAbandonedMountLockHold)
+					d.volumeLocks.Release(volumeID)
+				})
+				switch {
+				case errors.Is(err, errMountAttemptTimeout):
+					klog.Warningf("volume(%s): mount attempt of %q on %q did not complete in %v and is killed, retry", volumeID, source, targetPath, d.mountAttemptTimeout)
+					attemptTimedOut = true
+					return false, nil
+				case errors.Is(err, errMountAttemptAbandoned):
+					lockHandedOver = true
+				}
+			}
 			mountComplete = true
 			return true, err
 		})
+		if errors.Is(err, errMountAttemptAbandoned) {
+			return nil, status.Errorf(codes.DeadlineExceeded, "volume(%s) mount %q on %q did not complete in %v and could not be killed, the volume is busy until the abandoned mount attempt completes or at most %v", volumeID, source, targetPath, d.mountAttemptTimeout, maxAbandonedMountLockHold)
+		}
+		if !mountComplete && attemptTimedOut {
+			return nil, status.Errorf(codes.DeadlineExceeded, "volume(%s) mount %q on %q did not complete in %v in any attempt within timeout(2m)", volumeID, source, targetPath, d.mountAttemptTimeout)
+		}
+		d.mountRetryJitter.Record(volumeID, err)
 		if !mountComplete {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("volume(%s) mount %q on %q failed with timeout(10m)", volumeID, source, targetPath))
 		}
 		if err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("volume(%s) mount %q on %q failed with %v", volumeID, source, targetPath, err))
+			err = newMountError(classifyMountError(err, mountErrorRules), d.Name, source, mountOptions, fmt.Sprintf("volume(%s) mount %q on %q failed with %v", volumeID, source, targetPath, err))
+		}
+		d.nodeConditionReporter.Record(getServerFromSource(source), err)
+		if err != nil {
+			return nil, err
 		}
 		klog.V(2).Infof("volume(%s) mount %q on %q succeeded", volumeID, source, targetPath)
+		if runtime.GOOS != "windows" {
+			d.checkNegotiatedDialect(volumeID, targetPath)
+		}
+		d.stageCache.set(targetPath, stageEntry{
+			volumeID:       volumeID,
+			source:         source,
+			mountOptions:   mountOptions,
+			credentials:    stagedCredentials,
+			unionSources:   unionSources,
+			mountNamespace: mountNamespace,
+		})
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
@@ -243,6 +747,11 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 
 // NodeUnstageVolume unmount the volume from the staging path
 func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	return d.nodeUnstageVolume(ctx, req, d.rejectReferencedUnstage)
+}
+
+// nodeUnstageVolume unstages the volume, staging path which is still bind mounted in pods is not unmounted if rejectReferenced is true
+func (d *Driver) nodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest, rejectReferenced bool) (*csi.NodeUnstageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -251,25 +760,95 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	if len(stagingTargetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
 	}
+	if err := d.checkUnderKubeletRootDir(stagingTargetPath); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
 		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
 	}
-	defer d.volumeLocks.Release(volumeID)
+	// the lock is handed over to the cleanup which continues in background after ctx is done
+	lockHandedOver := false
+	defer func() {
+		if !lockHandedOver {
+			d.volumeLocks.Release(volumeID)
+		}
+	}()
 
+	if rejectReferenced && runtime.GOOS != "windows" {
+		refs, err := d.getPodMountRefs(stagingTargetPath)
+		if err != nil {
+			klog.Warningf("NodeUnstageVolume: failed to get mount references of staging target %s, unmount it anyway: %v", stagingTargetPath, err)
+		} else if len(refs) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "staging target %q of volume(%s) is still bind mounted on %v, unpublish them first", stagingTargetPath, volumeID, refs)
+		}
+	}
+
+	if entry, ok := d.stageCache.get(stagingTargetPath); ok && entry.mountNamespace != "" {
+		if err := d.unmountInNamespace(entry.mountNamespace, stagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q in mount namespace %s: %v", stagingTargetPath, entry.mountNamespace, err)
+		}
+	}
+
+	d.cleanupStageFailure(stagingTargetPath)
 	klog.V(2).Infof("NodeUnstageVolume: CleanupMountPoint on %s with volume %s", stagingTargetPath, volumeID)
-	if err := CleanupSMBMountPoint(d.mounter, stagingTargetPath, true /*extensiveMountPointCheck*/); err != nil {
+	err := cleanupMountPointWithContext(ctx, stagingTargetPath, func() error {
+		return retryOnBusy(ctx, stagingTargetPath, d.unstageBusyRetryTimeout, func() error {
+			return CleanupSMBMountPoint(d.mounter, stagingTargetPath, true /*extensiveMountPointCheck*/)
+		})
+	}, lazyUnmount, func(err error) {
+		// volume is busy until the background cleanup completes, so that the staging path is not mounted again meanwhile
+		defer d.volumeLocks.Release(volumeID)
+		if err != nil {
+			return
+		}
+		if err := d.completeUnstage(volumeID, stagingTargetPath); err != nil {
+			klog.Errorf("NodeUnstageVolume: failed to complete unstage of volume(%s) on %s in background: %v", volumeID, stagingTargetPath, err)
+		}
+	})
+	if err != nil {
+		if isContextError(err) {
+			lockHandedOver = true
+			return nil, err
+		}
 		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", stagingTargetPath, err)
 	}
-
-	if err := deleteKerberosCache(volumeID); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to delete kerberos cache: %v", err)
+	if err := d.completeUnstage(volumeID, stagingTargetPath); err != nil {
+		return nil, err
 	}
 
 	klog.V(2).Infof("NodeUnstageVolume: unmount volume %s on %s successfully", volumeID, stagingTargetPath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// completeUnstage cleans up state of the volume after staging path is unmounted, volume lock must be held by caller
+func (d *Driver) completeUnstage(volumeID, stagingTargetPath string) error {
+	if runtime.GOOS == "linux" {
+		if err := d.cleanupUnion(stagingTargetPath); err != nil {
+			return status.Errorf(codes.Internal, "failed to unmount shares of union on staging target %q: %v", stagingTargetPath, err)
+		}
+	}
+
+	d.stageCache.delete(stagingTargetPath)
+	d.stageQuarantine.Release(volumeID)
+	d.postUnmountHook.Run(volumeID, stagingTargetPath)
+
+	if d.krb5CacheGracePeriod > 0 {
+		klog.V(2).Infof("NodeUnstageVolume: delete kerberos cache of volume(%s) after %v", volumeID, d.krb5CacheGracePeriod)
+		d.krb5CacheDeletes.Schedule(volumeID, func() error {
+			// skip if volume is being staged or unstaged again, a new deletion would be scheduled on unstage
+			if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+				return nil
+			}
+			defer d.volumeLocks.Release(volumeID)
+			return deleteKerberosCache(volumeID)
+		})
+	} else if err := deleteKerberosCache(volumeID); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete kerberos cache: %v", err)
+	}
+	return nil
+}
+
 // NodeGetCapabilities return the capabilities of the Node plugin
 func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
@@ -279,9 +858,15 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 
 // NodeGetInfo return info of the node on which this plugin is running
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{
+	resp := &csi.NodeGetInfoResponse{
 		NodeId: d.NodeID,
-	}, nil
+	}
+	if d.enableHostnameTopology {
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: map[string]string{topologyKeyHostname: d.nodeHostname},
+		}
+	}
+	return resp, nil
 }
 
 // NodeGetVolumeStats get volume stats
@@ -300,38 +885,118 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.VolumePath, err)
 	}
 
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" && isStagingPath(req.VolumePath, d.kubeletRootDir, d.Name) {
+		stagingPath = req.VolumePath
+	}
+	if stagingPath != "" {
+		if err := d.checkStageComplete(stagingPath); err != nil {
+			return nil, err
+		}
+		if age, ok := d.stageCache.age(stagingPath); ok {
+			klog.V(4).Infof("NodeGetVolumeStats: volume(%s) is staged on %s for %v", req.VolumeId, stagingPath, age)
+		}
+	}
+
 	volumeMetrics, err := volume.NewMetricsStatFS(req.VolumePath).GetMetrics()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to get metrics: %v", err)
 	}
+	return d.getVolumeStats(req.VolumePath, volumeMetrics)
+}
 
-	available, ok := volumeMetrics.Available.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume available size(%v)", volumeMetrics.Available)
+// validateWindowsUsernameFormat returns error if format is not a supported windows username format
+func validateWindowsUsernameFormat(format string) error {
+	switch format {
+	case windowsUsernameFormatDownLevel, windowsUsernameFormatUPN:
+		return nil
 	}
-	capacity, ok := volumeMetrics.Capacity.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume capacity size(%v)", volumeMetrics.Capacity)
+	return fmt.Errorf("invalid windows username format: %s, supported values: %s, %s", format, windowsUsernameFormatDownLevel, windowsUsernameFormatUPN)
+}
+
+// getWindowsMountUsername returns username in the form of domain\username, or username@domain in upn format,
+// defaultDomain is used if domain is not specified, username which already contains a domain is returned as is
+func getWindowsMountUsername(username, domain, defaultDomain, format string) string {
+	if strings.ContainsAny(username, "\\@") {
+		return username
 	}
-	used, ok := volumeMetrics.Used.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume used size(%v)", volumeMetrics.Used)
+	if domain == "" {
+		domain = defaultDomain
+	}
+	if format == windowsUsernameFormatUPN {
+		return fmt.Sprintf("%s@%s", username, domain)
 	}
+	return fmt.Sprintf("%s\\%s", domain, username)
+}
 
-	inodesFree, ok := volumeMetrics.InodesFree.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes free(%v)", volumeMetrics.InodesFree)
+// checkStageComplete returns FailedPrecondition error if mount on stagingPath is not complete yet,
+// e.g. NodeGetVolumeStats races with NodeStageVolume, mount table is consulted if stage cache has no entry
+func (d *Driver) checkStageComplete(stagingPath string) error {
+	if runtime.GOOS == "windows" {
+		return nil
 	}
-	inodes, ok := volumeMetrics.Inodes.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes(%v)", volumeMetrics.Inodes)
+	if _, ok := d.stageCache.get(stagingPath); ok {
+		return nil
 	}
-	inodesUsed, ok := volumeMetrics.InodesUsed.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes used(%v)", volumeMetrics.InodesUsed)
+	if d.mounter != nil {
+		if notMnt, err := d.mounter.IsLikelyNotMountPoint(stagingPath); err == nil && !notMnt {
+			return nil
+		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "staging path %s is not mounted yet", stagingPath)
+}
+
+// getVolumeStats converts volume metrics of volumePath into NodeGetVolumeStats response
+func (d *Driver) getVolumeStats(volumePath string, volumeMetrics *volume.Metrics) (*csi.NodeGetVolumeStatsResponse, error) {
+	// a metric which could not be converted is reported as 0, so that other metrics are still usable by kubelet,
+	// an error is returned only if none of the reported metrics could be converted
+	var failed []string
+	toInt64 := func(name string, q *resource.Quantity) (int64, bool) {
+		if q == nil {
+			return 0, true
+		}
+		v, ok := q.AsInt64()
+		if !ok {
+			klog.Warningf("failed to transform %s(%v) of volume path %s, report it as 0", name, q, volumePath)
+			failed = append(failed, name)
+			return 0, false
+		}
+		return v, true
+	}
+	available, availableOK := toInt64("volume available size", volumeMetrics.Available)
+	capacity, capacityOK := toInt64("volume capacity size", volumeMetrics.Capacity)
+	used, usedOK := toInt64("volume used size", volumeMetrics.Used)
+	allBytesFailed := !availableOK && !capacityOK && !usedOK
+
+	var inodesFree, inodes, inodesUsed int64
+	inodesAvailable := !isInodesUnavailable(volumeMetrics)
+	// byte metrics decide alone whether to fail if inode metrics are not reported
+	allInodesFailed := true
+	if inodesAvailable {
+		var inodesFreeOK, inodesOK, inodesUsedOK bool
+		inodesFree, inodesFreeOK = toInt64("disk inodes free", volumeMetrics.InodesFree)
+		inodes, inodesOK = toInt64("disk inodes", volumeMetrics.Inodes)
+		inodesUsed, inodesUsedOK = toInt64("disk inodes used", volumeMetrics.InodesUsed)
+		allInodesFailed = !inodesFreeOK && !inodesOK && !inodesUsedOK
+	}
+	if allBytesFailed && allInodesFailed {
+		return nil, status.Errorf(codes.Internal, "failed to transform %s of volume path %s", strings.Join(failed, ", "), volumePath)
 	}
 
-	return &csi.NodeGetVolumeStatsResponse{
+	if d.volumeStatsWalkMaxEntries > 0 {
+		// statfs on a subdir bind mount reports usage of the whole share, walk the volume path instead
+		walkedUsed, walkedInodesUsed, complete, err := getDirUsage(volumePath, d.volumeStatsWalkMaxEntries)
+		switch {
+		case err != nil:
+			klog.Warningf("failed to walk volume path %s: %v, fall back to statfs", volumePath, err)
+		case !complete:
+			klog.V(4).Infof("volume path %s has more than %d entries, fall back to statfs", volumePath, d.volumeStatsWalkMaxEntries)
+		default:
+			used, inodesUsed = walkedUsed, walkedInodesUsed
+		}
+	}
+
+	resp := &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			{
 				Unit:      csi.VolumeUsage_BYTES,
@@ -339,20 +1004,106 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 				Total:     capacity,
 				Used:      used,
 			},
-			{
-				Unit:      csi.VolumeUsage_INODES,
-				Available: inodesFree,
-				Total:     inodes,
-				Used:      inodesUsed,
-			},
 		},
-	}, nil
+	}
+	if inodesAvailable || !d.omitUnavailableInodesUsage {
+		resp.Usage = append(resp.Usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_INODES,
+			Available: inodesFree,
+			Total:     inodes,
+			Used:      inodesUsed,
+		})
+	} else {
+		klog.V(4).Infof("inode metrics are not available on volume path %s, omit inodes usage", volumePath)
+	}
+	return resp, nil
+}
+
+// isInodesUnavailable checks whether inode metrics are not reported, e.g. smb server does not report inode counts
+func isInodesUnavailable(volumeMetrics *volume.Metrics) bool {
+	if volumeMetrics.Inodes == nil || volumeMetrics.InodesFree == nil || volumeMetrics.InodesUsed == nil {
+		return true
+	}
+	return volumeMetrics.Inodes.IsZero()
 }
 
 // NodeExpandVolume node expand volume
-// N/A for smb
+// there is nothing to resize on node for a file share, so a filesystem volume succeeds with the requested capacity,
+// a volume without capability is regarded as filesystem volume since block volume is not supported
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume(%s): block volume expansion is not supported", req.GetVolumeId())
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+}
+
+// getLiveStageMount returns the cifs mount on target in mount table if it could be read,
+// a stale mount is unmounted so that the volume is mounted again
+func (d *Driver) getLiveStageMount(target string) (mount.MountPoint, bool) {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		klog.Warningf("failed to list mount points: %v", err)
+		return mount.MountPoint{}, false
+	}
+	targetAbs, err := filepath.Abs(target)
+	if err != nil {
+		return mount.MountPoint{}, false
+	}
+	for _, mp := range mountPoints {
+		if mp.Path != targetAbs || mp.Type != "cifs" {
+			continue
+		}
+		if _, err := readDir(target); err != nil {
+			klog.Warningf("mount %s on %s is stale, unmount it before remount: %v", mp.Device, target, err)
+			if err := d.mounter.Unmount(target); err != nil {
+				klog.Errorf("Unmount directory %s failed with %v", target, err)
+			}
+			return mount.MountPoint{}, false
+		}
+		return mp, true
+	}
+	return mount.MountPoint{}, false
+}
+
+// checkPublishedSource returns FailedPrecondition error if target is already mounted from a source other than
+// staging path of the volume, e.g. target of another volume aliased by symlink, so that mounts are not stacked.
+// Bind mount in mount table has the device of its source mount, so the device of target is compared with staging path.
+func (d *Driver) checkPublishedSource(volumeID, stagingPath, target string) error {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		klog.Warningf("failed to list mount points: %v", err)
+		return nil
+	}
+	stagingAbs, err := filepath.Abs(stagingPath)
+	if err != nil {
+		return nil
+	}
+	// mount table has the resolved path of target
+	targetPath, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		if targetPath, err = filepath.Abs(target); err != nil {
+			return nil
+		}
+	}
+	var targetDevice, stagingDevice string
+	for _, mp := range mountPoints {
+		switch mp.Path {
+		case targetPath:
+			targetDevice = mp.Device
+		case stagingAbs:
+			stagingDevice = mp.Device
+		}
+	}
+	if targetDevice == "" || stagingDevice == "" || targetDevice == stagingDevice || targetDevice == stagingAbs {
+		return nil
+	}
+	return status.Errorf(codes.FailedPrecondition, "volume(%s): target %s is already mounted from %s, which is not the source %s of staging path %s", volumeID, target, targetDevice, stagingDevice, stagingPath)
 }
 
 // ensureMountPoint: create mount point if not exists
@@ -391,7 +1142,7 @@ func (d *Driver) ensureMountPoint(target string) (bool, error) {
 
 	if !notMnt {
 		// testing original mount point, make sure the mount link is valid
-		_, err := os.ReadDir(target)
+		err := d.probeMountPoint(target)
 		if err == nil {
 			klog.V(2).Infof("already mounted to target %s", target)
 			return !notMnt, nil
@@ -403,7 +1154,10 @@ func (d *Driver) ensureMountPoint(target string) (bool, error) {
 			return !notMnt, err
 		}
 		notMnt = true
-		return !notMnt, err
+		if !d.remountOnRecovery {
+			return !notMnt, err
+		}
+		klog.V(2).Infof("invalid mount on %s is unmounted, remount it in current call", target)
 	}
 
 	if err := makeDir(target); err != nil {
@@ -414,16 +1168,283 @@ func (d *Driver) ensureMountPoint(target string) (bool, error) {
 	return false, nil
 }
 
-func makeDir(pathname string) error {
-	err := os.MkdirAll(pathname, os.FileMode(0755))
+// getDirUsage walks dir recursively and returns total size of regular files in bytes and number of inodes,
+// the walk stops once more than maxEntries entries are found and complete would be false
+func getDirUsage(dir string, maxEntries int) (size int64, inodes int64, complete bool, err error) {
+	errTooManyEntries := fmt.Errorf("more than %d entries", maxEntries)
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if inodes++; inodes > int64(maxEntries) {
+			return errTooManyEntries
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err == errTooManyEntries {
+		return 0, 0, false, nil
+	}
 	if err != nil {
-		if !os.IsExist(err) {
+		return 0, 0, false, err
+	}
+	return size, inodes, true, nil
+}
+
+// handleCorruptedMount handles corrupted staging or target path detected during publish by corruptedMountPublishPolicy:
+// fail: return FailedPrecondition so that kubelet retries cleanly
+// recover: unmount the corrupted target path so that it would be bind mounted from the staging path again,
+// a corrupted staging path could not be recovered during publish since stage secrets are not available
+func (d *Driver) handleCorruptedMount(source, target string, isCorrupted func(string) bool) error {
+	policy := d.corruptedMountPublishPolicy
+	if policy != corruptedMountPolicyFail && policy != corruptedMountPolicyRecover {
+		return nil
+	}
+	if isCorrupted(source) {
+		return status.Errorf(codes.FailedPrecondition, "staging path %s is a corrupted mount", source)
+	}
+	if !isCorrupted(target) {
+		return nil
+	}
+	if policy == corruptedMountPolicyFail {
+		return status.Errorf(codes.FailedPrecondition, "target path %s is a corrupted mount", target)
+	}
+	klog.Warningf("detected corrupted mount for targetPath [%s], unmount it and publish again", target)
+	if err := d.mounter.Unmount(target); err != nil {
+		return status.Errorf(codes.Internal, "failed to unmount corrupted target path %s: %v", target, err)
+	}
+	return nil
+}
+
+// validateCorruptedMountPublishPolicy returns error if policy is not a supported corrupted mount publish policy, empty policy means ignore
+func validateCorruptedMountPublishPolicy(policy string) error {
+	switch policy {
+	case "", corruptedMountPolicyIgnore, corruptedMountPolicyFail, corruptedMountPolicyRecover:
+		return nil
+	}
+	return fmt.Errorf("invalid corrupted mount publish policy: %s, supported values: %s, %s, %s", policy, corruptedMountPolicyIgnore, corruptedMountPolicyFail, corruptedMountPolicyRecover)
+}
+
+// cleanupMountPointWithContext runs cleanup in a goroutine and returns DeadlineExceeded or Canceled error
+// once ctx is done, the cleanup would continue in background and lazyUnmount is used as a fallback
+// in case the cleanup is hung, e.g. the smb server is unreachable, onBackgroundDone(if not nil) is called
+// with the result of the cleanup once it completes in background
+func cleanupMountPointWithContext(ctx context.Context, target string, cleanup func() error, lazyUnmount func(string) error, onBackgroundDone func(error)) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cleanup()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		klog.Warningf("cleanup on %s is interrupted(%v), continue in background with lazy unmount", target, ctx.Err())
+		go func() {
+			if err := lazyUnmount(target); err != nil {
+				klog.Warningf("lazy unmount on %s failed: %v", target, err)
+			}
+			err := <-done
+			if err != nil {
+				klog.Errorf("background cleanup on %s failed: %v", target, err)
+			} else {
+				klog.V(2).Infof("background cleanup on %s completed", target)
+			}
+			if onBackgroundDone != nil {
+				onBackgroundDone(err)
+			}
+		}()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// retryOnBusy runs cleanup and retries it with exponential backoff while it fails with a busy error,
+// e.g. a pod has not fully released the mount, the last error is returned once timeout is reached or ctx is done
+func retryOnBusy(ctx context.Context, target string, timeout time.Duration, cleanup func() error) error {
+	deadline := time.Now().Add(timeout)
+	interval := unstageBusyRetryInitialInterval
+	for {
+		err := cleanup()
+		if err == nil || !isBusyError(err) {
 			return err
 		}
+		if time.Now().Add(interval).After(deadline) {
+			if timeout > 0 {
+				return fmt.Errorf("%s is still busy after retrying for %v: %v", target, timeout, err)
+			}
+			return err
+		}
+		klog.V(2).Infof("%s is busy, retry in %v: %v", target, interval, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s is still busy when retry is interrupted(%v): %v", target, ctx.Err(), err)
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > unstageBusyRetryMaxInterval {
+			interval = unstageBusyRetryMaxInterval
+		}
+	}
+}
+
+// isBusyError checks whether err is caused by a busy mount point
+func isBusyError(err error) bool {
+	if errors.Is(err, syscall.EBUSY) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "device or resource busy") || strings.Contains(msg, "target is busy")
+}
+
+// resolveSymlinkTargetPath returns the path which targetPath points to if targetPath is a symlink,
+// otherwise targetPath is returned. It returns error if targetPath is a symlink in strict mode
+// or the symlink could not be resolved to a path other than the root directory.
+func resolveSymlinkTargetPath(targetPath string, strict bool) (string, error) {
+	fi, err := os.Lstat(targetPath)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return targetPath, nil
+	}
+	if strict {
+		return "", fmt.Errorf("target path %s is a symlink", targetPath)
+	}
+	resolvedPath, err := filepath.EvalSymlinks(targetPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve symlink target path %s: %v", targetPath, err)
+	}
+	if resolvedPath, err = filepath.Abs(resolvedPath); err != nil {
+		return "", fmt.Errorf("failed to resolve symlink target path %s: %v", targetPath, err)
+	}
+	if filepath.Dir(resolvedPath) == resolvedPath {
+		return "", fmt.Errorf("symlink target path %s resolves to root directory %s", targetPath, resolvedPath)
+	}
+	return resolvedPath, nil
+}
+
+// isContextError checks whether err is returned due to canceled or expired request context
+func isContextError(err error) bool {
+	code := status.Code(err)
+	return code == codes.Canceled || code == codes.DeadlineExceeded
+}
+
+// recreateDir removes pathname with its content and creates it again,
+// it refuses to remove pathname if pathname or any path under it is a mount point
+func (d *Driver) recreateDir(pathname string, perm os.FileMode) error {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return fmt.Errorf("failed to list mount points: %v", err)
+	}
+	cleanPath := filepath.Clean(pathname)
+	for _, mp := range mountPoints {
+		if mp.Path == cleanPath || strings.HasPrefix(mp.Path, cleanPath+string(filepath.Separator)) {
+			return fmt.Errorf("refuse to remove %s since %s is mounted", pathname, mp.Path)
+		}
+	}
+	if err := os.RemoveAll(pathname); err != nil {
+		return err
+	}
+	klog.V(2).Infof("removed %s to recreate it", pathname)
+	return ensureDir(pathname, perm)
+}
+
+// mkdirAll is replaced in unit tests to inject errors
+var mkdirAll = os.MkdirAll
+
+// readDir probes mount points and is replaced in unit tests to simulate stale mounts
+var readDir = os.ReadDir
+
+// interval between ReadDir probes of a mount point, it is replaced in unit tests
+var readDirRetryInterval = 200 * time.Millisecond
+
+// probeMountPoint reads target to check whether the mount on it is valid,
+// a failed ReadDir is retried up to readDirRetries times since it may be transient on a busy share
+func (d *Driver) probeMountPoint(target string) error {
+	_, err := readDir(target)
+	for i := 0; err != nil && i < d.readDirRetries; i++ {
+		klog.V(4).Infof("ReadDir %s failed with %v, retry %d/%d after %v", target, err, i+1, d.readDirRetries, readDirRetryInterval)
+		time.Sleep(readDirRetryInterval)
+		_, err = readDir(target)
+	}
+	return err
+}
+
+func makeDir(pathname string) error {
+	return ensureDir(pathname, os.FileMode(0755))
+}
+
+// ensureDir creates pathname along with any missing parents, an existing directory is treated as success.
+// It's safe to be called concurrently on the same path: a transient EEXIST or ENOENT caused by
+// another caller creating or removing a parent directory at the same time is retried.
+func ensureDir(pathname string, perm os.FileMode) error {
+	var err error
+	for i := 0; i < ensureDirMaxRetries; i++ {
+		if err = mkdirAll(pathname, perm); err == nil {
+			return nil
+		}
+		if info, statErr := os.Stat(pathname); statErr == nil && info.IsDir() {
+			return nil
+		}
+		if !os.IsExist(err) && !os.IsNotExist(err) {
+			return err
+		}
+		klog.V(4).Infof("ensureDir(%s) failed with %v, retrying", pathname, err)
+	}
+	return err
+}
+
+// lookupGroup is replaced in unit tests
+var lookupGroup = user.LookupGroup
+
+// getVolumeMountGroupID returns numeric gid of volumeMountGroup, which is required by cifs gid mount option,
+// a group name is resolved to gid if resolveName is set, note that it's looked up in /etc/group of the driver container
+// rather than the host, so only groups present in the container image are resolved
+func getVolumeMountGroupID(volumeMountGroup string, resolveName bool) (string, error) {
+	if _, err := strconv.ParseUint(volumeMountGroup, 10, 32); err == nil {
+		return volumeMountGroup, nil
+	}
+	if !resolveName {
+		return "", fmt.Errorf("invalid volume mount group %s, it must be a numeric gid", volumeMountGroup)
+	}
+	group, err := lookupGroup(volumeMountGroup)
+	if err != nil {
+		return "", fmt.Errorf("invalid volume mount group %s, it's neither a numeric gid nor a group name in the driver container: %v", volumeMountGroup, err)
+	}
+	return group.Gid, nil
+}
+
+// checkUnderKubeletRootDir returns error if path is not under kubelet root directory when enforceKubeletRootDir is set
+func (d *Driver) checkUnderKubeletRootDir(path string) error {
+	if !d.enforceKubeletRootDir {
+		return nil
+	}
+	rel, err := filepath.Rel(d.kubeletRootDir, path)
+	if err != nil || !filepath.IsAbs(path) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("path %s is not under kubelet root directory %s", path, d.kubeletRootDir)
 	}
 	return nil
 }
 
+// getPodMountRefs returns mount points under pods directory of kubelet which are bind mounted from staging path,
+// other mounts sharing the same cifs superblock, e.g. staging paths of other volumes on the same share, are excluded
+func (d *Driver) getPodMountRefs(stagingPath string) ([]string, error) {
+	refs, err := d.mounter.GetMountRefs(stagingPath)
+	if err != nil {
+		return nil, err
+	}
+	podsDir := filepath.Join(d.kubeletRootDir, "pods") + string(filepath.Separator)
+	var podRefs []string
+	for _, ref := range refs {
+		if strings.HasPrefix(ref, podsDir) {
+			podRefs = append(podRefs, ref)
+		}
+	}
+	return podRefs, nil
+}
+
 func checkGidPresentInMountFlags(mountFlags []string) bool {
 	for _, mountFlag := range mountFlags {
 		if strings.HasPrefix(mountFlag, "gid") {
@@ -433,6 +1454,49 @@ func checkGidPresentInMountFlags(mountFlags []string) bool {
 	return false
 }
 
+// selectDomainByHostname returns the domain in domains which matches host name of the smb server,
+// a fully qualified domain (e.g. fabrikam.com) matches the suffix of host name and is preferred,
+// otherwise a NetBIOS domain (e.g. FABRIKAM) matches any label of host name.
+// It returns empty string if there is no match.
+func selectDomainByHostname(hostname string, domains []string) string {
+	hostname = strings.ToLower(hostname)
+	selected := ""
+	for _, domain := range domains {
+		d := strings.ToLower(domain)
+		if strings.HasSuffix(hostname, "."+d) && len(domain) > len(selected) {
+			selected = domain
+		}
+	}
+	if selected != "" {
+		return selected
+	}
+	labels := strings.Split(hostname, ".")
+	for _, domain := range domains {
+		for _, label := range labels[1:] {
+			if strings.EqualFold(label, domain) {
+				return domain
+			}
+		}
+	}
+	return ""
+}
+
+// applyEncryptionPolicy adds seal mount option when autoAdd is set,
+// or returns error when requireEncryption is set and seal mount option is not present
+func applyEncryptionPolicy(mountOptions []string, requireEncryption, autoAdd bool) ([]string, error) {
+	if hasMountOption(mountOptions, sealMountOption) {
+		return mountOptions, nil
+	}
+	if autoAdd {
+		klog.V(2).Infof("add %s mount option automatically", sealMountOption)
+		return append(mountOptions, sealMountOption), nil
+	}
+	if requireEncryption {
+		return mountOptions, fmt.Errorf("%s mount option is required since unencrypted mount is not allowed, current mount options: %v", sealMountOption, mountOptions)
+	}
+	return mountOptions, nil
+}
+
 func hasKerberosMountOption(mountFlags []string) bool {
 	for _, mountFlag := range mountFlags {
 		if strings.HasPrefix(mountFlag, "sec=krb5") {
@@ -443,15 +1507,31 @@ func hasKerberosMountOption(mountFlags []string) bool {
 }
 
 func getCredUID(mountFlags []string) (int, error) {
-	var cruidPrefix = "cruid="
-	for _, mountFlag := range mountFlags {
-		if strings.HasPrefix(mountFlag, cruidPrefix) {
-			return strconv.Atoi(strings.TrimPrefix(mountFlag, cruidPrefix))
-		}
+	if credUID, found := getMountOptionValue(mountFlags, cruidMountOption); found {
+		return strconv.Atoi(credUID)
 	}
 	return -1, fmt.Errorf("Can't find credUid in mount flags")
 }
 
+// ensureCredUID returns an error if kerberos mount flags do not have a valid cruid= option,
+// cruid=defaultCredUID is appended to a copy of mountFlags instead if defaultCredUID is not empty
+func ensureCredUID(mountFlags []string, defaultCredUID string) ([]string, error) {
+	if !hasKerberosMountOption(mountFlags) {
+		return mountFlags, nil
+	}
+	if hasMountOption(mountFlags, cruidMountOption) {
+		if _, err := getCredUID(mountFlags); err != nil {
+			return nil, fmt.Errorf("kerberos (sec=krb5) requires a valid cruid= mount option: %v", err)
+		}
+		return mountFlags, nil
+	}
+	if defaultCredUID == "" {
+		return nil, fmt.Errorf("kerberos (sec=krb5) requires a cruid= mount option, which is the uid owning the kerberos cache in secrets")
+	}
+	klog.V(2).Infof("cruid= is not in kerberos mount flags, use default cred uid %s", defaultCredUID)
+	return append(append([]string{}, mountFlags...), cruidMountOption+"="+defaultCredUID), nil
+}
+
 func getKrb5CcacheName(credUID int) string {
 	return fmt.Sprintf("%s%d", krb5Prefix, credUID)
 }
@@ -476,7 +1556,9 @@ func kerberosCacheDirectoryExists() (bool, error) {
 	return true, nil
 }
 
-func getKerberosCache(credUID int, secrets map[string]string) (string, []byte, error) {
+// getKerberosCache returns kerberos cache file name and decoded cache content of credUID from secrets,
+// cache content larger than maxSize(in bytes) is rejected before decoding, maxSize <= 0 means no limit
+func getKerberosCache(credUID int, secrets map[string]string, maxSize int64) (string, []byte, error) {
 	var krb5CcacheName = getKrb5CcacheName(credUID)
 	var krb5CcacheContent string
 	for k, v := range secrets {
@@ -488,6 +1570,9 @@ func getKerberosCache(credUID int, secrets map[string]string) (string, []byte, e
 	if krb5CcacheContent == "" {
 		return "", nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Empty kerberos cache in key %s", krb5CcacheName))
 	}
+	if maxSize > 0 && int64(base64.StdEncoding.DecodedLen(len(krb5CcacheContent))) > maxSize {
+		return "", nil, status.Errorf(codes.InvalidArgument, "kerberos cache in key %s exceeds size limit of %d bytes", krb5CcacheName, maxSize)
+	}
 	content, err := base64.StdEncoding.DecodeString(krb5CcacheContent)
 	if err != nil {
 		return "", nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Malformed kerberos cache in key %s, expected to be in base64 form: %v", krb5CcacheName, err))
@@ -500,7 +1585,7 @@ func getKerberosCache(credUID int, secrets map[string]string) (string, []byte, e
 // Create kerberos cache in the file based on the VolumeID, so it can be cleaned up during unstage
 // At the same time, kerberos expects to find cache in file named "krb5cc_*", so creating symlink
 // will allow both clean up and serving proper cache to the kerberos.
-func ensureKerberosCache(volumeID string, mountFlags []string, secrets map[string]string) (bool, error) {
+func ensureKerberosCache(volumeID string, mountFlags []string, secrets map[string]string, maxCacheSize int64) (bool, error) {
 	var securityIsKerberos = hasKerberosMountOption(mountFlags)
 	if securityIsKerberos {
 		_, err := kerberosCacheDirectoryExists()
@@ -511,7 +1596,7 @@ func ensureKerberosCache(volumeID string, mountFlags []string, secrets map[strin
 		if err != nil {
 			return false, err
 		}
-		krb5CacheFileName, content, err := getKerberosCache(credUID, secrets)
+		krb5CacheFileName, content, err := getKerberosCache(credUID, secrets, maxCacheSize)
 		if err != nil {
 			return false, err
 		}
@@ -526,16 +1611,8 @@ func ensureKerberosCache(volumeID string, mountFlags []string, secrets map[strin
 			return false, status.Error(codes.Internal, fmt.Sprintf("Couldn't chown kerberos cache %s to user %d: %v", volumeIDCacheAbsolutePath, credUID, err))
 		}
 
-		if _, err := os.Stat(krb5CacheFileName); os.IsNotExist(err) {
-			klog.Warningf("symlink file doesn't exist, it'll be created [%s]", krb5CacheFileName)
-		} else {
-			if err := os.Remove(krb5CacheFileName); err != nil {
-				klog.Warningf("couldn't delete the file [%s]", krb5CacheFileName)
-			}
-		}
-
-		// Create symlink to the cache file with expected name
-		if err := os.Symlink(volumeIDCacheAbsolutePath, krb5CacheFileName); err != nil {
+		// Create or replace symlink to the cache file with expected name
+		if err := replaceSymlink(volumeIDCacheAbsolutePath, krb5CacheFileName); err != nil {
 			return false, status.Error(codes.Internal, fmt.Sprintf("Couldn't create symlink to a cache file %s->%s to user %d: %v", krb5CacheFileName, volumeIDCacheFileName, credUID, err))
 		}
 
@@ -544,6 +1621,25 @@ func ensureKerberosCache(volumeID string, mountFlags []string, secrets map[strin
 	return false, nil
 }
 
+// symlinkTmpCounter makes temporary symlink names unique among concurrent replacements
+var symlinkTmpCounter uint64
+
+// replaceSymlink atomically points link at target by creating a temporary symlink and renaming it over link,
+// so that link always resolves to either the previous or the new target during replacement
+func replaceSymlink(target, link string) error {
+	tmpLink := fmt.Sprintf("%s.tmp%d", link, atomic.AddUint64(&symlinkTmpCounter, 1))
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpLink, link); err != nil {
+		if removeErr := os.Remove(tmpLink); removeErr != nil {
+			klog.Warningf("couldn't delete temporary symlink [%s]: %v", tmpLink, removeErr)
+		}
+		return err
+	}
+	return nil
+}
+
 func deleteKerberosCache(volumeID string) error {
 	exists, err := kerberosCacheDirectoryExists()
 	// If not supported, simply return
@@ -22,13 +22,16 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/kubernetes-csi/csi-driver-smb/test/utils/testutil"
 
@@ -36,6 +39,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/volume"
 	mount "k8s.io/mount-utils"
 	"k8s.io/utils/exec"
 )
@@ -84,6 +89,8 @@ func TestNodeStageVolume(t *testing.T) {
 		req         csi.NodeStageVolumeRequest
 		expectedErr testutil.TestError
 		cleanup     func(*Driver)
+		// encryption policy only applies to Linux node
+		skipOnWindows bool
 
 		// use this field only when Windows
 		// gives flaky error messages due
@@ -133,6 +140,49 @@ func TestNodeStageVolume(t *testing.T) {
 				WindowsError: status.Error(codes.Internal, fmt.Sprintf("Could not mount target %s: mkdir %s: The system cannot find the path specified.", smbFile, smbFile)),
 			},
 		},
+		{
+			desc: "[Error] Invalid domain selector",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    map[string]string{sourceField: testSource, "domainSelector": "unknown"}},
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "invalid domainselector value: unknown, supported values: hostname"),
+			},
+		},
+		{
+			desc: "[Error] Expected SPN in non-kerberos mount",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    map[string]string{sourceField: testSource, "expectedSpn": "cifs/smb-server"}},
+			skipOnWindows: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "expectedspn is only supported in kerberos mount"),
+			},
+		},
+		{
+			desc: "[Error] Realm in non-kerberos mount",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    map[string]string{sourceField: testSource, "realm": "FABRIKAM.COM"}},
+			skipOnWindows: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "realm is only supported in kerberos mount"),
+			},
+		},
+		{
+			desc: "[Error] Kerberos mount without cruid",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"sec=krb5"}},
+					},
+				},
+				VolumeContext: volContext},
+			skipOnWindows: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "volume(vol_1): kerberos (sec=krb5) requires a cruid= mount option, which is the uid owning the kerberos cache in secrets"),
+			},
+		},
 		{
 			desc: "[Error] Volume operation in progress",
 			setup: func(d *Driver) {
@@ -159,12 +209,118 @@ func TestNodeStageVolume(t *testing.T) {
 				"with NewSmbGlobalMapping(%s, %s) failed with error: rpc error: code = Unknown desc = NewSmbGlobalMapping failed.",
 				strings.Replace(testSource, "\\", "\\\\", -1), errorMountSensSource, testSource, errorMountSensSource),
 			expectedErr: testutil.TestError{
-				DefaultError: status.Errorf(codes.Internal,
+				DefaultError: newMountError(codes.Internal, DefaultDriverName, testSource, []string{"domain=test_doamin"},
 					fmt.Sprintf("volume(vol_1##) mount \"%s\" on \"%s\" failed with fake "+
 						"MountSensitive: target error",
 						strings.Replace(testSource, "\\", "\\\\", -1), errorMountSensSource)),
 			},
 		},
+		{
+			desc: "[Error] Unencrypted mount is not allowed",
+			setup: func(d *Driver) {
+				d.requireEncryption = true
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContext,
+				Secrets:          secrets},
+			skipOnWindows: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.FailedPrecondition, "volume(vol_1##): seal mount option is required since unencrypted mount is not allowed, current mount options: [domain=test_doamin]"),
+			},
+			cleanup: func(d *Driver) {
+				d.requireEncryption = false
+			},
+		},
+		{
+			desc: "[Error] Unknown secret key rejected",
+			setup: func(d *Driver) {
+				d.unknownSecretKeysPolicy = unknownSecretKeysPolicyReject
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContext,
+				Secrets:          map[string]string{usernameField: "test", "passwd": "test"}},
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "volume(vol_1##): unknown keys [passwd] in secret, supported keys: username, password, domain, mountOptions, krb5cc_*"),
+			},
+			cleanup: func(d *Driver) {
+				d.unknownSecretKeysPolicy = ""
+			},
+		},
+		{
+			desc: "[Error] Mount profile not found",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    map[string]string{sourceField: testSource, "profile": "unknown"},
+				Secrets:          secrets},
+			skipOnWindows: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "volume(vol_1##): mount profile unknown is not found"),
+			},
+		},
+		{
+			desc: "[Error] Invalid volume mount group",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: "smbusers"},
+					},
+				},
+				VolumeContext: volContext,
+				Secrets:       secrets},
+			skipOnWindows: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "volume(vol_1##): invalid volume mount group smbusers, it must be a numeric gid"),
+			},
+		},
+		{
+			desc: "[Error] Unresolved tokens in subDir",
+			setup: func(d *Driver) {
+				d.strictSubDirTokens = true
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    map[string]string{sourceField: testSource, subDirField: "${pvc.metadata.namespace}/${pvc.metadata.name}", pvcNamespaceKey: "pvcnamespace"},
+				Secrets:          secrets},
+			skipOnWindows: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "volume(vol_1##): unresolved tokens [${pvc.metadata.name}] in subdir: pvcnamespace/${pvc.metadata.name}"),
+			},
+			cleanup: func(d *Driver) {
+				d.strictSubDirTokens = false
+			},
+		},
+		{
+			desc: "[Success] Valid request with resolved subDir tokens",
+			setup: func(d *Driver) {
+				d.strictSubDirTokens = true
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    map[string]string{sourceField: testSource, subDirField: "${pvc.metadata.namespace}/${pvc.metadata.name}", pvcNamespaceKey: "pvcnamespace", pvcNameKey: "pvcname"},
+				Secrets:          secrets},
+			skipOnWindows: true,
+			expectedErr:   testutil.TestError{},
+			cleanup: func(d *Driver) {
+				d.strictSubDirTokens = false
+			},
+		},
+		{
+			desc: "[Success] Valid request with mount profile",
+			setup: func(d *Driver) {
+				d.mountProfiles = map[string][]string{"media": {"cache=loose", "actimeo=60"}}
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    map[string]string{sourceField: testSource, "profile": "media"},
+				Secrets:          secrets},
+			skipOnWindows: true,
+			expectedErr:   testutil.TestError{},
+			cleanup: func(d *Driver) {
+				d.mountProfiles = nil
+			},
+		},
 		{
 			desc: "[Success] Valid request",
 			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
@@ -193,6 +349,9 @@ func TestNodeStageVolume(t *testing.T) {
 	d := NewFakeDriver()
 
 	for _, test := range tests {
+		if test.skipOnWindows && runtime.GOOS == "windows" {
+			continue
+		}
 		mounter, err := NewFakeMounter()
 		if err != nil {
 			t.Fatalf(fmt.Sprintf("failed to get fake mounter: %v", err))
@@ -235,6 +394,37 @@ func TestNodeGetInfo(t *testing.T) {
 	resp, err := d.NodeGetInfo(context.Background(), &req)
 	assert.NoError(t, err)
 	assert.Equal(t, resp.GetNodeId(), fakeNodeID)
+	assert.Nil(t, resp.GetAccessibleTopology())
+}
+
+func TestNodeGetInfoWithHostnameTopology(t *testing.T) {
+	tests := []struct {
+		desc             string
+		nodeHostname     string
+		expectedHostname string
+	}{
+		{
+			desc:             "configured host name",
+			nodeHostname:     "node-1.example.com",
+			expectedHostname: "node-1.example.com",
+		},
+		{
+			desc:             "node id as host name",
+			expectedHostname: fakeNodeID,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewDriver(&DriverOptions{
+			NodeID:                 fakeNodeID,
+			DriverName:             DefaultDriverName,
+			EnableHostnameTopology: true,
+			NodeHostname:           test.nodeHostname,
+		})
+		resp, err := d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{topologyKeyHostname: test.expectedHostname}, resp.GetAccessibleTopology().GetSegments(), test.desc)
+	}
 }
 
 func TestNodeGetCapabilities(t *testing.T) {
@@ -258,11 +448,71 @@ func TestNodeGetCapabilities(t *testing.T) {
 
 func TestNodeExpandVolume(t *testing.T) {
 	d := NewFakeDriver()
-	req := csi.NodeExpandVolumeRequest{}
-	resp, err := d.NodeExpandVolume(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	capacityRange := &csi.CapacityRange{RequiredBytes: 10 * 1024 * 1024 * 1024}
+	tests := []struct {
+		desc         string
+		req          csi.NodeExpandVolumeRequest
+		expectedResp *csi.NodeExpandVolumeResponse
+		expectedErr  error
+	}{
+		{
+			desc:        "Volume ID missing",
+			req:         csi.NodeExpandVolumeRequest{VolumePath: "/target"},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+		},
+		{
+			desc:        "Volume path missing",
+			req:         csi.NodeExpandVolumeRequest{VolumeId: "vol_1"},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume path missing in request"),
+		},
+		{
+			desc: "Filesystem volume",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId:      "vol_1",
+				VolumePath:    "/target",
+				CapacityRange: capacityRange,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				},
+			},
+			expectedResp: &csi.NodeExpandVolumeResponse{CapacityBytes: capacityRange.RequiredBytes},
+		},
+		{
+			desc: "Block volume",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId:      "vol_1",
+				VolumePath:    "/target",
+				CapacityRange: capacityRange,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "volume(vol_1): block volume expansion is not supported"),
+		},
+		{
+			desc: "Volume capability absent",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId:      "vol_1",
+				VolumePath:    "/target",
+				CapacityRange: capacityRange,
+			},
+			expectedResp: &csi.NodeExpandVolumeResponse{CapacityBytes: capacityRange.RequiredBytes},
+		},
+		{
+			desc:         "Capacity range absent",
+			req:          csi.NodeExpandVolumeRequest{VolumeId: "vol_1", VolumePath: "/target"},
+			expectedResp: &csi.NodeExpandVolumeResponse{},
+		},
+	}
+
+	for _, test := range tests {
+		resp, err := d.NodeExpandVolume(context.Background(), &test.req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test case: %s, unexpected error: %v", test.desc, err)
+		}
+		if !reflect.DeepEqual(resp, test.expectedResp) {
+			t.Errorf("test case: %s, unexpected response: %v", test.desc, resp)
+		}
 	}
 }
 
@@ -463,6 +713,66 @@ func TestNodeUnpublishVolume(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNodeUnpublishVolumeSymlinkTarget(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlink target path is expected on Windows")
+	}
+	tmpDir, err := os.MkdirTemp("", "csi-smb-symlink-test")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		desc                string
+		strict              bool
+		expectedErr         error
+		expectedTargetExist bool
+	}{
+		{
+			desc:   "[Success] symlink target is resolved and unmounted",
+			strict: false,
+		},
+		{
+			desc:                "[Error] symlink target is rejected in strict mode",
+			strict:              true,
+			expectedErr:         status.Error(codes.InvalidArgument, fmt.Sprintf("target path %s is a symlink", filepath.Join(tmpDir, "link"))),
+			expectedTargetExist: true,
+		},
+	}
+
+	d := NewFakeDriver()
+	mounter, err := NewFakeMounter()
+	if err != nil {
+		t.Fatalf("failed to get fake mounter: %v", err)
+	}
+	d.mounter = mounter
+
+	for _, test := range tests {
+		realTarget := filepath.Join(tmpDir, "target")
+		link := filepath.Join(tmpDir, "link")
+		assert.NoError(t, makeDir(realTarget))
+		assert.NoError(t, os.Symlink(realTarget, link))
+
+		d.rejectSymlinkTargetPath = test.strict
+		_, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: link})
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test case: %s, unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		_, realTargetErr := os.Stat(realTarget)
+		_, linkErr := os.Lstat(link)
+		if test.expectedTargetExist {
+			assert.NoError(t, realTargetErr, test.desc)
+			assert.NoError(t, linkErr, test.desc)
+		} else {
+			assert.True(t, os.IsNotExist(realTargetErr), test.desc)
+			assert.True(t, os.IsNotExist(linkErr), test.desc)
+		}
+		_ = os.RemoveAll(link)
+		_ = os.RemoveAll(realTarget)
+	}
+}
+
 func TestNodeUnstageVolume(t *testing.T) {
 	errorTarget := testutil.GetWorkDirPath("error_is_likely_target", t)
 	targetFile := testutil.GetWorkDirPath("abc.go", t)
@@ -539,6 +849,54 @@ func TestNodeUnstageVolume(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNodeUnstageVolumeRejectReferenced(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	kubeletRootDir := t.TempDir()
+	stagingPath := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/vol1/globalmount")
+	otherStagingPath := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/vol2/globalmount")
+	podPath := filepath.Join(kubeletRootDir, "pods/uid/volumes/kubernetes.io~csi/pv1/mount")
+	assert.NoError(t, os.MkdirAll(stagingPath, 0750))
+
+	tests := []struct {
+		desc                string
+		mountPoints         []mount.MountPoint
+		expectedErr         error
+		expectedMountPoints int
+	}{
+		{
+			desc: "staging path still bind mounted in a pod",
+			mountPoints: []mount.MountPoint{
+				{Device: "//smb-server/share", Path: stagingPath, Type: "cifs"},
+				{Device: "//smb-server/share", Path: podPath, Type: "cifs"},
+			},
+			expectedErr:         status.Errorf(codes.FailedPrecondition, "staging target %q of volume(vol_1) is still bind mounted on [%s], unpublish them first", stagingPath, podPath),
+			expectedMountPoints: 2,
+		},
+		{
+			desc: "staging path of another volume on the same share is not a reference",
+			mountPoints: []mount.MountPoint{
+				{Device: "//smb-server/share", Path: stagingPath, Type: "cifs"},
+				{Device: "//smb-server/share", Path: otherStagingPath, Type: "cifs"},
+			},
+			expectedMountPoints: 1,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.kubeletRootDir = kubeletRootDir
+		d.rejectReferencedUnstage = true
+		fakeMounter := mount.NewFakeMounter(test.mountPoints)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: stagingPath})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Len(t, fakeMounter.MountPoints, test.expectedMountPoints, test.desc)
+	}
+}
+
 func TestEnsureMountPoint(t *testing.T) {
 	errorTarget := "./error_is_likely_target"
 	alreadyExistTarget := "./false_is_likely_exist_target"
@@ -601,109 +959,1177 @@ func TestEnsureMountPoint(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestMakeDir(t *testing.T) {
-	targetTest := "./target_test"
-
-	//Successfully create directory
-	err := makeDir(targetTest)
+func TestCleanupMountPointWithContext(t *testing.T) {
+	target := "./target_test"
+
+	// cleanup completes before ctx is done
+	err := cleanupMountPointWithContext(context.Background(), target, func() error {
+		return nil
+	}, func(string) error {
+		t.Errorf("lazy unmount should not be called")
+		return nil
+	}, func(error) {
+		t.Errorf("onBackgroundDone should not be called")
+	})
 	assert.NoError(t, err)
 
-	//Failed case
-	err = makeDir("./smb.go")
-	var e *os.PathError
-	if !errors.As(err, &e) {
-		t.Errorf("Unexpected Error: %v", err)
+	cleanupErr := fmt.Errorf("cleanup failed")
+	err = cleanupMountPointWithContext(context.Background(), target, func() error {
+		return cleanupErr
+	}, func(string) error {
+		return nil
+	}, nil)
+	assert.Equal(t, cleanupErr, err)
+
+	// cancel ctx during a hung cleanup
+	hung := make(chan struct{})
+	backgroundDone := make(chan error, 1)
+	lazyUnmounted := make(chan string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	err = cleanupMountPointWithContext(ctx, target, func() error {
+		<-hung
+		return cleanupErr
+	}, func(path string) error {
+		lazyUnmounted <- path
+		return nil
+	}, func(err error) {
+		backgroundDone <- err
+	})
+	assert.Equal(t, status.Error(codes.Canceled, context.Canceled.Error()), err)
+	select {
+	case path := <-lazyUnmounted:
+		assert.Equal(t, target, path)
+	case <-time.After(5 * time.Second):
+		t.Errorf("lazy unmount is not called after ctx is canceled")
+	}
+	// the hung cleanup continues in background
+	assert.Empty(t, backgroundDone)
+	close(hung)
+	select {
+	case err := <-backgroundDone:
+		assert.Equal(t, cleanupErr, err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("onBackgroundDone is not called after the cleanup completes")
 	}
-
-	// Remove the directory created
-	err = os.RemoveAll(targetTest)
-	assert.NoError(t, err)
 }
 
-func TestNodeGetVolumeStats(t *testing.T) {
-	nonexistedPath := "/not/a/real/directory"
-	fakePath := "/tmp/fake-volume-path"
+func TestNodeStageVolumeReadOnlyFilesystem(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	stagingPath := filepath.Join(os.TempDir(), "csi-smb-read-only-test")
+	defer func() {
+		mkdirAll = os.MkdirAll
+	}()
 
 	tests := []struct {
 		desc        string
-		req         csi.NodeGetVolumeStatsRequest
+		mkdirErr    error
 		expectedErr error
 	}{
 		{
-			desc:        "[Error] Volume ID missing",
-			req:         csi.NodeGetVolumeStatsRequest{VolumePath: fakePath},
-			expectedErr: status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume ID was empty"),
-		},
-		{
-			desc:        "[Error] VolumePath missing",
-			req:         csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1"},
-			expectedErr: status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty"),
-		},
-		{
-			desc:        "[Error] Incorrect volume path",
-			req:         csi.NodeGetVolumeStatsRequest{VolumePath: nonexistedPath, VolumeId: "vol_1"},
-			expectedErr: status.Errorf(codes.NotFound, "path /not/a/real/directory does not exist"),
+			desc:        "[Error] node filesystem is read-only",
+			mkdirErr:    &os.PathError{Op: "mkdir", Path: stagingPath, Err: syscall.EROFS},
+			expectedErr: status.Errorf(codes.FailedPrecondition, "failed to create staging path %s since node filesystem is read-only, check whether kubelet directory is mounted read-write: mkdir %s: read-only file system", stagingPath, stagingPath),
 		},
 		{
-			desc:        "[Success] Standard success",
-			req:         csi.NodeGetVolumeStatsRequest{VolumePath: fakePath, VolumeId: "vol_1"},
-			expectedErr: nil,
+			desc:        "[Error] generic mkdir error",
+			mkdirErr:    &os.PathError{Op: "mkdir", Path: stagingPath, Err: syscall.EIO},
+			expectedErr: status.Errorf(codes.Internal, "MkdirAll %s failed with error: mkdir %s: input/output error", stagingPath, stagingPath),
 		},
 	}
 
-	// Setup
-	_ = makeDir(fakePath)
 	d := NewFakeDriver()
 	for _, test := range tests {
-		_, err := d.NodeGetVolumeStats(context.Background(), &test.req)
+		mkdirAll = func(string, os.FileMode) error { return test.mkdirErr }
+		req := csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{}},
+			VolumeContext:    map[string]string{sourceField: "//smb-server/share"}}
+		_, err := d.NodeStageVolume(context.Background(), &req)
 		if !reflect.DeepEqual(err, test.expectedErr) {
-			t.Errorf("desc: %v, expected error: %v, actual error: %v", test.desc, test.expectedErr, err)
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
 		}
 	}
+}
 
-	// Clean up
-	err := os.RemoveAll(fakePath)
+func TestRecreateDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tmpDir, err := os.MkdirTemp("", "csi-smb-recreate-dir-test")
 	assert.NoError(t, err)
-}
+	defer os.RemoveAll(tmpDir)
+
+	unmounted := filepath.Join(tmpDir, "unmounted")
+	mounted := filepath.Join(tmpDir, "mounted")
+	nestedMounted := filepath.Join(tmpDir, "nested")
+	for _, path := range []string{unmounted, mounted, filepath.Join(nestedMounted, "subdir")} {
+		assert.NoError(t, makeDir(path))
+		assert.NoError(t, os.WriteFile(filepath.Join(path, "stale"), []byte("stale"), 0644))
+	}
+
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: mount.NewFakeMounter([]mount.MountPoint{
+			{Device: "//smb-server/share", Path: mounted, Type: "cifs"},
+			{Device: "//smb-server/share", Path: filepath.Join(nestedMounted, "subdir"), Type: "cifs"},
+		}),
+	}
 
-func TestCheckGidPresentInMountFlags(t *testing.T) {
 	tests := []struct {
-		desc       string
-		MountFlags []string
-		result     bool
+		desc        string
+		path        string
+		expectedErr error
 	}{
 		{
-			desc:       "[Success] Gid present in mount flags",
-			MountFlags: []string{"gid=3000"},
-			result:     true,
+			desc: "recreate when unmounted",
+			path: unmounted,
 		},
 		{
-			desc:       "[Success] Gid not present in mount flags",
-			MountFlags: []string{},
-			result:     false,
+			desc:        "refuse when mounted",
+			path:        mounted,
+			expectedErr: fmt.Errorf("refuse to remove %s since %s is mounted", mounted, mounted),
+		},
+		{
+			desc:        "refuse when a sub directory is mounted",
+			path:        nestedMounted,
+			expectedErr: fmt.Errorf("refuse to remove %s since %s is mounted", nestedMounted, filepath.Join(nestedMounted, "subdir")),
 		},
 	}
 
 	for _, test := range tests {
-		gIDPresent := checkGidPresentInMountFlags(test.MountFlags)
-		if gIDPresent != test.result {
-			t.Errorf("[%s]: Expected result : %t, Actual result: %t", test.desc, test.result, gIDPresent)
+		err := d.recreateDir(test.path, 0750)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		entries, _ := os.ReadDir(test.path)
+		if test.expectedErr == nil {
+			assert.Empty(t, entries, test.desc)
+		} else {
+			assert.NotEmpty(t, entries, test.desc)
 		}
 	}
 }
 
-func TestVolumeKerberosCacheName(t *testing.T) {
+func TestRetryOnBusy(t *testing.T) {
+	target := "./target_test"
+	busyErr := fmt.Errorf("unmount failed: %w", syscall.EBUSY)
+
 	tests := []struct {
-		name string
+		desc          string
+		timeout       time.Duration
+		errs          []error
+		expectedCalls int
+		expectedErr   error
 	}{
 		{
-			name: "s", // short name
+			desc:          "busy then success",
+			timeout:       5 * time.Second,
+			errs:          []error{busyErr, fmt.Errorf("umount: %s: target is busy", target), nil},
+			expectedCalls: 3,
 		},
 		{
-			name: "Volume Handle##unique suffix",
+			desc:          "not busy error is not retried",
+			timeout:       5 * time.Second,
+			errs:          []error{fmt.Errorf("permission denied")},
+			expectedCalls: 1,
+			expectedErr:   fmt.Errorf("permission denied"),
 		},
 		{
-			name: "Volume With Spaces and Slashes // and symbols that produce /+ after base64 ???????~~~~~~~~",
+			desc:          "busy error is not retried without timeout",
+			errs:          []error{busyErr},
+			expectedCalls: 1,
+			expectedErr:   busyErr,
+		},
+		{
+			desc:          "persistent busy error",
+			timeout:       500 * time.Millisecond,
+			errs:          []error{busyErr, busyErr, busyErr, busyErr},
+			expectedCalls: 2,
+			expectedErr:   fmt.Errorf("%s is still busy after retrying for %v: %v", target, 500*time.Millisecond, busyErr),
+		},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		err := retryOnBusy(context.Background(), target, test.timeout, func() error {
+			err := test.errs[calls]
+			calls++
+			return err
+		})
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if calls != test.expectedCalls {
+			t.Errorf("test[%s]: unexpected calls: %d, expected calls: %d", test.desc, calls, test.expectedCalls)
+		}
+	}
+
+	// retry is interrupted once ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	err := retryOnBusy(ctx, target, time.Minute, func() error {
+		calls++
+		cancel()
+		return busyErr
+	})
+	assert.Equal(t, fmt.Errorf("%s is still busy when retry is interrupted(%v): %v", target, context.Canceled, busyErr), err)
+	assert.Equal(t, 1, calls)
+	assert.Less(t, time.Since(start), unstageBusyRetryInitialInterval)
+}
+
+// blockingUnmounter blocks Unmount until release is closed
+type blockingUnmounter struct {
+	*mount.FakeMounter
+	release chan struct{}
+}
+
+func (m *blockingUnmounter) Unmount(target string) error {
+	<-m.release
+	return m.FakeMounter.Unmount(target)
+}
+
+func TestNodeUnstageVolumeBackgroundCleanup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	d := NewFakeDriver()
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	assert.NoError(t, os.MkdirAll(stagingPath, 0750))
+	fakeMounter := &blockingUnmounter{
+		FakeMounter: mount.NewFakeMounter([]mount.MountPoint{{Device: "//smb-server/share", Path: stagingPath, Type: "cifs"}}),
+		release:     make(chan struct{}),
+	}
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	d.stageCache.set(stagingPath, stageEntry{volumeID: "vol_1", source: "//smb-server/share"})
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: stagingPath}
+
+	// unmount is hung and request is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := d.NodeUnstageVolume(ctx, req)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// volume is busy until the background cleanup completes
+	_, err = d.NodeUnstageVolume(context.Background(), req)
+	assert.Equal(t, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, "vol_1"), err)
+	_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+		Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+	})
+	assert.Equal(t, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, "vol_1"), err)
+	assert.NotEmpty(t, d.stageCache.list())
+
+	// stage state is cleaned up once the background cleanup completes
+	close(fakeMounter.release)
+	assert.Eventually(t, func() bool {
+		if !d.volumeLocks.TryAcquire("vol_1") {
+			return false
+		}
+		d.volumeLocks.Release("vol_1")
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, d.stageCache.list())
+	assert.Empty(t, fakeMounter.MountPoints)
+}
+
+func TestMakeDir(t *testing.T) {
+	targetTest := "./target_test"
+
+	//Successfully create directory
+	err := makeDir(targetTest)
+	assert.NoError(t, err)
+
+	//Failed case
+	err = makeDir("./smb.go")
+	var e *os.PathError
+	if !errors.As(err, &e) {
+		t.Errorf("Unexpected Error: %v", err)
+	}
+
+	// Remove the directory created
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestRequiresDedicatedMount(t *testing.T) {
+	tests := []struct {
+		options  []string
+		expected bool
+	}{
+		{options: nil, expected: false},
+		{options: []string{"ro", "noexec"}, expected: false},
+		{options: []string{"noexec", "cache=none"}, expected: true},
+		{options: []string{"actimeo=30"}, expected: true},
+	}
+
+	for _, test := range tests {
+		result := requiresDedicatedMount(test.options)
+		if result != test.expected {
+			t.Errorf("requiresDedicatedMount(%v): unexpected output: %v, expected result: %v", test.options, result, test.expected)
+		}
+	}
+}
+
+func TestNodePublishVolumeDedicatedMount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	tmpDir, err := os.MkdirTemp("", "csi-smb-publish-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	stagingPath := filepath.Join(tmpDir, "globalmount")
+	volumeCap := csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	secrets := map[string]string{"username": "user", "password": "secret"}
+
+	tests := []struct {
+		desc            string
+		context         map[string]string
+		secrets         map[string]string
+		staged          bool
+		expectedErr     error
+		expectedDevice  string
+		expectedType    string
+		expectedOptions []string
+	}{
+		{
+			desc:            "[Success] bind mount by default",
+			staged:          true,
+			expectedDevice:  stagingPath,
+			expectedOptions: []string{"bind", "ro"},
+		},
+		{
+			desc:            "[Success] bind mount with bind compatible options",
+			context:         map[string]string{"publishMountOptions": "noexec"},
+			staged:          true,
+			expectedDevice:  stagingPath,
+			expectedOptions: []string{"bind", "ro", "noexec"},
+		},
+		{
+			desc:            "[Success] dedicated mount",
+			context:         map[string]string{"publishMountOptions": "cache=none"},
+			secrets:         secrets,
+			staged:          true,
+			expectedDevice:  "//server/share",
+			expectedType:    "cifs",
+			expectedOptions: []string{"vers=3.0", "cache=none", "ro", "username=user", "password=secret"},
+		},
+		{
+			desc:        "[Error] dedicated mount without stage state",
+			context:     map[string]string{"publishMountOptions": "cache=none"},
+			secrets:     secrets,
+			expectedErr: status.Errorf(codes.FailedPrecondition, "stage state of volume(vol_1) on %s not found, could not publish with mount options [cache=none]", stagingPath),
+		},
+		{
+			desc:        "[Error] dedicated mount without credentials",
+			context:     map[string]string{"publishMountOptions": "cache=none"},
+			staged:      true,
+			expectedErr: status.Errorf(codes.FailedPrecondition, "username is required in node publish secrets to publish volume(vol_1) with mount options [cache=none]"),
+		},
+	}
+
+	for i, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+		if test.staged {
+			d.stageCache.set(stagingPath, stageEntry{volumeID: "vol_1", source: "//server/share", mountOptions: []string{"vers=3.0,cache=strict"}})
+		}
+		target := filepath.Join(tmpDir, fmt.Sprintf("target-%d", i))
+		req := csi.NodePublishVolumeRequest{
+			VolumeCapability:  &csi.VolumeCapability{AccessMode: &volumeCap},
+			VolumeId:          "vol_1",
+			TargetPath:        target,
+			StagingTargetPath: stagingPath,
+			VolumeContext:     test.context,
+			Secrets:           test.secrets,
+			Readonly:          true,
+		}
+		_, err := d.NodePublishVolume(context.Background(), &req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+		}
+		if test.expectedErr != nil {
+			continue
+		}
+		mountPoints, _ := d.mounter.List()
+		if assert.Equal(t, 1, len(mountPoints), test.desc) {
+			assert.Equal(t, test.expectedDevice, mountPoints[0].Device, test.desc)
+			assert.Equal(t, test.expectedType, mountPoints[0].Type, test.desc)
+			assert.Equal(t, test.expectedOptions, mountPoints[0].Opts, test.desc)
+		}
+	}
+}
+
+func TestHandleCorruptedMount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	source := "/staging"
+	target := "/target"
+	tests := []struct {
+		desc              string
+		policy            string
+		corruptedPath     string
+		expectedErr       error
+		expectedUnmounted bool
+	}{
+		{
+			desc:          "[Success] Corrupted target is ignored by default",
+			corruptedPath: target,
+		},
+		{
+			desc:          "[Success] Corrupted target is ignored",
+			policy:        corruptedMountPolicyIgnore,
+			corruptedPath: target,
+		},
+		{
+			desc:   "[Success] No corrupted mount",
+			policy: corruptedMountPolicyFail,
+		},
+		{
+			desc:          "[Error] Corrupted target with fail policy",
+			policy:        corruptedMountPolicyFail,
+			corruptedPath: target,
+			expectedErr:   status.Errorf(codes.FailedPrecondition, "target path %s is a corrupted mount", target),
+		},
+		{
+			desc:              "[Success] Corrupted target is recovered",
+			policy:            corruptedMountPolicyRecover,
+			corruptedPath:     target,
+			expectedUnmounted: true,
+		},
+		{
+			desc:          "[Error] Corrupted staging path could not be recovered",
+			policy:        corruptedMountPolicyRecover,
+			corruptedPath: source,
+			expectedErr:   status.Errorf(codes.FailedPrecondition, "staging path %s is a corrupted mount", source),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.corruptedMountPublishPolicy = test.policy
+		fakeMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: source, Path: target, Type: "none"}})
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		err := d.handleCorruptedMount(source, target, func(path string) bool {
+			return path == test.corruptedPath
+		})
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+		}
+		mountPoints, _ := d.mounter.List()
+		if unmounted := len(mountPoints) == 0; unmounted != test.expectedUnmounted {
+			t.Errorf("[%s]: Expected unmounted : %v, Actual unmounted: %v", test.desc, test.expectedUnmounted, unmounted)
+		}
+	}
+
+	assert.NoError(t, validateCorruptedMountPublishPolicy(""))
+	assert.NoError(t, validateCorruptedMountPublishPolicy(corruptedMountPolicyRecover))
+	assert.Equal(t, fmt.Errorf("invalid corrupted mount publish policy: repair, supported values: ignore, fail, recover"), validateCorruptedMountPublishPolicy("repair"))
+}
+
+func TestEnsureDir(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "csi-smb-ensure-dir-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// create directory along with missing parents
+	target := filepath.Join(tmpDir, "a", "b", "c")
+	assert.NoError(t, ensureDir(target, 0750))
+	info, err := os.Stat(target)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	// existing directory is treated as success
+	assert.NoError(t, ensureDir(target, 0750))
+
+	// existing file is not a directory
+	file := filepath.Join(tmpDir, "file")
+	assert.NoError(t, os.WriteFile(file, []byte{}, 0644))
+	err = ensureDir(file, 0750)
+	var e *os.PathError
+	if !errors.As(err, &e) {
+		t.Errorf("Unexpected Error: %v", err)
+	}
+
+	// concurrent creation of the same path
+	concurrent := filepath.Join(tmpDir, "x", "y", "z")
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- ensureDir(concurrent, 0750)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	nonexistedPath := "/not/a/real/directory"
+	fakePath := "/tmp/fake-volume-path"
+
+	tests := []struct {
+		desc        string
+		req         csi.NodeGetVolumeStatsRequest
+		expectedErr error
+	}{
+		{
+			desc:        "[Error] Volume ID missing",
+			req:         csi.NodeGetVolumeStatsRequest{VolumePath: fakePath},
+			expectedErr: status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume ID was empty"),
+		},
+		{
+			desc:        "[Error] VolumePath missing",
+			req:         csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1"},
+			expectedErr: status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty"),
+		},
+		{
+			desc:        "[Error] Incorrect volume path",
+			req:         csi.NodeGetVolumeStatsRequest{VolumePath: nonexistedPath, VolumeId: "vol_1"},
+			expectedErr: status.Errorf(codes.NotFound, "path /not/a/real/directory does not exist"),
+		},
+		{
+			desc:        "[Success] Standard success",
+			req:         csi.NodeGetVolumeStatsRequest{VolumePath: fakePath, VolumeId: "vol_1"},
+			expectedErr: nil,
+		},
+	}
+
+	// Setup
+	_ = makeDir(fakePath)
+	d := NewFakeDriver()
+	for _, test := range tests {
+		_, err := d.NodeGetVolumeStats(context.Background(), &test.req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("desc: %v, expected error: %v, actual error: %v", test.desc, test.expectedErr, err)
+		}
+	}
+
+	// Clean up
+	err := os.RemoveAll(fakePath)
+	assert.NoError(t, err)
+}
+
+func TestGetWindowsMountUsername(t *testing.T) {
+	tests := []struct {
+		desc          string
+		username      string
+		domain        string
+		defaultDomain string
+		format        string
+		expected      string
+	}{
+		{
+			desc:          "built-in default domain",
+			username:      "user",
+			defaultDomain: NewFakeDriver().defaultDomain,
+			expected:      "AZURE\\user",
+		},
+		{
+			desc:          "default domain from flag",
+			username:      "user",
+			defaultDomain: NewDriver(&DriverOptions{DefaultDomain: "CONTOSO"}).defaultDomain,
+			expected:      "CONTOSO\\user",
+		},
+		{
+			desc:          "domain specified",
+			username:      "user",
+			domain:        "fabrikam",
+			defaultDomain: "CONTOSO",
+			expected:      "fabrikam\\user",
+		},
+		{
+			desc:          "username with domain",
+			username:      "fabrikam\\user",
+			defaultDomain: "CONTOSO",
+			expected:      "fabrikam\\user",
+		},
+		{
+			desc:          "default domain in upn format",
+			username:      "user",
+			defaultDomain: "CONTOSO",
+			format:        windowsUsernameFormatUPN,
+			expected:      "user@CONTOSO",
+		},
+		{
+			desc:          "domain specified in upn format",
+			username:      "user",
+			domain:        "fabrikam.com",
+			defaultDomain: "CONTOSO",
+			format:        windowsUsernameFormatUPN,
+			expected:      "user@fabrikam.com",
+		},
+		{
+			desc:     "username with domain in upn format",
+			username: "fabrikam\\user",
+			domain:   "contoso.com",
+			format:   windowsUsernameFormatUPN,
+			expected: "fabrikam\\user",
+		},
+		{
+			desc:          "upn username in down-level format",
+			username:      "user@fabrikam.com",
+			domain:        "CONTOSO",
+			defaultDomain: "AZURE",
+			format:        windowsUsernameFormatDownLevel,
+			expected:      "user@fabrikam.com",
+		},
+		{
+			desc:     "upn username in upn format",
+			username: "user@fabrikam.com",
+			domain:   "contoso.com",
+			format:   windowsUsernameFormatUPN,
+			expected: "user@fabrikam.com",
+		},
+	}
+
+	for _, test := range tests {
+		result := getWindowsMountUsername(test.username, test.domain, test.defaultDomain, test.format)
+		if result != test.expected {
+			t.Errorf("test[%s]: unexpected output: %s, expected result: %s", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestNodeGetVolumeStatsStageComplete(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tmpDir, err := os.MkdirTemp("", "csi-smb-volume-stats-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	volumePath := filepath.Join(tmpDir, "volume")
+	cachedStagingPath := filepath.Join(tmpDir, "cached")
+	mountedStagingPath := filepath.Join(tmpDir, "mounted")
+	inProgressStagingPath := filepath.Join(tmpDir, "in-progress")
+	for _, path := range []string{volumePath, cachedStagingPath, mountedStagingPath, inProgressStagingPath} {
+		assert.NoError(t, makeDir(path))
+	}
+
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: mount.NewFakeMounter([]mount.MountPoint{{Device: "//smb-server/share", Path: mountedStagingPath, Type: "cifs"}}),
+	}
+	d.stageCache.set(cachedStagingPath, stageEntry{volumeID: "vol_1", source: "//smb-server/share"})
+
+	tests := []struct {
+		desc        string
+		stagingPath string
+		expectedErr error
+	}{
+		{
+			desc:        "[Success] stage is complete in stage cache",
+			stagingPath: cachedStagingPath,
+		},
+		{
+			desc:        "[Success] stage is complete in mount table",
+			stagingPath: mountedStagingPath,
+		},
+		{
+			desc:        "[Error] stage is in progress",
+			stagingPath: inProgressStagingPath,
+			expectedErr: status.Errorf(codes.FailedPrecondition, "staging path %s is not mounted yet", inProgressStagingPath),
+		},
+	}
+
+	for _, test := range tests {
+		req := csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: volumePath, StagingTargetPath: test.stagingPath}
+		_, err := d.NodeGetVolumeStats(context.Background(), &req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGetVolumeMountGroupID(t *testing.T) {
+	defer func() {
+		lookupGroup = user.LookupGroup
+	}()
+	lookupGroup = func(name string) (*user.Group, error) {
+		if name == "smbusers" {
+			return &user.Group{Gid: "2000", Name: name}, nil
+		}
+		return nil, user.UnknownGroupError(name)
+	}
+
+	tests := []struct {
+		desc             string
+		volumeMountGroup string
+		resolveName      bool
+		expectedGid      string
+		expectedErr      error
+	}{
+		{
+			desc:             "numeric gid",
+			volumeMountGroup: "1000",
+			expectedGid:      "1000",
+		},
+		{
+			desc:             "resolvable group name",
+			volumeMountGroup: "smbusers",
+			resolveName:      true,
+			expectedGid:      "2000",
+		},
+		{
+			desc:             "group name without resolution",
+			volumeMountGroup: "smbusers",
+			expectedErr:      fmt.Errorf("invalid volume mount group smbusers, it must be a numeric gid"),
+		},
+		{
+			desc:             "unknown group name",
+			volumeMountGroup: "nogroup,uid=0",
+			resolveName:      true,
+			expectedErr:      fmt.Errorf("invalid volume mount group nogroup,uid=0, it's neither a numeric gid nor a group name in the driver container: group: unknown group nogroup,uid=0"),
+		},
+		{
+			desc:             "negative gid",
+			volumeMountGroup: "-1",
+			expectedErr:      fmt.Errorf("invalid volume mount group -1, it must be a numeric gid"),
+		},
+	}
+
+	for _, test := range tests {
+		gid, err := getVolumeMountGroupID(test.volumeMountGroup, test.resolveName)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedGid, gid, test.desc)
+	}
+}
+
+func TestNodeStageVolumePrefixPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tests := []struct {
+		desc           string
+		prefixPath     string
+		subDir         string
+		expectedSource string
+		expectedErr    error
+	}{
+		{
+			desc:           "prefixPath and subDir are joined",
+			prefixPath:     "/data/",
+			subDir:         "subdir",
+			expectedSource: "//smb-server/share/data/subdir",
+		},
+		{
+			desc:           "prefixPath without subDir",
+			prefixPath:     "data",
+			expectedSource: "//smb-server/share/data",
+		},
+		{
+			desc:        "prefixPath escapes share root",
+			prefixPath:  "../share2",
+			subDir:      "subdir",
+			expectedErr: status.Error(codes.InvalidArgument, "volume(vol_1##): invalid prefixpath value: ../share2, it must not contain .."),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "//smb-server/share", "prefixPath": test.prefixPath, subDirField: test.subDir},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		if test.expectedErr == nil {
+			assert.Len(t, fakeMounter.MountPoints, 1, test.desc)
+			assert.Equal(t, test.expectedSource, fakeMounter.MountPoints[0].Device, test.desc)
+		}
+	}
+}
+
+func TestNodeStageVolumeLiveMount(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("skip test on non-Linux node")
+	}
+	tmpDir := t.TempDir()
+	liveStagingPath := filepath.Join(tmpDir, "live")
+	staleStagingPath := filepath.Join(tmpDir, "stale")
+	defer func() {
+		readDir = os.ReadDir
+	}()
+	readDir = func(name string) ([]os.DirEntry, error) {
+		if name == staleStagingPath {
+			return nil, syscall.ESTALE
+		}
+		return os.ReadDir(name)
+	}
+
+	tests := []struct {
+		desc              string
+		stagingPath       string
+		expectedRemounted bool
+	}{
+		{
+			desc:        "live mount is reused",
+			stagingPath: liveStagingPath,
+		},
+		{
+			desc:              "stale mount is remounted",
+			stagingPath:       staleStagingPath,
+			expectedRemounted: true,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.reuseLiveStageMount = true
+		fakeMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "//smb-server/share", Path: test.stagingPath, Type: "cifs", Opts: []string{"rw", "vers=3.0"}}})
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: test.stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.NoError(t, err, test.desc)
+
+		var actions []string
+		for _, action := range fakeMounter.GetLog() {
+			actions = append(actions, action.Action)
+		}
+		if test.expectedRemounted {
+			assert.Equal(t, []string{mount.FakeActionUnmount, mount.FakeActionMount}, actions, test.desc)
+		} else {
+			assert.Empty(t, actions, test.desc)
+			entry, ok := d.stageCache.get(test.stagingPath)
+			assert.True(t, ok, test.desc)
+			assert.Equal(t, stageEntry{volumeID: "vol_1##", source: "//smb-server/share", mountOptions: []string{"rw", "vers=3.0"}}, stageEntry{volumeID: entry.volumeID, source: entry.source, mountOptions: entry.mountOptions}, test.desc)
+		}
+	}
+}
+
+func TestNodePublishVolumeStageComplete(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tmpDir := t.TempDir()
+	cachedStagingPath := filepath.Join(tmpDir, "cached")
+	mountedStagingPath := filepath.Join(tmpDir, "mounted")
+	inProgressStagingPath := filepath.Join(tmpDir, "in-progress")
+	for _, path := range []string{cachedStagingPath, mountedStagingPath, inProgressStagingPath} {
+		assert.NoError(t, makeDir(path))
+	}
+
+	volumeCap := csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	d := NewFakeDriver()
+	d.checkStagedOnPublish = true
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: mount.NewFakeMounter([]mount.MountPoint{{Device: "//smb-server/share", Path: mountedStagingPath, Type: "cifs"}}),
+	}
+	d.stageCache.set(cachedStagingPath, stageEntry{volumeID: "vol_1", source: "//smb-server/share"})
+
+	tests := []struct {
+		desc        string
+		stagingPath string
+		expectedErr error
+	}{
+		{
+			desc:        "[Success] stage is complete in stage cache",
+			stagingPath: cachedStagingPath,
+		},
+		{
+			desc:        "[Success] stage is complete in mount table",
+			stagingPath: mountedStagingPath,
+		},
+		{
+			desc:        "[Error] stage is in progress",
+			stagingPath: inProgressStagingPath,
+			expectedErr: status.Errorf(codes.FailedPrecondition, "volume(vol_1) staging not complete: staging path %s is not mounted yet", inProgressStagingPath),
+		},
+	}
+
+	for i, test := range tests {
+		req := csi.NodePublishVolumeRequest{
+			VolumeId:          "vol_1",
+			VolumeCapability:  &csi.VolumeCapability{AccessMode: &volumeCap},
+			TargetPath:        filepath.Join(tmpDir, fmt.Sprintf("target-%d", i)),
+			StagingTargetPath: test.stagingPath,
+		}
+		_, err := d.NodePublishVolume(context.Background(), &req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGetVolumeStats(t *testing.T) {
+	tests := []struct {
+		desc                string
+		omitUnavailable     bool
+		metrics             *volume.Metrics
+		expectedUsageLength int
+	}{
+		{
+			desc:            "share with inode data",
+			omitUnavailable: true,
+			metrics: &volume.Metrics{
+				Available:  resource.NewQuantity(100, resource.BinarySI),
+				Capacity:   resource.NewQuantity(300, resource.BinarySI),
+				Used:       resource.NewQuantity(200, resource.BinarySI),
+				InodesFree: resource.NewQuantity(10, resource.BinarySI),
+				Inodes:     resource.NewQuantity(30, resource.BinarySI),
+				InodesUsed: resource.NewQuantity(20, resource.BinarySI),
+			},
+			expectedUsageLength: 2,
+		},
+		{
+			desc:            "share without inode data",
+			omitUnavailable: true,
+			metrics: &volume.Metrics{
+				Available:  resource.NewQuantity(100, resource.BinarySI),
+				Capacity:   resource.NewQuantity(300, resource.BinarySI),
+				Used:       resource.NewQuantity(200, resource.BinarySI),
+				InodesFree: resource.NewQuantity(0, resource.BinarySI),
+				Inodes:     resource.NewQuantity(0, resource.BinarySI),
+				InodesUsed: resource.NewQuantity(0, resource.BinarySI),
+			},
+			expectedUsageLength: 1,
+		},
+		{
+			desc:            "share with nil inode data",
+			omitUnavailable: true,
+			metrics: &volume.Metrics{
+				Available: resource.NewQuantity(100, resource.BinarySI),
+				Capacity:  resource.NewQuantity(300, resource.BinarySI),
+				Used:      resource.NewQuantity(200, resource.BinarySI),
+			},
+			expectedUsageLength: 1,
+		},
+		{
+			desc: "share without inode data, omission disabled",
+			metrics: &volume.Metrics{
+				Available: resource.NewQuantity(100, resource.BinarySI),
+				Capacity:  resource.NewQuantity(300, resource.BinarySI),
+				Used:      resource.NewQuantity(200, resource.BinarySI),
+			},
+			expectedUsageLength: 2,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.omitUnavailableInodesUsage = test.omitUnavailable
+		resp, err := d.getVolumeStats("/tmp", test.metrics)
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expectedUsageLength, len(resp.Usage), test.desc)
+		assert.Equal(t, csi.VolumeUsage_BYTES, resp.Usage[0].Unit, test.desc)
+		assert.Equal(t, int64(200), resp.Usage[0].Used, test.desc)
+		if len(resp.Usage) == 2 {
+			assert.Equal(t, csi.VolumeUsage_INODES, resp.Usage[1].Unit, test.desc)
+		}
+	}
+}
+
+func TestNodeGetVolumeStatsWalk(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "csi-smb-volume-stats-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	assert.NoError(t, makeDir(filepath.Join(tmpDir, "subdir")))
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpDir, "a"), make([]byte, 1000), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpDir, "subdir", "b"), make([]byte, 24), 0644))
+
+	size, inodes, complete, err := getDirUsage(tmpDir, 10)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, int64(1024), size)
+	assert.Equal(t, int64(4), inodes)
+
+	_, _, complete, err = getDirUsage(tmpDir, 3)
+	assert.NoError(t, err)
+	assert.False(t, complete)
+
+	req := csi.NodeGetVolumeStatsRequest{VolumePath: tmpDir, VolumeId: "vol_1"}
+	d := NewFakeDriver()
+	statfsResp, err := d.NodeGetVolumeStats(context.Background(), &req)
+	assert.NoError(t, err)
+
+	d.volumeStatsWalkMaxEntries = 10
+	walkResp, err := d.NodeGetVolumeStats(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), walkResp.Usage[0].Used)
+	assert.Equal(t, int64(4), walkResp.Usage[1].Used)
+	assert.Equal(t, statfsResp.Usage[0].Total, walkResp.Usage[0].Total)
+	assert.NotEqual(t, statfsResp.Usage[0].Used, walkResp.Usage[0].Used)
+
+	// fall back to statfs if there are too many entries
+	d.volumeStatsWalkMaxEntries = 3
+	fallbackResp, err := d.NodeGetVolumeStats(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, int64(1024), fallbackResp.Usage[0].Used)
+}
+
+func TestCheckGidPresentInMountFlags(t *testing.T) {
+	tests := []struct {
+		desc       string
+		MountFlags []string
+		result     bool
+	}{
+		{
+			desc:       "[Success] Gid present in mount flags",
+			MountFlags: []string{"gid=3000"},
+			result:     true,
+		},
+		{
+			desc:       "[Success] Gid not present in mount flags",
+			MountFlags: []string{},
+			result:     false,
+		},
+	}
+
+	for _, test := range tests {
+		gIDPresent := checkGidPresentInMountFlags(test.MountFlags)
+		if gIDPresent != test.result {
+			t.Errorf("[%s]: Expected result : %t, Actual result: %t", test.desc, test.result, gIDPresent)
+		}
+	}
+}
+
+func TestSelectDomainByHostname(t *testing.T) {
+	tests := []struct {
+		desc     string
+		hostname string
+		domains  []string
+		expected string
+	}{
+		{
+			desc:     "[Success] No domains, fall back to single domain",
+			hostname: "fs1.fabrikam.com",
+			expected: "",
+		},
+		{
+			desc:     "[Success] Fully qualified domain matched",
+			hostname: "fs1.fabrikam.com",
+			domains:  []string{"contoso.com", "fabrikam.com"},
+			expected: "fabrikam.com",
+		},
+		{
+			desc:     "[Success] Longest fully qualified domain preferred",
+			hostname: "fs1.eu.fabrikam.com",
+			domains:  []string{"fabrikam.com", "eu.fabrikam.com"},
+			expected: "eu.fabrikam.com",
+		},
+		{
+			desc:     "[Success] NetBIOS domain matched",
+			hostname: "FS1.Fabrikam.com",
+			domains:  []string{"CONTOSO", "FABRIKAM"},
+			expected: "FABRIKAM",
+		},
+		{
+			desc:     "[Success] No domain matched, fall back to single domain",
+			hostname: "fs1.example.com",
+			domains:  []string{"CONTOSO", "FABRIKAM"},
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		result := selectDomainByHostname(test.hostname, test.domains)
+		if result != test.expected {
+			t.Errorf("[%s]: Expected result : %s, Actual result: %s", test.desc, test.expected, result)
+		}
+	}
+}
+
+func TestApplyEncryptionPolicy(t *testing.T) {
+	tests := []struct {
+		desc              string
+		mountOptions      []string
+		requireEncryption bool
+		autoAdd           bool
+		expectedOptions   []string
+		expectedErr       error
+	}{
+		{
+			desc:            "[Success] No encryption policy",
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:              "[Success] Seal present in require mode",
+			mountOptions:      []string{"vers=3.0,seal"},
+			requireEncryption: true,
+			expectedOptions:   []string{"vers=3.0,seal"},
+		},
+		{
+			desc:              "[Error] Seal missing in require mode",
+			mountOptions:      []string{"vers=3.0"},
+			requireEncryption: true,
+			expectedOptions:   []string{"vers=3.0"},
+			expectedErr:       fmt.Errorf("seal mount option is required since unencrypted mount is not allowed, current mount options: [vers=3.0]"),
+		},
+		{
+			desc:              "[Success] Seal added in auto mode",
+			mountOptions:      []string{"vers=3.0"},
+			requireEncryption: true,
+			autoAdd:           true,
+			expectedOptions:   []string{"vers=3.0", "seal"},
+		},
+		{
+			desc:            "[Success] Seal not duplicated in auto mode",
+			mountOptions:    []string{"seal"},
+			autoAdd:         true,
+			expectedOptions: []string{"seal"},
+		},
+	}
+
+	for _, test := range tests {
+		options, err := applyEncryptionPolicy(test.mountOptions, test.requireEncryption, test.autoAdd)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+		}
+		if !reflect.DeepEqual(options, test.expectedOptions) {
+			t.Errorf("[%s]: Expected options : %v, Actual options: %v", test.desc, test.expectedOptions, options)
+		}
+	}
+}
+
+func TestVolumeKerberosCacheName(t *testing.T) {
+	tests := []struct {
+		name string
+	}{
+		{
+			name: "s", // short name
+		},
+		{
+			name: "Volume Handle##unique suffix",
+		},
+		{
+			name: "Volume With Spaces and Slashes // and symbols that produce /+ after base64 ???????~~~~~~~~",
 		},
 	}
 
@@ -715,209 +2141,1132 @@ func TestVolumeKerberosCacheName(t *testing.T) {
 	}
 }
 
-func TestHasKerberosMountOption(t *testing.T) {
+func TestHasKerberosMountOption(t *testing.T) {
+	tests := []struct {
+		desc       string
+		MountFlags []string
+		result     bool
+	}{
+		{
+			desc:       "[Success] Sec kerberos present in mount flags",
+			MountFlags: []string{"sec=krb5"},
+			result:     true,
+		},
+		{
+			desc:       "[Success] Sec kerberos present in mount flags",
+			MountFlags: []string{"sec=krb5i"},
+			result:     true,
+		},
+		{
+			desc:       "[Success] Sec kerberos not present in mount flags",
+			MountFlags: []string{},
+			result:     false,
+		},
+		{
+			desc:       "[Success] Sec kerberos not present in mount flags",
+			MountFlags: []string{"sec=ntlm"},
+			result:     false,
+		},
+	}
+
+	for _, test := range tests {
+		securityIsKerberos := hasKerberosMountOption(test.MountFlags)
+		if securityIsKerberos != test.result {
+			t.Errorf("[%s]: Expected result : %t, Actual result: %t", test.desc, test.result, securityIsKerberos)
+		}
+	}
+}
+
+func TestGetCredUID(t *testing.T) {
+	_, convertErr := strconv.Atoi("foo")
+	tests := []struct {
+		desc        string
+		MountFlags  []string
+		result      int
+		expectedErr error
+	}{
+		{
+			desc:        "[Success] Got correct credUID",
+			MountFlags:  []string{"cruid=1000"},
+			result:      1000,
+			expectedErr: nil,
+		},
+		{
+			desc:        "[Success] Got correct credUID",
+			MountFlags:  []string{"cruid=0"},
+			result:      0,
+			expectedErr: nil,
+		},
+		{
+			desc:        "[Error] Got error when no CredUID",
+			MountFlags:  []string{},
+			result:      -1,
+			expectedErr: fmt.Errorf("Can't find credUid in mount flags"),
+		},
+		{
+			desc:        "[Error] Got error when CredUID is not an int",
+			MountFlags:  []string{"cruid=foo"},
+			result:      0,
+			expectedErr: convertErr,
+		},
+	}
+
+	for _, test := range tests {
+		credUID, err := getCredUID(test.MountFlags)
+		if credUID != test.result {
+			t.Errorf("[%s]: Expected result : %d, Actual result: %d", test.desc, test.result, credUID)
+		}
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+		}
+	}
+}
+
+func TestEnsureCredUID(t *testing.T) {
+	tests := []struct {
+		desc           string
+		mountFlags     []string
+		defaultCredUID string
+		result         []string
+		expectedErr    error
+	}{
+		{
+			desc:       "[Success] Non-kerberos mount is not changed",
+			mountFlags: []string{"vers=3.0"},
+			result:     []string{"vers=3.0"},
+		},
+		{
+			desc:           "[Success] CredUID in mount flags is kept",
+			mountFlags:     []string{"sec=krb5,cruid=1000"},
+			defaultCredUID: "2000",
+			result:         []string{"sec=krb5,cruid=1000"},
+		},
+		{
+			desc:           "[Success] Default CredUID is appended when no CredUID",
+			mountFlags:     []string{"sec=krb5"},
+			defaultCredUID: "2000",
+			result:         []string{"sec=krb5", "cruid=2000"},
+		},
+		{
+			desc:        "[Error] Got error when no CredUID and no default CredUID",
+			mountFlags:  []string{"sec=krb5"},
+			expectedErr: fmt.Errorf("kerberos (sec=krb5) requires a cruid= mount option, which is the uid owning the kerberos cache in secrets"),
+		},
+		{
+			desc:           "[Error] Got error when CredUID is not an int",
+			mountFlags:     []string{"sec=krb5", "cruid=foo"},
+			defaultCredUID: "2000",
+			expectedErr:    fmt.Errorf("kerberos (sec=krb5) requires a valid cruid= mount option: strconv.Atoi: parsing \"foo\": invalid syntax"),
+		},
+	}
+
+	for _, test := range tests {
+		mountFlags := append([]string{}, test.mountFlags...)
+		result, err := ensureCredUID(mountFlags, test.defaultCredUID)
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("[%s]: Expected result : %v, Actual result: %v", test.desc, test.result, result)
+		}
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+		}
+		if !reflect.DeepEqual(mountFlags, test.mountFlags) {
+			t.Errorf("[%s]: mount flags are changed: %v", test.desc, mountFlags)
+		}
+	}
+}
+
+func TestGetKerberosCache(t *testing.T) {
+	ticket := []byte{'G', 'O', 'L', 'A', 'N', 'G'}
+	base64Ticket := base64.StdEncoding.EncodeToString(ticket)
+	credUID := 1000
+	goodFileName := fmt.Sprintf("%s%s%d", krb5CacheDirectory, krb5Prefix, credUID)
+	krb5CcacheName := "krb5cc_1000"
+
+	_, base64DecError := base64.StdEncoding.DecodeString("123")
+	tests := []struct {
+		desc             string
+		credUID          int
+		secrets          map[string]string
+		maxSize          int64
+		expectedFileName string
+		expectedContent  []byte
+		expectedErr      error
+	}{
+		{
+			desc:    "[Success] Got correct filename and content",
+			credUID: 1000,
+			secrets: map[string]string{
+				krb5CcacheName: base64Ticket,
+			},
+			expectedFileName: goodFileName,
+			expectedContent:  ticket,
+			expectedErr:      nil,
+		},
+		{
+			desc:    "[Error] Throw error if credUID mismatch",
+			credUID: 1001,
+			secrets: map[string]string{
+				krb5CcacheName: base64Ticket,
+			},
+			expectedFileName: "",
+			expectedContent:  nil,
+			expectedErr:      status.Error(codes.InvalidArgument, fmt.Sprintf("Empty kerberos cache in key %s", "krb5cc_1001")),
+		},
+		{
+			desc:    "[Error] Throw error if ticket is empty in secret",
+			credUID: 1000,
+			secrets: map[string]string{
+				krb5CcacheName: "",
+			},
+			expectedFileName: "",
+			expectedContent:  nil,
+			expectedErr:      status.Error(codes.InvalidArgument, fmt.Sprintf("Empty kerberos cache in key %s", krb5CcacheName)),
+		},
+		{
+			desc:    "[Error] Throw error if ticket is invalid base64",
+			credUID: 1000,
+			secrets: map[string]string{
+				krb5CcacheName: "123",
+			},
+			expectedFileName: "",
+			expectedContent:  nil,
+			expectedErr:      status.Error(codes.InvalidArgument, fmt.Sprintf("Malformed kerberos cache in key %s, expected to be in base64 form: %v", krb5CcacheName, base64DecError)),
+		},
+		{
+			desc:    "[Success] Got correct content within size limit",
+			credUID: 1000,
+			secrets: map[string]string{
+				krb5CcacheName: base64Ticket,
+			},
+			maxSize:          int64(len(ticket)),
+			expectedFileName: goodFileName,
+			expectedContent:  ticket,
+			expectedErr:      nil,
+		},
+		{
+			desc:    "[Error] Throw error if ticket exceeds size limit",
+			credUID: 1000,
+			secrets: map[string]string{
+				krb5CcacheName: base64.StdEncoding.EncodeToString(make([]byte, 1025)),
+			},
+			maxSize:          1024,
+			expectedFileName: "",
+			expectedContent:  nil,
+			expectedErr:      status.Error(codes.InvalidArgument, fmt.Sprintf("kerberos cache in key %s exceeds size limit of %d bytes", krb5CcacheName, 1024)),
+		},
+	}
+
+	for _, test := range tests {
+		fileName, content, err := getKerberosCache(test.credUID, test.secrets, test.maxSize)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+		} else {
+			if fileName != test.expectedFileName {
+				t.Errorf("[%s]: Expected filename : %s, Actual result: %s", test.desc, test.expectedFileName, fileName)
+			}
+			if !reflect.DeepEqual(content, test.expectedContent) {
+				t.Errorf("[%s]: Expected content : %s, Actual content: %s", test.desc, test.expectedContent, content)
+			}
+		}
+	}
+
+}
+
+func TestReplaceSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	tmpDir, err := os.MkdirTemp("", "csi-smb-symlink-replace-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	var targets []string
+	for i := 0; i < 5; i++ {
+		target := filepath.Join(tmpDir, fmt.Sprintf("%s-vol-%d", krb5Prefix, i))
+		assert.NoError(t, os.WriteFile(target, []byte("ticket"), 0600))
+		targets = append(targets, target)
+	}
+	link := filepath.Join(tmpDir, krb5Prefix+"1000")
+	assert.NoError(t, replaceSymlink(targets[0], link))
+
+	// replace symlink concurrently while checking it always resolves
+	stop := make(chan struct{})
+	unresolved := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(unresolved)
+				return
+			default:
+			}
+			if _, err := os.Stat(link); err != nil {
+				unresolved <- err
+				close(unresolved)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, replaceSymlink(targets[(i+j)%len(targets)], link))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	if err := <-unresolved; err != nil {
+		t.Errorf("symlink %s did not resolve during replacement: %v", link, err)
+	}
+
+	// no temporary symlinks are left
+	entries, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Equal(t, len(targets)+1, len(entries))
+}
+
+func TestNodePublishVolumeIdempotentMount(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		return
+	}
+	sourceTest := "./sourcetest"
+	err := makeDir(sourceTest)
+	assert.NoError(t, err)
+
+	targetTest := "./targettest"
+	err = makeDir(targetTest)
+	assert.NoError(t, err)
+
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: mount.New(""),
+		Exec:      exec.New(),
+	}
+
+	volumeCap := csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	req := csi.NodePublishVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+		VolumeId:          "vol_1",
+		TargetPath:        targetTest,
+		StagingTargetPath: sourceTest,
+		Readonly:          true}
+
+	_, err = d.NodePublishVolume(context.Background(), &req)
+	assert.NoError(t, err)
+	_, err = d.NodePublishVolume(context.Background(), &req)
+	assert.NoError(t, err)
+
+	// ensure the target not be mounted twice
+	targetAbs, err := filepath.Abs(targetTest)
+	assert.NoError(t, err)
+
+	mountList, err := d.mounter.List()
+	assert.NoError(t, err)
+	mountPointNum := 0
+	for _, mountPoint := range mountList {
+		if mountPoint.Path == targetAbs {
+			mountPointNum++
+		}
+	}
+	assert.Equal(t, 1, mountPointNum)
+	err = d.mounter.Unmount(targetTest)
+	assert.NoError(t, err)
+	_ = d.mounter.Unmount(targetTest)
+	err = os.RemoveAll(sourceTest)
+	assert.NoError(t, err)
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestCheckUnderKubeletRootDir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "kubelet")
+	tests := []struct {
+		desc        string
+		path        string
+		enforce     bool
+		expectedErr bool
+	}{
+		{
+			desc:    "staging path under kubelet root",
+			path:    filepath.Join(root, "plugins", "kubernetes.io", "csi", DefaultDriverName, "abc", "globalmount"),
+			enforce: true,
+		},
+		{
+			desc:        "path outside kubelet root",
+			path:        filepath.Join(filepath.Dir(root), "etc", "target"),
+			enforce:     true,
+			expectedErr: true,
+		},
+		{
+			desc:        "path escaping kubelet root",
+			path:        root + string(filepath.Separator) + filepath.Join("..", "kubelet-other", "target"),
+			enforce:     true,
+			expectedErr: true,
+		},
+		{
+			desc:        "kubelet root itself",
+			path:        root,
+			enforce:     true,
+			expectedErr: true,
+		},
+		{
+			desc:        "relative path",
+			path:        filepath.Join("plugins", "target"),
+			enforce:     true,
+			expectedErr: true,
+		},
+		{
+			desc: "path outside kubelet root is allowed if not enforced",
+			path: filepath.Join(filepath.Dir(root), "etc", "target"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.kubeletRootDir = root
+		d.enforceKubeletRootDir = test.enforce
+		err := d.checkUnderKubeletRootDir(test.path)
+		assert.Equal(t, test.expectedErr, err != nil, "%s: %v", test.desc, err)
+	}
+}
+
+func TestNodeStageVolumeOutsideKubeletRootDir(t *testing.T) {
+	d := NewFakeDriver()
+	d.kubeletRootDir = filepath.Join(t.TempDir(), "kubelet")
+	d.enforceKubeletRootDir = true
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+
+	_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, statErr := os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(statErr), "staging path should not be created")
+
+	_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol_1##",
+		TargetPath: filepath.Join(t.TempDir(), "mount"),
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGetVolumeStatsPartialFailure(t *testing.T) {
+	overflow := resource.MustParse("100Ei")
+	d := NewFakeDriver()
+
+	resp, err := d.getVolumeStats("/tmp", &volume.Metrics{
+		Available:  resource.NewQuantity(100, resource.BinarySI),
+		Capacity:   &overflow,
+		Used:       resource.NewQuantity(200, resource.BinarySI),
+		InodesFree: resource.NewQuantity(10, resource.BinarySI),
+		Inodes:     resource.NewQuantity(30, resource.BinarySI),
+		InodesUsed: &overflow,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []*csi.VolumeUsage{
+		{Unit: csi.VolumeUsage_BYTES, Available: 100, Total: 0, Used: 200},
+		{Unit: csi.VolumeUsage_INODES, Available: 10, Total: 30, Used: 0},
+	}, resp.Usage)
+
+	// error is returned if none of the metrics could be converted
+	_, err = d.getVolumeStats("/tmp", &volume.Metrics{
+		Available: &overflow,
+		Capacity:  &overflow,
+		Used:      &overflow,
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	// inode metrics are still usable if all byte metrics failed
+	resp, err = d.getVolumeStats("/tmp", &volume.Metrics{
+		Available:  &overflow,
+		Capacity:   &overflow,
+		Used:       &overflow,
+		InodesFree: resource.NewQuantity(10, resource.BinarySI),
+		Inodes:     resource.NewQuantity(30, resource.BinarySI),
+		InodesUsed: resource.NewQuantity(20, resource.BinarySI),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []*csi.VolumeUsage{
+		{Unit: csi.VolumeUsage_BYTES, Available: 0, Total: 0, Used: 0},
+		{Unit: csi.VolumeUsage_INODES, Available: 10, Total: 30, Used: 20},
+	}, resp.Usage)
+
+	_, err = d.getVolumeStats("/tmp", &volume.Metrics{
+		Available:  &overflow,
+		Capacity:   &overflow,
+		Used:       &overflow,
+		InodesFree: &overflow,
+		Inodes:     &overflow,
+		InodesUsed: &overflow,
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestNodePublishVolumeBindMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip bind mode test on Windows")
+	}
+	tests := []struct {
+		desc              string
+		driverBindMode    string
+		volumeBindMode    string
+		expectedOptions   []string
+		expectedErrorCode codes.Code
+	}{
+		{
+			desc:            "default bind mode",
+			driverBindMode:  bindModeBind,
+			expectedOptions: []string{"bind"},
+		},
+		{
+			desc:            "rbind mode of driver",
+			driverBindMode:  bindModeRBind,
+			expectedOptions: []string{"rbind"},
+		},
+		{
+			desc:            "rbind mode in volume context overrides driver",
+			driverBindMode:  bindModeBind,
+			volumeBindMode:  "RBind",
+			expectedOptions: []string{"rbind"},
+		},
+		{
+			desc:              "invalid bind mode in volume context",
+			driverBindMode:    bindModeBind,
+			volumeBindMode:    "move",
+			expectedErrorCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+		d.bindMode = test.driverBindMode
+		volContext := map[string]string{}
+		if test.volumeBindMode != "" {
+			volContext["bindMode"] = test.volumeBindMode
+		}
+
+		_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol_1##",
+			TargetPath:        filepath.Join(t.TempDir(), "mount"),
+			StagingTargetPath: t.TempDir(),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: volContext,
+		})
+		assert.Equal(t, test.expectedErrorCode, status.Code(err), test.desc)
+		if test.expectedOptions != nil {
+			assert.Equal(t, 1, len(fakeMounter.MountPoints), test.desc)
+			if len(fakeMounter.MountPoints) == 1 {
+				assert.Equal(t, test.expectedOptions, fakeMounter.MountPoints[0].Opts, test.desc)
+			}
+		}
+	}
+}
+
+func TestNodeStageVolumeDisableGidMount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tests := []struct {
+		desc             string
+		context          map[string]string
+		volumeMountGroup string
+		expectedGid      bool
+	}{
+		{
+			desc:             "gid is appended from volume mount group by default",
+			context:          map[string]string{sourceField: "//smb-server/share"},
+			volumeMountGroup: "3000",
+			expectedGid:      true,
+		},
+		{
+			desc:             "gid is not appended if disableGidMount is true",
+			context:          map[string]string{sourceField: "//smb-server/share", "disableGidMount": "true"},
+			volumeMountGroup: "3000",
+		},
+		{
+			desc:             "gid is appended if disableGidMount is false",
+			context:          map[string]string{sourceField: "//smb-server/share", "disableGidMount": "false"},
+			volumeMountGroup: "3000",
+			expectedGid:      true,
+		},
+		{
+			desc:    "no gid without volume mount group",
+			context: map[string]string{sourceField: "//smb-server/share"},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: test.volumeMountGroup}},
+			},
+			VolumeContext: test.context,
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.NoError(t, err, test.desc)
+		assert.Len(t, fakeMounter.MountPoints, 1, test.desc)
+		if len(fakeMounter.MountPoints) == 1 {
+			assert.Equal(t, test.expectedGid, hasMountOption(fakeMounter.MountPoints[0].Opts, "gid"), test.desc)
+		}
+	}
+}
+
+func TestNodePublishVolumeConflictingSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
 	tests := []struct {
-		desc       string
-		MountFlags []string
-		result     bool
+		desc              string
+		targetDevice      string
+		symlinkTarget     bool
+		expectedErrorCode codes.Code
 	}{
 		{
-			desc:       "[Success] Sec kerberos present in mount flags",
-			MountFlags: []string{"sec=krb5"},
-			result:     true,
+			desc: "first publish",
 		},
 		{
-			desc:       "[Success] Sec kerberos present in mount flags",
-			MountFlags: []string{"sec=krb5i"},
-			result:     true,
+			desc:         "target is bind mount of the same staging path",
+			targetDevice: "//smb-server/share/vol1",
 		},
 		{
-			desc:       "[Success] Sec kerberos not present in mount flags",
-			MountFlags: []string{},
-			result:     false,
+			desc:              "target is bind mount of another volume",
+			targetDevice:      "//smb-server/share/vol2",
+			expectedErrorCode: codes.FailedPrecondition,
 		},
 		{
-			desc:       "[Success] Sec kerberos not present in mount flags",
-			MountFlags: []string{"sec=ntlm"},
-			result:     false,
+			desc:              "target aliases bind mount of another volume by symlink",
+			targetDevice:      "//smb-server/share/vol2",
+			symlinkTarget:     true,
+			expectedErrorCode: codes.FailedPrecondition,
 		},
 	}
 
 	for _, test := range tests {
-		securityIsKerberos := hasKerberosMountOption(test.MountFlags)
-		if securityIsKerberos != test.result {
-			t.Errorf("[%s]: Expected result : %t, Actual result: %t", test.desc, test.result, securityIsKerberos)
+		stagingPath := filepath.Join(t.TempDir(), "globalmount")
+		otherStagingPath := filepath.Join(t.TempDir(), "globalmount")
+		mountedTarget := filepath.Join(t.TempDir(), "mount")
+		assert.NoError(t, os.MkdirAll(stagingPath, 0750), test.desc)
+		assert.NoError(t, os.MkdirAll(mountedTarget, 0750), test.desc)
+		mountPoints := []mount.MountPoint{
+			{Device: "//smb-server/share/vol1", Path: stagingPath, Type: "cifs"},
+			{Device: "//smb-server/share/vol2", Path: otherStagingPath, Type: "cifs"},
+		}
+		if test.targetDevice != "" {
+			mountPoints = append(mountPoints, mount.MountPoint{Device: test.targetDevice, Path: mountedTarget, Type: "cifs"})
+		}
+		target := mountedTarget
+		if test.symlinkTarget {
+			target = filepath.Join(t.TempDir(), "mount")
+			assert.NoError(t, os.Symlink(mountedTarget, target), test.desc)
+		}
+
+		d := NewFakeDriver()
+		fakeMounter := mount.NewFakeMounter(mountPoints)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol_1##",
+			TargetPath:        target,
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+		}
+		_, err := d.NodePublishVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErrorCode, status.Code(err), test.desc)
+		if test.expectedErrorCode == codes.OK {
+			// re-publish of the same volume is idempotent
+			_, err = d.NodePublishVolume(context.Background(), req)
+			assert.NoError(t, err, test.desc)
+			assert.Len(t, fakeMounter.MountPoints, 3, test.desc)
+		} else {
+			assert.Len(t, fakeMounter.MountPoints, len(mountPoints), test.desc)
 		}
 	}
 }
 
-func TestGetCredUID(t *testing.T) {
-	_, convertErr := strconv.Atoi("foo")
+func TestNodeStageVolumeMaxSubDirDepth(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
 	tests := []struct {
-		desc        string
-		MountFlags  []string
-		result      int
-		expectedErr error
+		desc           string
+		maxSubDirDepth int
+		subDir         string
+		expectedErr    error
 	}{
 		{
-			desc:        "[Success] Got correct credUID",
-			MountFlags:  []string{"cruid=1000"},
-			result:      1000,
-			expectedErr: nil,
+			desc:   "no limit",
+			subDir: "a/b/c/${pvc.metadata.namespace}/${pvc.metadata.name}",
 		},
 		{
-			desc:        "[Success] Got correct credUID",
-			MountFlags:  []string{"cruid=0"},
-			result:      0,
-			expectedErr: nil,
+			desc:           "subDir within limit after replacement",
+			maxSubDirDepth: 2,
+			subDir:         "${pvc.metadata.namespace}/${pvc.metadata.name}",
 		},
 		{
-			desc:        "[Error] Got error when no CredUID",
-			MountFlags:  []string{},
-			result:      -1,
-			expectedErr: fmt.Errorf("Can't find credUid in mount flags"),
+			desc:           "subDir exceeds limit after replacement",
+			maxSubDirDepth: 2,
+			subDir:         "data/${pvc.metadata.namespace}/${pvc.metadata.name}",
+			expectedErr:    status.Error(codes.InvalidArgument, "volume(vol_1##): depth 3 of subdir data/pvcnamespace/pvcname exceeds max subdir depth 2"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.maxSubDirDepth = test.maxSubDirDepth
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "//smb-server/share", subDirField: test.subDir, pvcNamespaceKey: "pvcnamespace", pvcNameKey: "pvcname"},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		if test.expectedErr == nil {
+			assert.Len(t, fakeMounter.MountPoints, 1, test.desc)
+		} else {
+			assert.Empty(t, fakeMounter.MountPoints, test.desc)
+		}
+	}
+}
+
+func TestNodePublishVolumeRemountOnRecovery(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	defer func(f func(string) ([]os.DirEntry, error)) { readDir = f }(readDir)
+
+	tests := []struct {
+		desc              string
+		remountOnRecovery bool
+		expectedErr       bool
+	}{
+		{
+			desc:        "call fails after invalid mount is unmounted by default",
+			expectedErr: true,
 		},
 		{
-			desc:        "[Error] Got error when CredUID is not an int",
-			MountFlags:  []string{"cruid=foo"},
-			result:      0,
-			expectedErr: convertErr,
+			desc:              "invalid mount is remounted in the same call",
+			remountOnRecovery: true,
 		},
 	}
 
 	for _, test := range tests {
-		credUID, err := getCredUID(test.MountFlags)
-		if credUID != test.result {
-			t.Errorf("[%s]: Expected result : %d, Actual result: %d", test.desc, test.result, credUID)
+		stagingPath := t.TempDir()
+		target := filepath.Join(t.TempDir(), "mount")
+		assert.NoError(t, os.MkdirAll(target, 0750), test.desc)
+		// mount on target is stale until it's unmounted
+		stale := true
+		readDir = func(name string) ([]os.DirEntry, error) {
+			if name == target && stale {
+				return nil, syscall.ENOTCONN
+			}
+			return os.ReadDir(name)
 		}
-		if !reflect.DeepEqual(err, test.expectedErr) {
-			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+
+		d := NewFakeDriver()
+		d.remountOnRecovery = test.remountOnRecovery
+		fakeMounter := &unmountRecorder{FakeMounter: mount.NewFakeMounter([]mount.MountPoint{
+			{Device: stagingPath, Path: target, Opts: []string{"bind"}},
+		}), onUnmount: func() { stale = false }}
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol_1##",
+			TargetPath:        target,
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+		})
+		if test.expectedErr {
+			assert.Error(t, err, test.desc)
+			assert.Empty(t, fakeMounter.MountPoints, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		if assert.Len(t, fakeMounter.MountPoints, 1, test.desc) {
+			assert.Equal(t, stagingPath, fakeMounter.MountPoints[0].Device, test.desc)
+			assert.Equal(t, target, fakeMounter.MountPoints[0].Path, test.desc)
 		}
 	}
 }
 
-func TestGetKerberosCache(t *testing.T) {
-	ticket := []byte{'G', 'O', 'L', 'A', 'N', 'G'}
-	base64Ticket := base64.StdEncoding.EncodeToString(ticket)
-	credUID := 1000
-	goodFileName := fmt.Sprintf("%s%s%d", krb5CacheDirectory, krb5Prefix, credUID)
-	krb5CcacheName := "krb5cc_1000"
+func TestEnsureMountPointReadDirRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	defer func(f func(string) ([]os.DirEntry, error)) { readDir = f }(readDir)
+	defer func(interval time.Duration) { readDirRetryInterval = interval }(readDirRetryInterval)
+	readDirRetryInterval = time.Millisecond
 
-	_, base64DecError := base64.StdEncoding.DecodeString("123")
+	tests := []struct {
+		desc            string
+		readDirRetries  int
+		readDirFailures int
+		expectedMounted bool
+	}{
+		{
+			desc:            "transient ReadDir failure triggers unmount without retry",
+			readDirFailures: 1,
+		},
+		{
+			desc:            "transient ReadDir failure recovers on retry",
+			readDirRetries:  2,
+			readDirFailures: 2,
+			expectedMounted: true,
+		},
+		{
+			desc:            "persistent ReadDir failure triggers unmount after retries",
+			readDirRetries:  2,
+			readDirFailures: 3,
+		},
+	}
+
+	for _, test := range tests {
+		target := filepath.Join(t.TempDir(), "mount")
+		assert.NoError(t, os.MkdirAll(target, 0750), test.desc)
+		failures := 0
+		readDir = func(name string) ([]os.DirEntry, error) {
+			if name == target && failures < test.readDirFailures {
+				failures++
+				return nil, syscall.EIO
+			}
+			return os.ReadDir(name)
+		}
+
+		d := NewFakeDriver()
+		d.readDirRetries = test.readDirRetries
+		fakeMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "//smb-server/share", Path: target}})
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		mounted, err := d.ensureMountPoint(target)
+		assert.Equal(t, test.expectedMounted, mounted, test.desc)
+		assert.Equal(t, test.readDirFailures, failures, test.desc)
+		if test.expectedMounted {
+			assert.NoError(t, err, test.desc)
+			assert.Len(t, fakeMounter.MountPoints, 1, test.desc)
+		} else {
+			assert.Error(t, err, test.desc)
+			assert.Empty(t, fakeMounter.MountPoints, test.desc)
+		}
+	}
+}
+
+func TestNodeStageVolumeBlockAdminShares(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
 	tests := []struct {
 		desc             string
-		credUID          int
-		secrets          map[string]string
-		expectedFileName string
-		expectedContent  []byte
+		blockAdminShares bool
+		source           string
+		allowAdminShare  string
 		expectedErr      error
 	}{
 		{
-			desc:    "[Success] Got correct filename and content",
-			credUID: 1000,
-			secrets: map[string]string{
-				krb5CcacheName: base64Ticket,
-			},
-			expectedFileName: goodFileName,
-			expectedContent:  ticket,
-			expectedErr:      nil,
+			desc:             "administrative share is blocked",
+			blockAdminShares: true,
+			source:           "//smb-server/C$",
+			expectedErr:      status.Error(codes.InvalidArgument, "volume(vol_1##): administrative share C$ of //smb-server/C$ is blocked, set allowadminshare to true in volume context to allow it"),
 		},
 		{
-			desc:    "[Error] Throw error if credUID mismatch",
-			credUID: 1001,
-			secrets: map[string]string{
-				krb5CcacheName: base64Ticket,
-			},
-			expectedFileName: "",
-			expectedContent:  nil,
-			expectedErr:      status.Error(codes.InvalidArgument, fmt.Sprintf("Empty kerberos cache in key %s", "krb5cc_1001")),
+			desc:             "regular share is allowed",
+			blockAdminShares: true,
+			source:           "//smb-server/share",
 		},
 		{
-			desc:    "[Error] Throw error if ticket is empty in secret",
-			credUID: 1000,
-			secrets: map[string]string{
-				krb5CcacheName: "",
-			},
-			expectedFileName: "",
-			expectedContent:  nil,
-			expectedErr:      status.Error(codes.InvalidArgument, fmt.Sprintf("Empty kerberos cache in key %s", krb5CcacheName)),
+			desc:             "administrative share is allowed explicitly",
+			blockAdminShares: true,
+			source:           "//smb-server/ADMIN$",
+			allowAdminShare:  "true",
 		},
 		{
-			desc:    "[Error] Throw error if ticket is invalid base64",
-			credUID: 1000,
-			secrets: map[string]string{
-				krb5CcacheName: "123",
-			},
-			expectedFileName: "",
-			expectedContent:  nil,
-			expectedErr:      status.Error(codes.InvalidArgument, fmt.Sprintf("Malformed kerberos cache in key %s, expected to be in base64 form: %v", krb5CcacheName, base64DecError)),
+			desc:   "administrative share is not blocked by default",
+			source: "//smb-server/C$",
 		},
 	}
 
 	for _, test := range tests {
-		fileName, content, err := getKerberosCache(test.credUID, test.secrets)
-		if !reflect.DeepEqual(err, test.expectedErr) {
-			t.Errorf("[%s]: Expected error : %v, Actual error: %v", test.desc, test.expectedErr, err)
+		d := NewFakeDriver()
+		d.blockAdminShares = test.blockAdminShares
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: test.source, "allowAdminShare": test.allowAdminShare},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		if test.expectedErr == nil {
+			assert.Len(t, fakeMounter.MountPoints, 1, test.desc)
 		} else {
-			if fileName != test.expectedFileName {
-				t.Errorf("[%s]: Expected filename : %s, Actual result: %s", test.desc, test.expectedFileName, fileName)
-			}
-			if !reflect.DeepEqual(content, test.expectedContent) {
-				t.Errorf("[%s]: Expected content : %s, Actual content: %s", test.desc, test.expectedContent, content)
-			}
+			assert.Empty(t, fakeMounter.MountPoints, test.desc)
 		}
 	}
+}
 
+// sensitiveOptionsRecorder records sensitive options of the last mount
+type sensitiveOptionsRecorder struct {
+	*mount.FakeMounter
+	sensitiveOptions []string
 }
 
-func TestNodePublishVolumeIdempotentMount(t *testing.T) {
-	if runtime.GOOS == "windows" || os.Getuid() != 0 {
-		return
+func (m *sensitiveOptionsRecorder) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	m.sensitiveOptions = sensitiveOptions
+	return m.FakeMounter.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+func TestNodeStageVolumeCommaInCredentials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tests := []struct {
+		desc                     string
+		secrets                  map[string]string
+		expectedSensitiveOptions []string
+		expectedErr              error
+	}{
+		{
+			desc:                     "comma in password is escaped",
+			secrets:                  map[string]string{usernameField: "user", passwordField: "pa,ss"},
+			expectedSensitiveOptions: []string{"username=user,password=pa,,ss"},
+		},
+		{
+			desc:        "comma in username is rejected",
+			secrets:     map[string]string{usernameField: "user,admin", passwordField: "pass"},
+			expectedErr: status.Error(codes.InvalidArgument, "volume(vol_1##): value of mount option username must not contain a comma"),
+		},
+		{
+			desc:        "comma in domain is rejected",
+			secrets:     map[string]string{usernameField: "user", passwordField: "pass", domainField: "CONTOSO,ou=dev"},
+			expectedErr: status.Error(codes.InvalidArgument, "volume(vol_1##): value of mount option domain must not contain a comma"),
+		},
 	}
-	sourceTest := "./sourcetest"
-	err := makeDir(sourceTest)
-	assert.NoError(t, err)
 
-	targetTest := "./targettest"
-	err = makeDir(targetTest)
-	assert.NoError(t, err)
+	for _, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := &sensitiveOptionsRecorder{FakeMounter: mount.NewFakeMounter(nil)}
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+			Secrets:       test.secrets,
+		})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		if test.expectedErr == nil {
+			assert.Equal(t, test.expectedSensitiveOptions, fakeMounter.sensitiveOptions, test.desc)
+		} else {
+			assert.Empty(t, fakeMounter.MountPoints, test.desc)
+		}
+	}
+}
 
-	d := NewFakeDriver()
-	d.mounter = &mount.SafeFormatAndMount{
-		Interface: mount.New(""),
-		Exec:      exec.New(),
+func TestNodeStageVolumeNormalizeSourceSlashes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tests := []struct {
+		desc                   string
+		normalizeSourceSlashes bool
+		expectedDevice         string
+	}{
+		{
+			desc:                   "backslash source is converted",
+			normalizeSourceSlashes: true,
+			expectedDevice:         "//smb-server/share",
+		},
+		{
+			desc:           "backslash source is kept by default",
+			expectedDevice: "\\\\smb-server\\share",
+		},
 	}
 
-	volumeCap := csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
-	req := csi.NodePublishVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
-		VolumeId:          "vol_1",
-		TargetPath:        targetTest,
-		StagingTargetPath: sourceTest,
-		Readonly:          true}
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.normalizeSourceSlashes = test.normalizeSourceSlashes
+		fakeMounter := &sensitiveOptionsRecorder{FakeMounter: mount.NewFakeMounter(nil)}
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "\\\\smb-server\\share"},
+			Secrets:       map[string]string{usernameField: "CONTOSO\\user", passwordField: "pass"},
+		})
+		assert.NoError(t, err, test.desc)
+		if assert.Len(t, fakeMounter.MountPoints, 1, test.desc) {
+			assert.Equal(t, test.expectedDevice, fakeMounter.MountPoints[0].Device, test.desc)
+		}
+		// domain separator in username is preserved
+		assert.Equal(t, []string{"username=CONTOSO\\user,password=pass"}, fakeMounter.sensitiveOptions, test.desc)
+	}
+}
 
-	_, err = d.NodePublishVolume(context.Background(), &req)
-	assert.NoError(t, err)
-	_, err = d.NodePublishVolume(context.Background(), &req)
-	assert.NoError(t, err)
+// unmountRecorder calls onUnmount after a successful unmount
+type unmountRecorder struct {
+	*mount.FakeMounter
+	onUnmount func()
+}
 
-	// ensure the target not be mounted twice
-	targetAbs, err := filepath.Abs(targetTest)
-	assert.NoError(t, err)
+func (m *unmountRecorder) Unmount(target string) error {
+	if err := m.FakeMounter.Unmount(target); err != nil {
+		return err
+	}
+	m.onUnmount()
+	return nil
+}
 
-	mountList, err := d.mounter.List()
-	assert.NoError(t, err)
-	mountPointNum := 0
-	for _, mountPoint := range mountList {
-		if mountPoint.Path == targetAbs {
-			mountPointNum++
+func TestNodePublishVolumePublishSecretsPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	stageSecrets := map[string]string{usernameField: "stageuser", passwordField: "stagepass"}
+	tests := []struct {
+		desc                 string
+		publishSecretsPolicy string
+		publishMountOptions  string
+		publishSecrets       map[string]string
+		expectedErrorCode    codes.Code
+		expectedOptions      []string
+	}{
+		{
+			desc:                 "publish secrets are required by default",
+			publishSecretsPolicy: publishSecretsPolicyRequire,
+			publishMountOptions:  "cache=none",
+			expectedErrorCode:    codes.FailedPrecondition,
+		},
+		{
+			desc:                 "publish secrets only with require policy",
+			publishSecretsPolicy: publishSecretsPolicyRequire,
+			publishMountOptions:  "cache=none",
+			publishSecrets:       map[string]string{usernameField: "podname", passwordField: "podpass", domainField: "CONTOSO"},
+			expectedOptions:      []string{"vers=3.0", "cache=none", "username=podname", "password=podpass"},
+		},
+		{
+			desc:                 "credentials of stage are used without publish secrets",
+			publishSecretsPolicy: publishSecretsPolicyMerge,
+			publishMountOptions:  "cache=none",
+			expectedOptions:      []string{"vers=3.0", "cache=none", "username=stageuser", "password=stagepass"},
+		},
+		{
+			desc:                 "publish secrets override credentials of stage",
+			publishSecretsPolicy: publishSecretsPolicyMerge,
+			publishMountOptions:  "cache=none",
+			publishSecrets:       map[string]string{passwordField: "podpass", domainField: "CONTOSO"},
+			expectedOptions:      []string{"vers=3.0", "cache=none", "username=stageuser", "domain=CONTOSO", "password=podpass"},
+		},
+		{
+			desc:                 "publish secrets are ignored in bind mount",
+			publishSecretsPolicy: publishSecretsPolicyMerge,
+			publishSecrets:       map[string]string{usernameField: "pod\nuser", passwordField: "podpass"},
+			expectedOptions:      []string{"bind"},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.publishSecretsPolicy = test.publishSecretsPolicy
+		fakeMounter := mount.NewFakeMounter(nil)
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+		stagingPath := filepath.Join(t.TempDir(), "globalmount")
+		volCap := &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=3.0"}}},
+		}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  volCap,
+			VolumeContext:     map[string]string{sourceField: "//smb-server/share"},
+			Secrets:           stageSecrets,
+		})
+		assert.NoError(t, err, test.desc)
+		entry, _ := d.stageCache.get(stagingPath)
+		assert.Equal(t, test.publishSecretsPolicy == publishSecretsPolicyMerge, entry.credentials != nil, test.desc)
+
+		fakeMounter.MountPoints = nil
+		_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol_1##",
+			TargetPath:        filepath.Join(t.TempDir(), "mount"),
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  volCap,
+			VolumeContext:     map[string]string{publishMountOptionsField: test.publishMountOptions},
+			Secrets:           test.publishSecrets,
+		})
+		assert.Equal(t, test.expectedErrorCode, status.Code(err), test.desc)
+		if test.expectedOptions != nil && assert.Len(t, fakeMounter.MountPoints, 1, test.desc) {
+			assert.Equal(t, test.expectedOptions, fakeMounter.MountPoints[0].Opts, test.desc)
 		}
 	}
-	assert.Equal(t, 1, mountPointNum)
-	err = d.mounter.Unmount(targetTest)
-	assert.NoError(t, err)
-	_ = d.mounter.Unmount(targetTest)
-	err = os.RemoveAll(sourceTest)
-	assert.NoError(t, err)
-	err = os.RemoveAll(targetTest)
+}
+
+func TestNodeUnpublishVolumeRBind(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip bind mode test on Windows")
+	}
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	assert.NoError(t, os.MkdirAll(targetPath, 0750))
+	siblingPath := targetPath + "-sibling"
+
+	d := NewFakeDriver()
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "//smb-server/share", Path: targetPath, Type: "cifs", Opts: []string{"rbind"}},
+		{Device: "/dev/sdb", Path: filepath.Join(targetPath, "nested"), Type: "ext4"},
+		{Device: "tmpfs", Path: filepath.Join(targetPath, "nested", "deeper"), Type: "tmpfs"},
+		// mount point which shares the prefix of target path is not nested under it
+		{Device: "tmpfs", Path: siblingPath, Type: "tmpfs"},
+	})
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+	_, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1##", TargetPath: targetPath})
 	assert.NoError(t, err)
+
+	var unmounted []string
+	for _, action := range fakeMounter.GetLog() {
+		if action.Action == mount.FakeActionUnmount {
+			unmounted = append(unmounted, action.Target)
+		}
+	}
+	assert.Equal(t, []string{filepath.Join(targetPath, "nested", "deeper"), filepath.Join(targetPath, "nested"), targetPath}, unmounted)
+	assert.Equal(t, []mount.MountPoint{{Device: "tmpfs", Path: siblingPath, Type: "tmpfs"}}, fakeMounter.MountPoints)
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err))
 }
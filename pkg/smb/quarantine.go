@@ -0,0 +1,114 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// quarantineEntry records when a volume is quarantined and the stage error which caused the quarantine
+type quarantineEntry struct {
+	since   time.Time
+	lastErr string
+}
+
+// volumeQuarantine quarantines volumes which fail to stage repeatedly, stage requests of a quarantined volume
+// fail fast with a stable error until the volume is unstaged successfully or the cooldown expires
+type volumeQuarantine struct {
+	// consecutive stage failures to quarantine a volume, 0 means quarantine is disabled
+	threshold int
+	cooldown  time.Duration
+	failures  map[string]int
+	entries   map[string]quarantineEntry
+	now       func() time.Time
+	mux       sync.Mutex
+}
+
+func newVolumeQuarantine(threshold int, cooldown time.Duration) *volumeQuarantine {
+	return &volumeQuarantine{
+		threshold: threshold,
+		cooldown:  cooldown,
+		failures:  map[string]int{},
+		entries:   map[string]quarantineEntry{},
+		now:       time.Now,
+	}
+}
+
+// Check returns FailedPrecondition error if volumeID is quarantined, a quarantine is lifted once cooldown expires
+func (q *volumeQuarantine) Check(volumeID string) error {
+	if q.threshold <= 0 {
+		return nil
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	entry, ok := q.entries[volumeID]
+	if !ok {
+		return nil
+	}
+	if q.now().Sub(entry.since) >= q.cooldown {
+		klog.V(2).Infof("volume(%s) is released from quarantine after cooldown %v", volumeID, q.cooldown)
+		q.releaseLocked(volumeID)
+		return nil
+	}
+	return status.Errorf(codes.FailedPrecondition, "volume(%s) is quarantined after %d consecutive stage failures, last error: %s", volumeID, q.threshold, entry.lastErr)
+}
+
+// Record records the result of a stage request of volumeID, volumeID is quarantined once consecutive failures reach threshold,
+// Aborted errors are ignored since they are caused by concurrent operations on the same volume
+func (q *volumeQuarantine) Record(volumeID string, err error) {
+	if q.threshold <= 0 || status.Code(err) == codes.Aborted {
+		return
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if err == nil {
+		delete(q.failures, volumeID)
+		return
+	}
+	q.failures[volumeID]++
+	if q.failures[volumeID] < q.threshold {
+		return
+	}
+	if _, ok := q.entries[volumeID]; !ok {
+		klog.Warningf("volume(%s) is quarantined for %v after %d consecutive stage failures, last error: %v", volumeID, q.cooldown, q.failures[volumeID], err)
+		q.entries[volumeID] = quarantineEntry{since: q.now(), lastErr: err.Error()}
+		recordQuarantinedVolumes(len(q.entries))
+	}
+}
+
+// Release lifts quarantine and resets stage failures of volumeID
+func (q *volumeQuarantine) Release(volumeID string) {
+	if q.threshold <= 0 {
+		return
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.releaseLocked(volumeID)
+}
+
+func (q *volumeQuarantine) releaseLocked(volumeID string) {
+	delete(q.failures, volumeID)
+	if _, ok := q.entries[volumeID]; ok {
+		delete(q.entries, volumeID)
+		recordQuarantinedVolumes(len(q.entries))
+	}
+}
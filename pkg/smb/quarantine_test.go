@@ -0,0 +1,97 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeQuarantine(t *testing.T) {
+	now := time.Now()
+	q := newVolumeQuarantine(2, time.Minute)
+	q.now = func() time.Time { return now }
+	mountErr := status.Error(codes.Internal, "mount failed")
+
+	// a success resets consecutive failures
+	q.Record("vol_1", mountErr)
+	q.Record("vol_1", nil)
+	q.Record("vol_1", mountErr)
+	assert.NoError(t, q.Check("vol_1"))
+
+	// aborted errors are not counted
+	q.Record("vol_1", status.Error(codes.Aborted, "operation in progress"))
+	assert.NoError(t, q.Check("vol_1"))
+
+	// quarantined after threshold
+	q.Record("vol_1", mountErr)
+	expectedErr := status.Error(codes.FailedPrecondition, fmt.Sprintf("volume(vol_1) is quarantined after 2 consecutive stage failures, last error: %v", mountErr))
+	assert.Equal(t, expectedErr, q.Check("vol_1"))
+	assert.NoError(t, q.Check("vol_2"))
+	value, found := getMetricValue(t, "csi_smb_quarantined_volumes", map[string]string{})
+	assert.True(t, found)
+	assert.Equal(t, float64(1), value)
+
+	// released on unstage
+	q.Release("vol_1")
+	assert.NoError(t, q.Check("vol_1"))
+	value, _ = getMetricValue(t, "csi_smb_quarantined_volumes", map[string]string{})
+	assert.Equal(t, float64(0), value)
+
+	// released after cooldown
+	q.Record("vol_1", mountErr)
+	q.Record("vol_1", mountErr)
+	now = now.Add(30 * time.Second)
+	assert.Error(t, q.Check("vol_1"))
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, q.Check("vol_1"))
+	value, _ = getMetricValue(t, "csi_smb_quarantined_volumes", map[string]string{})
+	assert.Equal(t, float64(0), value)
+
+	// quarantine is disabled
+	disabled := newVolumeQuarantine(0, time.Minute)
+	for i := 0; i < 3; i++ {
+		disabled.Record("vol_1", mountErr)
+	}
+	assert.NoError(t, disabled.Check("vol_1"))
+}
+
+func TestNodeStageVolumeQuarantine(t *testing.T) {
+	d := NewFakeDriver()
+	d.stageQuarantine = newVolumeQuarantine(2, time.Hour)
+	req := &csi.NodeStageVolumeRequest{VolumeId: "vol_1"}
+	capabilityErr := status.Error(codes.InvalidArgument, "Volume capability not provided")
+
+	for i := 0; i < 2; i++ {
+		_, err := d.NodeStageVolume(context.Background(), req)
+		assert.Equal(t, capabilityErr, err)
+	}
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// a successful unstage lifts the quarantine
+	d.stageQuarantine.Release("vol_1")
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, capabilityErr, err)
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	serverinoMountOption   = "serverino"
+	noServerinoMountOption = "noserverino"
+	// volume context parameter which enables serverino/noserverino auto-detection
+	autoServerinoField = "autoserverino"
+	// max number of entries checked when probing inode collision
+	maxServerinoProbeEntries = 1000
+)
+
+// serverinoCache caches serverino/noserverino decision per smb server
+type serverinoCache struct {
+	sync.Mutex
+	options map[string]string
+	// serializes probes of the same server, so that probes of different servers do not block each other
+	serverLocks map[string]*sync.Mutex
+}
+
+func newServerinoCache() *serverinoCache {
+	return &serverinoCache{options: map[string]string{}, serverLocks: map[string]*sync.Mutex{}}
+}
+
+// getServerLock returns the lock which serializes probes of server
+func (c *serverinoCache) getServerLock(server string) *sync.Mutex {
+	c.Lock()
+	defer c.Unlock()
+	lock, ok := c.serverLocks[server]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.serverLocks[server] = lock
+	}
+	return lock
+}
+
+// getCachedOption returns the cached decision of server
+func (c *serverinoCache) getCachedOption(server string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	option, ok := c.options[server]
+	return option, ok
+}
+
+// getServerinoOption returns serverino or noserverino mount option of server, probe is only invoked
+// if there is no cached decision of server, it returns whether inode collision is detected on server
+// and whether the result is conclusive, an inconclusive result, e.g. less than two entries are checked,
+// falls back to serverino without being cached so that the server is probed again on next mount
+func (c *serverinoCache) getServerinoOption(server string, probe func() (bool, bool, error)) (string, error) {
+	server = strings.ToLower(server)
+	if option, ok := c.getCachedOption(server); ok {
+		return option, nil
+	}
+	lock := c.getServerLock(server)
+	lock.Lock()
+	defer lock.Unlock()
+	// decision may be cached by a concurrent probe of the same server
+	if option, ok := c.getCachedOption(server); ok {
+		return option, nil
+	}
+	collision, conclusive, err := probe()
+	if err != nil {
+		return "", err
+	}
+	option := serverinoMountOption
+	if collision {
+		option = noServerinoMountOption
+	}
+	if !conclusive {
+		klog.V(2).Infof("inode collision detection on server %s is inconclusive, use %s mount option without caching", server, option)
+		return option, nil
+	}
+	klog.V(2).Infof("inode collision(%v) detected on server %s, use %s mount option", collision, server, option)
+	c.Lock()
+	c.options[server] = option
+	c.Unlock()
+	return option, nil
+}
+
+// appendServerinoOption appends serverino or noserverino mount option detected on the server of source,
+// mountOptions are returned as is if serverino or noserverino is already specified or the probe fails
+func (d *Driver) appendServerinoOption(source string, mountOptions, sensitiveMountOptions []string) []string {
+	if hasMountOption(mountOptions, serverinoMountOption) || hasMountOption(mountOptions, noServerinoMountOption) {
+		return mountOptions
+	}
+	option, err := d.serverinoCache.getServerinoOption(getServerFromSource(source), func() (bool, bool, error) {
+		return d.probeInodeCollision(source, mountOptions, sensitiveMountOptions)
+	})
+	if err != nil {
+		klog.Warningf("failed to probe inode collision on %s: %v, skip serverino auto-detection", source, err)
+		return mountOptions
+	}
+	return appendMountOption(mountOptions, option)
+}
+
+// probeInodeCollision mounts source to a temporary directory and checks whether inode numbers collide
+func (d *Driver) probeInodeCollision(source string, mountOptions, sensitiveMountOptions []string) (bool, bool, error) {
+	probeDir, err := os.MkdirTemp(d.workingMountDir, "serverino-probe-")
+	if err != nil {
+		return false, false, fmt.Errorf("failed to create probe directory: %v", err)
+	}
+	defer os.Remove(probeDir)
+
+	if err := Mount(d.mounter, source, probeDir, "cifs", mountOptions, sensitiveMountOptions); err != nil {
+		return false, false, fmt.Errorf("failed to mount %s on %s: %v", source, probeDir, err)
+	}
+	defer func() {
+		if err := d.mounter.Unmount(probeDir); err != nil {
+			klog.Warningf("failed to unmount probe directory %s: %v", probeDir, err)
+		}
+	}()
+	return detectInodeCollision(probeDir)
+}
+
+// detectInodeCollision checks whether any two different entries in dir report the same inode number,
+// the result is not conclusive if there are less than two entries to compare
+func detectInodeCollision(dir string) (bool, bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, false, err
+	}
+	inodes := map[uint64]string{}
+	for i, entry := range entries {
+		if i >= maxServerinoProbeEntries {
+			break
+		}
+		info, err := os.Lstat(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return false, false, err
+		}
+		inode, ok := getFileInode(info)
+		if !ok {
+			return false, false, fmt.Errorf("inode number is not available on %s", info.Name())
+		}
+		if name, found := inodes[inode]; found {
+			klog.V(2).Infof("inode %d is shared by %s and %s in %s", inode, name, entry.Name(), dir)
+			return true, true, nil
+		}
+		inodes[inode] = entry.Name()
+	}
+	return false, len(inodes) >= 2, nil
+}
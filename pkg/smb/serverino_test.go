@@ -0,0 +1,188 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectInodeCollision(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	tmpDir, err := os.MkdirTemp("", "csi-smb-serverino-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// result is not conclusive with less than two entries
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpDir, "a"), []byte("a"), 0644))
+	collision, conclusive, err := detectInodeCollision(tmpDir)
+	assert.NoError(t, err)
+	assert.False(t, collision)
+	assert.False(t, conclusive)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpDir, "b"), []byte("b"), 0644))
+	collision, conclusive, err = detectInodeCollision(tmpDir)
+	assert.NoError(t, err)
+	assert.False(t, collision)
+	assert.True(t, conclusive)
+
+	// hard link shares the same inode number with the original file
+	assert.NoError(t, os.Link(filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "c")))
+	collision, conclusive, err = detectInodeCollision(tmpDir)
+	assert.NoError(t, err)
+	assert.True(t, collision)
+	assert.True(t, conclusive)
+}
+
+func TestGetServerinoOption(t *testing.T) {
+	tests := []struct {
+		desc           string
+		collision      bool
+		inconclusive   bool
+		probeErr       error
+		expectedOption string
+		expectedErr    error
+	}{
+		{
+			desc:           "inode collision detected",
+			collision:      true,
+			expectedOption: "noserverino",
+		},
+		{
+			desc:           "no inode collision detected",
+			collision:      false,
+			expectedOption: "serverino",
+		},
+		{
+			desc:           "inconclusive probe",
+			inconclusive:   true,
+			expectedOption: "serverino",
+		},
+		{
+			desc:        "probe failed",
+			probeErr:    fmt.Errorf("probe error"),
+			expectedErr: fmt.Errorf("probe error"),
+		},
+	}
+
+	for _, test := range tests {
+		cache := newServerinoCache()
+		probeCount := 0
+		probe := func() (bool, bool, error) {
+			probeCount++
+			return test.collision, !test.inconclusive, test.probeErr
+		}
+		for i := 0; i < 2; i++ {
+			option, err := cache.getServerinoOption("Server", probe)
+			if !reflect.DeepEqual(err, test.expectedErr) {
+				t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+			}
+			if option != test.expectedOption {
+				t.Errorf("test[%s]: unexpected option: %s, expected option: %s", test.desc, option, test.expectedOption)
+			}
+		}
+		// decision is cached per server, failed or inconclusive probe is not cached
+		expectedProbeCount := 1
+		if test.probeErr != nil || test.inconclusive {
+			expectedProbeCount = 2
+		}
+		if probeCount != expectedProbeCount {
+			t.Errorf("test[%s]: unexpected probe count: %d, expected probe count: %d", test.desc, probeCount, expectedProbeCount)
+		}
+		if test.probeErr == nil && !test.inconclusive {
+			if option, _ := cache.getServerinoOption("server", nil); option != test.expectedOption {
+				t.Errorf("test[%s]: unexpected cached option: %s, expected option: %s", test.desc, option, test.expectedOption)
+			}
+		}
+	}
+}
+
+func TestGetServerinoOptionConcurrent(t *testing.T) {
+	cache := newServerinoCache()
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	var probeCount int32
+	slowProbe := func() (bool, bool, error) {
+		atomic.AddInt32(&probeCount, 1)
+		close(probing)
+		<-release
+		return true, true, nil
+	}
+
+	var wg sync.WaitGroup
+	options := make([]string, 2)
+	for i := range options {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			options[i], _ = cache.getServerinoOption("server1", slowProbe)
+		}(i)
+	}
+	<-probing
+
+	// probe of another server is not blocked by the probe of server1 in progress
+	option, err := cache.getServerinoOption("server2", func() (bool, bool, error) {
+		return false, true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, serverinoMountOption, option)
+
+	// concurrent mounts of the same server share a single probe
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&probeCount))
+	assert.Equal(t, []string{noServerinoMountOption, noServerinoMountOption}, options)
+}
+
+func TestAppendServerinoOption(t *testing.T) {
+	d := NewFakeDriver()
+	d.serverinoCache.options["server"] = noServerinoMountOption
+
+	tests := []struct {
+		desc            string
+		mountOptions    []string
+		expectedOptions []string
+	}{
+		{
+			desc:            "cached decision appended",
+			mountOptions:    []string{"vers=3.0"},
+			expectedOptions: []string{"vers=3.0", "noserverino"},
+		},
+		{
+			desc:            "serverino specified explicitly",
+			mountOptions:    []string{"vers=3.0,serverino"},
+			expectedOptions: []string{"vers=3.0,serverino"},
+		},
+	}
+
+	for _, test := range tests {
+		result := d.appendServerinoOption("//server/share", test.mountOptions, nil)
+		if !reflect.DeepEqual(result, test.expectedOptions) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expectedOptions)
+		}
+	}
+}
@@ -17,7 +17,12 @@ limitations under the License.
 package smb
 
 import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
@@ -34,7 +39,11 @@ const (
 	passwordField        = "password"
 	sourceField          = "source"
 	subDirField          = "subdir"
+	prefixPathField      = "prefixpath"
 	domainField          = "domain"
+	domainsField         = "domains"
+	domainSelectorField  = "domainselector"
+	topologyKeyHostname  = "topology.smb.csi.k8s.io/hostname"
 	krb5Prefix           = "krb5cc_"
 	krb5CacheDirectory   = "/var/lib/kubelet/kerberos/"
 	mountOptionsField    = "mountoptions"
@@ -45,8 +54,29 @@ const (
 	pvcNameMetadata      = "${pvc.metadata.name}"
 	pvcNamespaceMetadata = "${pvc.metadata.namespace}"
 	pvNameMetadata       = "${pv.metadata.name}"
+	// select domain in domains by matching server host name
+	domainSelectorHostname = "hostname"
+	// max attempts of directory creation when racing with other callers
+	ensureDirMaxRetries = 3
+	// policies on corrupted mount detected during publish
+	corruptedMountPolicyIgnore  = "ignore"
+	corruptedMountPolicyFail    = "fail"
+	corruptedMountPolicyRecover = "recover"
+	// default size limit of kerberos cache content in secret
+	DefaultMaxKrb5CacheSize = 1024 * 1024
+	// backoff of unmount retries on a busy staging path
+	unstageBusyRetryInitialInterval = 200 * time.Millisecond
+	unstageBusyRetryMaxInterval     = 5 * time.Second
+	// username formats of smb mapping on Windows node, domain\username or username@domain
+	windowsUsernameFormatDownLevel = "down-level"
+	windowsUsernameFormatUPN       = "upn"
+	// stage an administrative share, e.g. C$ or ADMIN$, which is rejected with --block-admin-shares
+	allowAdminShareField = "allowadminshare"
 )
 
+// unresolvedTokenPattern matches ${...} tokens in subDir
+var unresolvedTokenPattern = regexp.MustCompile(`\$\{[^}]*\}`)
+
 // DriverOptions defines driver parameters specified in driver deployment
 type DriverOptions struct {
 	NodeID               string
@@ -55,6 +85,105 @@ type DriverOptions struct {
 	// this only applies to Windows node
 	RemoveSMBMappingDuringUnmount bool
 	WorkingMountDir               string
+	// this only applies to Linux node
+	RequireEncryption     bool
+	EnforceEncryptionAuto bool
+	// this only applies to Linux node
+	RejectSymlinkTargetPath bool
+	// max size of kerberos cache in bytes, 0 means no limit
+	MaxKrb5CacheSize int64
+	// policy on corrupted mount detected during publish: ignore, fail or recover
+	CorruptedMountPublishPolicy string
+	// kubelet root directory under which staging paths are created
+	KubeletRootDir string
+	// max number of entries walked to get volume usage in NodeGetVolumeStats, 0 means statfs is used
+	VolumeStatsWalkMaxEntries int
+	// file of rules which map mount errors to CSI error codes
+	MountErrorRulesFile string
+	// report INODES usage in NodeGetVolumeStats even if inode metrics are not available, it's omitted by default
+	ReportUnavailableInodesUsage bool
+	// delay kerberos cache deletion on unstage, 0 means delete immediately
+	Krb5CacheGracePeriod time.Duration
+	// retry unmount in NodeUnstageVolume within this period if the staging path is busy, 0 means no retry
+	UnstageBusyRetryTimeout time.Duration
+	// file of named mount option profiles referenced by profile parameter
+	MountProfilesFile string
+	// domain used on Windows node if domain is not specified, defaultDomainName is used if empty
+	DefaultDomain string
+	// quarantine a volume after this number of consecutive stage failures, 0 means no quarantine
+	QuarantineThreshold int
+	// quarantine of a volume is lifted after this period
+	QuarantineCooldown time.Duration
+	// remove and recreate staging directory before mount if it's not mounted
+	RecreateStagingDir bool
+	// disallow creating a volume from an existing volume, it's allowed by default
+	DisableVolumeClone bool
+	// how to handle unknown keys in node stage secret
+	UnknownSecretKeysPolicy string
+	// report node host name as topology segment and advertise accessibility constraints
+	EnableHostnameTopology bool
+	// host name reported in topology segment, NodeID is used if empty
+	NodeHostname string
+	// remove kerberos caches not used by staged volumes on driver start
+	CleanOrphanKrb5OnStart bool
+	// reject subDir with tokens left after replacement in NodeStageVolume
+	StrictSubDirTokens bool
+	// return FailedPrecondition in NodePublishVolume if staging path is not mounted yet
+	CheckStagedOnPublish bool
+	// vers mount option is set to this version if not specified, lower versions are rejected
+	MinSMBVersion string
+	// always remount in NodeStageVolume even if a live cifs mount is found on staging path, it's reused by default
+	DisableLiveStageMountReuse bool
+	// command run with volume id and staging path after a volume is unstaged
+	PostUnmountHook        string
+	PostUnmountHookTimeout time.Duration
+	// resolve group name in volumeMountGroup to gid with the group database of the driver container
+	ResolveMountGroupName bool
+	// reject staging and target paths outside of KubeletRootDir in node server
+	EnforceKubeletRootDir bool
+	// bind mount mode in NodePublishVolume, bind or rbind
+	BindMode string
+	// validate credentials with a session setup before mount on Linux node
+	PreAuthProbe        bool
+	PreAuthProbeTimeout time.Duration
+	// volume id longer than this is hashed in CreateVolume, 0 means no limit
+	MaxVolumeIDLength int
+	// max jitter of mount retry delay as a fraction of mount poll interval, 0 disables the delay
+	MountRetryJitter float64
+	// max number of path segments in subDir after replacement in NodeStageVolume, 0 means no limit
+	MaxSubDirDepth int
+	// keep staging directory on stage failure with failure.json of the sanitized error and options
+	RetainFailedStaging bool
+	// vers mount option is set to this version if not specified or vers=default, no pinning if empty
+	PinDefaultVers string
+	// remount in the same call after an invalid mount is unmounted, otherwise the call fails and remount is left to retry
+	RemountOnRecovery bool
+	// how node publish secrets are used in dedicated mount: require or merge
+	PublishSecretsPolicy string
+	// cruid mount option of kerberos mount without cruid= on Linux node, e.g. uid of pod processes, no fallback if empty
+	DefaultCredUID string
+	// set SMBConnectivityProblem node condition after this number of consecutive connectivity failures of a server, 0 means no reporting
+	NodeConditionFailureThreshold int
+	// username format of smb mapping on Windows node: down-level or upn
+	WindowsUsernameFormat string
+	// retries of ReadDir probe before a mount point is considered invalid and unmounted
+	ReadDirRetries int
+	// reject stage of administrative shares whose name ends with $, unless allowAdminShare is set in volume context
+	BlockAdminShares bool
+	// timeout of each cifs mount attempt in NodeStageVolume, a hung attempt is killed and retried, 0 means no timeout
+	MountAttemptTimeout time.Duration
+	// comma separated alias=field pairs of secret keys, e.g. user=username,pass=password
+	SecretKeyAliases string
+	// how a credential field provided in both volume context and secrets with different values is resolved
+	CredentialConflictPolicy string
+	// return FailedPrecondition in NodeUnstageVolume if staging path is still bind mounted in pods
+	RejectReferencedUnstage bool
+	// max duration to wait for the kerberos cache directory on startup, 0 means no wait
+	WaitForKrb5Dir time.Duration
+	// convert backslashes in source to forward slashes in NodeStageVolume on Linux node
+	NormalizeSourceSlashes bool
+	// comma separated glob patterns of mount namespace files allowed in mountNamespace parameter, empty allows none
+	AllowedMountNamespaces string
 }
 
 // Driver implements all interfaces of CSI drivers
@@ -68,6 +197,125 @@ type Driver struct {
 	enableGetVolumeStats bool
 	// this only applies to Windows node
 	removeSMBMappingDuringUnmount bool
+	// reject mounts without seal mount option
+	requireEncryption bool
+	// add seal mount option automatically if not present
+	enforceEncryptionAuto bool
+	// reject NodeUnpublishVolume if target path is a symlink instead of resolving it
+	rejectSymlinkTargetPath bool
+	// reject kerberos cache larger than this size in bytes, 0 means no limit
+	maxKrb5CacheSize int64
+	// how to handle corrupted mount detected during publish
+	corruptedMountPublishPolicy string
+	// serverino/noserverino decision of each smb server by auto-detection
+	serverinoCache *serverinoCache
+	kubeletRootDir string
+	// stage parameters of staged volumes keyed by staging path
+	stageCache *stageCache
+	// walk volume path to get subdir scoped usage if there are no more than this number of entries
+	volumeStatsWalkMaxEntries int
+	mountErrorRulesFile       string
+	// rules consulted before default rules to classify mount errors
+	mountErrorRules []mountErrorRule
+	// return only BYTES usage if smb server does not report inode counts
+	omitUnavailableInodesUsage bool
+	// kerberos cache is deleted after this period on unstage unless the volume is staged again
+	krb5CacheGracePeriod time.Duration
+	krb5CacheDeletes     *deferredDeletes
+	// unmount of a busy staging path is retried with backoff until this timeout
+	unstageBusyRetryTimeout time.Duration
+	// credential providers selected by credentialProvider parameter in volume context
+	credentialProviders *credentialProviders
+	mountProfilesFile   string
+	// mount options of each profile which could be referenced by profile parameter in volume context
+	mountProfiles map[string][]string
+	// domain used on Windows node if domain is not specified
+	defaultDomain string
+	// volumes failing to stage repeatedly
+	stageQuarantine *volumeQuarantine
+	// start from a clean staging directory on each mount
+	recreateStagingDir bool
+	enableVolumeClone  bool
+	// ignore, warn or reject unknown keys in node stage secret
+	unknownSecretKeysPolicy string
+	// cifs mount helper is checked before mount on Linux node
+	mountHelperChecker *mountHelperChecker
+	// mounts cifs in the mount namespace specified by mountNamespace parameter
+	namespaceMounter namespaceMounter
+	// volumes are pinned to the node host name reported in NodeGetInfo
+	enableHostnameTopology bool
+	nodeHostname           string
+	// remove kerberos caches not used by staged volumes on driver start
+	cleanOrphanKrb5OnStart bool
+	// reject subDir with tokens left after replacement instead of logging a warning
+	strictSubDirTokens bool
+	// publish is rejected with a retryable error before stage completes
+	checkStagedOnPublish bool
+	// floor of vers mount option on Linux node
+	minSMBVersion string
+	// live cifs mount on staging path is reused without remount, stale mount is remounted
+	reuseLiveStageMount bool
+	// run after staging path is unmounted, failure is only logged
+	postUnmountHook *postUnmountHook
+	// non-numeric volumeMountGroup is resolved as a group name, otherwise it's rejected
+	resolveMountGroupName bool
+	// staging and target paths must be under kubeletRootDir
+	enforceKubeletRootDir bool
+	// first mount option of bind mount in NodePublishVolume unless overridden by volume context
+	bindMode string
+	// serializes concurrent CreateVolume requests of the same name, e.g. retries of external-provisioner
+	createVolumeLocks *keyMutex
+	// new stage and publish requests are rejected in drain mode
+	drainMode drainMode
+	// credentials are validated before mount if set, bad credentials fail fast with Unauthenticated
+	authProber          authProber
+	preAuthProbeTimeout time.Duration
+	// volume id longer than maxVolumeIDLength is hashed, full volume id is kept in volume context and on the share
+	maxVolumeIDLength int
+	// mount retry of a volume whose last mount failed is delayed with jitter
+	mountRetryJitter *mountRetryJitter
+	// subDir deeper than maxSubDirDepth is rejected in NodeStageVolume
+	maxSubDirDepth int
+	// failure.json is written into staging directory on stage failure
+	retainFailedStaging bool
+	// canonical SMB version on Linux node instead of kernel default
+	pinDefaultVers string
+	// stage and publish proceed to mount after an invalid mount on the path is unmounted
+	remountOnRecovery bool
+	// merge keeps credentials of stage for dedicated mount, publish secrets override them
+	publishSecretsPolicy string
+	// fallback cruid of kerberos mount, kerberos mount without cruid= is rejected if empty
+	defaultCredUID string
+	// consecutive connectivity failures of a server to report it in node condition
+	nodeConditionFailureThreshold int
+	// reports connectivity problems of smb servers as node condition, nil if disabled
+	nodeConditionReporter *nodeConditionReporter
+	// down-level maps with domain\username, upn maps with username@domain
+	windowsUsernameFormat string
+	// retries of ReadDir probe in ensureMountPoint, 0 means no retry
+	readDirRetries int
+	// administrative shares, e.g. C$, are rejected in NodeStageVolume
+	blockAdminShares bool
+	// hung mount attempts are killed and retried within the overall mount timeout of NodeStageVolume
+	mountAttemptTimeout time.Duration
+	// raw value of --secret-key-aliases
+	secretKeyAliasesSpec string
+	// secret keys(lower case) which are accepted as username, password or domain, parsed from secretKeyAliasesSpec in Run
+	secretKeyAliases map[string]string
+	// secret or strict resolution of a credential field provided in both volume context and secrets
+	credentialConflictPolicy string
+	// NodeUnstageVolume fails with FailedPrecondition while staging path is still bind mounted in pods
+	rejectReferencedUnstage bool
+	// max duration to wait for the kerberos cache directory on startup, 0 means no wait
+	waitForKrb5Dir time.Duration
+	// kerberos mount returns Unavailable while waiting for the kerberos cache directory
+	krb5DirWait krb5DirWait
+	// backslashes in source are converted to forward slashes in NodeStageVolume on Linux node
+	normalizeSourceSlashes bool
+	// raw value of --allowed-mount-namespaces
+	allowedMountNamespacesSpec string
+	// glob patterns of mount namespace files allowed in mountNamespace parameter, parsed from allowedMountNamespacesSpec in Run
+	allowedMountNamespaces []string
 }
 
 // NewDriver Creates a NewCSIDriver object. Assumes vendor version is equal to driver version &
@@ -80,7 +328,80 @@ func NewDriver(options *DriverOptions) *Driver {
 	driver.enableGetVolumeStats = options.EnableGetVolumeStats
 	driver.removeSMBMappingDuringUnmount = options.RemoveSMBMappingDuringUnmount
 	driver.workingMountDir = options.WorkingMountDir
+	driver.requireEncryption = options.RequireEncryption
+	driver.enforceEncryptionAuto = options.EnforceEncryptionAuto
+	driver.rejectSymlinkTargetPath = options.RejectSymlinkTargetPath
+	driver.maxKrb5CacheSize = options.MaxKrb5CacheSize
+	driver.corruptedMountPublishPolicy = options.CorruptedMountPublishPolicy
 	driver.volumeLocks = newVolumeLocks()
+	driver.createVolumeLocks = newKeyMutex()
+	driver.maxVolumeIDLength = options.MaxVolumeIDLength
+	driver.mountRetryJitter = newMountRetryJitter(options.MountRetryJitter)
+	driver.maxSubDirDepth = options.MaxSubDirDepth
+	driver.retainFailedStaging = options.RetainFailedStaging
+	driver.pinDefaultVers = options.PinDefaultVers
+	driver.remountOnRecovery = options.RemountOnRecovery
+	driver.publishSecretsPolicy = options.PublishSecretsPolicy
+	driver.defaultCredUID = options.DefaultCredUID
+	driver.nodeConditionFailureThreshold = options.NodeConditionFailureThreshold
+	driver.readDirRetries = options.ReadDirRetries
+	driver.blockAdminShares = options.BlockAdminShares
+	driver.mountAttemptTimeout = options.MountAttemptTimeout
+	driver.secretKeyAliasesSpec = options.SecretKeyAliases
+	driver.credentialConflictPolicy = options.CredentialConflictPolicy
+	driver.rejectReferencedUnstage = options.RejectReferencedUnstage
+	driver.waitForKrb5Dir = options.WaitForKrb5Dir
+	driver.normalizeSourceSlashes = options.NormalizeSourceSlashes
+	driver.allowedMountNamespacesSpec = options.AllowedMountNamespaces
+	if options.PreAuthProbe {
+		driver.authProber = newSmbclientProber()
+		driver.preAuthProbeTimeout = options.PreAuthProbeTimeout
+	}
+	driver.serverinoCache = newServerinoCache()
+	driver.kubeletRootDir = options.KubeletRootDir
+	if driver.kubeletRootDir == "" {
+		driver.kubeletRootDir = DefaultKubeletRootDir
+	}
+	driver.stageCache = newStageCache()
+	driver.volumeStatsWalkMaxEntries = options.VolumeStatsWalkMaxEntries
+	driver.mountErrorRulesFile = options.MountErrorRulesFile
+	driver.omitUnavailableInodesUsage = !options.ReportUnavailableInodesUsage
+	driver.krb5CacheGracePeriod = options.Krb5CacheGracePeriod
+	driver.krb5CacheDeletes = newDeferredDeletes(options.Krb5CacheGracePeriod)
+	driver.credentialProviders = newCredentialProviders()
+	driver.unstageBusyRetryTimeout = options.UnstageBusyRetryTimeout
+	driver.mountProfilesFile = options.MountProfilesFile
+	driver.defaultDomain = options.DefaultDomain
+	if driver.defaultDomain == "" {
+		driver.defaultDomain = defaultDomainName
+	}
+	driver.recreateStagingDir = options.RecreateStagingDir
+	driver.enableVolumeClone = !options.DisableVolumeClone
+	driver.unknownSecretKeysPolicy = options.UnknownSecretKeysPolicy
+	driver.mountHelperChecker = newMountHelperChecker()
+	driver.namespaceMounter = newNsenterMounter()
+	driver.enableHostnameTopology = options.EnableHostnameTopology
+	driver.nodeHostname = options.NodeHostname
+	if driver.nodeHostname == "" {
+		driver.nodeHostname = options.NodeID
+	}
+	driver.cleanOrphanKrb5OnStart = options.CleanOrphanKrb5OnStart
+	driver.strictSubDirTokens = options.StrictSubDirTokens
+	driver.checkStagedOnPublish = options.CheckStagedOnPublish
+	driver.minSMBVersion = options.MinSMBVersion
+	driver.reuseLiveStageMount = !options.DisableLiveStageMountReuse
+	driver.postUnmountHook = newPostUnmountHook(options.PostUnmountHook, options.PostUnmountHookTimeout)
+	driver.resolveMountGroupName = options.ResolveMountGroupName
+	driver.enforceKubeletRootDir = options.EnforceKubeletRootDir
+	driver.bindMode = options.BindMode
+	if driver.bindMode == "" {
+		driver.bindMode = bindModeBind
+	}
+	driver.windowsUsernameFormat = options.WindowsUsernameFormat
+	if driver.windowsUsernameFormat == "" {
+		driver.windowsUsernameFormat = windowsUsernameFormatDownLevel
+	}
+	driver.stageQuarantine = newVolumeQuarantine(options.QuarantineThreshold, options.QuarantineCooldown)
 	return &driver
 }
 
@@ -91,19 +412,106 @@ func (d *Driver) Run(endpoint, kubeconfig string, testMode bool) {
 		klog.Fatalf("%v", err)
 	}
 	klog.V(2).Infof("\nDRIVER INFORMATION:\n-------------------\n%s\n\nStreaming logs below:", versionMeta)
+	recordBuildInfo()
+	registerStageMountAge(d.stageCache)
+	if runtime.GOOS == "linux" {
+		registerCifsStats()
+	}
 
 	d.mounter, err = mounter.NewSafeMounter(d.removeSMBMappingDuringUnmount)
 	if err != nil {
 		klog.Fatalf("Failed to get safe mounter. Error: %v", err)
 	}
+	if d.minSMBVersion != "" && len(parseSMBVersion(d.minSMBVersion)) == 0 {
+		klog.Fatalf("invalid minimum SMB version: %s", d.minSMBVersion)
+	}
+	if d.pinDefaultVers != "" {
+		if len(parseSMBVersion(d.pinDefaultVers)) == 0 {
+			klog.Fatalf("invalid pinned default SMB version: %s", d.pinDefaultVers)
+		}
+		if d.minSMBVersion != "" && compareSMBVersion(d.pinDefaultVers, d.minSMBVersion) < 0 {
+			klog.Fatalf("pinned default SMB version %s is lower than minimum SMB version %s", d.pinDefaultVers, d.minSMBVersion)
+		}
+	}
+	if err := validateBindMode(d.bindMode); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if err := validateWindowsUsernameFormat(d.windowsUsernameFormat); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if err := validatePublishSecretsPolicy(d.publishSecretsPolicy); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if err := validateCredentialConflictPolicy(d.credentialConflictPolicy); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if err := validateUnknownSecretKeysPolicy(d.unknownSecretKeysPolicy); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if err := validateCorruptedMountPublishPolicy(d.corruptedMountPublishPolicy); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if d.defaultCredUID != "" {
+		if uid, err := strconv.Atoi(d.defaultCredUID); err != nil || uid < 0 {
+			klog.Fatalf("invalid default cred uid: %s, it must be a non-negative integer", d.defaultCredUID)
+		}
+	}
+	if d.secretKeyAliases, err = parseSecretKeyAliases(d.secretKeyAliasesSpec); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if d.allowedMountNamespaces, err = parseMountNamespacePatterns(d.allowedMountNamespacesSpec); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if d.mountRetryJitter.fraction < 0 || d.mountRetryJitter.fraction > 1 {
+		klog.Fatalf("invalid mount retry jitter %v, it must be between 0 and 1", d.mountRetryJitter.fraction)
+	}
+	if d.readDirRetries < 0 {
+		klog.Fatalf("invalid ReadDir retries %d, it must not be negative", d.readDirRetries)
+	}
+	if d.maxSubDirDepth < 0 {
+		klog.Fatalf("invalid max subdir depth %d, it must not be negative", d.maxSubDirDepth)
+	}
+	if d.maxVolumeIDLength > 0 && d.maxVolumeIDLength < hashedVolumeIDLength {
+		klog.Fatalf("max volume id length %d is shorter than hash length %d of hashed volume id", d.maxVolumeIDLength, hashedVolumeIDLength)
+	}
+	if d.mountErrorRulesFile != "" {
+		if d.mountErrorRules, err = loadMountErrorRules(d.mountErrorRulesFile); err != nil {
+			klog.Fatalf("Failed to load mount error rules. Error: %v", err)
+		}
+		klog.V(2).Infof("loaded %d mount error rules from %s", len(d.mountErrorRules), d.mountErrorRulesFile)
+	}
+	if d.mountProfilesFile != "" {
+		if d.mountProfiles, err = loadMountProfiles(d.mountProfilesFile); err != nil {
+			klog.Fatalf("Failed to load mount profiles. Error: %v", err)
+		}
+		klog.V(2).Infof("loaded %d mount profiles from %s", len(d.mountProfiles), d.mountProfilesFile)
+	}
+	if d.waitForKrb5Dir > 0 && runtime.GOOS != "windows" {
+		d.startKrb5DirWait(krb5CacheDirectory, d.waitForKrb5Dir)
+	}
+	if d.nodeConditionFailureThreshold > 0 {
+		if client, err := getKubeClient(kubeconfig); err != nil {
+			klog.Warningf("failed to create kubernetes client, node condition reporter is disabled: %v", err)
+		} else {
+			d.nodeConditionReporter = newNodeConditionReporter(client, d.NodeID, d.nodeConditionFailureThreshold)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if mountPoints, err := d.mounter.List(); err != nil {
+			klog.Warningf("failed to list mount points, skip reconstructing stage state: %v", err)
+		} else {
+			klog.V(2).Infof("reconstructed stage state of %d volumes", d.reconstructStageCache(mountPoints))
+			if runtime.GOOS == "linux" {
+				klog.V(2).Infof("cleaned up %d orphan unions", d.cleanupOrphanUnions(mountPoints))
+			}
+			if d.cleanOrphanKrb5OnStart {
+				d.cleanOrphanKerberosCaches()
+			}
+		}
+	}
 
 	// Initialize default library driver
-	d.AddControllerServiceCapabilities(
-		[]csi.ControllerServiceCapability_RPC_Type{
-			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-			csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
-		})
+	d.AddControllerServiceCapabilities(d.getControllerServiceCapabilities())
 
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -156,6 +564,63 @@ func hasGuestMountOptions(options []string) bool {
 	return false
 }
 
+// normalizeSourceSlashes converts a source copied from Windows(e.g. \\server\share\dir) into the form of cifs mount
+// on Linux(e.g. //server/share/dir) by replacing backslashes with forward slashes
+func normalizeSourceSlashes(source string) string {
+	return strings.ReplaceAll(source, "\\", "/")
+}
+
+// getServerFromSource returns the server host name of source, e.g. "server" for //server/share or \\server\share
+func getServerFromSource(source string) string {
+	source = strings.TrimLeft(strings.ReplaceAll(source, "\\", "/"), "/")
+	return strings.SplitN(source, "/", 2)[0]
+}
+
+// getShareFromSource returns the share name of source, e.g. "share" for //server/share/dir or \\server\share\dir
+func getShareFromSource(source string) string {
+	segments := strings.SplitN(strings.TrimLeft(strings.ReplaceAll(source, "\\", "/"), "/"), "/", 3)
+	if len(segments) < 2 {
+		return ""
+	}
+	return segments[1]
+}
+
+// isAdminShare checks whether share is an administrative share, e.g. C$, ADMIN$ or IPC$
+func isAdminShare(share string) bool {
+	return strings.HasSuffix(share, "$")
+}
+
+// getControllerServiceCapabilities returns controller service capabilities of enabled features
+func (d *Driver) getControllerServiceCapabilities() []csi.ControllerServiceCapability_RPC_Type {
+	caps := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+	}
+	if d.enableVolumeClone {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_CLONE_VOLUME)
+	}
+	return caps
+}
+
+// validatePrefixPath rejects prefixPath escaping the share root, e.g. ../share2
+func validatePrefixPath(prefixPath string) error {
+	for _, segment := range strings.FieldsFunc(prefixPath, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return fmt.Errorf("invalid %s value: %s, it must not contain ..", prefixPathField, prefixPath)
+		}
+	}
+	return nil
+}
+
+// getMountSource joins subDir to source, trailing slashes of source are only trimmed when subDir is not empty
+// since a trailing slash is meaningful to some servers, e.g. //server/share/ as a DFS root
+func getMountSource(source, subDir string) string {
+	if subDir == "" {
+		return source
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimRight(source, "/"), strings.TrimLeft(subDir, "/"))
+}
+
 // setKeyValueInMap set key/value pair in map
 // key in the map is case insensitive, if key already exists, overwrite existing value
 func setKeyValueInMap(m map[string]string, key, value string) {
@@ -171,6 +636,30 @@ func setKeyValueInMap(m map[string]string, key, value string) {
 	m[key] = value
 }
 
+// getSubDirDepth returns the number of non-empty path segments in subDir
+func getSubDirDepth(subDir string) int {
+	var depth int
+	for _, segment := range strings.Split(subDir, "/") {
+		if segment != "" && segment != "." {
+			depth++
+		}
+	}
+	return depth
+}
+
+// getUnresolvedTokens returns distinct ${...} tokens left in str in order of appearance
+func getUnresolvedTokens(str string) []string {
+	var tokens []string
+	seen := map[string]bool{}
+	for _, token := range unresolvedTokenPattern.FindAllString(str, -1) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
 // replaceWithMap replace key with value for str
 func replaceWithMap(str string, m map[string]string) string {
 	for k, v := range m {
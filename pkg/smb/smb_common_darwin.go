@@ -20,7 +20,10 @@ limitations under the License.
 package smb
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"syscall"
 
 	mount "k8s.io/mount-utils"
 )
@@ -29,6 +32,11 @@ func Mount(m *mount.SafeFormatAndMount, source, target, fsType string, options [
 	return m.MountSensitive(source, target, fsType, options, sensitiveMountOptions)
 }
 
+// MountWithContext is Mount since mount could not be canceled on this platform
+func MountWithContext(ctx context.Context, m *mount.SafeFormatAndMount, source, target, fsType string, options, sensitiveMountOptions []string) error {
+	return Mount(m, source, target, fsType, options, sensitiveMountOptions)
+}
+
 func CleanupSMBMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMountCheck bool) error {
 	return mount.CleanupMountPoint(target, m, extensiveMountCheck)
 }
@@ -37,6 +45,10 @@ func CleanupMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMoun
 	return mount.CleanupMountPoint(target, m, extensiveMountCheck)
 }
 
+func lazyUnmount(target string) error {
+	return fmt.Errorf("lazy unmount is not supported on darwin")
+}
+
 func preparePublishPath(path string, m *mount.SafeFormatAndMount) error {
 	return nil
 }
@@ -48,3 +60,12 @@ func prepareStagePath(path string, m *mount.SafeFormatAndMount) error {
 func Mkdir(m *mount.SafeFormatAndMount, name string, perm os.FileMode) error {
 	return os.Mkdir(name, perm)
 }
+
+// getFileInode returns the inode number of a file
+func getFileInode(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Ino), true
+}
@@ -20,8 +20,14 @@ limitations under the License.
 package smb
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
+	"os/exec"
+	"syscall"
 
+	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
 )
 
@@ -29,6 +35,51 @@ func Mount(m *mount.SafeFormatAndMount, source, target, fsType string, options,
 	return m.MountSensitive(source, target, fsType, options, sensitiveMountOptions)
 }
 
+// MountWithContext is Mount which kills the mount command once ctx is done, mount command is run in its own process group
+// so that mount.cifs started by it is killed as well, systemd-run scope is not used since cifs has no daemon to keep
+// running, mounters other than mount command on the node could only be canceled if they implement contextMounter
+func MountWithContext(ctx context.Context, m *mount.SafeFormatAndMount, source, target, fsType string, options, sensitiveMountOptions []string) error {
+	if cm, ok := m.Interface.(contextMounter); ok {
+		return cm.MountSensitiveWithContext(ctx, source, target, fsType, options, sensitiveMountOptions)
+	}
+	if _, ok := m.Interface.(*mount.Mounter); !ok {
+		return Mount(m, source, target, fsType, options, sensitiveMountOptions)
+	}
+
+	mountArgs, mountArgsLogStr := mount.MakeMountArgsSensitive(source, target, fsType, options, sensitiveMountOptions)
+	klog.V(4).Infof("Mounting cmd (mount) with arguments (%s)", mountArgsLogStr)
+	var output bytes.Buffer
+	cmd := exec.Command("mount", mountArgs...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("mount failed: %v\nMounting command: mount\nMounting arguments: %s", err, mountArgsLogStr)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		if killErr := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); killErr != nil {
+			klog.Warningf("failed to kill mount command(pid %d) on %s: %v", cmd.Process.Pid, target, killErr)
+		}
+		if err = <-done; err == nil {
+			// mount completed before it's killed
+			return nil
+		}
+		err = fmt.Errorf("%v, killed after %v", err, ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("mount failed: %v\nMounting command: mount\nMounting arguments: %s\nOutput: %s", err, mountArgsLogStr, output.String())
+	}
+	return nil
+}
+
 func CleanupSMBMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMountCheck bool) error {
 	return mount.CleanupMountPoint(target, m, extensiveMountCheck)
 }
@@ -37,6 +88,14 @@ func CleanupMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMoun
 	return mount.CleanupMountPoint(target, m, extensiveMountCheck)
 }
 
+// lazyUnmount detaches the filesystem from target immediately and cleans up all references later
+func lazyUnmount(target string) error {
+	if out, err := exec.Command("umount", "-l", target).CombinedOutput(); err != nil {
+		return fmt.Errorf("lazy unmount %s failed with %v, output: %s", target, err, string(out))
+	}
+	return nil
+}
+
 func preparePublishPath(path string, m *mount.SafeFormatAndMount) error {
 	return nil
 }
@@ -48,3 +107,12 @@ func prepareStagePath(path string, m *mount.SafeFormatAndMount) error {
 func Mkdir(m *mount.SafeFormatAndMount, name string, perm os.FileMode) error {
 	return os.Mkdir(name, perm)
 }
+
+// getFileInode returns the inode number of a file
+func getFileInode(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Ino), true
+}
@@ -20,6 +20,7 @@ limitations under the License.
 package smb
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -35,6 +36,11 @@ func Mount(m *mount.SafeFormatAndMount, source, target, fsType string, mountOpti
 	return fmt.Errorf("could not cast to csi proxy class")
 }
 
+// MountWithContext is Mount since mount could not be canceled on this platform
+func MountWithContext(ctx context.Context, m *mount.SafeFormatAndMount, source, target, fsType string, options, sensitiveMountOptions []string) error {
+	return Mount(m, source, target, fsType, options, sensitiveMountOptions)
+}
+
 // CleanupSMBMountPoint - In windows CSI proxy call to umount is used to unmount the SMB.
 // The clean up mount point point calls is supposed for fix the corrupted directories as well.
 // For alpha CSI proxy integration, we only do an unmount.
@@ -52,6 +58,10 @@ func CleanupMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMoun
 	return fmt.Errorf("could not cast to csi proxy class")
 }
 
+func lazyUnmount(target string) error {
+	return fmt.Errorf("lazy unmount is not supported on windows")
+}
+
 func removeDir(path string, m *mount.SafeFormatAndMount) error {
 	if proxy, ok := m.Interface.(mounter.CSIProxyMounter); ok {
 		isExists, err := proxy.ExistsPath(path)
@@ -87,3 +97,8 @@ func Mkdir(m *mount.SafeFormatAndMount, name string, perm os.FileMode) error {
 	}
 	return fmt.Errorf("could not cast to csi proxy class")
 }
+
+// getFileInode is not supported on Windows
+func getFileInode(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
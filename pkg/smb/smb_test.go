@@ -17,6 +17,7 @@ limitations under the License.
 package smb
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -35,7 +36,10 @@ func NewFakeDriver() *Driver {
 		DriverName:           DefaultDriverName,
 		EnableGetVolumeStats: true,
 	}
-	return NewDriver(&options)
+	driver := NewDriver(&options)
+	// cifs mount helper is not required since mount is faked
+	driver.mountHelperChecker.lookPath = func(file string) (string, error) { return file, nil }
+	return driver
 }
 
 func TestNewFakeDriver(t *testing.T) {
@@ -46,6 +50,11 @@ func TestNewFakeDriver(t *testing.T) {
 	}
 	d := NewDriver(&options)
 	assert.NotNil(t, d)
+	// features enabled by default are enabled with zero value options
+	assert.True(t, d.enableVolumeClone)
+	assert.True(t, d.omitUnavailableInodesUsage)
+	assert.True(t, d.reuseLiveStageMount)
+	assert.False(t, d.resolveMountGroupName)
 }
 
 func TestIsCorruptedDir(t *testing.T) {
@@ -281,3 +290,156 @@ func TestReplaceWithMap(t *testing.T) {
 		}
 	}
 }
+
+func TestGetServerFromSource(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{source: "//smb-server.default.svc.cluster.local/share", expected: "smb-server.default.svc.cluster.local"},
+		{source: "\\\\fs1.fabrikam.com\\share\\dir", expected: "fs1.fabrikam.com"},
+		{source: "server", expected: "server"},
+		{source: "", expected: ""},
+	}
+
+	for _, test := range tests {
+		result := getServerFromSource(test.source)
+		if result != test.expected {
+			t.Errorf("getServerFromSource(%s): unexpected output: %s, expected result: %s", test.source, result, test.expected)
+		}
+	}
+}
+
+func TestGetShareFromSource(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{source: "//smb-server/share", expected: "share"},
+		{source: "\\\\fs1.fabrikam.com\\C$\\dir", expected: "C$"},
+		{source: "//smb-server/ADMIN$/", expected: "ADMIN$"},
+		{source: "server", expected: ""},
+	}
+
+	for _, test := range tests {
+		result := getShareFromSource(test.source)
+		if result != test.expected {
+			t.Errorf("getShareFromSource(%s): unexpected output: %s, expected result: %s", test.source, result, test.expected)
+		}
+	}
+}
+
+func TestNormalizeSourceSlashes(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{source: "\\\\smb-server\\share", expected: "//smb-server/share"},
+		{source: "\\\\fs1.fabrikam.com\\share\\dir\\", expected: "//fs1.fabrikam.com/share/dir/"},
+		{source: "//smb-server/share", expected: "//smb-server/share"},
+		{source: "\\\\smb-server/share\\dir", expected: "//smb-server/share/dir"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, normalizeSourceSlashes(test.source), test.source)
+	}
+}
+
+func TestValidatePrefixPath(t *testing.T) {
+	tests := []struct {
+		prefixPath  string
+		expectedErr error
+	}{
+		{prefixPath: ""},
+		{prefixPath: "/data/app..1/"},
+		{prefixPath: "data/../share2", expectedErr: fmt.Errorf("invalid prefixpath value: data/../share2, it must not contain ..")},
+		{prefixPath: "..\\share2", expectedErr: fmt.Errorf("invalid prefixpath value: ..\\share2, it must not contain ..")},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectedErr, validatePrefixPath(test.prefixPath), test.prefixPath)
+	}
+}
+
+func TestGetMountSource(t *testing.T) {
+	tests := []struct {
+		desc     string
+		source   string
+		subDir   string
+		expected string
+	}{
+		{
+			desc:     "source with subDir",
+			source:   "//smb-server/share",
+			subDir:   "subdir",
+			expected: "//smb-server/share/subdir",
+		},
+		{
+			desc:     "source with trailing slash and subDir",
+			source:   "//smb-server/share//",
+			subDir:   "/subdir",
+			expected: "//smb-server/share/subdir",
+		},
+		{
+			desc:     "source with trailing slash and without subDir",
+			source:   "//smb-server/share/",
+			expected: "//smb-server/share/",
+		},
+		{
+			desc:     "source without subDir",
+			source:   "//smb-server/share",
+			expected: "//smb-server/share",
+		},
+	}
+
+	for _, test := range tests {
+		result := getMountSource(test.source, test.subDir)
+		if result != test.expected {
+			t.Errorf("test[%s]: unexpected output: %s, expected result: %s", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestGetUnresolvedTokens(t *testing.T) {
+	tests := []struct {
+		desc     string
+		subDir   string
+		expected []string
+	}{
+		{
+			desc:   "fully resolved template",
+			subDir: replaceWithMap("${pvc.metadata.namespace}/${pvc.metadata.name}", map[string]string{pvcNamespaceMetadata: "ns", pvcNameMetadata: "pvc"}),
+		},
+		{
+			desc:     "partially resolved template",
+			subDir:   replaceWithMap("${pv.metadata.name}/${pvc.metadata.name}/${pvc.metadata.name}", map[string]string{pvNameMetadata: "pv"}),
+			expected: []string{"${pvc.metadata.name}"},
+		},
+		{
+			desc:     "unknown tokens",
+			subDir:   "${pvc.metadata.labels}/${}/$notatoken",
+			expected: []string{"${pvc.metadata.labels}", "${}"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getUnresolvedTokens(test.subDir), test.desc)
+	}
+}
+
+func TestGetSubDirDepth(t *testing.T) {
+	tests := []struct {
+		subDir   string
+		expected int
+	}{
+		{subDir: "", expected: 0},
+		{subDir: "pvc-1", expected: 1},
+		{subDir: "ns/pvc-1/", expected: 2},
+		{subDir: "/ns//./pvc-1", expected: 2},
+		{subDir: "a/b/c/d/e", expected: 5},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getSubDirDepth(test.subDir), test.subDir)
+	}
+}
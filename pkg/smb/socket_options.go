@@ -0,0 +1,147 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// volume context parameters translated into cifs socket tuning mount options
+	tcpNoDelayField   = "tcpnodelay"
+	noBlockSendField  = "noblocksend"
+	echoIntervalField = "echointerval"
+
+	tcpNoDelayMountOption   = "tcpnodelay"
+	noBlockSendMountOption  = "noblocksend"
+	echoIntervalMountOption = "echo_interval"
+
+	// range of seconds accepted by cifs echo_interval mount option
+	minEchoInterval = 1
+	maxEchoInterval = 600
+
+	kernelReleaseFile = "/proc/sys/kernel/osrelease"
+)
+
+// kernelMountOption describes a parameter translated into a cifs mount option which depends on the kernel version
+type kernelMountOption struct {
+	field string
+	// minimum kernel version of cifs client which accepts the mount option
+	minKernelVersion *version.Version
+	// toMountOption validates value and returns the mount option, an empty option means nothing to apply
+	toMountOption func(value string) (string, error)
+}
+
+// socketOptions are socket tuning parameters exposed by cifs client
+var socketOptions = []kernelMountOption{
+	{
+		field:            tcpNoDelayField,
+		minKernelVersion: version.MustParseGeneric("2.6.26"),
+		toMountOption:    boolMountOption(tcpNoDelayField, tcpNoDelayMountOption),
+	},
+	{
+		field:            noBlockSendField,
+		minKernelVersion: version.MustParseGeneric("2.6.26"),
+		toMountOption:    boolMountOption(noBlockSendField, noBlockSendMountOption),
+	},
+	{
+		field:            echoIntervalField,
+		minKernelVersion: version.MustParseGeneric("4.5"),
+		toMountOption: func(value string) (string, error) {
+			interval, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || interval < minEchoInterval || interval > maxEchoInterval {
+				return "", fmt.Errorf("invalid %s value: %s, it must be an integer between %d and %d", echoIntervalField, value, minEchoInterval, maxEchoInterval)
+			}
+			return fmt.Sprintf("%s=%d", echoIntervalMountOption, interval), nil
+		},
+	},
+}
+
+// boolMountOption returns a translator of a true/false parameter into a flag mount option
+func boolMountOption(field, option string) func(string) (string, error) {
+	return func(value string) (string, error) {
+		switch strings.ToLower(value) {
+		case "true":
+			return option, nil
+		case "false":
+			return "", nil
+		default:
+			return "", fmt.Errorf("invalid %s value: %s, supported values: true, false", field, value)
+		}
+	}
+}
+
+// getKernelVersion returns the version of the running kernel, it is replaced in unit tests
+var getKernelVersion = func() (*version.Version, error) {
+	release, err := os.ReadFile(kernelReleaseFile)
+	if err != nil {
+		return nil, err
+	}
+	return version.ParseGeneric(strings.TrimSpace(string(release)))
+}
+
+// getSocketMountOptions translates socket tuning parameters in context into cifs mount options and appends them to mountOptions,
+// options not supported by the running kernel are skipped with a warning and returned as the second value
+func getSocketMountOptions(context map[string]string, mountOptions []string) ([]string, []string, error) {
+	return getKernelMountOptions(context, mountOptions, socketOptions)
+}
+
+// getKernelMountOptions translates parameters of options in context into cifs mount options and appends them to mountOptions,
+// options not supported by the running kernel are skipped with a warning and returned as the second value
+func getKernelMountOptions(context map[string]string, mountOptions []string, options []kernelMountOption) ([]string, []string, error) {
+	params := map[string]string{}
+	for k, v := range context {
+		params[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+
+	var kernelVersion *version.Version
+	var kernelVersionChecked bool
+	var unsupported []string
+	for _, o := range options {
+		v, ok := params[o.field]
+		if !ok || v == "" {
+			continue
+		}
+		option, err := o.toMountOption(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		if option == "" {
+			continue
+		}
+		if !kernelVersionChecked {
+			kernelVersionChecked = true
+			if kernelVersion, err = getKernelVersion(); err != nil {
+				// kernel version is unknown, let cifs client decide
+				klog.Warningf("failed to get kernel version: %v", err)
+			}
+		}
+		if kernelVersion != nil && !kernelVersion.AtLeast(o.minKernelVersion) {
+			klog.Warningf("%s=%s is ignored, mount option %s requires kernel %s or later, current kernel: %s", o.field, v, getMountOptionKey(option), o.minKernelVersion, kernelVersion)
+			unsupported = append(unsupported, o.field)
+			continue
+		}
+		mountOptions = appendMountOption(mountOptions, option)
+	}
+	return mountOptions, unsupported, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+func TestGetSocketMountOptions(t *testing.T) {
+	tests := []struct {
+		desc                string
+		context             map[string]string
+		mountOptions        []string
+		kernelVersion       string
+		kernelVersionErr    error
+		expectedOptions     []string
+		expectedUnsupported []string
+		expectedErr         error
+	}{
+		{
+			desc:            "no socket tuning parameters",
+			context:         map[string]string{sourceField: "//smb-server/share"},
+			mountOptions:    []string{"vers=3.0"},
+			kernelVersion:   "5.15.0-1034-azure",
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:            "supported options are applied",
+			context:         map[string]string{"tcpNoDelay": "true", "noBlockSend": "false", "echoInterval": "30"},
+			mountOptions:    []string{"vers=3.0"},
+			kernelVersion:   "5.15.0-1034-azure",
+			expectedOptions: []string{"vers=3.0", "tcpnodelay", "echo_interval=30"},
+		},
+		{
+			desc:            "options already present are not duplicated",
+			context:         map[string]string{"tcpNoDelay": "true", "echoInterval": "30"},
+			mountOptions:    []string{"tcpnodelay,echo_interval=10"},
+			kernelVersion:   "5.15.0",
+			expectedOptions: []string{"tcpnodelay,echo_interval=10"},
+		},
+		{
+			desc:                "unsupported option on running kernel is skipped",
+			context:             map[string]string{"tcpNoDelay": "true", "echoInterval": "30"},
+			kernelVersion:       "4.4.0-210-generic",
+			expectedOptions:     []string{"tcpnodelay"},
+			expectedUnsupported: []string{echoIntervalField},
+		},
+		{
+			desc:             "options are applied if kernel version is unknown",
+			context:          map[string]string{"echoInterval": "30"},
+			kernelVersionErr: fmt.Errorf("no such file or directory"),
+			expectedOptions:  []string{"echo_interval=30"},
+		},
+		{
+			desc:        "invalid tcpNoDelay value",
+			context:     map[string]string{"tcpNoDelay": "yes"},
+			expectedErr: fmt.Errorf("invalid tcpnodelay value: yes, supported values: true, false"),
+		},
+		{
+			desc:        "invalid echoInterval value",
+			context:     map[string]string{"echoInterval": "0"},
+			expectedErr: fmt.Errorf("invalid echointerval value: 0, it must be an integer between 1 and 600"),
+		},
+	}
+
+	defer func(f func() (*version.Version, error)) { getKernelVersion = f }(getKernelVersion)
+	for _, test := range tests {
+		getKernelVersion = func() (*version.Version, error) {
+			if test.kernelVersionErr != nil {
+				return nil, test.kernelVersionErr
+			}
+			return version.ParseGeneric(test.kernelVersion)
+		}
+		options, unsupported, err := getSocketMountOptions(test.context, test.mountOptions)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedOptions, options, test.desc)
+		assert.Equal(t, test.expectedUnsupported, unsupported, test.desc)
+	}
+}
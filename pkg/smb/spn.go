@@ -0,0 +1,78 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// volume context parameter of the service principal name expected for kerberos mount
+	expectedSPNField = "expectedspn"
+	// service class of SPN requested by cifs client
+	cifsServiceClass = "cifs"
+	// volume context parameter of the kerberos realm, which is used as domain of kerberos mount if domain is not specified
+	realmField = "realm"
+)
+
+// realmPattern matches a kerberos realm, e.g. FABRIKAM.COM
+var realmPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// spnPattern matches <service class>/<host>[:<port>][@<realm>], e.g. cifs/fs1.fabrikam.com@FABRIKAM.COM
+var spnPattern = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*)/([A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?)(:[0-9]{1,5})?(@[A-Za-z0-9][A-Za-z0-9.-]*)?$`)
+
+// validateExpectedSPN checks spn is well-formed and identifies server, since cifs client requests
+// a ticket of cifs/<server host name>, a mismatch means the mount would authenticate against an unexpected principal
+func validateExpectedSPN(spn, server string) error {
+	matches := spnPattern.FindStringSubmatch(spn)
+	if matches == nil {
+		return fmt.Errorf("invalid %s value: %s, expected format: %s/<host>[@<realm>]", expectedSPNField, spn, cifsServiceClass)
+	}
+	if !strings.EqualFold(matches[1], cifsServiceClass) {
+		return fmt.Errorf("invalid %s value: %s, service class must be %s", expectedSPNField, spn, cifsServiceClass)
+	}
+	if host := matches[2]; !strings.EqualFold(host, server) {
+		return fmt.Errorf("%s %s does not match smb server %s", expectedSPNField, spn, server)
+	}
+	return nil
+}
+
+// getKerberosDomain returns domain if it's specified, otherwise the kerberos realm of a kerberos mount since the realm
+// maps to the smb domain, it returns empty string if mountFlags is not kerberos or no realm is found
+func getKerberosDomain(domain, realm, expectedSPN string, mountFlags []string) (string, error) {
+	if domain != "" || !hasKerberosMountOption(mountFlags) {
+		return domain, nil
+	}
+	return getKerberosRealm(realm, expectedSPN)
+}
+
+// getKerberosRealm returns realm if it's specified, otherwise the realm in expectedSPN, e.g. FABRIKAM.COM of
+// cifs/fs1.fabrikam.com@FABRIKAM.COM, it returns empty string if neither has a realm
+func getKerberosRealm(realm, expectedSPN string) (string, error) {
+	if realm == "" {
+		if i := strings.LastIndex(expectedSPN, "@"); i >= 0 {
+			return expectedSPN[i+1:], nil
+		}
+		return "", nil
+	}
+	if !realmPattern.MatchString(realm) {
+		return "", fmt.Errorf("invalid %s value: %s", realmField, realm)
+	}
+	return realm, nil
+}
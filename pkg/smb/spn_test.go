@@ -0,0 +1,139 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestValidateExpectedSPN(t *testing.T) {
+	tests := []struct {
+		desc        string
+		spn         string
+		server      string
+		expectedErr error
+	}{
+		{
+			desc:   "well-formed SPN",
+			spn:    "cifs/fs1.fabrikam.com",
+			server: "fs1.fabrikam.com",
+		},
+		{
+			desc:   "well-formed SPN with realm",
+			spn:    "CIFS/FS1.fabrikam.com@FABRIKAM.COM",
+			server: "fs1.fabrikam.com",
+		},
+		{
+			desc:        "malformed SPN",
+			spn:         "fs1.fabrikam.com",
+			server:      "fs1.fabrikam.com",
+			expectedErr: fmt.Errorf("invalid expectedspn value: fs1.fabrikam.com, expected format: cifs/<host>[@<realm>]"),
+		},
+		{
+			desc:        "SPN with invalid host",
+			spn:         "cifs/fs1_fabrikam.com",
+			server:      "fs1.fabrikam.com",
+			expectedErr: fmt.Errorf("invalid expectedspn value: cifs/fs1_fabrikam.com, expected format: cifs/<host>[@<realm>]"),
+		},
+		{
+			desc:        "unexpected service class",
+			spn:         "host/fs1.fabrikam.com",
+			server:      "fs1.fabrikam.com",
+			expectedErr: fmt.Errorf("invalid expectedspn value: host/fs1.fabrikam.com, service class must be cifs"),
+		},
+		{
+			desc:        "SPN not matching server",
+			spn:         "cifs/fs2.fabrikam.com",
+			server:      "fs1.fabrikam.com",
+			expectedErr: fmt.Errorf("expectedspn cifs/fs2.fabrikam.com does not match smb server fs1.fabrikam.com"),
+		},
+	}
+
+	for _, test := range tests {
+		err := validateExpectedSPN(test.spn, test.server)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGetKerberosDomain(t *testing.T) {
+	tests := []struct {
+		desc           string
+		domain         string
+		realm          string
+		expectedSPN    string
+		mountFlags     []string
+		expectedDomain string
+		expectedErr    error
+	}{
+		{
+			desc:           "realm is used as domain of kerberos mount",
+			realm:          "FABRIKAM.COM",
+			mountFlags:     []string{"sec=krb5"},
+			expectedDomain: "FABRIKAM.COM",
+		},
+		{
+			desc:           "realm in expected SPN is used as domain",
+			expectedSPN:    "cifs/fs1.fabrikam.com@FABRIKAM.COM",
+			mountFlags:     []string{"sec=krb5i"},
+			expectedDomain: "FABRIKAM.COM",
+		},
+		{
+			desc:           "realm takes precedence over realm in expected SPN",
+			realm:          "CONTOSO.COM",
+			expectedSPN:    "cifs/fs1.fabrikam.com@FABRIKAM.COM",
+			mountFlags:     []string{"sec=krb5"},
+			expectedDomain: "CONTOSO.COM",
+		},
+		{
+			desc:           "explicit domain takes precedence over realm",
+			domain:         "CONTOSO",
+			realm:          "FABRIKAM.COM",
+			mountFlags:     []string{"sec=krb5"},
+			expectedDomain: "CONTOSO",
+		},
+		{
+			desc:        "no realm in kerberos mount",
+			expectedSPN: "cifs/fs1.fabrikam.com",
+			mountFlags:  []string{"sec=krb5"},
+		},
+		{
+			desc:       "realm is not used in ntlm mount",
+			realm:      "FABRIKAM.COM",
+			mountFlags: []string{"sec=ntlmssp"},
+		},
+		{
+			desc:        "invalid realm",
+			realm:       "FABRIKAM.COM,uid=0",
+			mountFlags:  []string{"sec=krb5"},
+			expectedErr: fmt.Errorf("invalid realm value: FABRIKAM.COM,uid=0"),
+		},
+	}
+
+	for _, test := range tests {
+		domain, err := getKerberosDomain(test.domain, test.realm, test.expectedSPN, test.mountFlags)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if domain != test.expectedDomain {
+			t.Errorf("test[%s]: unexpected domain: %s, expected domain: %s", test.desc, domain, test.expectedDomain)
+		}
+	}
+}
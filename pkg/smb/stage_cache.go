@@ -0,0 +1,190 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// default kubelet root directory under which staging paths are created
+	DefaultKubeletRootDir = "/var/lib/kubelet"
+	// staging paths are created as <kubelet root>/plugins/kubernetes.io/csi/<driver name or pv>/<name>/globalmount
+	csiPluginsDir       = "plugins/kubernetes.io/csi"
+	legacyStagingDir    = "pv"
+	stagingPathBaseName = "globalmount"
+	// kubelet records volume handle of the staging path in vol_data.json next to it
+	volDataFileName = "vol_data.json"
+)
+
+// sensitiveMountOptionKeys are mount option keys which must not be kept in stage cache
+var sensitiveMountOptionKeys = map[string]bool{
+	"password":  true,
+	"password2": true,
+	"pass":      true,
+}
+
+// stageEntry records parameters used to stage a volume, secrets are excluded
+type stageEntry struct {
+	// volumeID is empty if the entry is reconstructed from mount table and kubelet volume data is not available
+	volumeID     string
+	source       string
+	mountOptions []string
+	// credentials of stage, only kept with merge publish secrets policy
+	credentials *Credentials
+	// shares overlaid on staging path if the volume is a union of shares
+	unionSources []string
+	// mount namespace in which cifs is mounted, empty for host namespace
+	mountNamespace string
+	// createdAt is the time when the volume is staged, or when the entry is reconstructed from mount table
+	createdAt time.Time
+}
+
+// stageCache caches stage parameters keyed by staging path
+type stageCache struct {
+	sync.RWMutex
+	entries map[string]stageEntry
+	now     func() time.Time
+}
+
+func newStageCache() *stageCache {
+	return &stageCache{entries: map[string]stageEntry{}, now: time.Now}
+}
+
+func (c *stageCache) set(stagingPath string, entry stageEntry) {
+	c.Lock()
+	defer c.Unlock()
+	entry.mountOptions = removeSensitiveMountOptions(entry.mountOptions)
+	if entry.createdAt.IsZero() {
+		entry.createdAt = c.now()
+	}
+	c.entries[filepath.Clean(stagingPath)] = entry
+}
+
+func (c *stageCache) get(stagingPath string) (stageEntry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, ok := c.entries[filepath.Clean(stagingPath)]
+	return entry, ok
+}
+
+func (c *stageCache) delete(stagingPath string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, filepath.Clean(stagingPath))
+}
+
+// age returns the time elapsed since the volume is staged on stagingPath
+func (c *stageCache) age(stagingPath string) (time.Duration, bool) {
+	entry, ok := c.get(stagingPath)
+	if !ok {
+		return 0, false
+	}
+	return c.now().Sub(entry.createdAt), true
+}
+
+// list returns a copy of all entries keyed by staging path
+func (c *stageCache) list() map[string]stageEntry {
+	c.RLock()
+	defer c.RUnlock()
+	result := make(map[string]stageEntry, len(c.entries))
+	for k, v := range c.entries {
+		result[k] = v
+	}
+	return result
+}
+
+// removeSensitiveMountOptions removes password mount options
+func removeSensitiveMountOptions(options []string) []string {
+	var result []string
+	for _, option := range splitMountOptions(options) {
+		if !sensitiveMountOptionKeys[strings.ToLower(getMountOptionKey(option))] {
+			result = append(result, option)
+		}
+	}
+	return result
+}
+
+// isStagingPath checks whether path is a staging path of this driver under kubeletRootDir
+func isStagingPath(path, kubeletRootDir, driverName string) bool {
+	rel, err := filepath.Rel(filepath.Join(kubeletRootDir, csiPluginsDir), path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	if len(segments) != 3 || segments[2] != stagingPathBaseName {
+		return false
+	}
+	return segments[0] == driverName || segments[0] == legacyStagingDir
+}
+
+// getStagedVolumeID returns volume handle which kubelet records for staging path in vol_data.json,
+// empty string is returned if it could not be read
+func getStagedVolumeID(stagingPath string) string {
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(stagingPath), volDataFileName))
+	if err != nil {
+		klog.V(4).Infof("failed to read volume data of staging path %s: %v", stagingPath, err)
+		return ""
+	}
+	var volData struct {
+		VolumeHandle string `json:"volumeHandle"`
+	}
+	if err := json.Unmarshal(content, &volData); err != nil {
+		klog.Warningf("failed to parse volume data of staging path %s: %v", stagingPath, err)
+		return ""
+	}
+	return volData.VolumeHandle
+}
+
+// reconstructStageCache rebuilds stage cache from cifs mounts and overlays of unions on staging paths of this driver,
+// it's used to recover stage state after driver restart
+func (d *Driver) reconstructStageCache(mountPoints []mount.MountPoint) int {
+	count := 0
+	for _, mp := range mountPoints {
+		if (mp.Type != "cifs" && mp.Type != "overlay") || !isStagingPath(mp.Path, d.kubeletRootDir, d.Name) {
+			continue
+		}
+		if _, ok := d.stageCache.get(mp.Path); ok {
+			continue
+		}
+		entry := stageEntry{
+			volumeID:     getStagedVolumeID(mp.Path),
+			source:       mp.Device,
+			mountOptions: mp.Opts,
+		}
+		if mp.Type == "overlay" {
+			sources, options := getUnionSources(mp.Path, mountPoints)
+			if len(sources) == 0 {
+				continue
+			}
+			// server of the first share is the source of a union as in NodeStageVolume
+			entry.source, entry.mountOptions, entry.unionSources = sources[0], options, sources
+		}
+		d.stageCache.set(mp.Path, entry)
+		klog.V(2).Infof("reconstructed stage state of %s on %s", entry.source, mp.Path)
+		count++
+	}
+	return count
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/component-base/metrics"
+	mount "k8s.io/mount-utils"
+)
+
+func TestRemoveSensitiveMountOptions(t *testing.T) {
+	options := []string{"username=user,password=secret", "vers=3.0", "pass=secret", "dir_mode=0777"}
+	expected := []string{"username=user", "vers=3.0", "dir_mode=0777"}
+	result := removeSensitiveMountOptions(options)
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("unexpected output: %v, expected result: %v", result, expected)
+	}
+}
+
+func TestStageCache(t *testing.T) {
+	cache := newStageCache()
+	cache.set("/staging/globalmount/", stageEntry{
+		volumeID:     "vol_1",
+		source:       "//server/share",
+		mountOptions: []string{"vers=3.0,password=secret"},
+	})
+
+	entry, ok := cache.get("/staging/globalmount")
+	assert.True(t, ok)
+	assert.Equal(t, "vol_1", entry.volumeID)
+	assert.Equal(t, []string{"vers=3.0"}, entry.mountOptions)
+	assert.False(t, entry.createdAt.IsZero())
+	assert.Equal(t, 1, len(cache.list()))
+
+	cache.delete("/staging/globalmount")
+	_, ok = cache.get("/staging/globalmount")
+	assert.False(t, ok)
+}
+
+func TestReconstructStageCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	d := NewFakeDriver()
+	d.kubeletRootDir = "/var/lib/kubelet"
+	stagingPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/smb.csi.k8s.io/abc/globalmount"
+	legacyStagingPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount"
+
+	mountPoints := []mount.MountPoint{
+		{Device: "//server/share", Path: stagingPath, Type: "cifs", Opts: []string{"rw", "vers=3.0", "username=user", "password=secret"}},
+		{Device: "//server/legacy", Path: legacyStagingPath, Type: "cifs", Opts: []string{"rw"}},
+		// publish path
+		{Device: "//server/share", Path: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv-1/mount", Type: "cifs", Opts: []string{"rw"}},
+		// staging path of another driver
+		{Device: "//server/other", Path: "/var/lib/kubelet/plugins/kubernetes.io/csi/file.csi.azure.com/abc/globalmount", Type: "cifs", Opts: []string{"rw"}},
+		// not a cifs mount
+		{Device: "server:/export", Path: "/var/lib/kubelet/plugins/kubernetes.io/csi/smb.csi.k8s.io/def/globalmount", Type: "nfs", Opts: []string{"rw"}},
+		// not under kubelet root directory
+		{Device: "//server/share", Path: "/mnt/smb.csi.k8s.io/abc/globalmount", Type: "cifs", Opts: []string{"rw"}},
+	}
+
+	count := d.reconstructStageCache(mountPoints)
+	assert.Equal(t, 2, count)
+
+	entries := d.stageCache.list()
+	assert.Equal(t, 2, len(entries))
+	entry, ok := entries[stagingPath]
+	assert.True(t, ok)
+	assert.Equal(t, "", entry.volumeID)
+	assert.Equal(t, "//server/share", entry.source)
+	assert.Equal(t, []string{"rw", "vers=3.0", "username=user"}, entry.mountOptions)
+	entry, ok = entries[legacyStagingPath]
+	assert.True(t, ok)
+	assert.Equal(t, "//server/legacy", entry.source)
+
+	// existing entries are not overwritten
+	assert.Equal(t, 0, d.reconstructStageCache(mountPoints))
+}
+
+func TestGetStagedVolumeID(t *testing.T) {
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	assert.Equal(t, "", getStagedVolumeID(stagingPath))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, volDataFileName), []byte("invalid"), 0640))
+	assert.Equal(t, "", getStagedVolumeID(stagingPath))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, volDataFileName), []byte(`{"driverName":"smb.csi.k8s.io","volumeHandle":"smb-server/share#vol_1##"}`), 0640))
+	assert.Equal(t, "smb-server/share#vol_1##", getStagedVolumeID(stagingPath))
+}
+
+func TestStageMountAge(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip stage mount age test on Windows")
+	}
+	d := NewFakeDriver()
+	mounter, err := NewFakeMounter()
+	assert.NoError(t, err)
+	d.mounter = mounter
+	now := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	d.stageCache.now = func() time.Time { return now }
+
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	stageReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+		Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+	}
+	_, err = d.NodeStageVolume(context.Background(), stageReq)
+	assert.NoError(t, err)
+
+	age, ok := d.stageCache.age(stagingPath)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), age)
+
+	now = now.Add(time.Hour)
+	age, _ = d.stageCache.age(stagingPath)
+	assert.Equal(t, time.Hour, age)
+
+	registry := metrics.NewKubeRegistry()
+	registry.CustomMustRegister(newStageMountAgeCollector(d.stageCache))
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(families))
+	assert.Equal(t, "csi_smb_stage_mount_age_seconds", families[0].GetName())
+	assert.Equal(t, float64(3600), families[0].GetMetric()[0].GetGauge().GetValue())
+
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+	_, ok = d.stageCache.age(stagingPath)
+	assert.False(t, ok)
+
+	// age is reset after restage
+	now = now.Add(time.Hour)
+	_, err = d.NodeStageVolume(context.Background(), stageReq)
+	assert.NoError(t, err)
+	age, ok = d.stageCache.age(stagingPath)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), age)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// file written into staging directory on stage failure if --retain-failed-staging is set
+	stageFailureFile = "failure.json"
+	// secret values in stage failure record are replaced by this string
+	redactedValue = "***"
+)
+
+// stageFailure is the record of a failed NodeStageVolume kept in staging directory for later inspection
+type stageFailure struct {
+	VolumeID      string            `json:"volumeID"`
+	Time          string            `json:"time"`
+	Code          string            `json:"code"`
+	Error         string            `json:"error"`
+	MountFlags    []string          `json:"mountFlags,omitempty"`
+	VolumeContext map[string]string `json:"volumeContext,omitempty"`
+}
+
+// recordStageFailure writes failure.json with the sanitized error and options into staging directory of req,
+// nothing is written if staging directory does not exist or is mounted, so that a failure is never written into a share
+func (d *Driver) recordStageFailure(req *csi.NodeStageVolumeRequest, stageErr error) {
+	stagingPath := req.GetStagingTargetPath()
+	if !d.retainFailedStaging || runtime.GOOS == "windows" || stagingPath == "" {
+		return
+	}
+	// the staging directory is being staged by another request or an abandoned mount attempt
+	if code := status.Code(stageErr); code == codes.Aborted || code == codes.DeadlineExceeded {
+		return
+	}
+	if mounted, err := d.isListedMountPoint(stagingPath); err != nil || mounted {
+		return
+	}
+	if info, err := os.Stat(stagingPath); err != nil || !info.IsDir() {
+		return
+	}
+
+	secrets := req.GetSecrets()
+	failure := stageFailure{
+		VolumeID:      req.GetVolumeId(),
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Code:          status.Code(stageErr).String(),
+		Error:         redactSecrets(status.Convert(stageErr).Message(), secrets),
+		VolumeContext: map[string]string{},
+	}
+	for k, v := range req.GetVolumeContext() {
+		failure.VolumeContext[k] = redactSecrets(v, secrets)
+	}
+	for _, flag := range req.GetVolumeCapability().GetMount().GetMountFlags() {
+		failure.MountFlags = append(failure.MountFlags, redactSecrets(flag, secrets))
+	}
+	content, err := json.MarshalIndent(failure, "", "  ")
+	if err != nil {
+		klog.Warningf("failed to marshal stage failure of volume(%s): %v", req.GetVolumeId(), err)
+		return
+	}
+	path := filepath.Join(stagingPath, stageFailureFile)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		klog.Warningf("failed to write stage failure of volume(%s) into %s: %v", req.GetVolumeId(), path, err)
+		return
+	}
+	klog.V(2).Infof("stage failure of volume(%s) is retained in %s", req.GetVolumeId(), path)
+}
+
+// cleanupStageFailure removes failure.json from staging directory on unstage so that the directory could be removed,
+// mount table is read instead of stat on staging path which could hang on a stale mount
+func (d *Driver) cleanupStageFailure(stagingPath string) {
+	if !d.retainFailedStaging || runtime.GOOS == "windows" {
+		return
+	}
+	if mounted, err := d.isListedMountPoint(stagingPath); err != nil || mounted {
+		return
+	}
+	removeStageFailure(stagingPath)
+}
+
+// isListedMountPoint returns whether path is a mount point in mount table
+func (d *Driver) isListedMountPoint(path string) (bool, error) {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return false, err
+	}
+	pathAbs, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	for _, mp := range mountPoints {
+		if mp.Path == pathAbs {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeStageFailure removes failure.json of a previous stage failure from staging directory before it's mounted
+// or removed, it must not be called if staging directory is mounted
+func removeStageFailure(stagingPath string) {
+	path := filepath.Join(stagingPath, stageFailureFile)
+	if err := os.Remove(path); err == nil {
+		klog.V(2).Infof("removed stage failure record %s", path)
+	} else if !os.IsNotExist(err) {
+		klog.Warningf("failed to remove stage failure record %s: %v", path, err)
+	}
+}
+
+// redactSecrets replaces secret values in str with redactedValue
+func redactSecrets(str string, secrets map[string]string) string {
+	for _, v := range secrets {
+		if v != "" {
+			str = strings.ReplaceAll(str, v, redactedValue)
+		}
+	}
+	return str
+}
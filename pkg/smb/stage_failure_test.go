@@ -0,0 +1,122 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestRecordStageFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tests := []struct {
+		desc                string
+		retainFailedStaging bool
+		expectedRecord      bool
+	}{
+		{
+			desc: "staging directory is not touched by default",
+		},
+		{
+			desc:                "failure is retained in staging directory",
+			retainFailedStaging: true,
+			expectedRecord:      true,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+		d.retainFailedStaging = test.retainFailedStaging
+		d.maxSubDirDepth = 1
+		stagingPath := filepath.Join(t.TempDir(), "globalmount")
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=3.0", "password=secretpass"}}},
+			},
+			VolumeContext: map[string]string{sourceField: "//smb-server/share", subDirField: "secretpass/subdir"},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "secretpass"},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), test.desc)
+		assert.DirExists(t, stagingPath, test.desc)
+
+		content, readErr := os.ReadFile(filepath.Join(stagingPath, stageFailureFile))
+		if !test.expectedRecord {
+			assert.True(t, os.IsNotExist(readErr), test.desc)
+			continue
+		}
+		assert.NoError(t, readErr, test.desc)
+		assert.NotContains(t, string(content), "secretpass", test.desc)
+		var failure stageFailure
+		assert.NoError(t, json.Unmarshal(content, &failure), test.desc)
+		assert.Equal(t, "vol_1##", failure.VolumeID, test.desc)
+		assert.Equal(t, codes.InvalidArgument.String(), failure.Code, test.desc)
+		assert.Equal(t, "volume(vol_1##): depth 2 of subdir ***/subdir exceeds max subdir depth 1", failure.Error, test.desc)
+		assert.Equal(t, []string{"vers=3.0", "password=***"}, failure.MountFlags, test.desc)
+	}
+}
+
+func TestStageFailureIsRemoved(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+	d.retainFailedStaging = true
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	failurePath := filepath.Join(stagingPath, stageFailureFile)
+	assert.NoError(t, os.MkdirAll(stagingPath, 0750))
+
+	// record is removed before the next mount attempt
+	assert.NoError(t, os.WriteFile(failurePath, []byte("{}"), 0600))
+	_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+		Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+	})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, failurePath)
+
+	// record is removed on unstage so that staging directory could be removed
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+	assert.NoError(t, os.WriteFile(failurePath, []byte("{}"), 0600))
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+	})
+	assert.NoError(t, err)
+	assert.NoDirExists(t, stagingPath)
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// experimental volume context parameter of comma separated shares which are overlaid read-only at staging path
+	sourcesField = "sources"
+	// minimum number of shares in a union, overlayfs without upper dir requires at least two lower dirs
+	minUnionSources = 2
+	// directory next to staging path in which each share of a union is mounted
+	unionMountDir = "union"
+)
+
+// parseUnionSources parses comma separated shares of sources parameter, the first share is the top layer of the union
+func parseUnionSources(value string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		if source = strings.TrimSpace(source); source != "" {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) < minUnionSources {
+		return nil, fmt.Errorf("invalid %s value: %s, at least %d shares are required", sourcesField, value, minUnionSources)
+	}
+	return sources, nil
+}
+
+// getUnionLowerDir returns the directory in which shares of the union on stagingPath are mounted,
+// it's next to stagingPath under kubelet directory so that it could be found on unstage after driver restart
+func getUnionLowerDir(stagingPath string) string {
+	return filepath.Join(filepath.Dir(stagingPath), unionMountDir)
+}
+
+// getUnionSources returns shares of the union on stagingPath in mount table ordered from the top layer,
+// together with mount options of the top layer
+func getUnionSources(stagingPath string, mountPoints []mount.MountPoint) ([]string, []string) {
+	lowerDir := getUnionLowerDir(stagingPath)
+	layers := map[int]mount.MountPoint{}
+	for _, mp := range mountPoints {
+		if mp.Type != "cifs" || filepath.Dir(mp.Path) != lowerDir {
+			continue
+		}
+		if i, err := strconv.Atoi(filepath.Base(mp.Path)); err == nil {
+			layers[i] = mp
+		}
+	}
+	indexes := make([]int, 0, len(layers))
+	for i := range layers {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	var sources, options []string
+	for _, i := range indexes {
+		sources = append(sources, layers[i].Device)
+	}
+	if len(indexes) > 0 {
+		options = layers[indexes[0]].Opts
+	}
+	return sources, options
+}
+
+// cleanupOrphanUnions cleans up shares of unions whose overlay is not mounted on staging path,
+// e.g. driver restarted while a union was being mounted or unmounted, it returns the number of unions cleaned up
+func (d *Driver) cleanupOrphanUnions(mountPoints []mount.MountPoint) int {
+	overlays := map[string]bool{}
+	for _, mp := range mountPoints {
+		if mp.Type == "overlay" {
+			overlays[mp.Path] = true
+		}
+	}
+	count := 0
+	cleaned := map[string]bool{}
+	for _, mp := range mountPoints {
+		if mp.Type != "cifs" || filepath.Base(filepath.Dir(mp.Path)) != unionMountDir {
+			continue
+		}
+		stagingPath := filepath.Join(filepath.Dir(filepath.Dir(mp.Path)), stagingPathBaseName)
+		if overlays[stagingPath] || cleaned[stagingPath] || !isStagingPath(stagingPath, d.kubeletRootDir, d.Name) {
+			continue
+		}
+		cleaned[stagingPath] = true
+		klog.V(2).Infof("overlay of union is not mounted on %s, clean up its shares", stagingPath)
+		if err := d.cleanupUnion(stagingPath); err != nil {
+			klog.Errorf("failed to clean up orphan union on %s: %v", stagingPath, err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// mountUnion mounts each share in sources read-only and overlays them on stagingPath,
+// all mounts of the union are cleaned up if any of them fails
+func (d *Driver) mountUnion(volumeID string, sources []string, stagingPath string, mountOptions, sensitiveMountOptions []string) error {
+	abort := func(err error) error {
+		if cleanupErr := d.cleanupUnion(stagingPath); cleanupErr != nil {
+			klog.Errorf("volume(%s): %v", volumeID, cleanupErr)
+		}
+		return err
+	}
+	lowerDir := getUnionLowerDir(stagingPath)
+	lowerDirs := make([]string, 0, len(sources))
+	for i, source := range sources {
+		dir := filepath.Join(lowerDir, strconv.Itoa(i))
+		if err := ensureDir(dir, 0750); err != nil {
+			return abort(fmt.Errorf("failed to create %s for share %s: %v", dir, source, err))
+		}
+		klog.V(2).Infof("volume(%s): mounting share %s of union on %s", volumeID, source, dir)
+		if err := Mount(d.mounter, source, dir, "cifs", setMountOption(mountOptions, "ro"), sensitiveMountOptions); err != nil {
+			return abort(fmt.Errorf("mount share %s of union failed: %v", source, err))
+		}
+		lowerDirs = append(lowerDirs, dir)
+	}
+	overlayOptions := []string{"ro", "lowerdir=" + strings.Join(lowerDirs, ":")}
+	if err := d.mounter.Mount("overlay", stagingPath, "overlay", overlayOptions); err != nil {
+		return abort(fmt.Errorf("overlay mount of union on %s failed: %v", stagingPath, err))
+	}
+	return nil
+}
+
+// cleanupUnion unmounts shares of the union on stagingPath and removes their directories,
+// the overlay on stagingPath must be unmounted before, it's a no-op if stagingPath is not a union
+func (d *Driver) cleanupUnion(stagingPath string) error {
+	lowerDir := getUnionLowerDir(stagingPath)
+	entries, err := os.ReadDir(lowerDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(lowerDir, entry.Name())
+		// directory is only removed after it's unmounted, so share content is never deleted
+		if err := CleanupMountPoint(d.mounter, dir, true); err != nil {
+			return fmt.Errorf("failed to clean up share of union on %s: %v", dir, err)
+		}
+	}
+	if err := os.Remove(lowerDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	klog.V(2).Infof("cleaned up shares of union on %s", stagingPath)
+	return nil
+}
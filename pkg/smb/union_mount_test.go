@@ -0,0 +1,214 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+// unionMounter fails mount of a source containing error_mount
+type unionMounter struct {
+	*mount.FakeMounter
+}
+
+func (m *unionMounter) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	if strings.Contains(source, "error_mount") {
+		return fmt.Errorf("fake mount error")
+	}
+	return m.FakeMounter.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+func TestParseUnionSources(t *testing.T) {
+	tests := []struct {
+		value           string
+		expectedSources []string
+		expectedErr     error
+	}{
+		{
+			value:           "//smb-server/share1, //smb-server/share2,",
+			expectedSources: []string{"//smb-server/share1", "//smb-server/share2"},
+		},
+		{
+			value:       "//smb-server/share1",
+			expectedErr: fmt.Errorf("invalid sources value: //smb-server/share1, at least 2 shares are required"),
+		},
+	}
+
+	for _, test := range tests {
+		sources, err := parseUnionSources(test.value)
+		assert.Equal(t, test.expectedErr, err, test.value)
+		assert.Equal(t, test.expectedSources, sources, test.value)
+	}
+}
+
+func TestNodeStageVolumeUnion(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("union of shares is only supported on Linux")
+	}
+	tests := []struct {
+		desc              string
+		sources           string
+		subDir            string
+		expectedErrorCode codes.Code
+	}{
+		{
+			desc:    "two shares are overlaid on staging path",
+			sources: "//smb-server/share1,//smb-server/share2",
+		},
+		{
+			desc:              "mounts are cleaned up if a share fails to mount",
+			sources:           "//smb-server/share1,//smb-server/error_mount",
+			expectedErrorCode: codes.Internal,
+		},
+		{
+			desc:              "subDir is not supported",
+			sources:           "//smb-server/share1,//smb-server/share2",
+			subDir:            "subdir",
+			expectedErrorCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := &unionMounter{FakeMounter: mount.NewFakeMounter(nil)}
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+		stagingPath := filepath.Join(t.TempDir(), "globalmount")
+		lowerDir := getUnionLowerDir(stagingPath)
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=3.0"}}},
+			},
+			VolumeContext: map[string]string{"sources": test.sources, subDirField: test.subDir},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.Equal(t, test.expectedErrorCode, status.Code(err), test.desc)
+		if test.expectedErrorCode != codes.OK {
+			assert.Empty(t, fakeMounter.MountPoints, test.desc)
+			assert.NoDirExists(t, lowerDir, test.desc)
+			continue
+		}
+
+		lowerDirs := []string{filepath.Join(lowerDir, "0"), filepath.Join(lowerDir, "1")}
+		if assert.Len(t, fakeMounter.MountPoints, 3, test.desc) {
+			for i, device := range []string{"//smb-server/share1", "//smb-server/share2"} {
+				assert.Equal(t, device, fakeMounter.MountPoints[i].Device, test.desc)
+				assert.Equal(t, lowerDirs[i], fakeMounter.MountPoints[i].Path, test.desc)
+				assert.Contains(t, fakeMounter.MountPoints[i].Opts, "ro", test.desc)
+			}
+			assert.Equal(t, mount.MountPoint{
+				Device: "overlay",
+				Path:   stagingPath,
+				Type:   "overlay",
+				Opts:   []string{"ro", "lowerdir=" + strings.Join(lowerDirs, ":")},
+			}, fakeMounter.MountPoints[2], test.desc)
+		}
+
+		// shares are unmounted on unstage after the overlay
+		_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: stagingPath})
+		assert.NoError(t, err, test.desc)
+		assert.Empty(t, fakeMounter.MountPoints, test.desc)
+		assert.NoDirExists(t, lowerDir, test.desc)
+	}
+}
+
+func TestUnionAfterRestart(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("union of shares is only supported on Linux")
+	}
+	kubeletRootDir := t.TempDir()
+	stagingPath := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/abc/globalmount")
+	lowerDir := getUnionLowerDir(stagingPath)
+	assert.Equal(t, filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/abc/union"), lowerDir)
+	fakeMounter := &unionMounter{FakeMounter: mount.NewFakeMounter(nil)}
+
+	d := NewFakeDriver()
+	d.kubeletRootDir = kubeletRootDir
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=3.0"}}},
+		},
+		VolumeContext: map[string]string{"sources": "//smb-server/share1,//smb-server/share2"},
+		Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, fakeMounter.MountPoints, 3)
+
+	// union is reconstructed from mount table after restart
+	d = NewFakeDriver()
+	d.kubeletRootDir = kubeletRootDir
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	assert.Equal(t, 1, d.reconstructStageCache(fakeMounter.MountPoints))
+	assert.Equal(t, 0, d.cleanupOrphanUnions(fakeMounter.MountPoints))
+	entry, ok := d.stageCache.get(stagingPath)
+	assert.True(t, ok)
+	assert.Equal(t, "//smb-server/share1", entry.source)
+	assert.Equal(t, []string{"//smb-server/share1", "//smb-server/share2"}, entry.unionSources)
+
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+	assert.Empty(t, fakeMounter.MountPoints)
+	assert.NoDirExists(t, lowerDir)
+}
+
+func TestCleanupOrphanUnions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("union of shares is only supported on Linux")
+	}
+	kubeletRootDir := t.TempDir()
+	orphanStagingPath := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/abc/globalmount")
+	stagingPath := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/def/globalmount")
+	otherDriverLowerDir := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/other.csi.k8s.io/ghi/union")
+	mountPoints := []mount.MountPoint{
+		// overlay is not mounted on orphanStagingPath
+		{Device: "//smb-server/share1", Path: filepath.Join(getUnionLowerDir(orphanStagingPath), "0"), Type: "cifs"},
+		{Device: "//smb-server/share2", Path: filepath.Join(getUnionLowerDir(orphanStagingPath), "1"), Type: "cifs"},
+		{Device: "//smb-server/share1", Path: filepath.Join(getUnionLowerDir(stagingPath), "0"), Type: "cifs"},
+		{Device: "//smb-server/share2", Path: filepath.Join(getUnionLowerDir(stagingPath), "1"), Type: "cifs"},
+		{Device: "overlay", Path: stagingPath, Type: "overlay"},
+		{Device: "//smb-server/share3", Path: filepath.Join(otherDriverLowerDir, "0"), Type: "cifs"},
+	}
+	for _, mp := range mountPoints {
+		assert.NoError(t, os.MkdirAll(mp.Path, 0750))
+	}
+	fakeMounter := mount.NewFakeMounter(mountPoints)
+	d := NewFakeDriver()
+	d.kubeletRootDir = kubeletRootDir
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+	assert.Equal(t, 1, d.cleanupOrphanUnions(fakeMounter.MountPoints))
+	assert.Equal(t, mountPoints[2:], fakeMounter.MountPoints)
+	assert.NoDirExists(t, getUnionLowerDir(orphanStagingPath))
+	assert.DirExists(t, getUnionLowerDir(stagingPath))
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// postUnmountHook runs a command with volume id and staging path after a volume is unstaged,
+// failure of the command is logged and does not fail NodeUnstageVolume
+type postUnmountHook struct {
+	command string
+	timeout time.Duration
+	// run is replaced in unit tests
+	run func(ctx context.Context, command string, args ...string) ([]byte, error)
+}
+
+func newPostUnmountHook(command string, timeout time.Duration) *postUnmountHook {
+	return &postUnmountHook{
+		command: command,
+		timeout: timeout,
+		run:     runHookCommand,
+	}
+}
+
+// runHookCommand runs command with PATH only in its environment, so that secrets in driver environment are not passed
+func runHookCommand(ctx context.Context, command string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
+	return cmd.CombinedOutput()
+}
+
+// Run runs the hook command if configured, it returns after the command exits or times out
+func (h *postUnmountHook) Run(volumeID, stagingPath string) {
+	if h == nil || h.command == "" {
+		return
+	}
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	output, err := h.run(ctx, h.command, volumeID, stagingPath)
+	if err != nil {
+		klog.Warningf("post unmount hook %s of volume(%s) on %s failed: %v, output: %s", h.command, volumeID, stagingPath, err, string(output))
+		return
+	}
+	klog.V(2).Infof("post unmount hook %s of volume(%s) on %s succeeded, output: %s", h.command, volumeID, stagingPath, string(output))
+}
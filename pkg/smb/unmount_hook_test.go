@@ -0,0 +1,104 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunHookCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip shell script test on Windows")
+	}
+	t.Setenv("SMB_PASSWORD", "secret")
+	tmpDir := t.TempDir()
+	outputFile := filepath.Join(tmpDir, "output")
+	script := filepath.Join(tmpDir, "hook.sh")
+	content := fmt.Sprintf("#!/bin/sh\necho \"$1 $2 password=$SMB_PASSWORD\" > %s\n", outputFile)
+	assert.NoError(t, os.WriteFile(script, []byte(content), 0755))
+
+	hook := newPostUnmountHook(script, 10*time.Second)
+	hook.Run("vol_1##", "/staging/globalmount")
+
+	output, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "vol_1## /staging/globalmount password=\n", string(output))
+}
+
+func TestPostUnmountHookTimeout(t *testing.T) {
+	var deadlineSet bool
+	hook := newPostUnmountHook("hook", time.Minute)
+	hook.run = func(ctx context.Context, command string, args ...string) ([]byte, error) {
+		_, deadlineSet = ctx.Deadline()
+		return nil, nil
+	}
+	hook.Run("vol_1##", "/staging/globalmount")
+	assert.True(t, deadlineSet)
+
+	// hook is disabled if command is not set
+	hook = newPostUnmountHook("", time.Minute)
+	hook.run = func(ctx context.Context, command string, args ...string) ([]byte, error) {
+		t.Errorf("hook should not run")
+		return nil, nil
+	}
+	hook.Run("vol_1##", "/staging/globalmount")
+}
+
+func TestNodeUnstageVolumePostUnmountHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	tests := []struct {
+		desc    string
+		hookErr error
+	}{
+		{
+			desc: "hook succeeds",
+		},
+		{
+			desc:    "failing hook does not fail unstage",
+			hookErr: fmt.Errorf("exit status 1"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		mounter, err := NewFakeMounter()
+		assert.NoError(t, err)
+		d.mounter = mounter
+		var hookArgs [][]string
+		d.postUnmountHook = newPostUnmountHook("/usr/local/bin/hook", time.Minute)
+		d.postUnmountHook.run = func(ctx context.Context, command string, args ...string) ([]byte, error) {
+			hookArgs = append(hookArgs, append([]string{command}, args...))
+			return []byte("output"), test.hookErr
+		}
+
+		stagingPath := filepath.Join(t.TempDir(), "globalmount")
+		_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: stagingPath})
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, [][]string{{"/usr/local/bin/hook", "vol_1##", stagingPath}}, hookArgs, test.desc)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// unstageResult is the result of unstaging the volume on a staging path
+type unstageResult struct {
+	VolumeID    string `json:"volumeID,omitempty"`
+	StagingPath string `json:"stagingPath"`
+	Skipped     bool   `json:"skipped,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// unstageSummary is the result of unstaging all volumes
+type unstageSummary struct {
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Skipped   int             `json:"skipped"`
+	Results   []unstageResult `json:"results"`
+}
+
+// unstageAll unstages every volume in stage cache, e.g. before the node is decommissioned,
+// a volume which is still bind mounted in pods is skipped, and a volume whose ID is unknown fails
+// since it could not be unstaged under the same lock as other operations on the volume
+func (d *Driver) unstageAll(ctx context.Context) unstageSummary {
+	entries := d.stageCache.list()
+	stagingPaths := make([]string, 0, len(entries))
+	for stagingPath := range entries {
+		stagingPaths = append(stagingPaths, stagingPath)
+	}
+	sort.Strings(stagingPaths)
+
+	summary := unstageSummary{Results: []unstageResult{}}
+	for _, stagingPath := range stagingPaths {
+		result := unstageResult{VolumeID: entries[stagingPath].volumeID, StagingPath: stagingPath}
+		if result.VolumeID == "" {
+			result.VolumeID = getStagedVolumeID(stagingPath)
+		}
+		if result.VolumeID == "" {
+			klog.Errorf("volume ID of staging path %s is unknown, skip unstaging it", stagingPath)
+			result.Error = "volume ID of staging path is unknown"
+			summary.Failed++
+			summary.Results = append(summary.Results, result)
+			continue
+		}
+		_, err := d.nodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: result.VolumeID, StagingTargetPath: stagingPath}, true /*rejectReferenced*/)
+		switch {
+		case err == nil:
+			summary.Succeeded++
+		case status.Code(err) == codes.FailedPrecondition:
+			klog.Warningf("skip unstaging volume(%s) on %s: %v", result.VolumeID, stagingPath, err)
+			result.Skipped = true
+			result.Error = err.Error()
+			summary.Skipped++
+		default:
+			klog.Errorf("failed to unstage volume(%s) on %s: %v", result.VolumeID, stagingPath, err)
+			result.Error = err.Error()
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, result)
+	}
+	klog.V(2).Infof("unstaged all volumes, succeeded: %d, failed: %d, skipped: %d", summary.Succeeded, summary.Failed, summary.Skipped)
+	return summary
+}
+
+// UnstageAllHandler returns a http handler which unstages all staged volumes on POST from a loopback address
+// and returns the results in JSON, status code is 500 if any volume fails to unstage, or 409 if any volume is skipped
+func (d *Driver) UnstageAllHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackRequest(r) {
+			http.Error(w, "unstage-all is only allowed from a loopback address", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		summary := d.unstageAll(r.Context())
+		content, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal unstage results: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if summary.Failed > 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else if summary.Skipped > 0 {
+			w.WriteHeader(http.StatusConflict)
+		}
+		_, _ = w.Write(append(content, '\n'))
+	})
+}
+
+// isLoopbackRequest returns true if the request is from a loopback address
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
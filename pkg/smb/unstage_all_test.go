@@ -0,0 +1,168 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+)
+
+func TestUnstageAll(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	d := NewFakeDriver()
+	fakeMounter := mount.NewFakeMounter(nil)
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+
+	// nothing is staged
+	summary := d.unstageAll(context.Background())
+	assert.Equal(t, unstageSummary{Results: []unstageResult{}}, summary)
+
+	stagingPaths := []string{filepath.Join(t.TempDir(), "globalmount"), filepath.Join(t.TempDir(), "globalmount")}
+	for i, volumeID := range []string{"vol_1##", "vol_2##"} {
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: stagingPaths[i],
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{sourceField: "//smb-server/share"},
+			Secrets:       map[string]string{usernameField: "user", passwordField: "pass"},
+		})
+		assert.NoError(t, err)
+	}
+	assert.Len(t, fakeMounter.MountPoints, 2)
+
+	summary = d.unstageAll(context.Background())
+	assert.Equal(t, 2, summary.Succeeded)
+	assert.Equal(t, 0, summary.Failed)
+	assert.ElementsMatch(t, []unstageResult{
+		{VolumeID: "vol_1##", StagingPath: stagingPaths[0]},
+		{VolumeID: "vol_2##", StagingPath: stagingPaths[1]},
+	}, summary.Results)
+	assert.Empty(t, fakeMounter.MountPoints)
+	assert.Empty(t, d.stageCache.list())
+}
+
+func TestUnstageAllReferencedAndReconstructed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	kubeletRootDir := t.TempDir()
+	referencedPath := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/vol1/globalmount")
+	reconstructedPath := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/vol2/globalmount")
+	unknownPath := filepath.Join(kubeletRootDir, "plugins/kubernetes.io/csi/smb.csi.k8s.io/vol3/globalmount")
+	podPath := filepath.Join(kubeletRootDir, "pods/uid/volumes/kubernetes.io~csi/pv1/mount")
+	for _, path := range []string{referencedPath, reconstructedPath, unknownPath} {
+		assert.NoError(t, os.MkdirAll(path, 0750))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(reconstructedPath), volDataFileName), []byte(`{"driverName":"smb.csi.k8s.io","volumeHandle":"vol_2"}`), 0640))
+
+	d := NewFakeDriver()
+	d.kubeletRootDir = kubeletRootDir
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "//smb-server/share1", Path: referencedPath, Type: "cifs"},
+		{Device: "//smb-server/share1", Path: podPath, Type: "cifs"},
+		{Device: "//smb-server/share2", Path: reconstructedPath, Type: "cifs"},
+		{Device: "//smb-server/share3", Path: unknownPath, Type: "cifs"},
+	})
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	d.stageCache.set(referencedPath, stageEntry{volumeID: "vol_1", source: "//smb-server/share1"})
+	assert.Equal(t, 2, d.reconstructStageCache(fakeMounter.MountPoints))
+
+	summary := d.unstageAll(context.Background())
+	assert.Equal(t, 1, summary.Succeeded)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, 1, summary.Skipped)
+	if assert.Len(t, summary.Results, 3) {
+		assert.Equal(t, "vol_1", summary.Results[0].VolumeID)
+		assert.True(t, summary.Results[0].Skipped)
+		assert.Contains(t, summary.Results[0].Error, "still bind mounted")
+		assert.Equal(t, unstageResult{VolumeID: "vol_2", StagingPath: reconstructedPath}, summary.Results[1])
+		assert.Equal(t, unstageResult{StagingPath: unknownPath, Error: "volume ID of staging path is unknown"}, summary.Results[2])
+	}
+	// referenced volume and volume with unknown ID are still mounted
+	assert.ElementsMatch(t, []mount.MountPoint{
+		{Device: "//smb-server/share1", Path: referencedPath, Type: "cifs"},
+		{Device: "//smb-server/share1", Path: podPath, Type: "cifs"},
+		{Device: "//smb-server/share3", Path: unknownPath, Type: "cifs"},
+	}, fakeMounter.MountPoints)
+}
+
+func TestUnstageAllHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	d.stageCache.set(stagingPath, stageEntry{volumeID: "vol_1", source: "//smb-server/share"})
+	d.volumeLocks.TryAcquire("vol_1")
+
+	tests := []struct {
+		desc           string
+		method         string
+		remoteAddr     string
+		expectedStatus int
+		expectedFailed int
+	}{
+		{desc: "GET is not allowed", method: http.MethodGet, remoteAddr: "127.0.0.1:1234", expectedStatus: http.StatusMethodNotAllowed},
+		{desc: "POST from a remote address is forbidden", method: http.MethodPost, remoteAddr: "192.0.2.1:1234", expectedStatus: http.StatusForbidden},
+		{desc: "operation is in progress on the volume", method: http.MethodPost, remoteAddr: "127.0.0.1:1234", expectedStatus: http.StatusInternalServerError, expectedFailed: 1},
+		{desc: "operation is in progress on the volume, IPv6 loopback address", method: http.MethodPost, remoteAddr: "[::1]:1234", expectedStatus: http.StatusInternalServerError, expectedFailed: 1},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(test.method, "/unstage-all", nil)
+		req.RemoteAddr = test.remoteAddr
+		d.UnstageAllHandler().ServeHTTP(w, req)
+		assert.Equal(t, test.expectedStatus, w.Code, test.desc)
+		if test.expectedStatus != http.StatusInternalServerError {
+			continue
+		}
+		var summary unstageSummary
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+		assert.Equal(t, test.expectedFailed, summary.Failed, test.desc)
+		if assert.Len(t, summary.Results, 1, test.desc) {
+			assert.Equal(t, "vol_1", summary.Results[0].VolumeID)
+			assert.Equal(t, stagingPath, summary.Results[0].StagingPath)
+			assert.Contains(t, summary.Results[0].Error, "already exists")
+		}
+	}
+	assert.Len(t, d.stageCache.list(), 1)
+
+	// volume is unstaged once the operation in progress completes
+	d.volumeLocks.Release("vol_1")
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/unstage-all", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	d.UnstageAllHandler().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, d.stageCache.list())
+}
@@ -56,3 +56,50 @@ func (vl *volumeLocks) Release(volumeID string) {
 	defer vl.mux.Unlock()
 	vl.locks.Delete(volumeID)
 }
+
+// keyMutex serializes operations with the same key, e.g. concurrent CreateVolume requests of the same name,
+// unlike volumeLocks the second operation waits instead of returning an Aborted error
+type keyMutex struct {
+	mux   sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// number of holders and waiters of the lock, it's removed from keyMutex when no one refers to it
+	refs int
+}
+
+func newKeyMutex() *keyMutex {
+	return &keyMutex{
+		locks: map[string]*keyLock{},
+	}
+}
+
+// Lock acquires the lock of key, it blocks until the lock is released by other holders
+func (km *keyMutex) Lock(key string) {
+	km.mux.Lock()
+	lock, ok := km.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		km.locks[key] = lock
+	}
+	lock.refs++
+	km.mux.Unlock()
+
+	lock.Lock()
+}
+
+// Unlock releases the lock of key
+func (km *keyMutex) Unlock(key string) {
+	km.mux.Lock()
+	defer km.mux.Unlock()
+	lock, ok := km.locks[key]
+	if !ok {
+		return
+	}
+	lock.Unlock()
+	if lock.refs--; lock.refs == 0 {
+		delete(km.locks, key)
+	}
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import "k8s.io/apimachinery/pkg/util/version"
+
+const (
+	// volume context parameters translated into cifs write behavior hints
+	noLeaseField = "nolease"
+
+	noLeaseMountOption = "nolease"
+)
+
+// writeHintOptions are hints on client side write caching exposed by cifs client, cifs has no delayed allocation
+// option like nodelalloc of local filesystems, the closest one is nolease which does not request leases from the server,
+// so writes are not cached on the client under a lease and are sent to the server without delay
+var writeHintOptions = []kernelMountOption{
+	{
+		field:            noLeaseField,
+		minKernelVersion: version.MustParseGeneric("5.9"),
+		toMountOption:    boolMountOption(noLeaseField, noLeaseMountOption),
+	},
+}
+
+// getWriteHintMountOptions translates write behavior hints in context into cifs mount options and appends them to mountOptions,
+// options not supported by the running kernel are skipped with a warning and returned as the second value
+func getWriteHintMountOptions(context map[string]string, mountOptions []string) ([]string, []string, error) {
+	return getKernelMountOptions(context, mountOptions, writeHintOptions)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+func TestGetWriteHintMountOptions(t *testing.T) {
+	tests := []struct {
+		desc                string
+		context             map[string]string
+		mountOptions        []string
+		kernelVersion       string
+		expectedOptions     []string
+		expectedUnsupported []string
+		expectedErr         error
+	}{
+		{
+			desc:            "no write hints",
+			context:         map[string]string{sourceField: "//smb-server/share"},
+			mountOptions:    []string{"vers=3.0"},
+			kernelVersion:   "5.15.0-1034-azure",
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:            "supported hint is applied",
+			context:         map[string]string{"noLease": "true"},
+			mountOptions:    []string{"vers=3.0"},
+			kernelVersion:   "5.15.0-1034-azure",
+			expectedOptions: []string{"vers=3.0", "nolease"},
+		},
+		{
+			desc:            "false hint is not applied",
+			context:         map[string]string{"noLease": "false"},
+			mountOptions:    []string{"vers=3.0"},
+			kernelVersion:   "5.15.0",
+			expectedOptions: []string{"vers=3.0"},
+		},
+		{
+			desc:            "hint already present is not duplicated",
+			context:         map[string]string{"noLease": "true"},
+			mountOptions:    []string{"vers=3.0,nolease"},
+			kernelVersion:   "5.15.0",
+			expectedOptions: []string{"vers=3.0,nolease"},
+		},
+		{
+			desc:                "unsupported hint on running kernel is skipped",
+			context:             map[string]string{"noLease": "true"},
+			mountOptions:        []string{"vers=3.0"},
+			kernelVersion:       "5.4.0-150-generic",
+			expectedOptions:     []string{"vers=3.0"},
+			expectedUnsupported: []string{noLeaseField},
+		},
+		{
+			desc:        "invalid noLease value",
+			context:     map[string]string{"noLease": "on"},
+			expectedErr: fmt.Errorf("invalid nolease value: on, supported values: true, false"),
+		},
+	}
+
+	defer func(f func() (*version.Version, error)) { getKernelVersion = f }(getKernelVersion)
+	for _, test := range tests {
+		getKernelVersion = func() (*version.Version, error) {
+			return version.ParseGeneric(test.kernelVersion)
+		}
+		options, unsupported, err := getWriteHintMountOptions(test.context, test.mountOptions)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedOptions, options, test.desc)
+		assert.Equal(t, test.expectedUnsupported, unsupported, test.desc)
+	}
+}